@@ -1,5 +1,10 @@
 package boogie
 
+import (
+	"fmt"
+	"strconv"
+)
+
 type InstructionType int
 
 const (
@@ -9,21 +14,94 @@ const (
 	INSTRUCTION_MATCH
 )
 
+/*
+END marks a jump target that ends the current thread of execution, which is
+the whole program at the top level, or a single branch inside a join.
+*/
+const END = -1
+
+/*
+Instruction is a single step of a compiled Boogie program. All jump targets
+are resolved to instruction indices, with END when execution stops.
+
+  - SPAWN runs a worker for Operation with Behavior and Params. Next holds the
+    single target taken when the worker succeeds, Fallbacks the targets to try,
+    in order, when it fails. Label names a context snapshot taken after it ran.
+  - FLOW directs the context. For next and jump, Next holds the target, for back
+    it holds the operation to retry, with Count retries allowed (0 for the VM
+    default). Fallbacks holds what remains of the chain once a back is
+    exhausted. The internal iterate flow loops back to Next[0] up to Count times
+    (ITERATE_UNBOUNDED for no limit) and then continues at Next[1]. send, cancel
+    and halt have no targets.
+  - JOIN starts a branch at each of Next, merges their contexts and continues
+    at Continue.
+  - MATCH compares the outcome of the previous step, or of the snapshot named by
+    Label, with the arm conditions in Params and jumps to the Next entry of the
+    first arm that applies, or to Continue when none does.
+*/
 type Instruction struct {
 	Type      InstructionType
 	Operation string
 	Behavior  string
+	Params    []string
+	Label     string
+	Count     int
 	Next      []int
 	Fallbacks []int
+	Continue  int
+}
+
+/*
+target is a jump target that may not be known yet while compiling, because it
+points forward in the program, or to a label defined later on. Targets can
+alias each other, and are resolved once the whole program has been compiled.
+*/
+type target struct {
+	index int
+	alias *target
+}
+
+func (target *target) resolve() int {
+	for target.alias != nil {
+		target = target.alias
+	}
+
+	return target.index
+}
+
+/*
+pending holds the unresolved targets of an instruction, parallel to the
+instructions themselves.
+*/
+type pending struct {
+	next      []*target
+	fallbacks []*target
+	cont      *target
+}
+
+type label struct {
+	target   *target
+	defined  bool
+	position Position
 }
 
 type Compiler struct {
 	instructions []Instruction
+	pending      []pending
+	labels       map[string]*label
+	uses         []*Node
+	entry        int
+	diagnostics  Diagnostics
 }
 
 func NewCompiler() *Compiler {
 	return &Compiler{
 		instructions: make([]Instruction, 0),
+		pending:      make([]pending, 0),
+		labels:       make(map[string]*label),
+		uses:         make([]*Node, 0),
+		entry:        END,
+		diagnostics:  make(Diagnostics, 0),
 	}
 }
 
@@ -31,55 +109,365 @@ func (compiler *Compiler) Load() []Instruction {
 	return compiler.instructions
 }
 
+/*
+Entry returns the index of the first instruction to execute, which is not
+necessarily zero, since a join is emitted after its branches.
+*/
+func (compiler *Compiler) Entry() int {
+	return compiler.entry
+}
+
+/*
+Diagnostics returns the problems found while compiling, such as jumps to
+labels that are never defined.
+*/
+func (compiler *Compiler) Diagnostics() Diagnostics {
+	return compiler.diagnostics
+}
+
+/*
+Generate compiles the AST into instructions, resolving every jump target, and
+returns the index of the entry instruction.
+*/
 func (compiler *Compiler) Generate(node *Node) int {
-	switch node.Type {
-	case NODE_PROGRAM:
-		compiler.Generate(node.Next[0])
-	case NODE_CLOSURE:
-		lastIdx := -1
+	end := &target{index: END}
+
+	var entry *target
+
+	if node.Type == NODE_PROGRAM {
+		entry = compiler.sequence(node.Next, end, nil)
+	} else {
+		entry = compiler.statement(node, end, nil)
+	}
+
+	compiler.resolve()
+	compiler.entry = entry.resolve()
+
+	return compiler.entry
+}
+
+/*
+sequence compiles statements that run one after the other, so each of them
+continues at the entry of the one that follows, and the last one continues at
+cont. It returns the entry of the first statement.
+*/
+func (compiler *Compiler) sequence(nodes []*Node, cont *target, previous *target) *target {
+	if len(nodes) == 0 {
+		return cont
+	}
+
+	conts := make([]*target, len(nodes))
+
+	for i := range nodes {
+		conts[i] = &target{}
+	}
 
-		for _, op := range node.Next {
-			lastIdx = compiler.Generate(op)
+	conts[len(nodes)-1].alias = cont
+
+	var first *target
+
+	for i, node := range nodes {
+		entry := compiler.statement(node, conts[i], previous)
+
+		if i == 0 {
+			first = entry
+		} else {
+			conts[i-1].alias = entry
 		}
 
-		return lastIdx
+		previous = entry
+	}
+
+	return first
+}
+
+/*
+statement compiles a single statement, where previous is the entry of the
+statement before it, which is where a `back` in a match goes to.
+*/
+func (compiler *Compiler) statement(node *Node, cont *target, previous *target) *target {
+	switch node.Type {
 	case NODE_OPERATION:
-		idx := len(compiler.instructions)
+		return compiler.operation(node, cont)
+	case NODE_CLOSURE:
+		entry := compiler.sequence(node.Next, cont, previous)
+		compiler.define(node, entry)
+		return entry
+	case NODE_JOIN:
+		return compiler.join(node, cont)
+	case NODE_MATCH:
+		return compiler.match(node, cont, previous)
+	case NODE_INVOKE:
+		compiler.report(node.Position, "subprogram '%s' must be linked before compiling", node.Value)
+	}
+
+	return cont
+}
+
+func (compiler *Compiler) operation(node *Node, cont *target) *target {
+	instruction := Instruction{
+		Type:      INSTRUCTION_SPAWN,
+		Operation: node.Value,
+		Params:    compiler.params(node),
+		Label:     node.Label,
+	}
+
+	if node.Behavior != nil {
+		instruction.Behavior = node.Behavior.Value
+	}
+
+	idx := compiler.emit(instruction)
+	self := &target{index: idx}
+	compiler.define(node, self)
+
+	chain := compiler.chain(node.Next, self, cont)
+	success := cont
+
+	if len(chain) > 0 {
+		success = chain[0]
+		compiler.pending[idx].fallbacks = chain[1:]
+	}
+
+	if node.Iterations != 0 {
+		iterate := compiler.emit(Instruction{
+			Type:      INSTRUCTION_FLOW,
+			Operation: "iterate",
+			Count:     node.Iterations,
+		})
+
+		compiler.pending[iterate].next = []*target{self, success}
+		success = &target{index: iterate}
+	}
+
+	compiler.pending[idx].next = []*target{success}
+	return self
+}
+
+/*
+chain compiles a flow chain, the primary target followed by its fallbacks,
+returning the entry of each. A back retries the retry target, and next
+continues at cont. Flows are given the remainder of the chain as their
+fallbacks, so an exhausted back can move on to the next option.
+*/
+func (compiler *Compiler) chain(nodes []*Node, retry *target, cont *target) []*target {
+	entries := make([]*target, len(nodes))
+	flows := make([]int, len(nodes))
+
+	for i, node := range nodes {
+		flows[i] = END
+
+		if node.Type != NODE_FLOW {
+			entries[i] = compiler.statement(node, cont, retry)
+			continue
+		}
 
-		instruction := Instruction{
-			Type:      INSTRUCTION_SPAWN,
+		idx := compiler.emit(Instruction{
+			Type:      INSTRUCTION_FLOW,
 			Operation: node.Value,
-			Next:      make([]int, 0),
-			Fallbacks: make([]int, 0),
+			Label:     node.Label,
+			Count:     compiler.count(node),
+		})
+
+		switch node.Value {
+		case "next":
+			compiler.pending[idx].next = []*target{cont}
+		case "back":
+			if retry != nil {
+				compiler.pending[idx].next = []*target{retry}
+			} else {
+				compiler.report(node.Position, "nothing to go back to")
+			}
+		case "jump":
+			compiler.uses = append(compiler.uses, node)
+			compiler.pending[idx].next = []*target{compiler.label(node.Label).target}
 		}
 
-		if node.Behavior != nil {
-			instruction.Behavior = node.Behavior.Value
+		entries[i] = &target{index: idx}
+		flows[i] = idx
+	}
+
+	for i, idx := range flows {
+		if idx != END {
+			compiler.pending[idx].fallbacks = entries[i+1:]
 		}
+	}
+
+	return entries
+}
+
+/*
+join compiles each branch as its own thread of execution, which ends at the
+end of the branch, followed by the join that starts them.
+*/
+func (compiler *Compiler) join(node *Node, cont *target) *target {
+	end := &target{index: END}
+	branches := make([]*target, 0, len(node.Next))
+
+	for _, branch := range node.Next {
+		branches = append(branches, compiler.statement(branch, end, nil))
+	}
+
+	idx := compiler.emit(Instruction{
+		Type:      INSTRUCTION_JOIN,
+		Operation: node.Value,
+	})
+
+	compiler.pending[idx].next = branches
+	compiler.pending[idx].cont = cont
+
+	return &target{index: idx}
+}
+
+/*
+match compiles the source of the match first, when it has one, so that it
+runs before the match and continues into it.
+*/
+func (compiler *Compiler) match(node *Node, cont *target, previous *target) *target {
+	self := &target{}
+	entry := self
+
+	instruction := Instruction{
+		Type:      INSTRUCTION_MATCH,
+		Operation: node.Value,
+		Params:    make([]string, 0, len(node.Next)),
+	}
 
-		for _, next := range node.Next {
-			nextIdx := compiler.Generate(next)
-			instruction.Next = append(instruction.Next, nextIdx)
+	if node.Source != nil {
+		switch node.Source.Type {
+		case NODE_LABEL:
+			instruction.Label = node.Source.Value
+			compiler.uses = append(compiler.uses, node.Source)
+		default:
+			entry = compiler.statement(node.Source, self, previous)
+			previous = entry
 		}
+	}
 
-		compiler.instructions = append(compiler.instructions, instruction)
-		return idx
-	case NODE_JOIN:
-		joinIdx := len(compiler.instructions)
-		parallelIdices := make([]int, 0)
+	arms := make([]*target, 0, len(node.Next))
 
-		for _, closure := range node.Next {
-			parallelIdices = append(parallelIdices, compiler.Generate(closure))
+	for _, arm := range node.Next {
+		chain := compiler.chain(arm.Next, previous, cont)
+
+		if len(chain) == 0 {
+			continue
 		}
 
-		instruction := Instruction{
-			Type: INSTRUCTION_JOIN,
-			Next: parallelIdices,
+		instruction.Params = append(instruction.Params, arm.Value)
+		arms = append(arms, chain[0])
+	}
+
+	idx := compiler.emit(instruction)
+	self.index = idx
+
+	compiler.pending[idx].next = arms
+	compiler.pending[idx].cont = cont
+
+	return entry
+}
+
+func (compiler *Compiler) params(node *Node) []string {
+	params := make([]string, len(node.Params))
+
+	for i, param := range node.Params {
+		params[i] = param.Value
+	}
+
+	return params
+}
+
+/*
+count reads the numeric behavior of a flow, such as the 3 in back<3>.
+*/
+func (compiler *Compiler) count(node *Node) int {
+	if node.Behavior == nil {
+		return 0
+	}
+
+	count, err := strconv.Atoi(node.Behavior.Value)
+	if err != nil {
+		compiler.report(node.Behavior.Position, "expected a count, found '%s'", node.Behavior.Value)
+		return 0
+	}
+
+	return count
+}
+
+func (compiler *Compiler) emit(instruction Instruction) int {
+	instruction.Next = make([]int, 0)
+	instruction.Fallbacks = make([]int, 0)
+	instruction.Continue = END
+
+	compiler.instructions = append(compiler.instructions, instruction)
+	compiler.pending = append(compiler.pending, pending{})
+
+	return len(compiler.instructions) - 1
+}
+
+func (compiler *Compiler) label(name string) *label {
+	if _, ok := compiler.labels[name]; !ok {
+		compiler.labels[name] = &label{target: &target{}}
+	}
+
+	return compiler.labels[name]
+}
+
+/*
+define makes the label of the node, if it has one, point at the given entry.
+*/
+func (compiler *Compiler) define(node *Node, entry *target) {
+	if node.Label == "" {
+		return
+	}
+
+	label := compiler.label(node.Label)
+
+	if label.defined {
+		compiler.report(node.Position, "label '[%s]' is already defined at %s", node.Label, label.position)
+		return
+	}
+
+	label.defined = true
+	label.position = node.Position
+	label.target.alias = entry
+}
+
+/*
+resolve turns all pending targets into instruction indices, reporting jumps to
+labels that were never defined.
+*/
+func (compiler *Compiler) resolve() {
+	for _, use := range compiler.uses {
+		name := use.Label
+
+		if use.Type == NODE_LABEL {
+			name = use.Value
 		}
 
-		compiler.instructions = append(compiler.instructions, instruction)
-		return joinIdx
+		if !compiler.label(name).defined {
+			compiler.report(use.Position, "undefined label '[%s]'", name)
+			compiler.label(name).target.index = END
+		}
 	}
 
-	return -1
+	for i, pending := range compiler.pending {
+		for _, next := range pending.next {
+			compiler.instructions[i].Next = append(compiler.instructions[i].Next, next.resolve())
+		}
+
+		for _, fallback := range pending.fallbacks {
+			compiler.instructions[i].Fallbacks = append(compiler.instructions[i].Fallbacks, fallback.resolve())
+		}
+
+		if pending.cont != nil {
+			compiler.instructions[i].Continue = pending.cont.resolve()
+		}
+	}
+}
+
+func (compiler *Compiler) report(position Position, format string, args ...any) {
+	compiler.diagnostics = append(compiler.diagnostics, Diagnostic{
+		Severity: SEVERITY_ERROR,
+		Position: position,
+		Message:  fmt.Sprintf(format, args...),
+	})
 }
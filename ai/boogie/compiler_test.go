@@ -40,7 +40,7 @@ func TestCompiler(t *testing.T) {
 				})
 
 				Convey("The second instruction should be send", func() {
-					So(compiler.instructions[1].Type, ShouldEqual, INSTRUCTION_SPAWN)
+					So(compiler.instructions[1].Type, ShouldEqual, INSTRUCTION_FLOW)
 					So(compiler.instructions[1].Operation, ShouldEqual, "send")
 				})
 			})
@@ -114,3 +114,215 @@ func TestCompiler(t *testing.T) {
 		})
 	})
 }
+
+func compile(program string) *Compiler {
+	compiler := NewCompiler()
+	compiler.Generate(parse(program))
+	return compiler
+}
+
+/*
+TestCompilerControlFlow checks that flows, matches, labels and iteration are
+lowered into instructions with resolved jump targets.
+*/
+func TestCompilerControlFlow(t *testing.T) {
+	Convey("Given a program with fallback chains", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze => next | back<3> | cancel
+			verify  => send
+		) <= in`)
+		instructions := compiler.Load()
+
+		Convey("It should emit the operation followed by its flows", func() {
+			So(len(instructions), ShouldEqual, 6)
+			So(instructions[0].Type, ShouldEqual, INSTRUCTION_SPAWN)
+			So(instructions[1].Operation, ShouldEqual, "next")
+			So(instructions[2].Operation, ShouldEqual, "back")
+			So(instructions[3].Operation, ShouldEqual, "cancel")
+			So(compiler.Entry(), ShouldEqual, 0)
+			So(compiler.Diagnostics(), ShouldBeEmpty)
+		})
+
+		Convey("It should fill the fallbacks of the operation", func() {
+			So(instructions[0].Next, ShouldResemble, []int{1})
+			So(instructions[0].Fallbacks, ShouldResemble, []int{2, 3})
+		})
+
+		Convey("It should resolve next to the following statement", func() {
+			So(instructions[1].Type, ShouldEqual, INSTRUCTION_FLOW)
+			So(instructions[1].Next, ShouldResemble, []int{4})
+		})
+
+		Convey("It should make back retry the operation, with the rest of the chain to fall back on", func() {
+			So(instructions[2].Next, ShouldResemble, []int{0})
+			So(instructions[2].Count, ShouldEqual, 3)
+			So(instructions[2].Fallbacks, ShouldResemble, []int{3})
+		})
+
+		Convey("It should give terminal flows no targets", func() {
+			So(instructions[3].Next, ShouldBeEmpty)
+			So(instructions[5].Operation, ShouldEqual, "send")
+			So(instructions[5].Next, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a program with a match block", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze => next
+			verify  => next
+			match (
+				ok    => send
+				error => cancel
+				_     => back
+			)
+		) <= in`)
+		instructions := compiler.Load()
+		match := instructions[7]
+
+		Convey("It should emit the arms before the match", func() {
+			So(len(instructions), ShouldEqual, 8)
+			So(match.Type, ShouldEqual, INSTRUCTION_MATCH)
+			So(match.Params, ShouldResemble, []string{"ok", "error", "_"})
+			So(match.Next, ShouldResemble, []int{4, 5, 6})
+			So(match.Continue, ShouldEqual, END)
+		})
+
+		Convey("It should continue from the previous statement into the match", func() {
+			So(instructions[3].Next, ShouldResemble, []int{7})
+		})
+
+		Convey("It should make back go to the statement before the match", func() {
+			So(instructions[6].Operation, ShouldEqual, "back")
+			So(instructions[6].Next, ShouldResemble, []int{2})
+		})
+	})
+
+	Convey("Given a program with a label reference", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze[myLabel] => next
+			verify           => next
+			match <= [myLabel] (
+				ok    => send
+				error => cancel
+			)
+		) <= in`)
+		instructions := compiler.Load()
+
+		Convey("It should name the snapshot on the operation and the match", func() {
+			So(instructions[0].Label, ShouldEqual, "myLabel")
+			So(instructions[6].Type, ShouldEqual, INSTRUCTION_MATCH)
+			So(instructions[6].Label, ShouldEqual, "myLabel")
+			So(compiler.Diagnostics(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a program with a jump target", t, func() {
+		compiler := compile(`
+		out <= (
+			[refine] => (
+				analyze => next
+				verify  => next
+				match (
+					ok    => send
+					error => [refine].jump
+				)
+			)
+		) <= in`)
+		instructions := compiler.Load()
+
+		Convey("It should resolve the jump to the start of the labelled closure", func() {
+			So(instructions[5].Operation, ShouldEqual, "jump")
+			So(instructions[5].Label, ShouldEqual, "refine")
+			So(instructions[5].Next, ShouldResemble, []int{0})
+			So(compiler.Diagnostics(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a program jumping to an undefined label", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze => [nowhere].jump
+		) <= in`)
+
+		Convey("It should report the label", func() {
+			So(len(compiler.Diagnostics()), ShouldEqual, 1)
+			So(compiler.Diagnostics()[0].Message, ShouldEqual, "undefined label '[nowhere]'")
+			So(compiler.Load()[1].Next, ShouldResemble, []int{END})
+		})
+	})
+
+	Convey("Given a program with a duplicate label", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze[twice] => next
+			verify[twice]  => send
+		) <= in`)
+
+		Convey("It should report the second definition", func() {
+			So(len(compiler.Diagnostics()), ShouldEqual, 1)
+			So(compiler.Diagnostics()[0].Message, ShouldContainSubstring, "already defined")
+		})
+	})
+
+	Convey("Given a program with iteration", t, func() {
+		compiler := compile(`
+		out <= (
+			analyze <= <3> => next
+			verify         => send
+		) <= in`)
+		instructions := compiler.Load()
+
+		Convey("It should loop through an iterate flow", func() {
+			So(instructions[0].Next, ShouldResemble, []int{2})
+			So(instructions[2].Operation, ShouldEqual, "iterate")
+			So(instructions[2].Count, ShouldEqual, 3)
+			So(instructions[2].Next, ShouldResemble, []int{0, 1})
+			So(instructions[1].Next, ShouldResemble, []int{3})
+		})
+	})
+
+	Convey("Given a program with unbounded iteration", t, func() {
+		instructions := compile(`out <= (analyze <= => send) <= in`).Load()
+
+		Convey("It should mark the iterate flow as unbounded", func() {
+			So(instructions[2].Count, ShouldEqual, ITERATE_UNBOUNDED)
+		})
+	})
+
+	Convey("Given a program matching on a join", t, func() {
+		compiler := compile(`
+		out <= (
+			match (
+				complete => send
+				_        => back
+			) <= join <= (
+				analyze => send
+			) (
+				verify => send
+			)
+			generate => send
+		) <= in`)
+		instructions := compiler.Load()
+
+		Convey("It should enter at the join and continue into the match", func() {
+			So(compiler.Entry(), ShouldEqual, 4)
+			So(instructions[4].Type, ShouldEqual, INSTRUCTION_JOIN)
+			So(instructions[4].Next, ShouldResemble, []int{0, 2})
+			So(instructions[4].Continue, ShouldEqual, 7)
+		})
+
+		Convey("It should end each branch on its own", func() {
+			So(instructions[1].Operation, ShouldEqual, "send")
+			So(instructions[0].Next, ShouldResemble, []int{1})
+		})
+
+		Convey("It should retry the join on back, and otherwise continue after the match", func() {
+			So(instructions[7].Type, ShouldEqual, INSTRUCTION_MATCH)
+			So(instructions[6].Next, ShouldResemble, []int{4})
+			So(instructions[7].Continue, ShouldEqual, 8)
+		})
+	})
+}
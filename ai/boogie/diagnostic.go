@@ -0,0 +1,90 @@
+package boogie
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Position is a 1-based line and column in the Boogie source. Columns count
+runes, not bytes.
+*/
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (position Position) String() string {
+	return fmt.Sprintf("%d:%d", position.Line, position.Column)
+}
+
+type Severity int
+
+const (
+	SEVERITY_ERROR Severity = iota
+	SEVERITY_WARNING
+)
+
+func (severity Severity) String() string {
+	if severity == SEVERITY_WARNING {
+		return "warning"
+	}
+
+	return "error"
+}
+
+/*
+Diagnostic describes a problem found in a Boogie program, and where it was
+found, so it can be reported back to whoever wrote the program.
+*/
+type Diagnostic struct {
+	Severity Severity
+	Position Position
+	Message  string
+}
+
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", diagnostic.Position, diagnostic.Severity, diagnostic.Message)
+}
+
+/*
+Diagnostics is a list of diagnostics, which doubles as an error so it can be
+returned wherever a program is loaded.
+*/
+type Diagnostics []Diagnostic
+
+func (diagnostics Diagnostics) Error() string {
+	lines := make([]string, len(diagnostics))
+
+	for i, diagnostic := range diagnostics {
+		lines[i] = diagnostic.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+/*
+HasErrors reports whether any of the diagnostics is an error, as opposed to a
+warning.
+*/
+func (diagnostics Diagnostics) HasErrors() bool {
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Err returns the diagnostics as an error when at least one of them is an error,
+and nil otherwise.
+*/
+func (diagnostics Diagnostics) Err() error {
+	if diagnostics.HasErrors() {
+		return diagnostics
+	}
+
+	return nil
+}
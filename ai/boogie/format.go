@@ -0,0 +1,493 @@
+package boogie
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+indentation is what a single level of nesting is indented with.
+*/
+const indentation = "    "
+
+/*
+Format parses the source and prints it back in canonical form, with every
+statement on its own line, blocks indented, the flows of consecutive statements
+aligned, and the comments of the source kept where they were. Source that
+does not parse is returned unchanged, together with the diagnostics.
+*/
+func Format(source string) (string, error) {
+	lexer := NewLexer()
+	tokens := make([]Lexeme, 0)
+
+	for token := range lexer.Generate(source) {
+		tokens = append(tokens, token)
+	}
+
+	stream := make(chan Lexeme, len(tokens))
+
+	for _, token := range tokens {
+		stream <- token
+	}
+
+	close(stream)
+
+	parser := NewParser()
+	ast := parser.Generate(stream)
+
+	if err := parser.Diagnostics().Err(); err != nil {
+		return source, err
+	}
+
+	formatter := newFormatter()
+	formatter.program(ast)
+	formatter.comments(lexer.Comments(), tokens)
+
+	return formatter.String(), nil
+}
+
+/*
+row is a single line of formatted output. The head is everything up to the
+flow chain, which goes in the tail, so the chains of consecutive statements can
+be aligned. Source is the line in the original program the output line came
+from, which is what comments are placed by.
+*/
+type row struct {
+	indent   int
+	head     string
+	tail     string
+	marked   bool
+	align    bool
+	source   int
+	inner    int
+	leading  []string
+	trailing string
+}
+
+func (row *row) write(text string) {
+	if row.marked {
+		row.tail += text
+		return
+	}
+
+	row.head += text
+}
+
+type formatter struct {
+	lines []*row
+	last  *row
+}
+
+func newFormatter() *formatter {
+	return &formatter{
+		lines: make([]*row, 0),
+	}
+}
+
+/*
+open starts a new line at the given indentation, for a node that starts at
+the given source line.
+*/
+func (formatter *formatter) open(indent, source int) {
+	formatter.last = &row{indent: indent, source: source, inner: indent}
+	formatter.lines = append(formatter.lines, formatter.last)
+}
+
+func (formatter *formatter) write(text string) {
+	formatter.last.write(text)
+}
+
+/*
+program writes the outer `out <= ( ... ) <= in` form when the program is a
+single closure, and the bare statements when it is a fragment.
+*/
+func (formatter *formatter) program(node *Node) {
+	declarations := make([]*Node, 0)
+	statements := make([]*Node, 0)
+
+	for _, child := range node.Next {
+		if child.Type == NODE_DEFINE || child.Type == NODE_INCLUDE {
+			declarations = append(declarations, child)
+			continue
+		}
+
+		statements = append(statements, child)
+	}
+
+	for i, declaration := range declarations {
+		// Definitions span several lines, so they are set apart by a blank line.
+		if i > 0 && (declaration.Type == NODE_DEFINE || declarations[i-1].Type == NODE_DEFINE) {
+			formatter.open(0, 0)
+		}
+
+		formatter.block([]*Node{declaration}, 0)
+	}
+
+	if len(declarations) > 0 && len(statements) > 0 {
+		formatter.open(0, 0)
+	}
+
+	if len(statements) == 1 && statements[0].Type == NODE_CLOSURE && statements[0].Label == "" {
+		closure := statements[0]
+
+		formatter.open(0, closure.Position.Line)
+		formatter.write("out <= ")
+		formatter.closure(closure, 0)
+		formatter.write(" <= in")
+
+		return
+	}
+
+	formatter.block(statements, 0)
+}
+
+/*
+block writes statements one per line, where a statement that fits on a single
+line can be aligned with its neighbours.
+*/
+func (formatter *formatter) block(nodes []*Node, indent int) {
+	for _, node := range nodes {
+		start := len(formatter.lines)
+		formatter.open(indent, node.Position.Line)
+		formatter.statement(node, indent)
+		formatter.lines[start].align = len(formatter.lines) == start+1
+	}
+}
+
+func (formatter *formatter) statement(node *Node, indent int) {
+	switch node.Type {
+	case NODE_OPERATION:
+		formatter.operation(node, indent)
+	case NODE_CLOSURE:
+		if node.Label != "" {
+			formatter.write("[" + node.Label + "]")
+			formatter.last.marked = true
+			formatter.write(" => ")
+		}
+
+		formatter.closure(node, indent)
+	case NODE_JOIN:
+		formatter.join(node, indent)
+	case NODE_MATCH:
+		formatter.match(node, indent)
+	case NODE_DEFINE:
+		formatter.write("define<" + node.Value + ">" + formatter.optional(node.Params))
+		formatter.last.marked = true
+		formatter.write(" => ")
+
+		if len(node.Next) > 0 {
+			formatter.closure(node.Next[0], indent)
+		}
+	case NODE_INVOKE:
+		formatter.write("use<" + node.Value + ">" + formatter.optional(node.Params))
+
+		if node.Label != "" {
+			formatter.write("[" + node.Label + "]")
+		}
+	case NODE_INCLUDE:
+		formatter.write("include<" + node.Value + ">")
+	}
+}
+
+/*
+closure writes the opening parenthesis on the current line, and leaves the
+line with the closing one open, so the caller can continue after it.
+*/
+func (formatter *formatter) closure(node *Node, indent int) {
+	if len(node.Next) == 0 {
+		formatter.write("()")
+		return
+	}
+
+	formatter.write("(")
+	formatter.block(node.Next, indent+1)
+	formatter.close(node, indent)
+}
+
+func (formatter *formatter) close(node *Node, indent int) {
+	formatter.open(indent, node.End.Line)
+	formatter.last.inner = indent + 1
+	formatter.write(")")
+}
+
+func (formatter *formatter) operation(node *Node, indent int) {
+	formatter.write(node.Value)
+
+	if node.Behavior != nil {
+		formatter.write("<")
+
+		if len(node.Params) > 0 {
+			formatter.write(formatter.params(node.Params) + " => ")
+		}
+
+		formatter.write(node.Behavior.Value + ">")
+	} else if len(node.Params) > 0 {
+		formatter.write(formatter.params(node.Params))
+	}
+
+	if node.Label != "" {
+		formatter.write("[" + node.Label + "]")
+	}
+
+	switch {
+	case node.Iterations == ITERATE_UNBOUNDED:
+		formatter.write(" <=")
+	case node.Iterations > 0:
+		formatter.write(" <= <" + strconv.Itoa(node.Iterations) + ">")
+	}
+
+	formatter.chain(node.Next, indent)
+}
+
+/*
+chain writes a flow chain, which marks where the line is aligned on.
+*/
+func (formatter *formatter) chain(targets []*Node, indent int) {
+	if len(targets) == 0 {
+		return
+	}
+
+	formatter.last.marked = true
+	formatter.write(" => ")
+
+	for i, target := range targets {
+		if i > 0 {
+			formatter.write(" | ")
+		}
+
+		formatter.target(target, indent)
+	}
+}
+
+func (formatter *formatter) target(node *Node, indent int) {
+	switch node.Type {
+	case NODE_FLOW:
+		if node.Value == "jump" {
+			formatter.write("[" + node.Label + "].jump")
+			return
+		}
+
+		formatter.write(node.Value)
+
+		if node.Behavior != nil {
+			formatter.write("<" + node.Behavior.Value + ">")
+		}
+	default:
+		formatter.statement(node, indent)
+	}
+}
+
+/*
+join writes each of its closures after the other, `join <= ( ... ) ( ... )`.
+*/
+func (formatter *formatter) join(node *Node, indent int) {
+	formatter.write("join <=")
+
+	for _, closure := range node.Next {
+		formatter.write(" ")
+		formatter.closure(closure, indent)
+	}
+}
+
+/*
+match writes a label source before the arms, and a join source after them,
+which is how both forms read most naturally.
+*/
+func (formatter *formatter) match(node *Node, indent int) {
+	formatter.write("match")
+
+	if node.Source != nil && node.Source.Type == NODE_LABEL {
+		formatter.write(" <= [" + node.Source.Value + "]")
+	}
+
+	formatter.write(" (")
+
+	for _, arm := range node.Next {
+		start := len(formatter.lines)
+		formatter.open(indent+1, arm.Position.Line)
+		formatter.write(arm.Value)
+		formatter.chain(arm.Next, indent+1)
+		formatter.lines[start].align = len(formatter.lines) == start+1
+	}
+
+	formatter.close(node, indent)
+
+	if node.Source != nil && node.Source.Type != NODE_LABEL {
+		formatter.write(" <= ")
+		formatter.statement(node.Source, indent)
+	}
+}
+
+/*
+optional writes the params when there are any, and nothing otherwise.
+*/
+func (formatter *formatter) optional(params []*Node) string {
+	if len(params) == 0 {
+		return ""
+	}
+
+	return formatter.params(params)
+}
+
+func (formatter *formatter) params(params []*Node) string {
+	values := make([]string, len(params))
+
+	for i, param := range params {
+		values[i] = quote(param.Value)
+	}
+
+	return "{" + strings.Join(values, ", ") + "}"
+}
+
+/*
+comments puts every comment back. A comment that follows code on its line
+trails the output line that code ended up on, and a comment on a line of its
+own goes above the first line that came after it in the source.
+*/
+func (formatter *formatter) comments(comments []Lexeme, tokens []Lexeme) {
+	for _, comment := range comments {
+		text := strings.TrimSpace("; " + comment.Text)
+
+		if formatter.follows(comment, tokens) {
+			if trailing := formatter.before(comment.Position.Line); trailing != nil {
+				trailing.trailing = strings.TrimSpace(trailing.trailing + " " + text)
+				continue
+			}
+		}
+
+		if after := formatter.after(comment.Position.Line); after != nil {
+			after.leading = append(after.leading, text)
+			continue
+		}
+
+		formatter.open(0, comment.Position.Line)
+		formatter.last.head = text
+	}
+}
+
+/*
+follows reports whether there is code before the comment on its line.
+*/
+func (formatter *formatter) follows(comment Lexeme, tokens []Lexeme) bool {
+	for _, token := range tokens {
+		if token.Position.Line == comment.Position.Line && token.Position.Column < comment.Position.Column {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+before returns the last output line that started on or before the source line.
+*/
+func (formatter *formatter) before(source int) *row {
+	var found *row
+
+	for _, row := range formatter.lines {
+		if row.source <= source && (found == nil || row.source >= found.source) {
+			found = row
+		}
+	}
+
+	return found
+}
+
+/*
+after returns the first output line that started after the source row.
+*/
+func (formatter *formatter) after(source int) *row {
+	for _, row := range formatter.lines {
+		if row.source > source {
+			return row
+		}
+	}
+
+	return nil
+}
+
+/*
+String renders the lines, aligning the flow chains of consecutive statements
+at the same depth, and the trailing comments of consecutive lines.
+*/
+func (formatter *formatter) String() string {
+	heads := make([]int, len(formatter.lines))
+	codes := make([]string, len(formatter.lines))
+
+	for i := range formatter.lines {
+		heads[i] = formatter.width(i, func(a, b *row) bool {
+			return a.align && b.align && a.marked && b.marked && a.indent == b.indent && len(b.leading) == 0
+		}, func(j int) int {
+			return len([]rune(formatter.lines[j].head))
+		})
+	}
+
+	for i, current := range formatter.lines {
+		head := current.head
+
+		if current.align && current.marked {
+			head += strings.Repeat(" ", heads[i]-len([]rune(head)))
+		}
+
+		codes[i] = strings.Repeat(indentation, current.indent) + head + current.tail
+	}
+
+	out := make([]string, 0, len(formatter.lines))
+
+	for i, current := range formatter.lines {
+		for _, comment := range current.leading {
+			out = append(out, strings.Repeat(indentation, current.inner)+comment)
+		}
+
+		if current.trailing == "" {
+			out = append(out, codes[i])
+			continue
+		}
+
+		width := formatter.width(i, func(a, b *row) bool {
+			return a.trailing != "" && b.trailing != "" && len(b.leading) == 0
+		}, func(j int) int {
+			return len([]rune(codes[j]))
+		})
+
+		out = append(out, codes[i]+strings.Repeat(" ", width-len([]rune(codes[i])))+" "+current.trailing)
+	}
+
+	return strings.Join(out, "\n") + "\n"
+}
+
+/*
+width returns the widest measure over the run of lines around line i in which
+every line is joined to the one before it.
+*/
+func (formatter *formatter) width(i int, joined func(a, b *row) bool, measure func(int) int) int {
+	start, end := i, i
+
+	for start > 0 && joined(formatter.lines[start-1], formatter.lines[start]) {
+		start--
+	}
+
+	for end < len(formatter.lines)-1 && joined(formatter.lines[end], formatter.lines[end+1]) {
+		end++
+	}
+
+	width := 0
+
+	for j := start; j <= end; j++ {
+		width = max(width, measure(j))
+	}
+
+	return width
+}
+
+/*
+quote returns the value as is when it reads back as a single identifier, and
+quoted otherwise.
+*/
+func quote(value string) string {
+	if !isName(value) {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
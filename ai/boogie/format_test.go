@@ -0,0 +1,145 @@
+package boogie
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFormat(t *testing.T) {
+	Convey("Given a program with inconsistent layout", t, func() {
+		source := `out <= (
+  analyze => next | back<3> | cancel ; Analysis with error handling
+      verify => send ; Verification
+) <= in`
+
+		formatted, err := Format(source)
+
+		Convey("It should indent the statements and align the flows and comments", func() {
+			So(err, ShouldBeNil)
+			So(formatted, ShouldEqual, `out <= (
+    analyze => next | back<3> | cancel ; Analysis with error handling
+    verify  => send                    ; Verification
+) <= in
+`)
+		})
+
+		Convey("It should be stable when formatted again", func() {
+			again, err := Format(formatted)
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, formatted)
+		})
+	})
+
+	Convey("Given a program with comments on their own lines", t, func() {
+		formatted, err := Format(`; Research a topic
+out <= (
+    ; Look it up first
+    call<{
+        search,
+        "some query"
+    } => browser> => next
+    analyze => send
+    ; Nothing after this
+) <= in ; Done`)
+
+		Convey("It should keep them above the code that followed them", func() {
+			So(err, ShouldBeNil)
+			So(formatted, ShouldEqual, `; Research a topic
+out <= (
+    ; Look it up first
+    call<{search, "some query"} => browser> => next
+    analyze                                 => send
+    ; Nothing after this
+) <= in ; Done
+`)
+		})
+	})
+
+	Convey("Given nested blocks", t, func() {
+		source := `out <= ( [refine] => ( analyze<surface> => next
+verify<validation> => next match ( ok => send error => [refine].jump ) )
+match ( complete => send _ => back ) <= join <= ( analyze => send ) ( verify <= <3> => send ) ) <= in`
+
+		formatted, err := Format(source)
+
+		Convey("It should put every statement on its own line", func() {
+			So(err, ShouldBeNil)
+			So(formatted, ShouldEqual, `out <= (
+    [refine] => (
+        analyze<surface>   => next
+        verify<validation> => next
+        match (
+            ok    => send
+            error => [refine].jump
+        )
+    )
+    match (
+        complete => send
+        _        => back
+    ) <= join <= (
+        analyze => send
+    ) (
+        verify <= <3> => send
+    )
+) <= in
+`)
+		})
+
+		Convey("It should produce the same program", func() {
+			So(compile(formatted).Load(), ShouldResemble, compile(source).Load())
+		})
+	})
+
+	Convey("Given a program with subprograms", t, func() {
+		source := `include<common>
+; the checked flow
+define<checked>{focus,retries} => ( analyze<focus>[start] => next
+verify => send | back<retries> | [start].jump )
+define<other> => (analyze => next)
+out <= (
+  use<checked>{surface, 3} ; first
+  use<other>[o]
+) <= in`
+
+		formatted, err := Format(source)
+
+		Convey("It should set the definitions apart from each other and the program", func() {
+			So(err, ShouldBeNil)
+			So(formatted, ShouldEqual, `include<common>
+
+; the checked flow
+define<checked>{focus, retries} => (
+    analyze<focus>[start] => next
+    verify                => send | back<retries> | [start].jump
+)
+
+define<other> => (
+    analyze => next
+)
+
+out <= (
+    use<checked>{surface, 3} ; first
+    use<other>[o]
+) <= in
+`)
+		})
+
+		Convey("It should be stable when formatted again", func() {
+			again, err := Format(formatted)
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, formatted)
+		})
+	})
+
+	Convey("Given a program that does not parse", t, func() {
+		source := `out <= ( analyze => ) <= in`
+		formatted, err := Format(source)
+
+		Convey("It should return the source unchanged with the diagnostics", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "without target")
+			So(formatted, ShouldEqual, source)
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package boogie
 
 import (
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -20,6 +21,9 @@ var operations = []string{
 	"halt",
 	"match",
 	"join",
+	"define",
+	"use",
+	"include",
 }
 
 var values = []string{
@@ -43,6 +47,9 @@ var delimiters = []string{
 	"}",
 	",",
 	"|",
+	"<",
+	">",
+	".",
 }
 
 type TokenType uint
@@ -58,15 +65,24 @@ const (
 )
 
 type Lexeme struct {
-	ID   TokenType
-	Text string
+	ID       TokenType
+	Text     string
+	Position Position
 }
 
+/*
+Lexer turns Boogie source into a stream of lexemes. Identifiers that are known
+operations become OPERATION tokens, any other identifier (values, behaviors,
+labels, match conditions) becomes a VALUE token, and quoted strings become
+PARAMETER tokens. Comments are not part of the stream, but are kept aside so
+tools like the formatter can put them back.
+*/
 type Lexer struct {
-	buffer     strings.Builder
-	inBehavior bool
-	lexeme     bool
-	state      TokenType
+	source   []rune
+	pos      int
+	counted  int
+	position Position
+	comments []Lexeme
 }
 
 func NewLexer() *Lexer {
@@ -76,115 +92,163 @@ func NewLexer() *Lexer {
 func (lexer *Lexer) Generate(source string) chan Lexeme {
 	out := make(chan Lexeme, 1024)
 
+	lexer.source = []rune(source)
+	lexer.pos = 0
+	lexer.counted = 0
+	lexer.position = Position{Line: 1, Column: 1}
+	lexer.comments = make([]Lexeme, 0)
+
 	go func() {
 		defer close(out)
 
-		for _, char := range source + " " {
-			lexer.processChar(char)
+		for lexer.pos < len(lexer.source) {
+			start := lexer.locate()
+
+			lexeme, ok := lexer.next()
 
-			if lexer.lexeme && lexer.buffer.Len() > 0 {
-				out <- Lexeme{ID: lexer.state, Text: lexer.buffer.String()}
-				lexer.buffer.Reset()
-				lexer.lexeme = false
-				lexer.state = UNKNOWN
+			if !ok {
+				continue
 			}
 
-			if !unicode.IsSpace(char) && lexer.state != COMMENT {
-				lexer.buffer.WriteRune(char)
+			lexeme.Position = start
+
+			if lexeme.ID == COMMENT {
+				lexer.comments = append(lexer.comments, lexeme)
+				continue
 			}
+
+			out <- lexeme
 		}
 	}()
 
 	return out
 }
 
-func (lexer *Lexer) processChar(char rune) {
-	shouldReturn1 := lexer.handleComment(char)
-	if shouldReturn1 {
-		return
-	}
+/*
+Comments returns the comments found in the source, with the `;` stripped off.
+They are only complete once the channel returned by Generate is drained.
+*/
+func (lexer *Lexer) Comments() []Lexeme {
+	return lexer.comments
+}
 
-	if char == '<' {
-		lexer.lexeme, lexer.state = lexer.check(operations, OPERATION)
-		return
+/*
+next scans a single lexeme starting at the current position, returning false
+when only whitespace was consumed.
+*/
+func (lexer *Lexer) next() (Lexeme, bool) {
+	char := lexer.source[lexer.pos]
+
+	switch {
+	case unicode.IsSpace(char):
+		lexer.pos++
+		return Lexeme{}, false
+	case char == ';':
+		return lexer.scanComment(), true
+	case char == '"':
+		return lexer.scanString(), true
+	case isIdentifier(char):
+		return lexer.scanIdentifier(), true
 	}
 
-	if lexer.buffer.String() == "<" && char != '=' {
-		lexer.inBehavior = true
-		lexer.lexeme, lexer.state = true, DELIMITER
-		return
-	}
+	// Flow operators take precedence over the single character delimiters
+	// they start with.
+	if lexer.pos+1 < len(lexer.source) {
+		pair := string(lexer.source[lexer.pos : lexer.pos+2])
 
-	if lexer.inBehavior {
-		if char == '>' {
-			lexer.inBehavior = false
-			lexer.lexeme, lexer.state = true, VALUE
+		if utils.ContainsAny(flows, pair) {
+			lexer.pos += 2
+			return Lexeme{ID: FLOW, Text: pair}, true
 		}
-		return
 	}
 
-	if char == ';' {
-		lexer.lexeme, lexer.state = false, COMMENT
-		return
-	}
+	lexer.pos++
 
-	// Check if current character is a delimiter
 	if utils.ContainsAny(delimiters, string(char)) {
-		// If we have content in buffer, process it before handling the delimiter
-		if lexer.buffer.Len() > 0 {
-			if ok, token := lexer.check(operations, OPERATION); ok {
-				lexer.lexeme = true
-				lexer.state = token
-				return
-			}
+		return Lexeme{ID: DELIMITER, Text: string(char)}, true
+	}
+
+	return Lexeme{ID: UNKNOWN, Text: string(char)}, true
+}
+
+/*
+locate returns the position of the current rune, counting forward from the
+last located rune so the whole source is only walked once.
+*/
+func (lexer *Lexer) locate() Position {
+	for ; lexer.counted < lexer.pos; lexer.counted++ {
+		if lexer.source[lexer.counted] == '\n' {
+			lexer.position.Line++
+			lexer.position.Column = 1
+			continue
 		}
 
-		lexer.lexeme, lexer.state = true, DELIMITER
-		return
+		lexer.position.Column++
 	}
 
-	lexer.handleSpace(char)
+	return lexer.position
 }
 
-func (lexer *Lexer) handleComment(char rune) bool {
-	if lexer.state == COMMENT && char != '\n' {
-		return true
-	}
+func (lexer *Lexer) scanComment() Lexeme {
+	start := lexer.pos + 1
 
-	if lexer.state == COMMENT && char == '\n' {
-		lexer.state = UNKNOWN
-		return true
+	for lexer.pos < len(lexer.source) && lexer.source[lexer.pos] != '\n' {
+		lexer.pos++
 	}
 
-	return false
+	return Lexeme{ID: COMMENT, Text: strings.TrimSpace(string(lexer.source[start:lexer.pos]))}
 }
 
-func (lexer *Lexer) handleSpace(char rune) bool {
-	if unicode.IsSpace(char) {
-		if lexer.lexeme, lexer.state = lexer.check(operations, OPERATION); lexer.lexeme {
-			return true
-		}
+func (lexer *Lexer) scanIdentifier() Lexeme {
+	start := lexer.pos
 
-		if lexer.lexeme, lexer.state = lexer.check(values, VALUE); lexer.lexeme {
-			return true
-		}
+	for lexer.pos < len(lexer.source) && isIdentifier(lexer.source[lexer.pos]) {
+		lexer.pos++
+	}
 
-		if lexer.lexeme, lexer.state = lexer.check(flows, FLOW); lexer.lexeme {
-			return true
-		}
+	text := string(lexer.source[start:lexer.pos])
 
-		if lexer.lexeme, lexer.state = lexer.check(delimiters, DELIMITER); lexer.lexeme {
-			return true
-		}
+	if utils.ContainsAny(operations, text) {
+		return Lexeme{ID: OPERATION, Text: text}
 	}
 
-	return false
+	return Lexeme{ID: VALUE, Text: text}
 }
 
-func (lexer *Lexer) check(set []string, token TokenType) (bool, TokenType) {
-	if utils.ContainsAny(set, lexer.buffer.String()) {
-		return true, token
+/*
+scanString reads a double quoted string, honoring backslash escapes, and
+returns its unquoted contents as a PARAMETER. An unterminated string runs to
+the end of the line and is returned as UNKNOWN.
+*/
+func (lexer *Lexer) scanString() Lexeme {
+	start := lexer.pos
+	lexer.pos++
+
+	for lexer.pos < len(lexer.source) {
+		switch lexer.source[lexer.pos] {
+		case '\\':
+			lexer.pos += 2
+			continue
+		case '\n':
+			return Lexeme{ID: UNKNOWN, Text: string(lexer.source[start:lexer.pos])}
+		case '"':
+			lexer.pos++
+			raw := string(lexer.source[start:lexer.pos])
+
+			if text, err := strconv.Unquote(raw); err == nil {
+				return Lexeme{ID: PARAMETER, Text: text}
+			}
+
+			return Lexeme{ID: PARAMETER, Text: strings.Trim(raw, `"`)}
+		}
+
+		lexer.pos++
 	}
 
-	return false, lexer.state
+	lexer.pos = len(lexer.source)
+	return Lexeme{ID: UNKNOWN, Text: string(lexer.source[start:])}
+}
+
+func isIdentifier(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_'
 }
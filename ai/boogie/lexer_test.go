@@ -20,7 +20,7 @@ func TestLexerEmptyProgram(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -44,7 +44,7 @@ func TestLexerSingleOperation(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -74,7 +74,7 @@ func TestLexerMultiOperation(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -106,7 +106,7 @@ func TestLexerMultiOperation(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -158,7 +158,7 @@ func TestLexerMultiOperationWithConditionalFlow(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -206,7 +206,7 @@ func TestLexerMultiOperationWithParallelExecution(t *testing.T) {
 			lexer := NewLexer()
 
 			for lexeme := range lexer.Generate(program) {
-				lexemes = append(lexemes, lexeme)
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
 			}
 
 			So(lexemes, ShouldResemble, []Lexeme{
@@ -238,3 +238,89 @@ func TestLexerMultiOperationWithParallelExecution(t *testing.T) {
 		})
 	})
 }
+
+func TestLexerLabelsAndParams(t *testing.T) {
+	Convey("Given a Boogie program with labels, jumps and params", t, func() {
+		program := `
+		out <= (
+			[myLabel] => (
+				call<{search, "some query"} => browser> => next
+				match (
+					_ => [myLabel].jump
+				)
+			)
+		) <= in
+		`
+		Convey(whenTokenized, func() {
+			lexemes := make([]Lexeme, 0)
+			lexer := NewLexer()
+
+			for lexeme := range lexer.Generate(program) {
+				lexemes = append(lexemes, Lexeme{ID: lexeme.ID, Text: lexeme.Text})
+			}
+
+			So(lexemes, ShouldResemble, []Lexeme{
+				{ID: VALUE, Text: "out"},
+				{ID: FLOW, Text: "<="},
+				{ID: DELIMITER, Text: "("},
+				{ID: DELIMITER, Text: "["},
+				{ID: VALUE, Text: "myLabel"},
+				{ID: DELIMITER, Text: "]"},
+				{ID: FLOW, Text: "=>"},
+				{ID: DELIMITER, Text: "("},
+				{ID: OPERATION, Text: "call"},
+				{ID: DELIMITER, Text: "<"},
+				{ID: DELIMITER, Text: "{"},
+				{ID: VALUE, Text: "search"},
+				{ID: DELIMITER, Text: ","},
+				{ID: PARAMETER, Text: "some query"},
+				{ID: DELIMITER, Text: "}"},
+				{ID: FLOW, Text: "=>"},
+				{ID: VALUE, Text: "browser"},
+				{ID: DELIMITER, Text: ">"},
+				{ID: FLOW, Text: "=>"},
+				{ID: OPERATION, Text: "next"},
+				{ID: OPERATION, Text: "match"},
+				{ID: DELIMITER, Text: "("},
+				{ID: VALUE, Text: "_"},
+				{ID: FLOW, Text: "=>"},
+				{ID: DELIMITER, Text: "["},
+				{ID: VALUE, Text: "myLabel"},
+				{ID: DELIMITER, Text: "]"},
+				{ID: DELIMITER, Text: "."},
+				{ID: VALUE, Text: "jump"},
+				{ID: DELIMITER, Text: ")"},
+				{ID: DELIMITER, Text: ")"},
+				{ID: DELIMITER, Text: ")"},
+				{ID: FLOW, Text: "<="},
+				{ID: VALUE, Text: "in"},
+			})
+		})
+	})
+}
+
+func TestLexerPositions(t *testing.T) {
+	Convey("Given a multi line Boogie program", t, func() {
+		program := "out <= (\n    analyze => next ; comment\n) <= in"
+
+		Convey(whenTokenized, func() {
+			lexemes := make([]Lexeme, 0)
+			lexer := NewLexer()
+
+			for lexeme := range lexer.Generate(program) {
+				lexemes = append(lexemes, lexeme)
+			}
+
+			Convey("Each lexeme should carry its line and column", func() {
+				So(lexemes[0].Position, ShouldResemble, Position{Line: 1, Column: 1})
+				So(lexemes[1].Position, ShouldResemble, Position{Line: 1, Column: 5})
+				So(lexemes[2].Position, ShouldResemble, Position{Line: 1, Column: 8})
+				So(lexemes[3].Position, ShouldResemble, Position{Line: 2, Column: 5})
+				So(lexemes[4].Position, ShouldResemble, Position{Line: 2, Column: 13})
+				So(lexemes[5].Position, ShouldResemble, Position{Line: 2, Column: 16})
+				So(lexemes[6].Position, ShouldResemble, Position{Line: 3, Column: 1})
+				So(lexemes[8].Position, ShouldResemble, Position{Line: 3, Column: 6})
+			})
+		})
+	})
+}
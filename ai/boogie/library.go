@@ -0,0 +1,89 @@
+package boogie
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+/*
+extension is what Boogie files end in.
+*/
+const extension = ".boogie"
+
+/*
+Library is a directory of Boogie files holding vetted subprograms, so they
+can be used by any program without being copied into it. A subprogram is
+found in the file named after it, or in any file that is included with
+`include<name>`.
+*/
+type Library struct {
+	root string
+}
+
+func NewLibrary(root string) *Library {
+	return &Library{root: root}
+}
+
+/*
+NewConfigLibrary uses the directory set as `boogie.library` in the config,
+which defaults to ~/.amsh/boogie.
+*/
+func NewConfigLibrary() *Library {
+	root := viper.GetViper().GetString("boogie.library")
+	home, _ := os.UserHomeDir()
+
+	if root == "" {
+		root = filepath.Join(home, ".amsh", "boogie")
+	}
+
+	if rest, ok := strings.CutPrefix(root, "~/"); ok {
+		root = filepath.Join(home, rest)
+	}
+
+	return NewLibrary(root)
+}
+
+/*
+Load reads and parses the file with the given name, returning the parse
+errors as the error when it does not parse.
+*/
+func (library *Library) Load(name string) (*Node, error) {
+	source, err := os.ReadFile(filepath.Join(library.root, name+extension))
+	if err != nil {
+		return nil, err
+	}
+
+	program, diagnostics := Parse(string(source))
+
+	if err = diagnostics.Err(); err != nil {
+		return nil, err
+	}
+
+	return program, nil
+}
+
+/*
+Names returns the names of the files in the library, sorted, or nothing when
+there is no library.
+*/
+func (library *Library) Names() []string {
+	entries, err := os.ReadDir(library.root)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), extension); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,309 @@
+package boogie
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+/*
+Linker replaces every `use<name>{args}` in a program with the body of the
+subprogram, so the compiler only ever sees plain closures. Subprograms are
+looked up in the program itself first, then in the files it includes, and
+finally in the library file named after the subprogram.
+
+Arguments replace the parameters wherever they appear as a behavior or a
+param in the body, and the labels a body defines are renamed for every use, so
+a subprogram can be used more than once without its labels clashing.
+*/
+type Linker struct {
+	library     *Library
+	definitions map[string]*Node
+	loaded      map[string]bool
+	expanding   []string
+	expansions  int
+	diagnostics Diagnostics
+}
+
+/*
+NewLinker returns a linker that links against the library, which can be nil
+for programs that only use their own subprograms.
+*/
+func NewLinker(library *Library) *Linker {
+	return &Linker{
+		library:     library,
+		definitions: make(map[string]*Node),
+		loaded:      make(map[string]bool),
+		expanding:   make([]string, 0),
+		diagnostics: make(Diagnostics, 0),
+	}
+}
+
+/*
+Link returns a copy of the program with all subprograms inlined, and the
+definitions and includes left out, together with anything that could not be
+linked.
+*/
+func (linker *Linker) Link(program *Node) (*Node, Diagnostics) {
+	linker.collect(program, true)
+	linked := linker.copy(program, nil, nil)
+
+	sort.SliceStable(linker.diagnostics, func(i, j int) bool {
+		a, b := linker.diagnostics[i].Position, linker.diagnostics[j].Position
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+
+	return linked, linker.diagnostics
+}
+
+/*
+collect registers the definitions of a program, and then loads what it
+includes. Definitions in the program itself win over those that are included,
+which only fill in what is missing.
+*/
+func (linker *Linker) collect(program *Node, local bool) {
+	for _, node := range program.Next {
+		if node.Type != NODE_DEFINE || node.Value == "" {
+			continue
+		}
+
+		if defined, ok := linker.definitions[node.Value]; ok {
+			if local {
+				linker.report(node.Position, "subprogram '%s' is already defined at %s", node.Value, defined.Position)
+			}
+
+			continue
+		}
+
+		linker.definitions[node.Value] = node
+	}
+
+	for _, node := range program.Next {
+		if node.Type != NODE_INCLUDE || node.Value == "" || linker.loaded[node.Value] {
+			continue
+		}
+
+		err := linker.load(node.Value)
+
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			linker.report(node.Position, "cannot include '%s', it is not in the library", node.Value)
+		case err != nil:
+			linker.report(node.Position, "cannot include '%s': %s", node.Value, err)
+		}
+	}
+}
+
+/*
+load collects the definitions of a library file, once.
+*/
+func (linker *Linker) load(name string) error {
+	if linker.library == nil {
+		return errors.New("there is no library")
+	}
+
+	linker.loaded[name] = true
+
+	program, err := linker.library.Load(name)
+	if err != nil {
+		return err
+	}
+
+	linker.collect(program, false)
+	return nil
+}
+
+/*
+resolve finds the definition of a subprogram, loading the library file named
+after it when it is not defined anywhere yet.
+*/
+func (linker *Linker) resolve(name string, at Position) *Node {
+	if define, ok := linker.definitions[name]; ok {
+		return define
+	}
+
+	if linker.library == nil || linker.loaded[name] {
+		return nil
+	}
+
+	if err := linker.load(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		linker.report(at, "cannot load '%s': %s", name, err)
+	}
+
+	return linker.definitions[name]
+}
+
+func (linker *Linker) copy(node *Node, parent *Node, scope *scope) *Node {
+	if node == nil {
+		return nil
+	}
+
+	if node.Type == NODE_INVOKE {
+		return linker.expand(node, parent, scope)
+	}
+
+	out := *node
+	out.Parent = parent
+	out.Label = scope.label(node.Label)
+	out.Behavior = linker.value(node.Behavior, &out, scope)
+	out.Params = make([]*Node, len(node.Params))
+	out.Source = linker.copy(node.Source, &out, scope)
+	out.Next = make([]*Node, 0, len(node.Next))
+
+	if node.Type == NODE_LABEL {
+		out.Value = scope.label(node.Value)
+	}
+
+	for i, param := range node.Params {
+		out.Params[i] = linker.value(param, &out, scope)
+	}
+
+	for _, child := range node.Next {
+		if child.Type == NODE_DEFINE || child.Type == NODE_INCLUDE {
+			continue
+		}
+
+		out.Next = append(out.Next, linker.copy(child, &out, scope))
+	}
+
+	return &out
+}
+
+/*
+value copies a behavior or param, replacing it with the argument when it
+names a parameter.
+*/
+func (linker *Linker) value(node *Node, parent *Node, scope *scope) *Node {
+	if node == nil {
+		return nil
+	}
+
+	out := *node
+	out.Parent = parent
+	out.Value = scope.bind(node.Value)
+
+	return &out
+}
+
+/*
+expand returns the body of the subprogram as a closure, in place of the
+invocation. Anything that cannot be expanded becomes an empty closure, so the
+rest of the program can still be checked.
+*/
+func (linker *Linker) expand(node *Node, parent *Node, outer *scope) *Node {
+	empty := &Node{Type: NODE_CLOSURE, Position: node.Position, End: node.Position, Next: make([]*Node, 0), Parent: parent}
+
+	for _, active := range linker.expanding {
+		if active == node.Value {
+			linker.report(node.Position, "subprogram '%s' uses itself", node.Value)
+			return empty
+		}
+	}
+
+	define := linker.resolve(node.Value, node.Position)
+
+	switch {
+	case define == nil:
+		linker.report(node.Position, "undefined subprogram '%s'", node.Value)
+		return empty
+	case len(node.Params) != len(define.Params):
+		linker.report(
+			node.Position, "subprogram '%s' takes %d arguments, found %d",
+			node.Value, len(define.Params), len(node.Params),
+		)
+		return empty
+	case len(define.Next) == 0:
+		return empty
+	}
+
+	linker.expansions++
+
+	inner := &scope{bindings: make(map[string]string), labels: make(map[string]string)}
+
+	for i, param := range define.Params {
+		inner.bindings[param.Value] = outer.bind(node.Params[i].Value)
+	}
+
+	for _, name := range definedLabels(define.Next[0], nil) {
+		inner.labels[name] = fmt.Sprintf("%s.%s.%d", node.Value, name, linker.expansions)
+	}
+
+	linker.expanding = append(linker.expanding, node.Value)
+	defer func() { linker.expanding = linker.expanding[:len(linker.expanding)-1] }()
+
+	body := linker.copy(define.Next[0], parent, inner)
+	body.Position = node.Position
+	body.Label = outer.label(node.Label)
+
+	return body
+}
+
+func (linker *Linker) report(position Position, format string, args ...any) {
+	linker.diagnostics = append(linker.diagnostics, Diagnostic{
+		Severity: SEVERITY_ERROR,
+		Position: position,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+/*
+scope is what applies inside the body of a subprogram being expanded: the
+arguments bound to its parameters, and the new names of its labels. The
+program itself has no scope, which leaves everything as it is.
+*/
+type scope struct {
+	bindings map[string]string
+	labels   map[string]string
+}
+
+func (scope *scope) bind(value string) string {
+	if scope == nil {
+		return value
+	}
+
+	if bound, ok := scope.bindings[value]; ok {
+		return bound
+	}
+
+	return value
+}
+
+func (scope *scope) label(name string) string {
+	if scope == nil || name == "" {
+		return name
+	}
+
+	if renamed, ok := scope.labels[name]; ok {
+		return renamed
+	}
+
+	return name
+}
+
+/*
+definedLabels returns the labels defined in the body, including those put on
+the subprograms it uses, but not the labels inside them, since those are
+renamed when they are expanded.
+*/
+func definedLabels(node *Node, out []string) []string {
+	if node == nil {
+		return out
+	}
+
+	if node.Label != "" && (node.Type == NODE_OPERATION || node.Type == NODE_CLOSURE || node.Type == NODE_INVOKE) {
+		out = append(out, node.Label)
+	}
+
+	if node.Type == NODE_INVOKE {
+		return out
+	}
+
+	out = definedLabels(node.Source, out)
+
+	for _, child := range node.Next {
+		out = definedLabels(child, out)
+	}
+
+	return out
+}
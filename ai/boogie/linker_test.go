@@ -0,0 +1,177 @@
+package boogie
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+link parses, links and compiles the program against the library.
+*/
+func link(program string, library *Library) (*Compiler, Diagnostics) {
+	ast, diagnostics := Parse(program)
+	So(diagnostics, ShouldBeEmpty)
+
+	linked, diagnostics := NewLinker(library).Link(ast)
+
+	compiler := NewCompiler()
+	compiler.Generate(linked)
+
+	return compiler, append(diagnostics, compiler.Diagnostics()...)
+}
+
+func spawns(compiler *Compiler) []string {
+	out := make([]string, 0)
+
+	for _, instruction := range compiler.Load() {
+		if instruction.Type == INSTRUCTION_SPAWN {
+			out = append(out, instruction.Operation+"<"+instruction.Behavior+">")
+		}
+	}
+
+	return out
+}
+
+func TestLinker(t *testing.T) {
+	Convey("Given a program that defines a subprogram and uses it twice", t, func() {
+		compiler, diagnostics := link(`
+		define<checked>{focus, retries} => (
+			analyze<focus>[start] => next
+			verify => send | back<retries> | [start].jump
+		)
+
+		out <= (
+			use<checked>{surface, 3}
+			use<checked>{practical, 1}
+		) <= in`, nil)
+
+		Convey("It should inline the body with the arguments in place of the parameters", func() {
+			So(diagnostics, ShouldBeEmpty)
+			So(spawns(compiler), ShouldResemble, []string{
+				"analyze<surface>", "verify<>", "analyze<practical>", "verify<>",
+			})
+		})
+
+		Convey("It should give every use its own labels", func() {
+			labels := make([]string, 0)
+			counts := make([]int, 0)
+
+			for _, instruction := range compiler.Load() {
+				switch {
+				case instruction.Type == INSTRUCTION_SPAWN && instruction.Label != "":
+					labels = append(labels, instruction.Label)
+				case instruction.Operation == "back":
+					counts = append(counts, instruction.Count)
+				}
+			}
+
+			So(labels, ShouldResemble, []string{"checked.start.1", "checked.start.2"})
+			So(counts, ShouldResemble, []int{3, 1})
+		})
+	})
+
+	Convey("Given subprograms that use each other", t, func() {
+		compiler, diagnostics := link(`
+		define<inner>{behavior} => (
+			analyze<behavior> => next
+		)
+
+		define<outer>{behavior} => (
+			use<inner>{behavior}
+			verify => send
+		)
+
+		out <= ( use<outer>{pattern} ) <= in`, nil)
+
+		Convey("It should pass the arguments through", func() {
+			So(diagnostics, ShouldBeEmpty)
+			So(spawns(compiler), ShouldResemble, []string{"analyze<pattern>", "verify<>"})
+		})
+	})
+
+	Convey("Given a library directory", t, func() {
+		root := t.TempDir()
+
+		So(os.WriteFile(filepath.Join(root, "retry.boogie"), []byte(`
+		define<retry>{operation} => (
+			verify<operation> => send | back<3> | cancel
+		)`), 0644), ShouldBeNil)
+
+		So(os.WriteFile(filepath.Join(root, "common.boogie"), []byte(`
+		define<survey> => ( analyze<surface> => next )
+		define<deep>   => ( analyze<pattern> => next )`), 0644), ShouldBeNil)
+
+		library := NewLibrary(root)
+
+		Convey("It should list the files in it", func() {
+			So(library.Names(), ShouldResemble, []string{"common", "retry"})
+		})
+
+		Convey("It should link a subprogram from the file named after it", func() {
+			compiler, diagnostics := link(`out <= ( use<retry>{validation} ) <= in`, library)
+			So(diagnostics, ShouldBeEmpty)
+			So(spawns(compiler), ShouldResemble, []string{"verify<validation>"})
+		})
+
+		Convey("It should link the subprograms of included files", func() {
+			compiler, diagnostics := link(`
+			include<common>
+
+			out <= (
+				use<survey>
+				use<deep>
+			) <= in`, library)
+
+			So(diagnostics, ShouldBeEmpty)
+			So(spawns(compiler), ShouldResemble, []string{"analyze<surface>", "analyze<pattern>"})
+		})
+
+		Convey("It should prefer what the program defines itself", func() {
+			compiler, diagnostics := link(`
+			define<retry>{operation} => ( reason<operation> => send )
+
+			out <= ( use<retry>{deductive} ) <= in`, library)
+
+			So(diagnostics, ShouldBeEmpty)
+			So(spawns(compiler), ShouldResemble, []string{"reason<deductive>"})
+		})
+	})
+
+	Convey("Given subprograms that cannot be linked", t, func() {
+		_, diagnostics := link(`
+		include<missing>
+
+		define<loop> => ( use<loop> )
+		define<pair>{a, b} => ( analyze<a> => next )
+		define<pair> => ( analyze => next )
+
+		out <= (
+			use<loop>
+			use<pair>{surface}
+			use<nowhere>
+		) <= in`, NewLibrary(t.TempDir()))
+
+		Convey("It should report every one of them", func() {
+			So(messages(diagnostics), ShouldResemble, []string{
+				"2:3: error: cannot include 'missing', it is not in the library",
+				"4:21: error: subprogram 'loop' uses itself",
+				"6:3: error: subprogram 'pair' is already defined at 5:3",
+				"10:4: error: subprogram 'pair' takes 2 arguments, found 1",
+				"11:4: error: undefined subprogram 'nowhere'",
+			})
+		})
+	})
+
+	Convey("Given a program that was not linked", t, func() {
+		compiler := compile(`out <= ( use<checked> ) <= in`)
+
+		Convey("It should not compile", func() {
+			So(messages(compiler.Diagnostics()), ShouldResemble, []string{
+				"1:10: error: subprogram 'checked' must be linked before compiling",
+			})
+		})
+	})
+}
@@ -2,6 +2,9 @@ package boogie
 
 import (
 	"fmt"
+	"strconv"
+
+	"github.com/theapemachine/amsh/utils"
 )
 
 type NodeType int
@@ -14,19 +17,62 @@ const (
 	NODE_MATCH
 	NODE_CLOSURE
 	NODE_JOIN
+	NODE_ARM
+	NODE_LABEL
+	NODE_VALUE
+	NODE_DEFINE
+	NODE_INVOKE
+	NODE_INCLUDE
 )
 
+/*
+ITERATE_UNBOUNDED marks an operation using the `<= =>` iteration form without
+an explicit limit.
+*/
+const ITERATE_UNBOUNDED = -1
+
+/*
+flowOperations are the operations that direct the context rather than mutate
+it, and which are therefore built as NODE_FLOW targets.
+*/
+var flowOperations = []string{
+	"next",
+	"send",
+	"back",
+	"cancel",
+	"halt",
+}
+
+/*
+Node is a single element of the Boogie AST.
+
+Operations keep their flow chain in Next, with the primary target first and
+any `|` fallbacks after it. Closures and joins keep their children in Next,
+and a match keeps its arms in Next. Label holds the label defined on an
+operation or closure, or the label a `jump` flow refers to. Source is what a
+match reads from, either a label reference or a join. End is the position of
+the ')' closing a closure or match.
+*/
 type Node struct {
-	Type     NodeType
-	Value    string
-	Behavior *Node
-	Next     []*Node
-	Parent   *Node
+	Type       NodeType
+	Value      string
+	Position   Position
+	End        Position
+	Behavior   *Node
+	Params     []*Node
+	Label      string
+	Iterations int
+	Source     *Node
+	Next       []*Node
+	Parent     *Node
 }
+
 type Parser struct {
-	current  *Node  // Current node we're building
-	program  *Node  // Root of our AST
-	lastFlow string // Tracks the last flow operator encountered
+	tokens      []Lexeme
+	pos         int
+	skipped     int
+	program     *Node
+	diagnostics Diagnostics
 }
 
 func NewParser() *Parser {
@@ -36,72 +82,612 @@ func NewParser() *Parser {
 	}
 
 	return &Parser{
-		program:  program,
-		current:  program,
-		lastFlow: "",
+		program:     program,
+		skipped:     -1,
+		diagnostics: make(Diagnostics, 0),
 	}
 }
 
+/*
+Parse is a convenience wrapper that lexes and parses the source in one go,
+returning the AST together with any diagnostics.
+*/
+func Parse(source string) (*Node, Diagnostics) {
+	parser := NewParser()
+	ast := parser.Generate(NewLexer().Generate(source))
+
+	return ast, parser.Diagnostics()
+}
+
+/*
+Diagnostics returns the problems found during the last call to Generate. The
+AST is still built when there are errors, but it should not be executed.
+*/
+func (parser *Parser) Diagnostics() Diagnostics {
+	return parser.diagnostics
+}
+
+/*
+Generate builds the AST for the program described by the incoming tokens.
+The program has the form `out <= stage <= in`, where the outer context values
+are optional so fragments can be parsed as well.
+*/
 func (parser *Parser) Generate(tokens chan Lexeme) *Node {
 	for token := range tokens {
-		//fmt.Printf("Token: %s\n", token.Text)
-		switch token.ID {
-		case DELIMITER:
-			parser.handleDelimiter(token)
-		case OPERATION:
-			parser.handleOperation(token)
-		case FLOW:
-			// Skip flow tokens as they don't need to create nodes
+		parser.tokens = append(parser.tokens, token)
+	}
+
+	if parser.peekIs(VALUE, "out") && parser.peekAt(1).Text == "<=" {
+		parser.pos += 2
+	}
+
+	for !parser.done() {
+		// Definitions and includes can come before the program itself.
+		if parser.peekIs(VALUE, "out") && parser.peekAt(1).Text == "<=" {
+			parser.pos += 2
 			continue
-		case VALUE:
-			// Skip value tokens (in/out) as they don't need to create nodes
+		}
+
+		if parser.peekIs(FLOW, "<=") && parser.peekAt(1).Text == "in" {
+			parser.pos += 2
 			continue
-		default:
-			fmt.Printf("Unhandled token: %s\n", token.Text)
 		}
+
+		if stage := parser.parseStage(parser.program); stage != nil {
+			parser.program.Next = append(parser.program.Next, stage)
+			continue
+		}
+
+		if parser.peekIs(DELIMITER, ")") {
+			parser.report(parser.peek().Position, "unbalanced ')' has no matching '('")
+			parser.advance()
+			continue
+		}
+
+		parser.skip()
 	}
 
 	return parser.program
 }
 
-func (parser *Parser) handleDelimiter(token Lexeme) {
-	switch token.Text {
-	case "(":
-		closure := &Node{
-			Type:   NODE_CLOSURE,
-			Next:   make([]*Node, 0),
-			Parent: parser.current,
+/*
+parseStage parses anything that can appear as a statement: a closure, a join,
+a match, a labelled closure or an operation with its flow chain.
+*/
+func (parser *Parser) parseStage(parent *Node) *Node {
+	token := parser.peek()
+
+	switch {
+	case token.ID == DELIMITER && token.Text == "(":
+		return parser.parseClosure(parent)
+	case token.ID == DELIMITER && token.Text == "[":
+		return parser.parseLabelledClosure(parent)
+	case token.ID == OPERATION && token.Text == "join":
+		return parser.parseJoin(parent)
+	case token.ID == OPERATION && token.Text == "match":
+		return parser.parseMatch(parent)
+	case token.ID == OPERATION && token.Text == "define":
+		return parser.parseDefinition(parent)
+	case token.ID == OPERATION && token.Text == "use":
+		return parser.parseInvocation(parent)
+	case token.ID == OPERATION && token.Text == "include":
+		return parser.parseInclude(parent)
+	case token.ID == OPERATION:
+		return parser.parseOperation(parent)
+	case token.ID == VALUE && parser.startsStatement(parser.peekAt(1)):
+		parser.report(token.Position, "unknown operation '%s'", token.Text)
+		return parser.parseOperation(parent)
+	}
+
+	return nil
+}
+
+/*
+startsStatement reports whether the token following an identifier makes it
+look like it was meant as an operation, so an unknown operation can be
+reported as such instead of as a stray token.
+*/
+func (parser *Parser) startsStatement(token Lexeme) bool {
+	switch token.ID {
+	case FLOW:
+		return true
+	case DELIMITER:
+		return token.Text == "<" || token.Text == "[" || token.Text == "{"
+	}
+
+	return false
+}
+
+func (parser *Parser) parseClosure(parent *Node) *Node {
+	closure := parser.newNode(NODE_CLOSURE, "", parser.peek(), parent)
+	parser.expect(DELIMITER, "(")
+
+	for !parser.done() && !parser.peekIs(DELIMITER, ")") {
+		if child := parser.parseStage(closure); child != nil {
+			closure.Next = append(closure.Next, child)
+			continue
+		}
+
+		parser.skip()
+	}
+
+	closure.End = parser.close(closure.Position)
+	return closure
+}
+
+/*
+parseLabelledClosure handles `[label] => (...)`, which defines a jump target
+at the start of the closure.
+*/
+func (parser *Parser) parseLabelledClosure(parent *Node) *Node {
+	start := parser.peek()
+	label := parser.parseLabel()
+
+	if !parser.accept(FLOW, "=>") || !parser.peekIs(DELIMITER, "(") {
+		parser.report(start.Position, "label '[%s]' must be followed by '=> ('", label)
+		return nil
+	}
+
+	closure := parser.parseClosure(parent)
+	closure.Label = label
+
+	return closure
+}
+
+func (parser *Parser) parseJoin(parent *Node) *Node {
+	token := parser.advance()
+	join := parser.newNode(NODE_JOIN, token.Text, token, parent)
+	parser.expect(FLOW, "<=")
+
+	for parser.peekIs(DELIMITER, "(") {
+		join.Next = append(join.Next, parser.parseClosure(join))
+	}
+
+	if len(join.Next) == 0 {
+		parser.report(token.Position, "join without any closures to run")
+	}
+
+	return join
+}
+
+/*
+parseMatch handles both `match <= source ( arms )` and
+`match ( arms ) <= source`, where source is a label reference or a join.
+*/
+func (parser *Parser) parseMatch(parent *Node) *Node {
+	token := parser.advance()
+	match := parser.newNode(NODE_MATCH, token.Text, token, parent)
+
+	if parser.accept(FLOW, "<=") {
+		match.Source = parser.parseSource(match)
+	}
+
+	open := parser.peek()
+
+	if !parser.expect(DELIMITER, "(") {
+		return match
+	}
+
+	for !parser.done() && !parser.peekIs(DELIMITER, ")") {
+		if arm := parser.parseArm(match); arm != nil {
+			match.Next = append(match.Next, arm)
+			continue
+		}
+
+		parser.skip()
+	}
+
+	match.End = parser.close(open.Position)
+
+	if match.Source == nil && parser.accept(FLOW, "<=") {
+		match.Source = parser.parseSource(match)
+	}
+
+	return match
+}
+
+func (parser *Parser) parseSource(parent *Node) *Node {
+	token := parser.peek()
+
+	if parser.peekIs(DELIMITER, "[") {
+		return parser.newNode(NODE_LABEL, parser.parseLabel(), token, parent)
+	}
+
+	if source := parser.parseStage(parent); source != nil {
+		return source
+	}
+
+	parser.report(token.Position, "expected a label or join as the source, found %s", describe(token))
+	return nil
+}
+
+func (parser *Parser) parseArm(parent *Node) *Node {
+	token := parser.peek()
+
+	if token.ID != VALUE && token.ID != OPERATION {
+		return nil
+	}
+
+	arm := parser.newNode(NODE_ARM, parser.advance().Text, token, parent)
+
+	if !parser.peekIs(FLOW, "=>") {
+		parser.report(token.Position, "match arm '%s' has no flow", token.Text)
+		return arm
+	}
+
+	parser.parseFlowChain(arm)
+	return arm
+}
+
+/*
+parseDefinition handles `define<name>{params} => ( ... )`, which defines a
+subprogram that can be used by name.
+*/
+func (parser *Parser) parseDefinition(parent *Node) *Node {
+	define := parser.parseNamed(NODE_DEFINE, parent, "define<name>{params} => ( ... )")
+
+	for _, param := range define.Params {
+		if !isName(param.Value) {
+			parser.report(param.Position, "parameter '%s' must be a name", param.Value)
+		}
+	}
+
+	if !parser.accept(FLOW, "=>") || !parser.peekIs(DELIMITER, "(") {
+		parser.report(define.Position, "subprogram '%s' must be followed by '=> ('", define.Value)
+		return define
+	}
+
+	define.Next = append(define.Next, parser.parseClosure(define))
+	return define
+}
+
+/*
+parseInvocation handles `use<name>{args}`, which runs a subprogram in place,
+and continues with the next statement once it is done, so it takes no flows.
+*/
+func (parser *Parser) parseInvocation(parent *Node) *Node {
+	use := parser.parseNamed(NODE_INVOKE, parent, "use<name>{args}")
+
+	if parser.peekIs(FLOW, "=>") {
+		parser.report(parser.peek().Position, "'use<%s>' continues with the next statement, and takes no flows", use.Value)
+		parser.parseFlowChain(&Node{})
+	}
+
+	return use
+}
+
+func (parser *Parser) parseInclude(parent *Node) *Node {
+	return parser.parseNamed(NODE_INCLUDE, parent, "include<name>")
+}
+
+/*
+parseNamed parses the keyword and modifiers shared by definitions,
+invocations and includes, where the name goes in the behavior position.
+Definitions and includes are only allowed at the top level of a program.
+*/
+func (parser *Parser) parseNamed(nodeType NodeType, parent *Node, example string) *Node {
+	token := parser.advance()
+	node := parser.newNode(nodeType, "", token, parent)
+	parser.parseModifiers(node)
+
+	if node.Behavior == nil {
+		parser.report(token.Position, "%s needs a name, e.g. %s", token.Text, example)
+	} else {
+		node.Value = node.Behavior.Value
+	}
+
+	if nodeType != NODE_INVOKE && parent.Type != NODE_PROGRAM {
+		parser.report(token.Position, "%s is only allowed at the top level", token.Text)
+	}
+
+	return node
+}
+
+/*
+parseOperation parses an operation with its optional behavior, params, label,
+iteration and flow chain, e.g. `analyze<surface>[start] <= <3> => next | cancel`.
+*/
+func (parser *Parser) parseOperation(parent *Node) *Node {
+	token := parser.advance()
+	operation := parser.newNode(NODE_OPERATION, token.Text, token, parent)
+	parser.parseModifiers(operation)
+
+	if parser.accept(FLOW, "<=") {
+		operation.Iterations = ITERATE_UNBOUNDED
+
+		if parser.accept(DELIMITER, "<") {
+			if count, err := strconv.Atoi(parser.peek().Text); err == nil {
+				parser.advance()
+				operation.Iterations = count
+			}
+
+			parser.expect(DELIMITER, ">")
 		}
+	}
+
+	parser.parseFlowChain(operation)
+	return operation
+}
 
-		// Add closure to parent's Next slice
-		parser.current.Next = append(parser.current.Next, closure)
-		parser.current = closure
-	case ")":
-		parser.current = parser.current.Parent
+func (parser *Parser) parseModifiers(node *Node) {
+	for {
+		switch {
+		case parser.peekIs(DELIMITER, "<"):
+			parser.parseBehavior(node)
+		case parser.peekIs(DELIMITER, "{"):
+			node.Params = append(node.Params, parser.parseParams(node)...)
+		case parser.peekIs(DELIMITER, "["):
+			node.Label = parser.parseLabel()
+		default:
+			return
+		}
 	}
 }
 
-func (parser *Parser) handleOperation(token Lexeme) {
-	// Handle join operation specially
-	if token.Text == "join" {
-		joinNode := &Node{
-			Type:   NODE_JOIN,
-			Value:  token.Text,
-			Next:   make([]*Node, 0),
-			Parent: parser.current,
+/*
+parseBehavior handles `<behavior>` as well as the parameterised system
+integration form `<{params} => behavior>`.
+*/
+func (parser *Parser) parseBehavior(node *Node) {
+	parser.expect(DELIMITER, "<")
+
+	if parser.peekIs(DELIMITER, "{") {
+		node.Params = append(node.Params, parser.parseParams(node)...)
+		parser.expect(FLOW, "=>")
+	}
+
+	if token := parser.peek(); token.ID == VALUE || token.ID == OPERATION {
+		node.Behavior = parser.newNode(NODE_BEHAVIOR, parser.advance().Text, token, node)
+	}
+
+	parser.expect(DELIMITER, ">")
+}
+
+func (parser *Parser) parseParams(parent *Node) []*Node {
+	params := make([]*Node, 0)
+	parser.expect(DELIMITER, "{")
+
+	for !parser.done() && !parser.peekIs(DELIMITER, "}") {
+		token := parser.peek()
+
+		if token.ID == VALUE || token.ID == OPERATION || token.ID == PARAMETER {
+			params = append(params, parser.newNode(NODE_VALUE, parser.advance().Text, token, parent))
+			parser.accept(DELIMITER, ",")
+			continue
 		}
-		parser.current.Next = append(parser.current.Next, joinNode)
-		parser.current = joinNode
+
+		parser.skip()
+	}
+
+	parser.expect(DELIMITER, "}")
+	return params
+}
+
+func (parser *Parser) parseLabel() string {
+	parser.expect(DELIMITER, "[")
+
+	label := ""
+
+	if token := parser.peek(); token.ID == VALUE || token.ID == OPERATION {
+		label = parser.advance().Text
+	} else {
+		parser.report(token.Position, "expected a label name, found %s", describe(token))
+	}
+
+	parser.expect(DELIMITER, "]")
+	return label
+}
+
+/*
+parseFlowChain parses `=> target | fallback | ...` into the Next slice of the
+given node.
+*/
+func (parser *Parser) parseFlowChain(node *Node) {
+	if !parser.peekIs(FLOW, "=>") {
 		return
 	}
 
-	operation := &Node{
-		Type:   NODE_OPERATION,
-		Value:  token.Text,
-		Next:   make([]*Node, 0),
-		Parent: parser.current,
+	flow := parser.advance()
+
+	if target := parser.parseTarget(node); target != nil {
+		node.Next = append(node.Next, target)
+	} else {
+		parser.report(flow.Position, "flow '=>' without target")
+	}
+
+	for parser.peekIs(DELIMITER, "|") {
+		pipe := parser.advance()
+
+		if target := parser.parseTarget(node); target != nil {
+			node.Next = append(node.Next, target)
+			continue
+		}
+
+		parser.report(pipe.Position, "dangling '|' without fallback target")
 	}
-	parser.current.Next = append(parser.current.Next, operation)
+}
+
+func (parser *Parser) parseTarget(parent *Node) *Node {
+	token := parser.peek()
+
+	switch {
+	case token.ID == OPERATION && utils.ContainsAny(flowOperations, token.Text):
+		flow := parser.newNode(NODE_FLOW, parser.advance().Text, token, parent)
+
+		if parser.peekIs(DELIMITER, "<") {
+			parser.parseBehavior(flow)
+		}
+
+		return flow
+	case token.ID == DELIMITER && token.Text == "[":
+		flow := parser.newNode(NODE_FLOW, "jump", token, parent)
+		flow.Label = parser.parseLabel()
+
+		if parser.accept(DELIMITER, ".") {
+			parser.expect(VALUE, "jump")
+		}
+
+		return flow
+	case token.ID == DELIMITER && token.Text == "(":
+		return parser.parseClosure(parent)
+	case token.ID == OPERATION:
+		return parser.parseStage(parent)
+	case token.ID == VALUE:
+		parser.report(token.Position, "unknown flow target '%s'", token.Text)
+		return parser.newNode(NODE_FLOW, parser.advance().Text, token, parent)
+	}
+
+	return nil
+}
+
+func (parser *Parser) newNode(nodeType NodeType, value string, at Lexeme, parent *Node) *Node {
+	return &Node{
+		Type:     nodeType,
+		Value:    value,
+		Position: at.Position,
+		Next:     make([]*Node, 0),
+		Parent:   parent,
+	}
+}
+
+func (parser *Parser) report(position Position, format string, args ...any) {
+	parser.diagnostics = append(parser.diagnostics, Diagnostic{
+		Severity: SEVERITY_ERROR,
+		Position: position,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (parser *Parser) done() bool {
+	return parser.pos >= len(parser.tokens)
+}
+
+func (parser *Parser) peek() Lexeme {
+	return parser.peekAt(0)
+}
+
+func (parser *Parser) peekAt(offset int) Lexeme {
+	if parser.pos+offset >= len(parser.tokens) {
+		return Lexeme{ID: UNKNOWN, Position: parser.end()}
+	}
+
+	return parser.tokens[parser.pos+offset]
+}
+
+func (parser *Parser) peekIs(id TokenType, text string) bool {
+	token := parser.peek()
+	return token.ID == id && token.Text == text
+}
+
+func (parser *Parser) advance() Lexeme {
+	token := parser.peek()
+
+	if !parser.done() {
+		parser.pos++
+	}
+
+	return token
+}
+
+func (parser *Parser) accept(id TokenType, text string) bool {
+	if parser.peekIs(id, text) {
+		parser.pos++
+		return true
+	}
+
+	return false
+}
+
+/*
+expect consumes the token when it matches, and reports it as missing when it
+does not, without consuming anything so parsing can recover.
+*/
+func (parser *Parser) expect(id TokenType, text string) bool {
+	if parser.accept(id, text) {
+		return true
+	}
+
+	token := parser.peek()
+	parser.report(token.Position, "expected '%s', found %s", text, describe(token))
+
+	return false
+}
+
+/*
+close consumes the ')' ending a block opened at the given position, and
+returns where it was, reporting the block as unbalanced when the input ends
+first.
+*/
+func (parser *Parser) close(open Position) Position {
+	if parser.peekIs(DELIMITER, ")") {
+		return parser.advance().Position
+	}
+
+	parser.report(open, "unbalanced '(' is never closed")
+	return parser.end()
+}
+
+/*
+skip steps over a token that cannot start anything at this point. Only the
+first of a run of skipped tokens is reported, to avoid a cascade of errors for
+a single mistake.
+*/
+func (parser *Parser) skip() {
+	token := parser.peek()
+
+	if parser.skipped != parser.pos-1 {
+		switch token.ID {
+		case UNKNOWN:
+			parser.report(token.Position, "unexpected character %s", describe(token))
+		default:
+			parser.report(token.Position, "unexpected %s", describe(token))
+		}
+	}
+
+	parser.skipped = parser.pos
+	parser.advance()
+}
+
+/*
+end returns the position just after the last token, used to report problems
+found at the end of the input.
+*/
+func (parser *Parser) end() Position {
+	if len(parser.tokens) == 0 {
+		return Position{Line: 1, Column: 1}
+	}
+
+	last := parser.tokens[len(parser.tokens)-1]
+
+	return Position{
+		Line:   last.Position.Line,
+		Column: last.Position.Column + len([]rune(last.Text)),
+	}
+}
+
+/*
+isName reports whether the value is a single identifier.
+*/
+func isName(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for _, char := range value {
+		if !isIdentifier(char) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func describe(token Lexeme) string {
+	if token.Text == "" {
+		return "end of input"
+	}
+
+	return "'" + token.Text + "'"
 }
 
 func (parser *Parser) PrintAST(node *Node, depth int) {
@@ -11,7 +11,6 @@ const shouldBeProgram = "It should be a program"
 const shouldHaveOneChild = "It should have one child"
 const shouldHaveNoChildren = "It should have no children"
 const shouldHaveTwoChildren = "It should have two children"
-const shouldHaveFourChildren = "It should have four children"
 const shouldHaveClosure = "It should have a closure"
 const shouldHaveNextOp = "It should have a next operation"
 const shouldHaveJoin = "It should have a join"
@@ -72,8 +71,8 @@ func TestParser(t *testing.T) {
 					So(closure.Type, ShouldEqual, NODE_CLOSURE)
 				})
 
-				Convey(shouldHaveTwoChildren, func() {
-					So(len(closure.Next), ShouldEqual, 2)
+				Convey(shouldHaveOneChild, func() {
+					So(len(closure.Next), ShouldEqual, 1)
 				})
 
 				analyze := closure.Next[0]
@@ -83,11 +82,10 @@ func TestParser(t *testing.T) {
 					So(analyze.Value, ShouldEqual, "analyze")
 				})
 
-				send := closure.Next[1]
-
 				Convey(shouldHaveSend, func() {
-					So(send.Type, ShouldEqual, NODE_OPERATION)
-					So(send.Value, ShouldEqual, "send")
+					So(len(analyze.Next), ShouldEqual, 1)
+					So(analyze.Next[0].Type, ShouldEqual, NODE_FLOW)
+					So(analyze.Next[0].Value, ShouldEqual, "send")
 				})
 			})
 		})
@@ -118,9 +116,10 @@ func TestParser(t *testing.T) {
 				So(closure.Type, ShouldEqual, NODE_CLOSURE)
 			})
 
-			Convey(shouldHaveFourChildren, func() {
-				So(len(closure.Next), ShouldEqual, 4)
+			Convey(shouldHaveTwoChildren, func() {
+				So(len(closure.Next), ShouldEqual, 2)
 			})
+
 			analyze := closure.Next[0]
 
 			Convey(shouldHaveAnalysis, func() {
@@ -128,25 +127,21 @@ func TestParser(t *testing.T) {
 				So(analyze.Value, ShouldEqual, "analyze")
 			})
 
-			next := closure.Next[1]
-
 			Convey(shouldHaveNextOp, func() {
-				So(next.Type, ShouldEqual, NODE_OPERATION)
-				So(next.Value, ShouldEqual, "next")
+				So(analyze.Next[0].Type, ShouldEqual, NODE_FLOW)
+				So(analyze.Next[0].Value, ShouldEqual, "next")
 			})
 
-			verify := closure.Next[2]
+			verify := closure.Next[1]
 
 			Convey(shouldHaveVerify, func() {
 				So(verify.Type, ShouldEqual, NODE_OPERATION)
 				So(verify.Value, ShouldEqual, "verify")
 			})
 
-			send := closure.Next[3]
-
 			Convey(shouldHaveSend, func() {
-				So(send.Type, ShouldEqual, NODE_OPERATION)
-				So(send.Value, ShouldEqual, "send")
+				So(verify.Next[0].Type, ShouldEqual, NODE_FLOW)
+				So(verify.Next[0].Value, ShouldEqual, "send")
 			})
 		})
 	})
@@ -195,8 +190,8 @@ func TestParser(t *testing.T) {
 					Convey("It should have a closure for the first child", func() {
 						So(join.Next[0].Type, ShouldEqual, NODE_CLOSURE)
 
-						Convey(shouldHaveFourChildren, func() {
-							So(len(join.Next[0].Next), ShouldEqual, 4)
+						Convey(shouldHaveTwoChildren, func() {
+							So(len(join.Next[0].Next), ShouldEqual, 2)
 
 							Convey(shouldHaveAnalysis, func() {
 								So(join.Next[0].Next[0].Type, ShouldEqual, NODE_OPERATION)
@@ -204,18 +199,18 @@ func TestParser(t *testing.T) {
 							})
 
 							Convey(shouldHaveNextOp, func() {
-								So(join.Next[0].Next[1].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[0].Next[1].Value, ShouldEqual, "next")
+								So(join.Next[0].Next[0].Next[0].Type, ShouldEqual, NODE_FLOW)
+								So(join.Next[0].Next[0].Next[0].Value, ShouldEqual, "next")
 							})
 
 							Convey(shouldHaveVerify, func() {
-								So(join.Next[0].Next[2].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[0].Next[2].Value, ShouldEqual, "verify")
+								So(join.Next[0].Next[1].Type, ShouldEqual, NODE_OPERATION)
+								So(join.Next[0].Next[1].Value, ShouldEqual, "verify")
 							})
 
 							Convey(shouldHaveSend, func() {
-								So(join.Next[0].Next[3].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[0].Next[3].Value, ShouldEqual, "send")
+								So(join.Next[0].Next[1].Next[0].Type, ShouldEqual, NODE_FLOW)
+								So(join.Next[0].Next[1].Next[0].Value, ShouldEqual, "send")
 							})
 						})
 					})
@@ -223,8 +218,8 @@ func TestParser(t *testing.T) {
 					Convey("It should have a closure for the second child", func() {
 						So(join.Next[1].Type, ShouldEqual, NODE_CLOSURE)
 
-						Convey(shouldHaveFourChildren, func() {
-							So(len(join.Next[1].Next), ShouldEqual, 4)
+						Convey(shouldHaveTwoChildren, func() {
+							So(len(join.Next[1].Next), ShouldEqual, 2)
 
 							Convey(shouldHaveAnalysis, func() {
 								So(join.Next[1].Next[0].Type, ShouldEqual, NODE_OPERATION)
@@ -232,18 +227,18 @@ func TestParser(t *testing.T) {
 							})
 
 							Convey(shouldHaveNextOp, func() {
-								So(join.Next[1].Next[1].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[1].Next[1].Value, ShouldEqual, "next")
+								So(join.Next[1].Next[0].Next[0].Type, ShouldEqual, NODE_FLOW)
+								So(join.Next[1].Next[0].Next[0].Value, ShouldEqual, "next")
 							})
 
 							Convey(shouldHaveVerify, func() {
-								So(join.Next[1].Next[2].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[1].Next[2].Value, ShouldEqual, "verify")
+								So(join.Next[1].Next[1].Type, ShouldEqual, NODE_OPERATION)
+								So(join.Next[1].Next[1].Value, ShouldEqual, "verify")
 							})
 
 							Convey(shouldHaveSend, func() {
-								So(join.Next[1].Next[3].Type, ShouldEqual, NODE_OPERATION)
-								So(join.Next[1].Next[3].Value, ShouldEqual, "send")
+								So(join.Next[1].Next[1].Next[0].Type, ShouldEqual, NODE_FLOW)
+								So(join.Next[1].Next[1].Next[0].Value, ShouldEqual, "send")
 							})
 						})
 					})
@@ -253,3 +248,473 @@ func TestParser(t *testing.T) {
 		})
 	})
 }
+
+func parse(program string) *Node {
+	return NewParser().Generate(NewLexer().Generate(program))
+}
+
+/*
+TestParserConstructs checks the AST for each construct documented in the README.
+*/
+func TestParserConstructs(t *testing.T) {
+	Convey("Given a program with fallback chains", t, func() {
+		program := `
+		out <= (
+			analyze => next | back | cancel ; Analysis with error handling
+			verify  => send | back | cancel ; Verification, and send up the chain
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey(shouldHaveTwoChildren, func() {
+				So(len(closure.Next), ShouldEqual, 2)
+			})
+
+			Convey("It should keep the primary target first, followed by the fallbacks", func() {
+				analyze := closure.Next[0]
+				So(len(analyze.Next), ShouldEqual, 3)
+				So(analyze.Next[0].Value, ShouldEqual, "next")
+				So(analyze.Next[1].Value, ShouldEqual, "back")
+				So(analyze.Next[2].Value, ShouldEqual, "cancel")
+
+				for _, flow := range analyze.Next {
+					So(flow.Type, ShouldEqual, NODE_FLOW)
+					So(flow.Parent, ShouldEqual, analyze)
+				}
+			})
+		})
+	})
+
+	Convey("Given a program with retry counts", t, func() {
+		program := `
+		out <= (
+			analyze => next | back<3> | cancel ; Analysis with error handling
+			verify  => send | back<3> | cancel ; Verification, and send up the chain
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should attach the retry count to the back flow", func() {
+				for _, statement := range closure.Next {
+					back := statement.Next[1]
+					So(back.Value, ShouldEqual, "back")
+					So(back.Behavior, ShouldNotBeNil)
+					So(back.Behavior.Type, ShouldEqual, NODE_BEHAVIOR)
+					So(back.Behavior.Value, ShouldEqual, "3")
+				}
+			})
+		})
+	})
+
+	Convey("Given a program with a match block", t, func() {
+		program := `
+		out <= (
+			analyze => next ; Analysis without any behavior
+			verify  => next ; Verification, and send up the chain
+			match (
+				ok    => send   ; If ok, send up the chain
+				error => cancel ; If error, cancel
+				_     => back   ; In any other case, go back to verify
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should have three statements", func() {
+				So(len(closure.Next), ShouldEqual, 3)
+			})
+
+			match := closure.Next[2]
+
+			Convey("It should have a match with three arms", func() {
+				So(match.Type, ShouldEqual, NODE_MATCH)
+				So(match.Source, ShouldBeNil)
+				So(len(match.Next), ShouldEqual, 3)
+			})
+
+			Convey("Each arm should hold its condition and target", func() {
+				expected := [][]string{{"ok", "send"}, {"error", "cancel"}, {"_", "back"}}
+
+				for i, arm := range match.Next {
+					So(arm.Type, ShouldEqual, NODE_ARM)
+					So(arm.Value, ShouldEqual, expected[i][0])
+					So(arm.Next[0].Type, ShouldEqual, NODE_FLOW)
+					So(arm.Next[0].Value, ShouldEqual, expected[i][1])
+				}
+			})
+		})
+	})
+
+	Convey("Given a program with a label reference", t, func() {
+		program := `
+		out <= (
+			analyze[myLabel] => next ; Analysis without any behavior
+			verify           => next ; Verification, and send up the chain
+			match <= [myLabel] (
+				ok    => send   ; If ok, send up the chain
+				error => cancel ; If error, cancel
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should define the label on the operation", func() {
+				So(closure.Next[0].Value, ShouldEqual, "analyze")
+				So(closure.Next[0].Label, ShouldEqual, "myLabel")
+				So(closure.Next[0].Next[0].Value, ShouldEqual, "next")
+			})
+
+			Convey("It should use the label as the match source", func() {
+				match := closure.Next[2]
+				So(match.Type, ShouldEqual, NODE_MATCH)
+				So(match.Source.Type, ShouldEqual, NODE_LABEL)
+				So(match.Source.Value, ShouldEqual, "myLabel")
+				So(len(match.Next), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given a program with a jump target", t, func() {
+		program := `
+		out <= (
+			[myLabel] => (
+				analyze => next ; Analysis without any behavior
+				verify  => next ; Verification, and send up the chain
+				match (
+					ok    => send           ; If ok, send up the chain
+					error => cancel         ; If error, cancel
+					_     => [myLabel].jump ; In any other case, jump to the beginning
+				)
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should have a labelled closure", func() {
+				So(len(closure.Next), ShouldEqual, 1)
+				So(closure.Next[0].Type, ShouldEqual, NODE_CLOSURE)
+				So(closure.Next[0].Label, ShouldEqual, "myLabel")
+				So(len(closure.Next[0].Next), ShouldEqual, 3)
+			})
+
+			Convey("It should have a jump flow to the label", func() {
+				arm := closure.Next[0].Next[2].Next[2]
+				So(arm.Value, ShouldEqual, "_")
+				So(arm.Next[0].Type, ShouldEqual, NODE_FLOW)
+				So(arm.Next[0].Value, ShouldEqual, "jump")
+				So(arm.Next[0].Label, ShouldEqual, "myLabel")
+			})
+		})
+	})
+
+	Convey("Given a program with iteration", t, func() {
+		program := `
+		out <= (
+			analyze <= => next | back | cancel ; Analysis with error handling and (infinite) iteration
+			verify     => send | back | cancel ; Verification, and send up the chain
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should mark the operation as unbounded", func() {
+				So(closure.Next[0].Iterations, ShouldEqual, ITERATE_UNBOUNDED)
+				So(len(closure.Next[0].Next), ShouldEqual, 3)
+				So(closure.Next[1].Iterations, ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given a program with an iteration limit", t, func() {
+		program := `
+		out <= (
+			analyze <= <3> => next ; Analysis with 3 iterations maximum
+			verify         => send ; Verification, and send up the chain
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should store the iteration limit", func() {
+				So(closure.Next[0].Iterations, ShouldEqual, 3)
+				So(closure.Next[0].Behavior, ShouldBeNil)
+				So(closure.Next[0].Next[0].Value, ShouldEqual, "next")
+			})
+		})
+	})
+
+	Convey("Given a program with a system integration call", t, func() {
+		program := `
+		out <= (
+			call<{
+				search,
+				"some query"
+			} => browser> => send ; Browser search operation
+		) <= in`
+
+		Convey(whenParsed, func() {
+			call := parse(program).Next[0].Next[0]
+
+			Convey("It should have the behavior and params", func() {
+				So(call.Value, ShouldEqual, "call")
+				So(call.Behavior.Value, ShouldEqual, "browser")
+				So(len(call.Params), ShouldEqual, 2)
+				So(call.Params[0].Type, ShouldEqual, NODE_VALUE)
+				So(call.Params[0].Value, ShouldEqual, "search")
+				So(call.Params[1].Value, ShouldEqual, "some query")
+				So(call.Next[0].Value, ShouldEqual, "send")
+			})
+		})
+	})
+
+	Convey("Given a program with a behavior", t, func() {
+		program := `
+		out <= (
+			analyze<surface> => send
+		) <= in`
+
+		Convey(whenParsed, func() {
+			analyze := parse(program).Next[0].Next[0]
+
+			Convey("It should attach the behavior to the operation", func() {
+				So(analyze.Behavior.Type, ShouldEqual, NODE_BEHAVIOR)
+				So(analyze.Behavior.Value, ShouldEqual, "surface")
+				So(analyze.Behavior.Parent, ShouldEqual, analyze)
+			})
+		})
+	})
+
+	Convey("Given the multi-stage analysis example", t, func() {
+		program := `
+		out <= (
+			call<{search, "topic"} => browser> => next                 ; Initial research
+			analyze<pattern>                   => next | back | cancel ; Pattern analysis
+			analyze<temporal>                  => next | back | cancel ; Timeline analysis
+			match (
+				ok     => send   ; Send if analysis complete
+				error  => cancel ; Cancel on errors
+				_      => back   ; Otherwise retry analysis
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should have four statements", func() {
+				So(len(closure.Next), ShouldEqual, 4)
+				So(closure.Next[0].Params[1].Value, ShouldEqual, "topic")
+				So(closure.Next[1].Behavior.Value, ShouldEqual, "pattern")
+				So(closure.Next[2].Behavior.Value, ShouldEqual, "temporal")
+				So(closure.Next[3].Type, ShouldEqual, NODE_MATCH)
+			})
+		})
+	})
+
+	Convey("Given the iterative refinement example", t, func() {
+		program := `
+		out <= (
+			[refine] => (
+				analyze<surface>   => next ; Initial analysis
+				analyze<practical> => next ; Practical check
+				verify<validation> => next ; Validation
+				match (
+					ok    => send          ; Accept if valid
+					error => [refine].jump ; Jump back if needs work
+				)
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			refine := parse(program).Next[0].Next[0]
+
+			Convey("It should have the labelled closure with its jump back", func() {
+				So(refine.Label, ShouldEqual, "refine")
+				So(len(refine.Next), ShouldEqual, 4)
+				So(refine.Next[3].Next[1].Next[0].Label, ShouldEqual, "refine")
+			})
+		})
+	})
+
+	Convey("Given the parallel processing example", t, func() {
+		program := `
+		out <= (
+			match (
+				complete => send   ; Send combined results
+				error    => cancel ; Cancel on error
+				_        => back   ; Retry if incomplete
+			) <= join <= (
+				analyze<pattern> => next ; Pattern analysis path
+				verify           => send
+			) (
+				call<{query} => wiki> => next ; Wiki lookup path
+				analyze<practical>    => send
+			)
+		) <= in`
+
+		Convey(whenParsed, func() {
+			closure := parse(program).Next[0]
+
+			Convey("It should have a single match statement", func() {
+				So(len(closure.Next), ShouldEqual, 1)
+				So(closure.Next[0].Type, ShouldEqual, NODE_MATCH)
+				So(len(closure.Next[0].Next), ShouldEqual, 3)
+			})
+
+			Convey("It should use the join as the match source", func() {
+				join := closure.Next[0].Source
+				So(join.Type, ShouldEqual, NODE_JOIN)
+				So(len(join.Next), ShouldEqual, 2)
+				So(join.Next[1].Next[0].Behavior.Value, ShouldEqual, "wiki")
+				So(join.Next[1].Next[0].Params[0].Value, ShouldEqual, "query")
+			})
+		})
+	})
+}
+
+/*
+TestParserDiagnostics checks that malformed programs are reported with their
+positions instead of silently producing a wrong tree.
+*/
+func TestParserDiagnostics(t *testing.T) {
+	Convey("Given a valid Boogie program", t, func() {
+		_, diagnostics := Parse(`out <= (analyze => next | cancel) <= in`)
+
+		Convey("It should have no diagnostics", func() {
+			So(diagnostics, ShouldBeEmpty)
+			So(diagnostics.Err(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a program with an unclosed closure", t, func() {
+		_, diagnostics := Parse("out <= (\n    analyze => next\n")
+
+		Convey("It should report the unbalanced parenthesis where it was opened", func() {
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Position, ShouldResemble, Position{Line: 1, Column: 8})
+			So(diagnostics[0].Message, ShouldContainSubstring, "unbalanced '('")
+			So(diagnostics.Err(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a program with an extra closing parenthesis", t, func() {
+		_, diagnostics := Parse(`out <= (analyze => next)) <= in`)
+
+		Convey("It should report the unbalanced parenthesis", func() {
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Position, ShouldResemble, Position{Line: 1, Column: 25})
+			So(diagnostics[0].Message, ShouldContainSubstring, "unbalanced ')'")
+		})
+	})
+
+	Convey("Given a program with an unknown operation", t, func() {
+		ast, diagnostics := Parse("out <= (\n    analyse => next\n    verify  => send\n) <= in")
+
+		Convey("It should report the unknown operation", func() {
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Position, ShouldResemble, Position{Line: 2, Column: 5})
+			So(diagnostics[0].Message, ShouldEqual, "unknown operation 'analyse'")
+		})
+
+		Convey("It should recover and parse the rest of the program", func() {
+			So(len(ast.Next[0].Next), ShouldEqual, 2)
+			So(ast.Next[0].Next[1].Value, ShouldEqual, "verify")
+		})
+	})
+
+	Convey("Given a program with a flow without target", t, func() {
+		_, diagnostics := Parse("out <= (\n    analyze =>\n) <= in")
+
+		Convey("It should report the flow", func() {
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Position, ShouldResemble, Position{Line: 2, Column: 13})
+			So(diagnostics[0].Message, ShouldContainSubstring, "without target")
+		})
+	})
+
+	Convey("Given a program with a dangling fallback", t, func() {
+		_, diagnostics := Parse("out <= (\n    analyze => next |\n) <= in")
+
+		Convey("It should report the dangling pipe", func() {
+			So(len(diagnostics), ShouldEqual, 1)
+			So(diagnostics[0].Position, ShouldResemble, Position{Line: 2, Column: 21})
+			So(diagnostics[0].Message, ShouldContainSubstring, "dangling '|'")
+		})
+	})
+
+	Convey("Given a program with an unterminated label", t, func() {
+		_, diagnostics := Parse(`out <= (analyze[start => next) <= in`)
+
+		Convey("It should report the missing bracket", func() {
+			So(len(diagnostics), ShouldBeGreaterThan, 0)
+			So(diagnostics[0].Message, ShouldEqual, "expected ']', found '=>'")
+			So(diagnostics.Error(), ShouldStartWith, "1:23: error:")
+		})
+	})
+
+	Convey("Given a program with subprograms", t, func() {
+		ast, diagnostics := Parse(`
+		include<common>
+
+		define<checked>{focus} => (
+			analyze<focus> => next
+		)
+
+		out <= (
+			use<checked>{surface}[first]
+		) <= in`)
+
+		Convey("It should parse the definitions, includes and uses", func() {
+			So(diagnostics, ShouldBeEmpty)
+			So(len(ast.Next), ShouldEqual, 3)
+			So(ast.Next[0].Type, ShouldEqual, NODE_INCLUDE)
+			So(ast.Next[0].Value, ShouldEqual, "common")
+			So(ast.Next[1].Type, ShouldEqual, NODE_DEFINE)
+			So(ast.Next[1].Value, ShouldEqual, "checked")
+			So(ast.Next[1].Params[0].Value, ShouldEqual, "focus")
+			So(ast.Next[1].Next[0].Type, ShouldEqual, NODE_CLOSURE)
+
+			use := ast.Next[2].Next[0]
+			So(use.Type, ShouldEqual, NODE_INVOKE)
+			So(use.Value, ShouldEqual, "checked")
+			So(use.Params[0].Value, ShouldEqual, "surface")
+			So(use.Label, ShouldEqual, "first")
+		})
+	})
+
+	Convey("Given subprograms that are written wrong", t, func() {
+		_, diagnostics := Parse(`
+		define => ( analyze => next )
+		define<a>{"not a name"} => analyze
+		out <= (
+			define<b> => ( analyze => next )
+			use<a> => next
+		) <= in`)
+
+		Convey("It should report every mistake", func() {
+			So(messages(diagnostics), ShouldResemble, []string{
+				"2:3: error: define needs a name, e.g. define<name>{params} => ( ... )",
+				"3:13: error: parameter 'not a name' must be a name",
+				"3:3: error: subprogram 'a' must be followed by '=> ('",
+				"5:4: error: define is only allowed at the top level",
+				"6:11: error: 'use<a>' continues with the next statement, and takes no flows",
+			})
+		})
+	})
+
+	Convey("Given the nodes of a parsed program", t, func() {
+		ast, _ := Parse("out <= (\n    analyze<surface> => next\n) <= in")
+		analyze := ast.Next[0].Next[0]
+
+		Convey("They should carry their source positions", func() {
+			So(ast.Next[0].Position, ShouldResemble, Position{Line: 1, Column: 8})
+			So(analyze.Position, ShouldResemble, Position{Line: 2, Column: 5})
+			So(analyze.Behavior.Position, ShouldResemble, Position{Line: 2, Column: 13})
+			So(analyze.Next[0].Position, ShouldResemble, Position{Line: 2, Column: 25})
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package boogie
+
+import (
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+/*
+Registry is the catalog a program is validated against: the operations a
+worker can perform, the behaviors each of them accepts, and the tools that can
+be used with `call`. A category that has nothing registered is not checked,
+and neither are the behaviors of an operation that was registered without any.
+*/
+type Registry struct {
+	operations map[string]map[string]bool
+	tools      map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		operations: make(map[string]map[string]bool),
+		tools:      make(map[string]bool),
+	}
+}
+
+/*
+NewConfigRegistry builds the registry from the `boogie.registry` section of
+the config, so operations, behaviors and tools added there are valid without
+any code changes.
+*/
+func NewConfigRegistry() *Registry {
+	registry := NewRegistry()
+	v := viper.GetViper()
+
+	for operation := range v.GetStringMap("boogie.registry.operations") {
+		registry.Register(operation, v.GetStringSlice("boogie.registry.operations."+operation)...)
+	}
+
+	return registry.RegisterTools(v.GetStringSlice("boogie.registry.tools")...)
+}
+
+/*
+Register adds the operation, together with the behaviors it accepts.
+*/
+func (registry *Registry) Register(operation string, behaviors ...string) *Registry {
+	if _, ok := registry.operations[operation]; !ok {
+		registry.operations[operation] = make(map[string]bool)
+	}
+
+	for _, behavior := range behaviors {
+		registry.operations[operation][behavior] = true
+	}
+
+	return registry
+}
+
+func (registry *Registry) RegisterTools(tools ...string) *Registry {
+	for _, tool := range tools {
+		registry.tools[tool] = true
+	}
+
+	return registry
+}
+
+/*
+Operation reports whether the operation is known.
+*/
+func (registry *Registry) Operation(operation string) bool {
+	if len(registry.operations) == 0 {
+		return true
+	}
+
+	_, ok := registry.operations[operation]
+	return ok
+}
+
+/*
+Behavior reports whether the operation accepts the behavior.
+*/
+func (registry *Registry) Behavior(operation, behavior string) bool {
+	behaviors := registry.operations[operation]
+	return len(behaviors) == 0 || behaviors[behavior]
+}
+
+func (registry *Registry) Tool(tool string) bool {
+	return len(registry.tools) == 0 || registry.tools[tool]
+}
+
+/*
+Operations returns the names of the registered operations, sorted.
+*/
+func (registry *Registry) Operations() []string {
+	return keys(registry.operations)
+}
+
+/*
+Behaviors returns the behaviors registered for the operation, sorted.
+*/
+func (registry *Registry) Behaviors(operation string) []string {
+	return keys(registry.operations[operation])
+}
+
+/*
+Tools returns the names of the registered tools, sorted.
+*/
+func (registry *Registry) Tools() []string {
+	return keys(registry.tools)
+}
+
+func keys[T any](m map[string]T) []string {
+	out := make([]string, 0, len(m))
+
+	for key := range m {
+		out = append(out, key)
+	}
+
+	sort.Strings(out)
+	return out
+}
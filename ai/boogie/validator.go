@@ -0,0 +1,277 @@
+package boogie
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/theapemachine/amsh/utils"
+)
+
+/*
+terminalFlows are the flows after which execution never continues with the
+next statement.
+*/
+var terminalFlows = []string{
+	"send",
+	"cancel",
+	"halt",
+	"jump",
+	"back",
+}
+
+/*
+Validator checks a parsed program against a Registry, before it is compiled
+and executed. Anything the program cannot run with, such as an unknown tool,
+is an error, while anything that is merely suspicious, such as a behavior that
+is not in the catalog or code that can never be reached, is a warning.
+*/
+type Validator struct {
+	registry    *Registry
+	definitions []*Node
+	labels      map[string]*Node
+	used        map[string]bool
+	diagnostics Diagnostics
+}
+
+func NewValidator(registry *Registry) *Validator {
+	return &Validator{
+		registry:    registry,
+		labels:      make(map[string]*Node),
+		used:        make(map[string]bool),
+		diagnostics: make(Diagnostics, 0),
+	}
+}
+
+/*
+Validate checks the program, and returns what it found.
+*/
+func (validator *Validator) Validate(program *Node) Diagnostics {
+	validator.collect(program)
+	validator.node(program)
+
+	for _, node := range validator.definitions {
+		if !validator.used[node.Label] {
+			validator.report(SEVERITY_WARNING, node.Position, "label '[%s]' is never used", node.Label)
+		}
+	}
+
+	sort.SliceStable(validator.diagnostics, func(i, j int) bool {
+		a, b := validator.diagnostics[i].Position, validator.diagnostics[j].Position
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+
+	return validator.diagnostics
+}
+
+/*
+collect finds every label definition and use up front, since a label can be
+used before it is defined.
+*/
+func (validator *Validator) collect(node *Node) {
+	if node == nil {
+		return
+	}
+
+	switch {
+	case node.Type == NODE_LABEL:
+		validator.used[node.Value] = true
+	case node.Type == NODE_FLOW && node.Value == "jump":
+		validator.used[node.Label] = true
+	}
+
+	if node.Label != "" && (node.Type == NODE_OPERATION || node.Type == NODE_CLOSURE) {
+		if defined, ok := validator.labels[node.Label]; ok {
+			validator.report(
+				SEVERITY_ERROR, node.Position, "label '[%s]' is already defined at %s", node.Label, defined.Position,
+			)
+		} else {
+			validator.labels[node.Label] = node
+			validator.definitions = append(validator.definitions, node)
+		}
+	}
+
+	validator.collect(node.Source)
+
+	for _, child := range node.Next {
+		validator.collect(child)
+	}
+}
+
+func (validator *Validator) node(node *Node) {
+	switch node.Type {
+	case NODE_PROGRAM, NODE_CLOSURE:
+		validator.sequence(node.Next)
+	case NODE_OPERATION:
+		validator.operation(node)
+	case NODE_FLOW:
+		validator.flow(node)
+	case NODE_LABEL:
+		validator.reference(node, node.Value)
+	case NODE_MATCH:
+		if node.Source != nil {
+			validator.node(node.Source)
+		}
+
+		validator.arms(node)
+	}
+
+	if node.Type != NODE_PROGRAM && node.Type != NODE_CLOSURE && node.Type != NODE_MATCH {
+		for _, child := range node.Next {
+			validator.node(child)
+		}
+	}
+}
+
+/*
+sequence checks statements that run one after the other, warning about the
+first one that can never be reached, because the one before it never
+continues. A statement with a label that is jumped to is always reachable.
+*/
+func (validator *Validator) sequence(nodes []*Node) {
+	reachable, warned := true, false
+
+	for _, node := range nodes {
+		if !reachable && node.Label != "" && validator.used[node.Label] {
+			reachable, warned = true, false
+		}
+
+		if !reachable && !warned {
+			validator.report(SEVERITY_WARNING, node.Position, "unreachable statement, the one before it never continues")
+			warned = true
+		}
+
+		validator.node(node)
+		reachable = reachable && validator.continues(node)
+	}
+}
+
+func (validator *Validator) operation(node *Node) {
+	if !validator.registry.Operation(node.Value) {
+		validator.report(SEVERITY_ERROR, node.Position, "operation '%s' is not registered", node.Value)
+		return
+	}
+
+	if node.Value == "call" {
+		switch {
+		case node.Behavior == nil:
+			validator.report(SEVERITY_ERROR, node.Position, "call needs a tool, e.g. call<{query} => wiki>")
+		case !validator.registry.Tool(node.Behavior.Value):
+			validator.report(SEVERITY_ERROR, node.Behavior.Position, "tool '%s' is not registered", node.Behavior.Value)
+		}
+
+		return
+	}
+
+	if node.Behavior != nil && !validator.registry.Behavior(node.Value, node.Behavior.Value) {
+		validator.report(
+			SEVERITY_WARNING, node.Behavior.Position,
+			"behavior '%s' is not registered for '%s'", node.Behavior.Value, node.Value,
+		)
+	}
+}
+
+func (validator *Validator) flow(node *Node) {
+	switch node.Value {
+	case "jump":
+		validator.reference(node, node.Label)
+	case "back":
+		if node.Behavior == nil {
+			return
+		}
+
+		if count, err := strconv.Atoi(node.Behavior.Value); err != nil || count < 1 {
+			validator.report(SEVERITY_ERROR, node.Behavior.Position, "expected a count, found '%s'", node.Behavior.Value)
+		}
+	}
+}
+
+/*
+arms checks the arms of a match, warning about arms that come after the catch
+all, and conditions that are repeated.
+*/
+func (validator *Validator) arms(match *Node) {
+	seen := make(map[string]bool)
+
+	for _, arm := range match.Next {
+		switch {
+		case seen["_"]:
+			validator.report(SEVERITY_WARNING, arm.Position, "unreachable arm '%s', it comes after '_'", arm.Value)
+		case seen[arm.Value]:
+			validator.report(SEVERITY_WARNING, arm.Position, "duplicate arm '%s'", arm.Value)
+		}
+
+		seen[arm.Value] = true
+
+		for _, target := range arm.Next {
+			validator.node(target)
+		}
+	}
+}
+
+/*
+reference reports the label the node refers to when it is never defined.
+*/
+func (validator *Validator) reference(node *Node, name string) {
+	if _, ok := validator.labels[name]; !ok {
+		validator.report(SEVERITY_ERROR, node.Position, "undefined label '[%s]'", name)
+	}
+}
+
+/*
+continues reports whether execution can move on to the statement after the
+node, which it cannot when every way out of it ends the thread or goes
+elsewhere.
+*/
+func (validator *Validator) continues(node *Node) bool {
+	switch node.Type {
+	case NODE_OPERATION:
+		return len(node.Next) == 0 || validator.chain(node.Next)
+	case NODE_CLOSURE:
+		for _, child := range node.Next {
+			if !validator.continues(child) {
+				return false
+			}
+		}
+	case NODE_MATCH:
+		for _, arm := range node.Next {
+			if arm.Value == "_" {
+				for _, other := range node.Next {
+					if validator.chain(other.Next) {
+						return true
+					}
+				}
+
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (validator *Validator) chain(targets []*Node) bool {
+	for _, target := range targets {
+		if target.Type != NODE_FLOW {
+			if validator.continues(target) {
+				return true
+			}
+
+			continue
+		}
+
+		if !utils.ContainsAny(terminalFlows, target.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (validator *Validator) report(severity Severity, position Position, format string, args ...any) {
+	validator.diagnostics = append(validator.diagnostics, Diagnostic{
+		Severity: severity,
+		Position: position,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,167 @@
+package boogie
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func registry() *Registry {
+	return NewRegistry().
+		Register("analyze", "surface", "pattern", "practical").
+		Register("verify", "validation").
+		Register("call").
+		RegisterTools("browser", "wiki")
+}
+
+func validate(program string) Diagnostics {
+	return NewValidator(registry()).Validate(parse(program))
+}
+
+func messages(diagnostics Diagnostics) []string {
+	out := make([]string, len(diagnostics))
+
+	for i, diagnostic := range diagnostics {
+		out[i] = diagnostic.String()
+	}
+
+	return out
+}
+
+func TestValidator(t *testing.T) {
+	Convey("Given programs that only use registered constructs", t, func() {
+		programs := []string{
+			`out <= (
+				analyze => next | back<3> | cancel
+				verify  => send | back<3> | cancel
+			) <= in`,
+			`out <= (
+				analyze[myLabel] => next
+				verify           => next
+				match <= [myLabel] (
+					ok    => send
+					error => cancel
+				)
+			) <= in`,
+			`out <= (
+				[refine] => (
+					analyze<surface>   => next
+					analyze<practical> => next
+					verify<validation> => next
+					match (
+						ok    => send
+						error => [refine].jump
+					)
+				)
+			) <= in`,
+			`out <= (
+				match (
+					complete => send
+					error    => cancel
+					_        => back
+				) <= join <= (
+					analyze<pattern> => next
+					verify           => send
+				) (
+					call<{query} => wiki> => next
+					analyze<practical>    => send
+				)
+			) <= in`,
+		}
+
+		Convey("It should not report anything", func() {
+			for _, program := range programs {
+				So(messages(validate(program)), ShouldBeEmpty)
+			}
+		})
+	})
+
+	Convey("Given a program using constructs that are not in the catalog", t, func() {
+		diagnostics := validate(`out <= (
+			analyze<vibes>     => next
+			reason             => next
+			call<{q} => fax>   => next
+			call               => send
+		) <= in`)
+
+		Convey("It should warn about unknown behaviors and fail on unknown operations and tools", func() {
+			So(messages(diagnostics), ShouldResemble, []string{
+				"2:12: warning: behavior 'vibes' is not registered for 'analyze'",
+				"3:4: error: operation 'reason' is not registered",
+				"4:16: error: tool 'fax' is not registered",
+				"5:4: error: call needs a tool, e.g. call<{query} => wiki>",
+			})
+			So(diagnostics.HasErrors(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a program with label problems", t, func() {
+		diagnostics := validate(`out <= (
+			analyze[a] => next
+			verify[a]  => next
+			analyze[b] => next
+			match <= [c] ( ok => send )
+		) <= in`)
+
+		Convey("It should report duplicate, undefined and unused labels", func() {
+			So(messages(diagnostics), ShouldResemble, []string{
+				"2:4: warning: label '[a]' is never used",
+				"3:4: error: label '[a]' is already defined at 2:4",
+				"4:4: warning: label '[b]' is never used",
+				"5:13: error: undefined label '[c]'",
+			})
+		})
+	})
+
+	Convey("Given a program with code that can never run", t, func() {
+		diagnostics := validate(`out <= (
+			analyze => send | cancel
+			verify  => send
+			match (
+				ok => send
+				_  => cancel
+				error => back
+			)
+		) <= in`)
+
+		Convey("It should only warn about the first unreachable statement, and the arm", func() {
+			So(messages(diagnostics), ShouldResemble, []string{
+				"3:4: warning: unreachable statement, the one before it never continues",
+				"7:5: warning: unreachable arm 'error', it comes after '_'",
+			})
+		})
+	})
+
+	Convey("Given a jump back to a label after a terminal statement", t, func() {
+		diagnostics := validate(`out <= (
+			analyze => [retry].jump
+			[retry] => (
+				verify => send
+			)
+		) <= in`)
+
+		Convey("It should consider the labelled statement reachable", func() {
+			So(messages(diagnostics), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a registry built from the config", t, func() {
+		viper.Set("boogie.registry.operations", map[string]any{
+			"analyze": []string{"surface", "sentiment"},
+		})
+		viper.Set("boogie.registry.tools", []string{"browser"})
+
+		defer viper.Reset()
+
+		registry := NewConfigRegistry()
+
+		Convey("It should accept what the config adds", func() {
+			So(registry.Operations(), ShouldResemble, []string{"analyze"})
+			So(registry.Behavior("analyze", "sentiment"), ShouldBeTrue)
+			So(registry.Behavior("analyze", "quantum"), ShouldBeFalse)
+			So(registry.Tool("browser"), ShouldBeTrue)
+			So(registry.Tool("wiki"), ShouldBeFalse)
+		})
+	})
+}
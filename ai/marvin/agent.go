@@ -11,6 +11,12 @@ import (
 	"github.com/theapemachine/errnie"
 )
 
+/*
+toolRounds is how many times in a row an agent can call tools before it has
+to answer, so a model that keeps calling them cannot loop forever.
+*/
+const toolRounds = 8
+
 type Agent struct {
 	Name      string
 	Role      string
@@ -20,25 +26,54 @@ type Agent struct {
 	processes map[string]*data.Artifact
 	sidekicks map[string][]*Agent
 	tool      ai.Tool
+	tools     map[string]ai.Tool
+	params    provider.GenerationParams
 	provider  provider.Provider
+	keyring   *data.Keyring
+	result    *twoface.Accumulator
 }
 
+/*
+NewAgent returns an agent with the generation params set for its role in the
+config, under `ai.setups.marvin.generation`. Its usage is tallied to its role,
+on top of the accounts of the context, and the whole of what it generates is
+signed with the key of its role, rather than every artifact it streams.
+*/
 func NewAgent(ctx context.Context, role, scope string, induction *data.Artifact) *Agent {
 	return &Agent{
 		Name:      utils.NewName(),
 		Role:      role,
 		Scope:     scope,
-		ctx:       ctx,
+		ctx:       provider.WithAccount(ctx, provider.ACCOUNT_AGENT, role),
 		buffer:    NewBuffer().Poke(induction),
 		processes: make(map[string]*data.Artifact),
 		sidekicks: make(map[string][]*Agent),
-		provider:  provider.NewBalancedProvider(),
+		tools:     make(map[string]ai.Tool),
+		params:    provider.NewConfigGenerationParams("ai.setups.marvin.generation." + role),
+		provider:  provider.NewCachedProvider(),
+		keyring:   data.NewConfigKeyring(),
 	}
 }
 
+/*
+AddTool gives the agent a tool, which the model calls natively. An interactive
+tool is driven by commands instead, so it is described in the prompt.
+*/
 func (agent *Agent) AddTool(tool ai.Tool) {
 	agent.tool = tool
 
+	if _, ok := tool.(ai.InteractiveTool); !ok {
+		definition, err := provider.NewToolDefinition(tool.GenerateSchema())
+		if err != nil {
+			errnie.Error(err)
+			return
+		}
+
+		agent.tools[definition.Name] = tool
+		agent.params.Tools = append(agent.params.Tools, definition)
+		return
+	}
+
 	message := []string{
 		"You have been given access to new tools.",
 		"You can use the tools by calling them with the appropriate arguments.",
@@ -55,25 +90,29 @@ func (agent *Agent) AddProcesses(processes ...*data.Artifact) {
 	}
 }
 
+/*
+AddSidekick gives the agent a sidekick, which the model can hand a task to by
+calling the tool named after the key.
+*/
 func (agent *Agent) AddSidekick(key string, sidekick *Agent) {
-	agent.sidekicks[key] = append(agent.sidekicks[key], sidekick)
-
-	message := []string{
-		"You have been given access to a new sidekick.",
-		"You can give the sidekick a task to perform by using the following syntax:",
-		"",
-		"```json",
-		"{",
-		"  \"key\": \"" + key + "\",",
-		"  \"prompt\": <prompt>",
-		"}",
-		"```",
-		"",
-		"Make sure your prompt contains all the necessary information and details to perform the task.",
-		"Send the prompt as a continuous string, without any line breaks.",
+	if _, ok := agent.sidekicks[key]; !ok {
+		agent.params.Tools = append(agent.params.Tools, provider.ToolDefinition{
+			Name:        key,
+			Description: "Give the " + key + " sidekick a task to perform.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"prompt": map[string]any{
+						"type":        "string",
+						"description": "The task, with all the necessary information and details to perform it.",
+					},
+				},
+				"required": []string{"prompt"},
+			},
+		})
 	}
 
-	agent.buffer.Poke(data.New("assistant", "assistant", "sidekick", []byte(utils.JoinWith("\n", message...))))
+	agent.sidekicks[key] = append(agent.sidekicks[key], sidekick)
 }
 
 func (agent *Agent) Generate(prompt *data.Artifact) <-chan *data.Artifact {
@@ -81,12 +120,16 @@ func (agent *Agent) Generate(prompt *data.Artifact) <-chan *data.Artifact {
 
 	agent.buffer.Poke(prompt)
 
-	return twoface.NewAccumulator(
+	agent.result = twoface.NewAccumulator(
 		"agent",
 		agent.Role,
 		agent.Name,
 		prompt,
-	).Yield(func(accumulator *twoface.Accumulator) {
+	).Finish(func(result *data.Artifact) {
+		agent.keyring.Sign(agent.Role, result)
+	})
+
+	return agent.result.Yield(func(accumulator *twoface.Accumulator) {
 		defer close(accumulator.Out)
 
 		if agent.Role == "sidekick" {
@@ -98,29 +141,115 @@ func (agent *Agent) Generate(prompt *data.Artifact) <-chan *data.Artifact {
 	}).Generate()
 }
 
+/*
+Result returns the whole of what the agent generated the last time, once it
+is done generating it, derived from the conversation that led to it.
+*/
+func (agent *Agent) Result() *data.Artifact {
+	return agent.result.Take()
+}
+
+/*
+handleAgent generates a response, and while the model calls tools, runs them
+and feeds the results back for it to continue with.
+*/
 func (agent *Agent) handleAgent(accumulator *twoface.Accumulator) {
-	for artifact := range agent.provider.Generate(agent.buffer.Peek()) {
-		accumulator.Out <- artifact
+	// The response is derived from the whole conversation, including the
+	// tool calls and their results.
+	defer func() {
+		accumulator.In = append(accumulator.In, agent.buffer.Peek()...)
+	}()
+
+	for round := 0; round < toolRounds; round++ {
+		requests := make([]*data.Artifact, 0)
+		text := ""
+
+		for artifact := range agent.provider.Generate(agent.params, agent.buffer.Peek()) {
+			if usage, ok := provider.UsageOf(artifact); ok {
+				provider.NewConfigLedger().Record(agent.ctx, usage)
+				continue
+			}
+
+			if _, ok := provider.ToolCallOf(artifact); ok {
+				requests = append(requests, artifact)
+			} else if _, ok := provider.ErrorOf(artifact); !ok {
+				text += artifact.Peek("payload")
+			}
+
+			accumulator.Out <- artifact
+		}
+
+		if len(requests) == 0 {
+			return
+		}
+
+		// What the model said before it called the tools is part of the
+		// conversation it continues from, so it goes in before the calls.
+		if text != "" {
+			agent.buffer.Poke(data.New(agent.Name, "assistant", agent.Scope, []byte(text)))
+		}
+
+		for _, request := range requests {
+			agent.buffer.Poke(request)
+		}
+
+		for _, request := range requests {
+			call, _ := provider.ToolCallOf(request)
+			answer, outputs := agent.call(request, call, accumulator)
+
+			result := provider.NewToolResultArtifact(agent.Name, call, answer)
+			result.DeriveFrom(append([]*data.Artifact{request}, outputs...)...)
+			agent.buffer.Poke(result.Attach(agent.attachments(call)...))
+		}
 	}
 
-	blocks := utils.ExtractJSONBlocks(accumulator.Take().Peek("payload"))
-
-	if len(blocks) > 0 {
-		for _, block := range blocks {
-			// Check if there is a key that matches with the sidekicks.
-			for key, sidekicks := range agent.sidekicks {
-				if block["key"] == key {
-					for _, sidekick := range sidekicks {
-						for skArtifact := range sidekick.Generate(
-							data.New(agent.Name, "user", "prompt", []byte(block["prompt"].(string))),
-						) {
-							accumulator.Out <- skArtifact
-						}
-					}
-				}
+	errnie.Warn("marvin.Agent.handleAgent %s still calling tools after %d rounds", agent.Name, toolRounds)
+}
+
+/*
+call runs a tool call, handing the prompt to the sidekicks when it names
+them, and returns the result, along with the results of the sidekicks, which
+it is derived from.
+*/
+func (agent *Agent) call(request *data.Artifact, call provider.ToolCall, accumulator *twoface.Accumulator) (string, []*data.Artifact) {
+	if sidekicks, ok := agent.sidekicks[call.Name]; ok {
+		prompt, _ := call.Arguments["prompt"].(string)
+		results := make([]string, 0, len(sidekicks))
+		outputs := make([]*data.Artifact, 0, len(sidekicks))
+
+		for _, sidekick := range sidekicks {
+			result := ""
+			task := data.New(agent.Name, "user", "prompt", []byte(prompt)).DeriveFrom(request)
+
+			for artifact := range sidekick.Generate(task) {
+				result += artifact.Peek("payload")
+				accumulator.Out <- artifact
 			}
+
+			results = append(results, result)
+			outputs = append(outputs, sidekick.Result())
 		}
+
+		return utils.JoinWith("\n\n", results...), outputs
+	}
+
+	if tool, ok := agent.tools[call.Name]; ok {
+		return tool.Use(agent.ctx, call.Arguments), nil
 	}
+
+	return "there is no tool called '" + call.Name + "'", nil
+}
+
+/*
+attachments returns the parts the tool of a call attached to its result, such
+as a screenshot, so a model with vision can look at them.
+*/
+func (agent *Agent) attachments(call provider.ToolCall) []data.Part {
+	if tool, ok := agent.tools[call.Name].(ai.AttachingTool); ok {
+		return tool.Attachments()
+	}
+
+	return nil
 }
 
 func (agent *Agent) handleSidekick(accumulator *twoface.Accumulator) {
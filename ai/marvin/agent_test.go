@@ -0,0 +1,71 @@
+package marvin
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
+)
+
+/*
+labelTool labels tickets, and remembers what it was called with.
+*/
+type labelTool struct {
+	calls []map[string]any
+}
+
+func (tool *labelTool) GenerateSchema() string {
+	return `{"$ref": "#/$defs/Label", "$defs": {"Label": {"type": "object", "properties": {"label": {"type": "string"}}}}}`
+}
+
+func (tool *labelTool) Use(ctx context.Context, args map[string]any) string {
+	tool.calls = append(tool.calls, args)
+	return "labelled"
+}
+
+func TestAgent(t *testing.T) {
+	Convey("Given an agent with a tool", t, func() {
+		tool := &labelTool{}
+		agent := NewAgent(context.Background(), "assistant", "test", data.New("test", "system", "prompt", []byte("You are a helpdesk.")))
+		agent.AddTool(tool)
+
+		agent.provider = provider.NewScriptedProvider(
+			&provider.Script{Key: "ticket", Responses: []string{"This is a bug. ```json\n{\"tool\": \"label\", \"arguments\": {\"label\": \"bug\"}}\n```"}},
+			&provider.Script{Responses: []string{"Labelled as a bug."}},
+		)
+
+		Convey("When the model says something before it calls the tool", func() {
+			for range agent.Generate(data.New("test", "user", "prompt", []byte("Label this ticket."))) {
+			}
+
+			buffer := agent.buffer.Peek()
+			roles := make([]string, 0, len(buffer))
+
+			for _, artifact := range buffer {
+				roles = append(roles, artifact.Peek("role"))
+			}
+
+			Convey("It should run the tool", func() {
+				So(tool.calls, ShouldHaveLength, 1)
+				So(tool.calls[0]["label"], ShouldEqual, "bug")
+			})
+
+			Convey("It should keep what the model said, before the call", func() {
+				So(roles, ShouldResemble, []string{"system", "user", "assistant", "assistant", "tool"})
+				So(buffer[2].Peek("payload"), ShouldStartWith, "This is a bug. ")
+
+				_, ok := provider.ToolCallOf(buffer[2])
+				So(ok, ShouldBeFalse)
+
+				_, ok = provider.ToolCallOf(buffer[3])
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("It should answer once it has the result", func() {
+				So(agent.Result().Peek("payload"), ShouldContainSubstring, "Labelled as a bug.")
+			})
+		})
+	})
+}
@@ -1,82 +1,79 @@
-package marvin
-
-import (
-	"github.com/charmbracelet/log"
-	"github.com/pkoukk/tiktoken-go"
-	"github.com/theapemachine/amsh/data"
-)
-
-type Buffer struct {
-	messages         []*data.Artifact
-	maxContextTokens int
-}
-
-func NewBuffer() *Buffer {
-	return &Buffer{
-		messages:         make([]*data.Artifact, 0),
-		maxContextTokens: 128000,
-	}
-}
-
-func (buffer *Buffer) Peek() []*data.Artifact {
-	buffer.truncate()
-	return buffer.messages
-}
-
-func (buffer *Buffer) Poke(artifact *data.Artifact) *Buffer {
-	buffer.messages = append(buffer.messages, artifact)
-	return buffer
-}
-
-/*
-Truncate the buffer to the maximum context tokens, making sure to always keep the
-first two messages, which are the system prompt and the user message.
-*/
-func (buffer *Buffer) truncate() {
-	// Always include first two messages (system prompt and user message)
-	if len(buffer.messages) < 2 {
-		return
-	}
-
-	maxTokens := buffer.maxContextTokens - 500 // Reserve tokens for response
-	totalTokens := 0
-	var truncatedMessages []*data.Artifact
-
-	// Add first two messages
-	truncatedMessages = append(truncatedMessages, buffer.messages[0], buffer.messages[1])
-	totalTokens += buffer.estimateTokens(buffer.messages[0])
-	totalTokens += buffer.estimateTokens(buffer.messages[1])
-
-	// Start from the most recent message for the rest
-	for i := len(buffer.messages) - 1; i >= 2; i-- {
-		msg := buffer.messages[i]
-		messageTokens := buffer.estimateTokens(msg)
-		if totalTokens+messageTokens <= maxTokens {
-			truncatedMessages = append([]*data.Artifact{msg}, truncatedMessages[2:]...)
-			truncatedMessages = append(buffer.messages[0:2], truncatedMessages...)
-			totalTokens += messageTokens
-		} else {
-			break
-		}
-	}
-
-	buffer.messages = truncatedMessages
-}
-
-func (buffer *Buffer) estimateTokens(msg *data.Artifact) int { // Use tiktoken-go to estimate tokens
-	encoding, err := tiktoken.EncodingForModel("gpt-4o-mini")
-	if err != nil {
-		log.Error("Error getting encoding", "error", err)
-		return 0
-	}
-
-	tokensPerMessage := 4 // As per OpenAI's token estimation guidelines
-
-	numTokens := tokensPerMessage
-	numTokens += len(encoding.Encode(msg.Peek("payload"), nil, nil))
-	if msg.Peek("role") == "user" || msg.Peek("role") == "assistant" || msg.Peek("role") == "system" || msg.Peek("role") == "tool" {
-		numTokens += len(encoding.Encode(msg.Peek("role"), nil, nil))
-	}
-
-	return numTokens
-}
+package marvin
+
+import (
+	"github.com/charmbracelet/log"
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/theapemachine/amsh/data"
+)
+
+type Buffer struct {
+	messages         []*data.Artifact
+	maxContextTokens int
+}
+
+func NewBuffer() *Buffer {
+	return &Buffer{
+		messages:         make([]*data.Artifact, 0),
+		maxContextTokens: 128000,
+	}
+}
+
+func (buffer *Buffer) Peek() []*data.Artifact {
+	buffer.truncate()
+	return buffer.messages
+}
+
+func (buffer *Buffer) Poke(artifact *data.Artifact) *Buffer {
+	buffer.messages = append(buffer.messages, artifact)
+	return buffer
+}
+
+/*
+Truncate the buffer to the maximum context tokens, making sure to always keep the
+first two messages, which are the system prompt and the user message.
+*/
+func (buffer *Buffer) truncate() {
+	// Always include first two messages (system prompt and user message)
+	if len(buffer.messages) < 2 {
+		return
+	}
+
+	maxTokens := buffer.maxContextTokens - 500 // Reserve tokens for response
+	totalTokens := buffer.estimateTokens(buffer.messages[0]) + buffer.estimateTokens(buffer.messages[1])
+	start := len(buffer.messages)
+
+	// Keep as many of the most recent messages as fit, in their order.
+	for start > 2 {
+		messageTokens := buffer.estimateTokens(buffer.messages[start-1])
+		if totalTokens+messageTokens > maxTokens {
+			break
+		}
+
+		totalTokens += messageTokens
+		start--
+	}
+
+	truncatedMessages := make([]*data.Artifact, 0, 2+len(buffer.messages)-start)
+	truncatedMessages = append(truncatedMessages, buffer.messages[0], buffer.messages[1])
+	truncatedMessages = append(truncatedMessages, buffer.messages[start:]...)
+
+	buffer.messages = truncatedMessages
+}
+
+func (buffer *Buffer) estimateTokens(msg *data.Artifact) int { // Use tiktoken-go to estimate tokens
+	encoding, err := tiktoken.EncodingForModel("gpt-4o-mini")
+	if err != nil {
+		log.Error("Error getting encoding", "error", err)
+		return 0
+	}
+
+	tokensPerMessage := 4 // As per OpenAI's token estimation guidelines
+
+	numTokens := tokensPerMessage
+	numTokens += len(encoding.Encode(msg.Peek("payload"), nil, nil))
+	if msg.Peek("role") == "user" || msg.Peek("role") == "assistant" || msg.Peek("role") == "system" || msg.Peek("role") == "tool" {
+		numTokens += len(encoding.Encode(msg.Peek("role"), nil, nil))
+	}
+
+	return numTokens
+}
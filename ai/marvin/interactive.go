@@ -7,6 +7,7 @@ import (
 	"io"
 
 	"github.com/theapemachine/amsh/ai"
+	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/twoface"
 	"github.com/theapemachine/errnie"
@@ -46,10 +47,27 @@ func (toolHandler *ToolHandler) Accumulator() *twoface.Accumulator {
 		defer close(acc.Out)
 
 		// Generate next command
-		for artifact := range toolHandler.agent.provider.Generate(toolHandler.agent.buffer.Peek()) {
+		var failure error
+
+		for artifact := range toolHandler.agent.provider.Generate(provider.GenerationParams{}, toolHandler.agent.buffer.Peek()) {
+			if usage, ok := provider.UsageOf(artifact); ok {
+				provider.NewConfigLedger().Record(toolHandler.agent.ctx, usage)
+				continue
+			}
+
+			if err, ok := provider.ErrorOf(artifact); ok {
+				failure = err
+			}
+
 			acc.Out <- artifact
 		}
 
+		// The error is not a command, so it is not run
+		if failure != nil {
+			errnie.Error(failure)
+			return
+		}
+
 		// Execute command and handle response
 		command := acc.Take().Peek("payload")
 		if err := toolHandler.executeCommand(command, acc.Out); err != nil {
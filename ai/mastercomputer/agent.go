@@ -5,6 +5,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/errnie"
 )
 
@@ -14,18 +15,31 @@ Agent is a type that can communicate with an AI provider and execute operations.
 type Agent struct {
 	ID        string
 	ctx       context.Context
+	role      string
 	buffer    *Buffer
 	processes map[string]Process
 	prompt    *Prompt
+	provider  provider.Provider
+	params    provider.GenerationParams
+	origin    string
+	model     string
 }
 
-func NewAgent(ctx context.Context, role string) *Agent {
+/*
+NewAgent returns an agent with the generation params set for its role in the
+config, under `ai.setups.mastercomputer.generation`. Its usage is tallied to
+its role, on top of the accounts of the context.
+*/
+func NewAgent(ctx context.Context, role string, generator provider.Provider) *Agent {
 	return &Agent{
 		ID:        uuid.New().String(),
-		ctx:       ctx,
+		ctx:       provider.WithAccount(ctx, provider.ACCOUNT_AGENT, role),
+		role:      role,
 		buffer:    NewBuffer(),
 		processes: make(map[string]Process),
 		prompt:    NewPrompt(role),
+		provider:  generator,
+		params:    provider.NewConfigGenerationParams("ai.setups.mastercomputer.generation." + role),
 	}
 }
 
@@ -41,7 +55,86 @@ func (agent *Agent) Generate(input string) <-chan provider.Event {
 		Content: input,
 	})
 
-	errnie.Log("%s", agent.buffer.Truncate())
+	go func() {
+		defer close(out)
+
+		for artifact := range agent.provider.Generate(agent.params, agent.artifacts()) {
+			// Keep draining the provider once cancelled, so it is never left
+			// blocked on a send nobody will receive.
+			if agent.ctx.Err() != nil {
+				continue
+			}
+
+			if err, ok := provider.ErrorOf(artifact); ok {
+				out <- provider.Event{
+					AgentID: agent.ID,
+					Type:    provider.EventError,
+					Content: err.Error(),
+					Error:   err,
+				}
+
+				continue
+			}
+
+			if usage, ok := provider.UsageOf(artifact); ok {
+				provider.NewConfigLedger().Record(agent.ctx, usage)
+				continue
+			}
+
+			if call, ok := provider.ToolCallOf(artifact); ok {
+				out <- provider.Event{
+					AgentID:  agent.ID,
+					Type:     provider.EventToolCall,
+					Content:  artifact.Peek("payload"),
+					ToolCall: &call,
+				}
+
+				continue
+			}
+
+			agent.origin = artifact.Peek("origin")
+			agent.model = artifact.Peek("scope")
+
+			out <- provider.Event{
+				AgentID: agent.ID,
+				Type:    provider.EventToken,
+				Content: artifact.Peek("payload"),
+			}
+		}
+	}()
 
 	return out
 }
+
+/*
+SetParams sets the generation params used for every call to the provider,
+falling back to those of the role for whatever they leave unset.
+*/
+func (agent *Agent) SetParams(params provider.GenerationParams) *Agent {
+	agent.params = params.WithDefaults(agent.params)
+	return agent
+}
+
+/*
+Source returns the provider and model that generated the last response, as
+reported by the artifacts the provider produced.
+*/
+func (agent *Agent) Source() (string, string) {
+	return agent.origin, agent.model
+}
+
+/*
+artifacts converts the truncated buffer into the artifacts a provider expects.
+*/
+func (agent *Agent) artifacts() []*data.Artifact {
+	messages := agent.buffer.Truncate()
+	artifacts := make([]*data.Artifact, 0, len(messages))
+
+	for _, message := range messages {
+		artifacts = append(artifacts, data.New(
+			"mastercomputer", message.Role, agent.role, []byte(message.Content),
+		))
+	}
+
+	return artifacts
+}
@@ -3,8 +3,6 @@ package mastercomputer
 import (
 	"fmt"
 
-	"github.com/charmbracelet/log"
-	"github.com/pkoukk/tiktoken-go"
 	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/utils"
 )
@@ -83,18 +81,12 @@ func (buffer *Buffer) Truncate() []provider.Message {
 }
 
 func (buffer *Buffer) estimateTokens(msg provider.Message) int { // Use tiktoken-go to estimate tokens
-	encoding, err := tiktoken.EncodingForModel("gpt-4o-mini")
-	if err != nil {
-		log.Error("Error getting encoding", "error", err)
-		return 0
-	}
-
 	tokensPerMessage := 4 // As per OpenAI's token estimation guidelines
 
 	numTokens := tokensPerMessage
-	numTokens += len(encoding.Encode(msg.Content, nil, nil))
+	numTokens += provider.CountTokens(msg.Content)
 	if msg.Role == "user" || msg.Role == "assistant" || msg.Role == "system" || msg.Role == "function" {
-		numTokens += len(encoding.Encode(msg.Role, nil, nil))
+		numTokens += provider.CountTokens(msg.Role)
 	}
 
 	return numTokens
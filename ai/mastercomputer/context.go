@@ -0,0 +1,125 @@
+package mastercomputer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+/*
+Entry is a single mutation of the context, made by the worker that executed
+an operation.
+*/
+type Entry struct {
+	Operation string
+	Behavior  string
+	Content   string
+	Outcome   string
+}
+
+/*
+Context is the `in` of a Boogie program, which flows through every operation.
+It is append-only, starting with the initial input and growing with the output
+of each worker, while Outcome holds the outcome of the most recent step, which
+is what a match looks at.
+*/
+type Context struct {
+	Input   string
+	Entries []Entry
+	Outcome string
+}
+
+func NewContext(input string) *Context {
+	return &Context{
+		Input:   input,
+		Entries: make([]Entry, 0),
+	}
+}
+
+/*
+Clone returns a copy of the context, so concurrent branches can each mutate
+their own.
+*/
+func (context *Context) Clone() *Context {
+	entries := make([]Entry, len(context.Entries))
+	copy(entries, context.Entries)
+
+	return &Context{
+		Input:   context.Input,
+		Entries: entries,
+		Outcome: context.Outcome,
+	}
+}
+
+/*
+Append adds the entry to the context and makes its outcome the current one.
+*/
+func (context *Context) Append(entry Entry) *Context {
+	context.Entries = append(context.Entries, entry)
+	context.Outcome = entry.Outcome
+	return context
+}
+
+/*
+Merge appends the entries each branch added on top of the context, in the
+order the branches are given, so the result does not depend on which branch
+finished first.
+*/
+func (context *Context) Merge(outcome string, branches ...*Context) *Context {
+	base := len(context.Entries)
+
+	for _, branch := range branches {
+		if len(branch.Entries) > base {
+			context.Entries = append(context.Entries, branch.Entries[base:]...)
+		}
+	}
+
+	context.Outcome = outcome
+	return context
+}
+
+/*
+Output returns the content of the most recent entry, or the input when no
+operation has written to the context yet.
+*/
+func (context *Context) Output() string {
+	if len(context.Entries) == 0 {
+		return context.Input
+	}
+
+	return context.Entries[len(context.Entries)-1].Content
+}
+
+/*
+String renders the context the way it is handed to a worker.
+*/
+func (context *Context) String() string {
+	out := []string{
+		"<context>",
+		fmt.Sprintf("\t<in>\n\t\t%s\n\t</in>", context.Input),
+	}
+
+	for _, entry := range context.Entries {
+		tag := entry.Operation
+
+		if entry.Behavior != "" {
+			tag = fmt.Sprintf("%s behavior=%q", entry.Operation, entry.Behavior)
+		}
+
+		out = append(out, fmt.Sprintf(
+			"\t<%s outcome=%q>\n\t\t%s\n\t</%s>", tag, entry.Outcome, entry.Content, entry.Operation,
+		))
+	}
+
+	return strings.Join(out, "\n") + "\n</context>"
+}
+
+/*
+Hash identifies the state of the context, so a trace can tell whether a step
+saw the same context when it is replayed.
+*/
+func (context *Context) Hash() string {
+	sum := sha256.Sum256([]byte(context.String()))
+	return hex.EncodeToString(sum[:])
+}
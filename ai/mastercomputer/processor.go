@@ -2,49 +2,165 @@ package mastercomputer
 
 import (
 	"context"
+	"regexp"
+	"strings"
 
 	"github.com/theapemachine/amsh/ai/boogie"
 	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/utils"
 	"github.com/theapemachine/errnie"
-	"github.com/theapemachine/qpool"
 )
 
+/*
+outcomePattern matches the line a worker ends its response with, to tell the
+VM how the operation went, e.g. `outcome: ok`.
+*/
+var outcomePattern = regexp.MustCompile(`(?im)^\s*outcome:\s*([a-z_]+)\s*$`)
+
+/*
+Processor executes a single spawn instruction, by handing the current context
+to a short-lived worker agent and collecting the mutation it makes.
+*/
 type Processor struct {
 	ctx         context.Context
-	pool        *qpool.Q
 	instruction boogie.Instruction
-	cores       []*Core
+	agent       *Agent
+	response    string
+	entry       Entry
 }
 
-func NewProcessor(ctx context.Context, instruction boogie.Instruction) *Processor {
+func NewProcessor(
+	ctx context.Context, instruction boogie.Instruction, provider provider.Provider,
+) *Processor {
 	errnie.Log("processor.NewProcessor(%v)", instruction)
 
 	return &Processor{
 		ctx:         ctx,
-		pool:        qpool.NewQ(ctx, 1, 4, &qpool.Config{}),
 		instruction: instruction,
-		cores:       make([]*Core, 0),
+		agent:       NewAgent(ctx, "worker", provider).SetParams(params(instruction)),
 	}
 }
 
-func (processor *Processor) Generate(in string) chan provider.Event {
-	errnie.Log("processor.Generate(%s)", in)
+/*
+Generate streams the events of the worker, and records the resulting entry,
+which is available from Entry once the channel is closed. When the provider
+failed, the outcome is an error, even if it got part of a response out.
+*/
+func (processor *Processor) Generate(in *Context) <-chan provider.Event {
+	errnie.Log("processor.Generate(%s)", processor.instruction.Operation)
 
 	out := make(chan provider.Event)
 
 	go func() {
 		defer close(out)
 
-		processor.cores = append(processor.cores, NewCore(processor.ctx, processor.pool))
+		var (
+			buffer strings.Builder
+			failed bool
+		)
+
+		for event := range processor.agent.Generate(processor.task(in)) {
+			switch event.Type {
+			case provider.EventToken:
+				buffer.WriteString(event.Content)
+			case provider.EventError:
+				failed = true
+			}
+
+			out <- event
+		}
+
+		processor.response = buffer.String()
+		processor.entry = processor.parse(processor.response)
 
-		for _, core := range processor.cores {
-			accumulator := provider.NewAccumulator()
-			accumulator.Stream(
-				core.Generate(in),
-				out,
-			)
+		if failed {
+			processor.entry.Outcome = "error"
 		}
 	}()
 
 	return out
 }
+
+/*
+params returns the generation params for the instruction, which are set in
+the config under `boogie.generation`, per behavior first, and then per
+operation, so `analyze<moonshot>` samples differently from `analyze<surface>`.
+*/
+func params(instruction boogie.Instruction) provider.GenerationParams {
+	behavior := provider.GenerationParams{}
+
+	if instruction.Behavior != "" {
+		behavior = provider.NewConfigGenerationParams("boogie.generation.behaviors." + instruction.Behavior)
+	}
+
+	return behavior.WithDefaults(
+		provider.NewConfigGenerationParams("boogie.generation.operations." + instruction.Operation),
+	)
+}
+
+func (processor *Processor) Entry() Entry {
+	return processor.entry
+}
+
+/*
+Response returns the response of the worker as it was generated, before the
+outcome was taken off.
+*/
+func (processor *Processor) Response() string {
+	return processor.response
+}
+
+func (processor *Processor) Source() (string, string) {
+	return processor.agent.Source()
+}
+
+/*
+task describes the operation for the worker, together with the context it
+should operate on.
+*/
+func (processor *Processor) task(in *Context) string {
+	instruction := processor.instruction
+
+	task := []string{
+		"<operation>" + instruction.Operation + "</operation>",
+	}
+
+	if instruction.Behavior != "" {
+		task = append(task, "<behavior>"+instruction.Behavior+"</behavior>")
+	}
+
+	if len(instruction.Params) > 0 {
+		task = append(task, "<params>"+strings.Join(instruction.Params, ", ")+"</params>")
+	}
+
+	return utils.JoinWith("\n", append(task, in.String())...)
+}
+
+/*
+parse splits the outcome line off the response of the worker. A response
+without an outcome line is taken as ok, unless it is empty, which means the
+worker failed to produce anything.
+*/
+func (processor *Processor) parse(response string) Entry {
+	entry := Entry{
+		Operation: processor.instruction.Operation,
+		Behavior:  processor.instruction.Behavior,
+		Outcome:   "ok",
+	}
+
+	matches := outcomePattern.FindAllStringSubmatchIndex(response, -1)
+
+	if len(matches) > 0 {
+		last := matches[len(matches)-1]
+		entry.Outcome = strings.ToLower(response[last[2]:last[3]])
+		response = response[:last[0]] + response[last[1]:]
+	}
+
+	entry.Content = strings.TrimSpace(response)
+
+	if entry.Content == "" && len(matches) == 0 {
+		entry.Outcome = "error"
+	}
+
+	return entry
+}
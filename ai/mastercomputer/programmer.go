@@ -11,11 +11,11 @@ type Programmer struct {
 	agent *Agent
 }
 
-func NewProgrammer(ctx context.Context) *Programmer {
+func NewProgrammer(ctx context.Context, provider provider.Provider) *Programmer {
 	errnie.Log("programmer.NewProgrammer()")
 
 	return &Programmer{
-		agent: NewAgent(ctx, "programmer"),
+		agent: NewAgent(ctx, "programmer", provider),
 	}
 }
 
@@ -26,7 +26,10 @@ func (programmer *Programmer) Generate(input string) <-chan provider.Event {
 
 	go func() {
 		defer close(out)
-		provider.NewAccumulator().Stream(programmer.agent.Generate(input), out)
+		// Every token is part of the program, so none of them can be dropped.
+		for event := range programmer.agent.Generate(input) {
+			out <- event
+		}
 	}()
 
 	return out
@@ -14,21 +14,36 @@ It is responsible for kicking off workflows when a workload is received.
 */
 type System struct {
 	ctx         context.Context
+	provider    provider.Provider
 	vm          *VM
 	programmers []*Programmer
 }
 
 /*
-NewSystem creates a new system with a unique key.
+NewSystem creates a new system, with every agent in it generating on the provider.
 */
-func NewSystem(ctx context.Context) *System {
+func NewSystem(ctx context.Context, provider provider.Provider) *System {
 	errnie.Log("system.NewSystem()")
 
-	return &System{ctx: ctx, vm: NewVM(ctx), programmers: make([]*Programmer, 0)}
+	return &System{
+		ctx:         ctx,
+		provider:    provider,
+		vm:          NewVM(ctx, provider),
+		programmers: make([]*Programmer, 0),
+	}
 }
 
 /*
-Input kicks off a new workflow with the provided input.
+maxRepairRounds is the number of times a programmer is asked to fix a program
+that does not parse, before the workflow is given up on.
+*/
+const maxRepairRounds = 3
+
+/*
+Input kicks off a new workflow with the provided input. The programmer writes a
+program for it, which the VM then executes with the input as its context. When
+the program has syntax errors, the diagnostics are fed back to the same
+programmer for a repair round, instead of executing a broken program.
 */
 func (system *System) Input(input string) <-chan provider.Event {
 	errnie.Log("system.Input(%s)", input)
@@ -38,22 +53,68 @@ func (system *System) Input(input string) <-chan provider.Event {
 	go func() {
 		defer close(out)
 
-		system.programmers = append(system.programmers, NewProgrammer(system.ctx))
+		programmer := NewProgrammer(system.ctx, system.provider)
+		system.programmers = append(system.programmers, programmer)
 
-		accumulator := provider.NewAccumulator()
-		accumulator.Stream(
-			system.programmers[0].Generate(input),
-			out,
+		var (
+			prompt = input
+			err    error
 		)
 
-		system.vm.Load(accumulator.String())
+		for round := 0; round <= maxRepairRounds; round++ {
+			accumulator := provider.NewAccumulator()
+			accumulator.Stream(
+				programmer.Generate(prompt),
+				out,
+			)
+
+			program := accumulator.String()
+
+			if err = system.load(program); err == nil {
+				for event := range system.vm.Run(input) {
+					out <- event
+				}
+
+				return
+			}
+
+			prompt = system.repair(input, program, err)
+		}
+
+		out <- provider.Event{
+			Type:    provider.EventError,
+			Content: err.Error(),
+			Error:   err,
+		}
 	}()
 
 	return out
 }
 
-func (system *System) load(input string) {
+func (system *System) load(input string) error {
 	errnie.Log("system.load(%s)", input)
 
-	system.vm.Load(utils.StripMarkdown(input, "boogie"))
+	return system.vm.Load(utils.StripMarkdown(input, "boogie"))
+}
+
+/*
+repair builds the prompt for a repair round, giving the programmer its own
+program back together with the diagnostics the parser produced for it.
+*/
+func (system *System) repair(input, program string, err error) string {
+	return utils.JoinWith("\n",
+		input,
+		"",
+		"The boogie program you wrote for this could not be parsed:",
+		"",
+		"```boogie",
+		utils.StripMarkdown(program, "boogie"),
+		"```",
+		"",
+		"The parser reported the following problems (line:column: severity: message):",
+		"",
+		err.Error(),
+		"",
+		"Respond with the complete, corrected boogie program.",
+	)
 }
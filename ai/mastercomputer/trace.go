@@ -0,0 +1,152 @@
+package mastercomputer
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theapemachine/amsh/ai/boogie"
+	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Trace records every operation a run of the VM executed, as one artifact per
+step. The payload holds the response of the worker exactly as it was generated,
+and the attributes describe the step:
+
+  - instruction: the index of the spawn instruction
+  - operation, behavior, params and label: what the instruction asked for
+  - context: the hash of the context the worker was given
+  - outcome: the outcome of the step
+  - started and duration: when the step ran, and for how long, in nanoseconds
+  - provider and model: what generated the response
+*/
+type Trace struct {
+	steps []*data.Artifact
+	mu    sync.Mutex
+}
+
+func NewTrace() *Trace {
+	return &Trace{steps: make([]*data.Artifact, 0)}
+}
+
+/*
+Record adds a step to the trace.
+*/
+func (trace *Trace) Record(
+	ip int, instruction boogie.Instruction, context string, processor *Processor, started time.Time,
+) {
+	step := data.New("mastercomputer", "step", "trace", []byte(processor.Response()))
+	origin, model := processor.Source()
+
+	step.Poke("instruction", strconv.Itoa(ip))
+	step.Poke("operation", instruction.Operation)
+	step.Poke("behavior", instruction.Behavior)
+	step.Poke("params", strings.Join(instruction.Params, ","))
+	step.Poke("label", instruction.Label)
+	step.Poke("context", context)
+	step.Poke("outcome", processor.Entry().Outcome)
+	step.Poke("started", strconv.FormatInt(started.UnixNano(), 10))
+	step.Poke("duration", strconv.FormatInt(int64(time.Since(started)), 10))
+	step.Poke("provider", origin)
+	step.Poke("model", model)
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+
+	trace.steps = append(trace.steps, step)
+}
+
+/*
+Artifacts returns the recorded steps, in the order they finished.
+*/
+func (trace *Trace) Artifacts() []*data.Artifact {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+
+	steps := make([]*data.Artifact, len(trace.steps))
+	copy(steps, trace.steps)
+
+	return steps
+}
+
+/*
+Replay hands out the recorded responses of a trace, in place of a provider.
+Every instruction gets its recorded steps in the order they were recorded, so
+loops and retries replay the same way they ran.
+*/
+type Replay struct {
+	steps map[int][]*data.Artifact
+	mu    sync.Mutex
+}
+
+func NewReplay(trace []*data.Artifact) *Replay {
+	replay := &Replay{steps: make(map[int][]*data.Artifact)}
+
+	for _, step := range trace {
+		ip, err := strconv.Atoi(step.Peek("instruction"))
+		if err != nil {
+			errnie.Warn("replay.NewReplay skipping step without instruction %s", step.Peek("id"))
+			continue
+		}
+
+		replay.steps[ip] = append(replay.steps[ip], step)
+	}
+
+	return replay
+}
+
+/*
+Next returns a provider that generates the next recorded response for the
+instruction. When the context differs from the one that was recorded, the run
+has diverged from the trace, which is logged, but the recording is still used.
+*/
+func (replay *Replay) Next(ip int, context string) *Recording {
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+
+	if len(replay.steps[ip]) == 0 {
+		errnie.Warn("replay.Next no recorded step left for instruction %d", ip)
+		return &Recording{}
+	}
+
+	step := replay.steps[ip][0]
+	replay.steps[ip] = replay.steps[ip][1:]
+
+	if step.Peek("context") != context {
+		errnie.Warn("replay.Next instruction %d diverged from the trace", ip)
+	}
+
+	return &Recording{step: step}
+}
+
+/*
+Recording is a provider that generates a single recorded response, or nothing
+at all when there was no recording, which fails the step.
+*/
+type Recording struct {
+	step *data.Artifact
+}
+
+func (recording *Recording) Generate(params provider.GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	return twoface.NewAccumulator(
+		"replay",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		if recording.step == nil {
+			return
+		}
+
+		accumulator.Out <- data.New(
+			"replay", "assistant", recording.step.Peek("model"), []byte(recording.step.Peek("payload")),
+		)
+	}).Generate()
+}
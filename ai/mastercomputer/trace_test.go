@@ -0,0 +1,104 @@
+package mastercomputer
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
+)
+
+const refine = `
+out <= (
+	[refine] => (
+		analyze<surface>   => next
+		verify<validation> => next
+		match (
+			ok    => send
+			error => [refine].jump
+		)
+	)
+) <= in`
+
+func attributes(trace []*data.Artifact, key string) []string {
+	out := make([]string, len(trace))
+
+	for i, step := range trace {
+		out[i] = step.Peek(key)
+	}
+
+	return out
+}
+
+func TestTrace(t *testing.T) {
+	Convey("Given a program that ran on a provider", t, func() {
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: behavior("surface"), Responses: []string{"first look", "second look"}},
+			&provider.Script{Key: behavior("validation"), Responses: []string{
+				"not yet\noutcome: error", "good\noutcome: ok",
+			}},
+		)
+
+		vm := NewVM(context.Background(), scripted)
+		So(vm.Load(refine), ShouldBeNil)
+
+		for range vm.Run("input") {
+		}
+
+		trace := vm.Trace()
+
+		Convey("It should record every step", func() {
+			So(attributes(trace, "operation"), ShouldResemble, []string{"analyze", "verify", "analyze", "verify"})
+			So(attributes(trace, "behavior"), ShouldResemble, []string{"surface", "validation", "surface", "validation"})
+			So(attributes(trace, "outcome"), ShouldResemble, []string{"ok", "error", "ok", "ok"})
+			So(attributes(trace, "provider"), ShouldResemble, []string{"scripted", "scripted", "scripted", "scripted"})
+			So(trace[0].Peek("instruction"), ShouldEqual, trace[2].Peek("instruction"))
+		})
+
+		Convey("It should keep the responses as they were generated", func() {
+			So(attributes(trace, "payload"), ShouldResemble, []string{
+				"first look", "not yet\noutcome: error", "second look", "good\noutcome: ok",
+			})
+		})
+
+		Convey("It should hash the context each step was given", func() {
+			So(trace[0].Peek("context"), ShouldEqual, NewContext("input").Hash())
+			So(trace[2].Peek("context"), ShouldNotEqual, trace[0].Peek("context"))
+		})
+
+		Convey("When the trace is replayed without a provider", func() {
+			offline := provider.NewScriptedProvider()
+			replayed := NewVM(context.Background(), offline).Replay(trace)
+			So(replayed.Load(refine), ShouldBeNil)
+
+			var done provider.Event
+
+			for event := range replayed.Run("input") {
+				done = event
+			}
+
+			Convey("It should reproduce the run from the recorded responses", func() {
+				So(offline.Prompts(), ShouldBeEmpty)
+				So(done.Content, ShouldEqual, "good")
+				So(replayed.Context().Entries, ShouldResemble, vm.Context().Entries)
+				So(attributes(replayed.Trace(), "context"), ShouldResemble, attributes(trace, "context"))
+				So(attributes(replayed.Trace(), "provider"), ShouldResemble, []string{
+					"replay", "replay", "replay", "replay",
+				})
+			})
+		})
+
+		Convey("When the trace runs out while replaying", func() {
+			replayed := NewVM(context.Background(), provider.NewScriptedProvider()).Replay(trace[:1])
+			So(replayed.Load(`out <= ( analyze<surface> => next verify<validation> => send ) <= in`), ShouldBeNil)
+
+			for range replayed.Run("input") {
+			}
+
+			Convey("It should fail the steps that were not recorded", func() {
+				So(attributes(replayed.Trace(), "outcome"), ShouldResemble, []string{"ok", "error"})
+			})
+		})
+	})
+}
@@ -2,65 +2,448 @@ package mastercomputer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/theapemachine/amsh/ai/boogie"
 	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/errnie"
 )
 
+/*
+Status describes how a thread of execution ended.
+*/
+type Status int
+
+const (
+	// STATUS_ENDED means the thread ran to the end without sending anything.
+	STATUS_ENDED Status = iota
+	// STATUS_SENT means the thread sent its context up the chain.
+	STATUS_SENT
+	// STATUS_CANCELLED means the thread was cancelled, or failed.
+	STATUS_CANCELLED
+	// STATUS_HALTED means the whole program was halted.
+	STATUS_HALTED
+)
+
+func (status Status) String() string {
+	return [...]string{"ended", "sent", "cancelled", "halted"}[status]
+}
+
+/*
+The defaults for the limits of the VM, which keep a program that never
+settles from running forever.
+*/
+const (
+	defaultMaxSteps      = 256
+	defaultMaxRetries    = 3
+	defaultMaxIterations = 10
+)
+
+/*
+VM executes compiled Boogie programs. It walks the instruction graph from the
+entry of the program, threading the context through every operation, and
+streams the events of the workers out while it does.
+*/
 type VM struct {
-	ctx          context.Context
-	lexer        *boogie.Lexer
-	parser       *boogie.Parser
-	compiler     *boogie.Compiler
-	instructions []boogie.Instruction
-	processors   []*Processor
-	buffer       *Buffer
-	LoadStream   chan provider.Event
+	ctx           context.Context
+	provider      provider.Provider
+	registry      *boogie.Registry
+	library       *boogie.Library
+	instructions  []boogie.Instruction
+	entry         int
+	program       string
+	context       *Context
+	trace         *Trace
+	recorded      []*data.Artifact
+	replay        *Replay
+	snapshots     map[string]*Context
+	mu            sync.Mutex
+	maxSteps      int
+	maxRetries    int
+	maxIterations int
 }
 
-func NewVM(ctx context.Context) *VM {
+/*
+NewVM creates a VM that runs the workers of its programs on the provider.
+*/
+func NewVM(ctx context.Context, provider provider.Provider) *VM {
 	errnie.Log("vm.NewVM()")
 
 	return &VM{
-		ctx:        ctx,
-		lexer:      boogie.NewLexer(),
-		parser:     boogie.NewParser(),
-		compiler:   boogie.NewCompiler(),
-		processors: make([]*Processor, 0),
-		buffer:     NewBuffer(),
+		ctx:           ctx,
+		provider:      provider,
+		registry:      boogie.NewConfigRegistry(),
+		library:       boogie.NewConfigLibrary(),
+		instructions:  make([]boogie.Instruction, 0),
+		entry:         boogie.END,
+		trace:         NewTrace(),
+		snapshots:     make(map[string]*Context),
+		maxSteps:      defaultMaxSteps,
+		maxRetries:    defaultMaxRetries,
+		maxIterations: defaultMaxIterations,
 	}
 }
 
-func (vm *VM) Load(program string) {
+/*
+Load compiles the program into the instructions of the VM, after inlining the
+subprograms it uses from itself and the library. When the program does not
+parse, link, validate or compile, the returned error holds the
+boogie.Diagnostics describing what is wrong with it, and the previously loaded
+instructions are kept. Warnings are only logged.
+*/
+func (vm *VM) Load(program string) error {
 	errnie.Log("vm.Load(%s)", program)
 
+	ast, diagnostics := boogie.Parse(program)
+
+	if err := diagnostics.Err(); err != nil {
+		errnie.Warn("vm.Load diagnostics\n%s", diagnostics.Error())
+		return err
+	}
+
+	if ast, diagnostics = boogie.NewLinker(vm.library).Link(ast); diagnostics.HasErrors() {
+		errnie.Warn("vm.Load diagnostics\n%s", diagnostics.Error())
+		return diagnostics
+	}
+
+	diagnostics = boogie.NewValidator(vm.registry).Validate(ast)
+
+	if len(diagnostics) > 0 {
+		errnie.Warn("vm.Load diagnostics\n%s", diagnostics.Error())
+	}
+
+	if err := diagnostics.Err(); err != nil {
+		return err
+	}
+
 	compiler := boogie.NewCompiler()
-	compiler.Generate(
-		boogie.NewParser().Generate(
-			boogie.NewLexer().Generate(program),
-		),
-	)
+	entry := compiler.Generate(ast)
+
+	if err := compiler.Diagnostics().Err(); err != nil {
+		errnie.Warn("vm.Load diagnostics\n%s", compiler.Diagnostics().Error())
+		return err
+	}
 
 	vm.instructions = compiler.Load()
+	vm.entry = entry
+	vm.program = fingerprint(program)
 	errnie.Log("vm.instructions(%v)", vm.instructions)
+
+	return nil
 }
 
-func (vm *VM) Generate(instruction boogie.Instruction) {
-	errnie.Log("vm.Generate(%v)", instruction)
+/*
+fingerprint identifies a program by its source, which is what its usage is
+tallied to.
+*/
+func fingerprint(program string) string {
+	sum := sha256.Sum256([]byte(program))
+	return hex.EncodeToString(sum[:6])
+}
+
+/*
+Program returns the fingerprint of the loaded program.
+*/
+func (vm *VM) Program() string {
+	return vm.program
+}
+
+/*
+Context returns the context as it was when the last run ended.
+*/
+func (vm *VM) Context() *Context {
+	return vm.context
+}
+
+/*
+Trace returns the steps of the last run, one artifact per executed operation.
+*/
+func (vm *VM) Trace() []*data.Artifact {
+	return vm.trace.Artifacts()
+}
+
+/*
+Replay makes the following runs use the responses recorded in the trace,
+instead of calling the provider, so a run can be reproduced exactly. Passing
+nil goes back to using the provider.
+*/
+func (vm *VM) Replay(trace []*data.Artifact) *VM {
+	vm.recorded = trace
+	return vm
+}
+
+/*
+Run executes the loaded program with the input as the initial context. The
+channel carries the events of the workers, and ends with an EventDone, holding
+the output when the program sent one, or an EventError when it was cancelled.
+The usage of the workers is tallied to the program.
+*/
+func (vm *VM) Run(input string) <-chan provider.Event {
+	errnie.Log("vm.Run(%s)", input)
+
+	out := make(chan provider.Event)
+
+	go func() {
+		defer close(out)
+
+		ctx, cancel := context.WithCancel(provider.WithAccount(vm.ctx, provider.ACCOUNT_PROGRAM, vm.program))
+		defer cancel()
+
+		vm.snapshots = make(map[string]*Context)
+		vm.context = NewContext(input)
+		vm.trace = NewTrace()
+		vm.replay = nil
+
+		if vm.recorded != nil {
+			vm.replay = NewReplay(vm.recorded)
+		}
+
+		status := vm.thread(ctx, cancel, vm.entry, vm.context, out)
+
+		switch status {
+		case STATUS_SENT:
+			out <- provider.Event{Type: provider.EventDone, Content: vm.context.Output()}
+		case STATUS_ENDED:
+			out <- provider.Event{Type: provider.EventDone}
+		default:
+			err := errors.New("program cancelled")
+
+			if status == STATUS_HALTED {
+				err = errors.New("program halted")
+			}
+
+			out <- provider.Event{Type: provider.EventError, Content: err.Error(), Error: err}
+		}
+	}()
+
+	return out
+}
+
+/*
+thread executes instructions from ip until the thread ends, mutating the given
+context as it goes. The program itself is a thread, and so is every branch of
+a join.
+*/
+func (vm *VM) thread(
+	ctx context.Context, halt context.CancelFunc, ip int, in *Context, out chan<- provider.Event,
+) Status {
+	var (
+		retries    = make(map[int]int)
+		iterations = make(map[int]int)
+	)
+
+	for steps := 0; ip != boogie.END; steps++ {
+		if ctx.Err() != nil {
+			return STATUS_HALTED
+		}
+
+		if steps >= vm.maxSteps {
+			errnie.Warn("vm.thread exceeded %d steps", vm.maxSteps)
+			return STATUS_CANCELLED
+		}
+
+		instruction := vm.instructions[ip]
+		errnie.Log("vm.thread(%d: %v)", ip, instruction)
 
-	switch instruction.Type {
-	case boogie.INSTRUCTION_SPAWN:
-		vm.processors = append(vm.processors, NewProcessor(vm.ctx, instruction))
-	case boogie.INSTRUCTION_JOIN:
-		vm.parallel(instruction.Next)
+		switch instruction.Type {
+		case boogie.INSTRUCTION_SPAWN:
+			in.Append(vm.spawn(ctx, ip, instruction, in, out))
+
+			if instruction.Label != "" {
+				vm.snapshot(instruction.Label, in)
+			}
+
+			// A failed operation moves on to its first fallback, and without
+			// one it continues as usual, so a match further on can see the error.
+			if in.Outcome == "error" && len(instruction.Fallbacks) > 0 {
+				ip = instruction.Fallbacks[0]
+				continue
+			}
+
+			ip = vm.first(instruction.Next)
+		case boogie.INSTRUCTION_FLOW:
+			switch instruction.Operation {
+			case "send":
+				return STATUS_SENT
+			case "cancel":
+				return STATUS_CANCELLED
+			case "halt":
+				halt()
+				return STATUS_HALTED
+			case "back":
+				if retries[ip] < vm.limit(instruction.Count, vm.maxRetries) && len(instruction.Next) > 0 {
+					retries[ip]++
+					ip = instruction.Next[0]
+					continue
+				}
+
+				retries[ip] = 0
+
+				if len(instruction.Fallbacks) == 0 {
+					return STATUS_CANCELLED
+				}
+
+				ip = instruction.Fallbacks[0]
+			case "iterate":
+				iterations[ip]++
+
+				if in.Outcome != "done" && iterations[ip] < vm.limit(instruction.Count, vm.maxIterations) {
+					ip = instruction.Next[0]
+					continue
+				}
+
+				iterations[ip] = 0
+				ip = instruction.Next[1]
+			default:
+				ip = vm.first(instruction.Next)
+			}
+		case boogie.INSTRUCTION_JOIN:
+			status := vm.join(ctx, halt, instruction, in, out)
+
+			if status == STATUS_HALTED {
+				return status
+			}
+
+			ip = instruction.Continue
+		case boogie.INSTRUCTION_MATCH:
+			ip = vm.match(instruction, in)
+		}
+	}
+
+	return STATUS_ENDED
+}
+
+/*
+spawn runs a worker for the operation, forwarding its events, and returns the
+entry it adds to the context. The step is recorded in the trace, and when
+replaying, the worker gets the recorded response instead of calling out.
+*/
+func (vm *VM) spawn(
+	ctx context.Context, ip int, instruction boogie.Instruction, in *Context, out chan<- provider.Event,
+) Entry {
+	var (
+		started = time.Now()
+		hash    = in.Hash()
+		source  = vm.provider
+	)
+
+	if vm.replay != nil {
+		source = vm.replay.Next(ip, hash)
+	}
+
+	processor := NewProcessor(ctx, instruction, source)
+
+	for event := range processor.Generate(in) {
+		out <- event
+	}
+
+	vm.trace.Record(ip, instruction, hash, processor, started)
+	return processor.Entry()
+}
+
+/*
+join runs every branch concurrently, each on its own copy of the context, and
+merges the contexts of the branches that sent theirs up. The outcome of the
+join is complete when all of them did, error when any was cancelled, and
+incomplete otherwise.
+*/
+func (vm *VM) join(
+	ctx context.Context, halt context.CancelFunc, instruction boogie.Instruction, in *Context, out chan<- provider.Event,
+) Status {
+	var (
+		wg       sync.WaitGroup
+		branches = make([]*Context, len(instruction.Next))
+		statuses = make([]Status, len(instruction.Next))
+	)
+
+	for i, entry := range instruction.Next {
+		branches[i] = in.Clone()
+		wg.Add(1)
+
+		go func(i, entry int) {
+			defer wg.Done()
+			statuses[i] = vm.thread(ctx, halt, entry, branches[i], out)
+		}(i, entry)
+	}
+
+	wg.Wait()
+
+	outcome := "complete"
+	sent := make([]*Context, 0, len(branches))
+
+	for i, status := range statuses {
+		switch status {
+		case STATUS_SENT:
+			sent = append(sent, branches[i])
+		case STATUS_HALTED:
+			return STATUS_HALTED
+		case STATUS_CANCELLED:
+			outcome = "error"
+		default:
+			if outcome != "error" {
+				outcome = "incomplete"
+			}
+		}
 	}
+
+	in.Merge(outcome, sent...)
+	return STATUS_ENDED
 }
 
-func (vm *VM) parallel(indices []int) {
-	errnie.Log("vm.parallel(%v)", indices)
+/*
+match looks up the outcome to match on, and returns the target of the first
+arm that applies, where _ applies to any outcome.
+*/
+func (vm *VM) match(instruction boogie.Instruction, in *Context) int {
+	outcome := in.Outcome
+
+	if instruction.Label != "" {
+		vm.mu.Lock()
+		snapshot, ok := vm.snapshots[instruction.Label]
+		vm.mu.Unlock()
 
-	for _, idx := range indices {
-		vm.Generate(vm.instructions[idx])
+		if ok {
+			outcome = snapshot.Outcome
+		}
 	}
+
+	for i, condition := range instruction.Params {
+		if condition == outcome || condition == "_" {
+			return instruction.Next[i]
+		}
+	}
+
+	return instruction.Continue
+}
+
+func (vm *VM) snapshot(label string, in *Context) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	vm.snapshots[label] = in.Clone()
+}
+
+func (vm *VM) first(targets []int) int {
+	if len(targets) == 0 {
+		return boogie.END
+	}
+
+	return targets[0]
+}
+
+/*
+limit returns the count given in the program, or the default when it has
+none, which is also used to cap unbounded iteration.
+*/
+func (vm *VM) limit(count, fallback int) int {
+	if count <= 0 {
+		return fallback
+	}
+
+	return count
 }
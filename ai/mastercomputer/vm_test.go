@@ -1,2 +1,503 @@
-// vm_test.go
 package mastercomputer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/ai/provider"
+)
+
+/*
+operation returns the key a script uses to answer the worker for an operation.
+*/
+func operation(name string) string {
+	return "<operation>" + name + "</operation>"
+}
+
+func behavior(name string) string {
+	return "<behavior>" + name + "</behavior>"
+}
+
+/*
+run loads the program into a VM on the scripted provider, and runs it to the
+end, returning the final event and the context the VM ended with.
+*/
+func run(scripted *provider.ScriptedProvider, program, input string) (provider.Event, *Context) {
+	vm := NewVM(context.Background(), scripted)
+	So(vm.Load(program), ShouldBeNil)
+
+	var last provider.Event
+
+	for event := range vm.Run(input) {
+		last = event
+	}
+
+	return last, vm.Context()
+}
+
+/*
+trace lists the operations that wrote to the context, with their behavior.
+*/
+func trace(ctx *Context) []string {
+	out := make([]string, 0, len(ctx.Entries))
+
+	for _, entry := range ctx.Entries {
+		if entry.Behavior != "" {
+			out = append(out, entry.Operation+"<"+entry.Behavior+">")
+			continue
+		}
+
+		out = append(out, entry.Operation)
+	}
+
+	return out
+}
+
+func TestVMFlow(t *testing.T) {
+	Convey("Given a program that analyzes and verifies", t, func() {
+		program := `
+		out <= (
+			analyze => next ; Analysis without any behavior
+			verify  => send ; Verification, and send up the chain
+		) <= in`
+
+		Convey("When both operations succeed", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Responses: []string{"it is a question"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"the answer is 42\noutcome: ok"}},
+			)
+
+			done, ctx := run(scripted, program, "what is the answer?")
+
+			Convey("It should run every operation in order", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "verify"})
+			})
+
+			Convey("It should thread the context from one operation to the next", func() {
+				prompts := scripted.Prompts()
+				So(len(prompts), ShouldEqual, 2)
+				So(prompts[0], ShouldContainSubstring, "what is the answer?")
+				So(prompts[1], ShouldContainSubstring, "it is a question")
+			})
+
+			Convey("It should strip the outcome from the context", func() {
+				So(ctx.Entries[1], ShouldResemble, Entry{
+					Operation: "verify", Content: "the answer is 42", Outcome: "ok",
+				})
+			})
+
+			Convey("It should send the output up", func() {
+				So(done.Type, ShouldEqual, provider.EventDone)
+				So(done.Content, ShouldEqual, "the answer is 42")
+			})
+		})
+	})
+
+	Convey("Given a program with fallback chains", t, func() {
+		program := `
+		out <= (
+			analyze => next | back | cancel
+			verify  => send
+		) <= in`
+
+		Convey("When an operation fails fewer times than it may be retried", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Failures: 2, Responses: []string{"analysis"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+			)
+
+			done, ctx := run(scripted, program, "input")
+
+			Convey("It should go back and retry the operation", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "analyze", "analyze", "verify"})
+				So(ctx.Entries[0].Outcome, ShouldEqual, "error")
+				So(ctx.Entries[2].Outcome, ShouldEqual, "ok")
+				So(done.Content, ShouldEqual, "verified")
+			})
+		})
+
+		Convey("When an operation keeps failing", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Failures: 10},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+			)
+
+			done, ctx := run(scripted, program, "input")
+
+			Convey("It should cancel once the retries are exhausted", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "analyze", "analyze", "analyze"})
+				So(done.Type, ShouldEqual, provider.EventError)
+			})
+		})
+
+		Convey("When the retry count is given", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Failures: 10},
+			)
+
+			_, ctx := run(scripted, `out <= ( analyze => next | back<1> | cancel ) <= in`, "input")
+
+			Convey("It should retry that many times", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "analyze"})
+			})
+		})
+	})
+
+	Convey("Given a program with a match block", t, func() {
+		program := `
+		out <= (
+			analyze => next
+			verify  => next
+			match (
+				ok    => send
+				error => cancel
+			)
+		) <= in`
+
+		Convey("When verification succeeds", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Responses: []string{"analysis"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"correct\noutcome: ok"}},
+			)
+
+			done, _ := run(scripted, program, "input")
+
+			Convey("It should take the ok arm", func() {
+				So(done.Type, ShouldEqual, provider.EventDone)
+				So(done.Content, ShouldEqual, "correct")
+			})
+		})
+
+		Convey("When verification fails", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Responses: []string{"analysis"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"wrong\noutcome: error"}},
+			)
+
+			done, ctx := run(scripted, program, "input")
+
+			Convey("It should take the error arm", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "verify"})
+				So(done.Type, ShouldEqual, provider.EventError)
+			})
+		})
+	})
+
+	Convey("Given a match on a label", t, func() {
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: operation("analyze"), Responses: []string{"unclear\noutcome: error"}},
+			&provider.Script{Key: operation("verify"), Responses: []string{"fine\noutcome: ok"}},
+		)
+
+		done, ctx := run(scripted, `
+		out <= (
+			analyze[myLabel] => next
+			verify           => next
+			match <= [myLabel] (
+				ok    => send
+				error => cancel
+			)
+		) <= in`, "input")
+
+		Convey("It should match on the snapshot instead of the last outcome", func() {
+			So(trace(ctx), ShouldResemble, []string{"analyze", "verify"})
+			So(done.Type, ShouldEqual, provider.EventError)
+		})
+	})
+
+	Convey("Given a program that jumps to a label", t, func() {
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: behavior("surface"), Responses: []string{"surface"}},
+			&provider.Script{Key: behavior("practical"), Responses: []string{"practical"}},
+			&provider.Script{Key: behavior("validation"), Responses: []string{
+				"needs work\noutcome: error", "valid\noutcome: ok",
+			}},
+		)
+
+		done, ctx := run(scripted, `
+		out <= (
+			[refine] => (
+				analyze<surface>   => next
+				analyze<practical> => next
+				verify<validation> => next
+				match (
+					ok    => send
+					error => [refine].jump
+				)
+			)
+		) <= in`, "input")
+
+		Convey("It should refine until the validation passes", func() {
+			So(trace(ctx), ShouldResemble, []string{
+				"analyze<surface>", "analyze<practical>", "verify<validation>",
+				"analyze<surface>", "analyze<practical>", "verify<validation>",
+			})
+			So(done.Content, ShouldEqual, "valid")
+		})
+	})
+
+	Convey("Given a program with iteration", t, func() {
+		Convey("When the iteration is limited", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Responses: []string{"one", "two", "three", "four"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+			)
+
+			_, ctx := run(scripted, `
+			out <= (
+				analyze <= <3> => next
+				verify         => send
+			) <= in`, "input")
+
+			Convey("It should run the operation that many times", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "analyze", "analyze", "verify"})
+				So(ctx.Entries[2].Content, ShouldEqual, "three")
+			})
+		})
+
+		Convey("When the iteration is unbounded", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: operation("analyze"), Responses: []string{"one", "two\noutcome: done"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+			)
+
+			_, ctx := run(scripted, `
+			out <= (
+				analyze <= => next | back | cancel
+				verify     => send | back | cancel
+			) <= in`, "input")
+
+			Convey("It should iterate until the operation is done", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze", "analyze", "verify"})
+			})
+		})
+	})
+
+	Convey("Given a program with concurrent branches", t, func() {
+		program := `
+		out <= (
+			match (
+				complete => send
+				error    => cancel
+			) <= join <= (
+				analyze<pattern> => next
+				verify           => send
+			) (
+				call<{query} => wiki> => next
+				analyze<practical>    => send
+			)
+		) <= in`
+
+		Convey("When every branch sends", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: behavior("pattern"), Responses: []string{"pattern"}, Latency: 50 * time.Millisecond},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+				&provider.Script{Key: behavior("wiki"), Responses: []string{"wiki"}},
+				&provider.Script{Key: behavior("practical"), Responses: []string{"practical"}},
+			)
+
+			done, ctx := run(scripted, program, "input")
+
+			Convey("It should merge the branches in program order", func() {
+				So(trace(ctx), ShouldResemble, []string{
+					"analyze<pattern>", "verify", "call<wiki>", "analyze<practical>",
+				})
+				So(ctx.Outcome, ShouldEqual, "complete")
+				So(done.Content, ShouldEqual, "practical")
+			})
+
+			Convey("It should run each branch on its own context", func() {
+				var practical string
+
+				for _, prompt := range scripted.Prompts() {
+					if strings.Contains(prompt, behavior("practical")) {
+						practical = prompt
+					}
+				}
+
+				So(practical, ShouldContainSubstring, "wiki")
+				So(practical, ShouldNotContainSubstring, "verified")
+			})
+		})
+
+		Convey("When a branch is cancelled", func() {
+			scripted := provider.NewScriptedProvider(
+				&provider.Script{Key: behavior("pattern"), Responses: []string{"pattern"}},
+				&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+				&provider.Script{Key: behavior("wiki"), Failures: 1},
+			)
+
+			done, ctx := run(scripted, `
+			out <= (
+				match (
+					complete => send
+					error    => cancel
+				) <= join <= (
+					analyze<pattern> => next
+					verify           => send
+				) (
+					call<{query} => wiki> => next | cancel
+					analyze<practical>    => send
+				)
+			) <= in`, "input")
+
+			Convey("It should only merge the branches that sent", func() {
+				So(trace(ctx), ShouldResemble, []string{"analyze<pattern>", "verify"})
+				So(ctx.Outcome, ShouldEqual, "error")
+				So(done.Type, ShouldEqual, provider.EventError)
+			})
+		})
+	})
+
+	Convey("Given a program that halts", t, func() {
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: operation("analyze"), Responses: []string{"stop\noutcome: error"}},
+			&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+		)
+
+		done, ctx := run(scripted, `
+		out <= (
+			analyze => next | halt
+			verify  => send
+		) <= in`, "input")
+
+		Convey("It should stop the whole program", func() {
+			So(trace(ctx), ShouldResemble, []string{"analyze"})
+			So(done.Type, ShouldEqual, provider.EventError)
+			So(done.Content, ShouldEqual, "program halted")
+		})
+	})
+
+	Convey("Given a program that uses a subprogram from the library", t, func() {
+		root := t.TempDir()
+		So(os.WriteFile(filepath.Join(root, "checked.boogie"), []byte(`
+		define<checked>{focus} => (
+			analyze<focus> => next
+			verify         => send | back<1> | cancel
+		)`), 0644), ShouldBeNil)
+
+		viper.Set("boogie.library", root)
+		defer viper.Reset()
+
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: behavior("surface"), Responses: []string{"looked"}},
+			&provider.Script{Key: operation("verify"), Responses: []string{"fine\noutcome: error", "fine"}},
+		)
+
+		done, ctx := run(scripted, `out <= ( use<checked>{surface} ) <= in`, "input")
+
+		Convey("It should run the subprogram in place, with the arguments", func() {
+			So(trace(ctx), ShouldResemble, []string{"analyze<surface>", "verify", "verify"})
+			So(done.Type, ShouldEqual, provider.EventDone)
+		})
+	})
+
+	Convey("Given generation params for operations and behaviors", t, func() {
+		viper.Set("boogie.generation", map[string]any{
+			"operations": map[string]any{
+				"analyze": map[string]any{"temperature": 0.3, "max_tokens": 512},
+			},
+			"behaviors": map[string]any{
+				"moonshot": map[string]any{"temperature": 1.2, "stop": []string{"END"}, "policy": "fastest"},
+			},
+		})
+		viper.Set("ai.setups.mastercomputer.generation.worker", map[string]any{
+			"capabilities": []string{"long_context"},
+		})
+		defer viper.Reset()
+
+		scripted := provider.NewScriptedProvider(&provider.Script{Responses: []string{"done"}})
+
+		run(scripted, `
+		out <= (
+			analyze           => next
+			analyze<moonshot> => next
+			verify            => send
+		) <= in`, "input")
+
+		Convey("It should pass them to the provider for every step", func() {
+			params := scripted.Params()
+			So(params, ShouldHaveLength, 3)
+
+			So(*params[0].Temperature, ShouldEqual, 0.3)
+			So(params[0].MaxTokens, ShouldEqual, 512)
+
+			So(*params[1].Temperature, ShouldEqual, 1.2)
+			So(params[1].MaxTokens, ShouldEqual, 512)
+			So(params[1].Stop, ShouldResemble, []string{"END"})
+			So(params[1].Policy, ShouldEqual, provider.POLICY_FASTEST)
+
+			So(params[2].Temperature, ShouldBeNil)
+			So(params[2].MaxTokens, ShouldEqual, 0)
+			So(params[2].Policy, ShouldBeEmpty)
+		})
+
+		Convey("It should fall back to the params of the worker role", func() {
+			for _, params := range scripted.Params() {
+				So(params.Capabilities, ShouldResemble, []string{provider.CAPABILITY_LONG_CONTEXT})
+			}
+		})
+	})
+}
+
+func TestSystem(t *testing.T) {
+	Convey("Given a system whose programmer first writes a broken program", t, func() {
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: operation("analyze"), Responses: []string{"analysis"}},
+			&provider.Script{Key: operation("verify"), Responses: []string{"verified"}},
+			&provider.Script{Responses: []string{
+				"```boogie\nout <= ( analyze => next\n```",
+				"```boogie\nout <= ( analyze => next verify => send ) <= in\n```",
+			}},
+		)
+
+		system := NewSystem(context.Background(), scripted)
+
+		var last provider.Event
+
+		for event := range system.Input("what is the answer?") {
+			last = event
+		}
+
+		Convey("It should repair the program, and execute it", func() {
+			prompts := scripted.Prompts()
+			So(len(prompts), ShouldEqual, 4)
+			So(prompts[1], ShouldContainSubstring, "could not be parsed")
+			So(prompts[2], ShouldContainSubstring, operation("analyze"))
+			So(prompts[3], ShouldContainSubstring, operation("verify"))
+			So(last.Type, ShouldEqual, provider.EventDone)
+			So(last.Content, ShouldEqual, "verified")
+		})
+	})
+}
+
+func TestVMUsage(t *testing.T) {
+	Convey("Given a program that is run", t, func() {
+		program := `
+		out <= (
+			analyze => send ; Tallied to the program
+		) <= in`
+
+		scripted := provider.NewScriptedProvider(
+			&provider.Script{Key: operation("analyze"), Responses: []string{"it is a question\noutcome: ok"}},
+		)
+
+		run(scripted, program, "what does it cost?")
+
+		Convey("It should tally the usage of its workers to the program, and to their role", func() {
+			report := provider.NewConfigLedger().Report()
+			tally := report.Accounts[provider.ACCOUNT_PROGRAM][fingerprint(program)]
+
+			So(tally, ShouldNotBeNil)
+			So(tally.Calls, ShouldEqual, 1)
+			So(tally.PromptTokens, ShouldBeGreaterThan, 0)
+			So(report.Accounts[provider.ACCOUNT_AGENT]["worker"].Calls, ShouldBeGreaterThanOrEqualTo, 1)
+		})
+	})
+}
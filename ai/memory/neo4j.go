@@ -5,9 +5,29 @@ import (
 	"os"
 
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/errnie"
 )
 
+/*
+exportArtifact merges an artifact into the graph, along with an edge to each
+of its parents, which are merged by id, so the export of a parent, before or
+after, fills them in.
+*/
+const exportArtifact = `
+MERGE (artifact:Artifact {id: $id})
+SET artifact.trace = $trace,
+    artifact.origin = $origin,
+    artifact.role = $role,
+    artifact.scope = $scope,
+    artifact.payload = $payload,
+    artifact.timestamp = $timestamp
+WITH artifact
+UNWIND $parents AS parentID
+MERGE (parent:Artifact {id: parentID})
+MERGE (artifact)-[:DERIVED_FROM]->(parent)
+`
+
 // Neo4j represents the Neo4j client.
 type Neo4j struct {
 	client neo4j.DriverWithContext
@@ -70,6 +90,53 @@ func (n *Neo4j) Write(query string) (neo4j.ResultWithContext, error) {
 	return session.Run(ctx, query, nil)
 }
 
+/*
+ExportLineage writes the artifacts to the graph as Artifact nodes, with a
+DERIVED_FROM edge to each of their parents, in a single transaction, so every
+input that led to an answer can be queried with
+`MATCH (:Artifact {id: $id})-[:DERIVED_FROM*]->(input) RETURN input`.
+*/
+func (n *Neo4j) ExportLineage(artifacts ...*data.Artifact) error {
+	ctx := context.Background()
+	session := n.client.NewSession(ctx, neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+	defer session.Close(ctx)
+
+	_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		return nil, exportLineage(ctx, tx, artifacts)
+	})
+
+	return err
+}
+
+/*
+transaction is what exportLineage runs its queries in, which is a
+neo4j.ManagedTransaction, other than in the tests.
+*/
+type transaction interface {
+	Run(ctx context.Context, cypher string, params map[string]any) (neo4j.ResultWithContext, error)
+}
+
+func exportLineage(ctx context.Context, tx transaction, artifacts []*data.Artifact) error {
+	for _, artifact := range artifacts {
+		node := data.NodeOf(artifact)
+
+		if _, err := tx.Run(ctx, exportArtifact, map[string]any{
+			"id":        node.ID,
+			"trace":     node.Trace,
+			"origin":    node.Origin,
+			"role":      node.Role,
+			"scope":     node.Scope,
+			"payload":   node.Payload,
+			"timestamp": node.Timestamp,
+			"parents":   node.Parents,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Close closes the Neo4j client connection.
 func (n *Neo4j) Close() error {
 	ctx := context.Background()
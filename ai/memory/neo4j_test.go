@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+/*
+recordingTransaction records the queries it is given, instead of running them,
+and fails from the query it is told to.
+*/
+type recordingTransaction struct {
+	cyphers []string
+	params  []map[string]any
+	failAt  int
+}
+
+func (tx *recordingTransaction) Run(ctx context.Context, cypher string, params map[string]any) (neo4j.ResultWithContext, error) {
+	tx.cyphers = append(tx.cyphers, cypher)
+	tx.params = append(tx.params, params)
+
+	if len(tx.cyphers) == tx.failAt {
+		return nil, errors.New("constraint violated")
+	}
+
+	return nil, nil
+}
+
+func TestExportLineage(t *testing.T) {
+	Convey("Given the lineage of an answer", t, func() {
+		prompt := data.New("test", "user", "prompt", []byte("Label this ticket."))
+		answer := data.New("agent", "assistant", "answer", []byte("bug")).DeriveFrom(prompt)
+		tx := &recordingTransaction{}
+
+		Convey("It should merge every artifact, with an edge to each of its parents", func() {
+			So(exportLineage(context.Background(), tx, []*data.Artifact{prompt, answer}), ShouldBeNil)
+
+			So(tx.cyphers, ShouldHaveLength, 2)
+			So(tx.cyphers[1], ShouldEqual, exportArtifact)
+			So(exportArtifact, ShouldContainSubstring, "MERGE (artifact:Artifact {id: $id})")
+			So(exportArtifact, ShouldContainSubstring, "MERGE (artifact)-[:DERIVED_FROM]->(parent)")
+
+			So(tx.params[0], ShouldResemble, map[string]any{
+				"id":        prompt.Peek("id"),
+				"trace":     prompt.Peek("id"),
+				"origin":    "test",
+				"role":      "user",
+				"scope":     "prompt",
+				"payload":   "Label this ticket.",
+				"timestamp": int64(prompt.Timestamp()),
+				"parents":   []string{},
+			})
+
+			So(tx.params[1]["parents"], ShouldResemble, []string{prompt.Peek("id")})
+			So(tx.params[1]["trace"], ShouldEqual, prompt.Peek("id"))
+		})
+
+		Convey("It should stop at the first query that fails", func() {
+			tx.failAt = 1
+
+			So(exportLineage(context.Background(), tx, []*data.Artifact{prompt, answer}), ShouldNotBeNil)
+			So(tx.cyphers, ShouldHaveLength, 1)
+		})
+	})
+}
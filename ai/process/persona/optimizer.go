@@ -1,6 +1,13 @@
 package persona
 
-import "github.com/theapemachine/amsh/utils"
+import (
+	"context"
+
+	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+	"github.com/theapemachine/errnie"
+)
 
 type Optimizer struct {
 	Assessment      []Assessment   `json:"assessment" jsonschema:"title=Assessment,description=The assessment of the Agent's layering process response,required"`
@@ -24,12 +31,54 @@ type Score struct {
 
 type Optimization struct {
 	Type           string  `json:"type" jsonschema:"title=Type,description=Type of optimization,enum=parameter,enum=training_format,enum=improvement,required"`
-	Parameter      string  `json:"parameter,omitempty" jsonschema:"title=Parameter,description=Parameter to adjust if type is parameter"`
+	Parameter      string  `json:"parameter,omitempty" jsonschema:"title=Parameter,description=Parameter to adjust if type is parameter,enum=temperature,enum=top_p,enum=top_k,enum=presence_penalty,enum=frequency_penalty,enum=max_tokens"`
 	NewValue       float64 `json:"new_value,omitempty" jsonschema:"title=New Value,description=New parameter value if type is parameter"`
 	TrainingFormat string  `json:"training_format,omitempty" jsonschema:"title=Training Format,description=Formatted training example if quality is sufficient"`
 	Suggestion     string  `json:"suggestion,omitempty" jsonschema:"title=Suggestion,description=Specific improvement suggestion if needed"`
 }
 
+/*
+Optimize has the model assess the buffer of an agent, with the system prompt,
+the user prompt and the response in it, and returns the assessment, which is
+validated against the schema of the Optimizer, and sent back to be repaired
+up to repairs times, rather than taken on trust.
+*/
+func Optimize(ctx context.Context, generator provider.Provider, buffer string, repairs int) (*Optimizer, error) {
+	optimizer := &Optimizer{}
+
+	assessment, err := provider.NewStructured[Optimizer](generator, repairs).Generate(
+		ctx,
+		provider.GenerationParams{},
+		[]*data.Artifact{
+			data.New("optimizer", "system", "prompt", []byte(optimizer.SystemPrompt(buffer))),
+			data.New("optimizer", "user", "prompt", []byte(buffer)),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &assessment, nil
+}
+
+/*
+Tune applies the parameter optimizations to the params, so they can be used
+for the next generation. Anything that does not name a known param is skipped.
+*/
+func (optimizer *Optimizer) Tune(params provider.GenerationParams) provider.GenerationParams {
+	for _, optimization := range optimizer.Optimizations {
+		if optimization.Type != "parameter" {
+			continue
+		}
+
+		if err := params.Set(optimization.Parameter, optimization.NewValue); err != nil {
+			errnie.Warn("persona.Optimizer.Tune %s", err)
+		}
+	}
+
+	return params
+}
+
 func (optimizer *Optimizer) SystemPrompt(buffer string) string {
 	return `
     You are a core component of The Ape Machine's training data collection system. You evaluate responses against their prompts to identify high-quality examples for training.
@@ -8,6 +8,7 @@ import (
 	"github.com/anthropics/anthropic-sdk-go/option"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/amsh/utils"
 	"github.com/theapemachine/errnie"
 )
 
@@ -36,7 +37,7 @@ func (a *Anthropic) Configure(config map[string]interface{}) {
 	}
 }
 
-func (a *Anthropic) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
+func (a *Anthropic) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
 	return twoface.NewAccumulator(
 		"anthropic",
 		"provider",
@@ -46,41 +47,92 @@ func (a *Anthropic) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
 		defer close(accumulator.Out)
 
 		errnie.Log("===START===")
-		requestParams := a.buildRequestParams(artifacts)
+		requestParams := a.buildRequestParams(params, artifacts)
 		stream := a.client.Messages.NewStreaming(context.Background(), requestParams)
 		errnie.Log("===END===")
 
+		calls := newToolCallDeltas()
+
+		var (
+			content                   strings.Builder
+			inputTokens, outputTokens int64
+		)
+
 		for stream.Next() {
 			event := stream.Current()
 
 			switch event := event.AsUnion().(type) {
+			case anthropic.MessageStartEvent:
+				inputTokens = event.Message.Usage.InputTokens
+			case anthropic.MessageDeltaEvent:
+				outputTokens = event.Usage.OutputTokens
+			case anthropic.ContentBlockStartEvent:
+				if event.ContentBlock.Type == anthropic.ContentBlockStartEventContentBlockTypeToolUse {
+					calls.add(event.Index, event.ContentBlock.ID, event.ContentBlock.Name, "")
+				}
 			case anthropic.ContentBlockDeltaEvent:
 				if event.Delta.Text != "" {
+					content.WriteString(event.Delta.Text)
 					response := data.New("anthropic", "assistant", a.model, []byte(event.Delta.Text))
 					accumulator.Out <- response
 				}
+
+				if event.Delta.PartialJSON != "" {
+					calls.add(event.Index, "", "", event.Delta.PartialJSON)
+				}
 			}
 		}
 
 		if err := stream.Err(); err != nil {
 			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("anthropic", a.model, err)
+			return
 		}
+
+		for _, call := range calls.done() {
+			accumulator.Out <- NewToolCallArtifact("anthropic", a.model, call)
+		}
+
+		accumulator.Out <- NewUsageArtifact("anthropic", a.model, newUsage(
+			int(inputTokens), int(outputTokens), artifacts, content.String(),
+		))
 	}).Generate()
 }
 
-func (a *Anthropic) buildRequestParams(artifacts []*data.Artifact) anthropic.MessageNewParams {
+/*
+buildRequestParams converts the artifacts to messages, and sets whatever the
+params ask for. Anthropic always needs max tokens, so the temperature and max
+tokens it used before params could be passed are kept as the defaults, and it
+has no penalties, which are left out. Images are sent as image blocks, in the
+user turn, whatever the artifact they are attached to.
+*/
+func (a *Anthropic) buildRequestParams(params GenerationParams, artifacts []*data.Artifact) anthropic.MessageNewParams {
+	params = params.WithDefaults(GenerationParams{
+		Temperature: utils.Float64Ptr(0.7),
+		MaxTokens:   int(a.maxTokens),
+	})
+
 	messages := make([]anthropic.MessageParam, 0)
 	var systemMessage string
 
 	// First pass to extract system message and build regular messages
 	for _, artifact := range artifacts {
 		role := artifact.Peek("role")
-		payload := artifact.Peek("payload")
+		payload, images := contentOf(artifact)
 
 		errnie.Log("Anthropic.Generate role %s payload %s", role, payload)
 
 		if role == "system" {
 			systemMessage = payload
+			messages = appendImages(messages, images)
+			continue
+		}
+
+		if call, ok := ToolCallOf(artifact); ok {
+			messages = appendBlock(messages, anthropic.MessageParamRoleAssistant, anthropic.NewToolUseBlockParam(
+				call.ID, call.Name, call.Arguments,
+			))
+
 			continue
 		}
 
@@ -90,28 +142,58 @@ func (a *Anthropic) buildRequestParams(artifacts []*data.Artifact) anthropic.Mes
 			anthropicRole = anthropic.MessageParamRoleUser
 		case "assistant":
 			anthropicRole = anthropic.MessageParamRoleAssistant
+		case "tool":
+			messages = appendBlock(messages, anthropic.MessageParamRoleUser, anthropic.NewToolResultBlock(
+				artifact.Peek("tool_call_id"), payload, false,
+			))
+
+			messages = appendImages(messages, images)
+			continue
 		default:
 			errnie.Warn("Anthropic.Generate unknown_role %s", role)
 			continue
 		}
 
-		messages = append(messages, anthropic.MessageParam{
-			Role: anthropic.F(anthropicRole),
-			Content: anthropic.F([]anthropic.MessageParamContentUnion{
-				anthropic.MessageParamContent{
-					Type: anthropic.F(anthropic.MessageParamContentTypeText),
-					Text: anthropic.F(payload),
-				},
-			}),
+		messages = appendBlock(messages, anthropicRole, anthropic.MessageParamContent{
+			Type: anthropic.F(anthropic.MessageParamContentTypeText),
+			Text: anthropic.F(payload),
 		})
+
+		messages = appendImages(messages, images)
 	}
 
 	// Build request params
 	requestParams := anthropic.MessageNewParams{
 		Model:       anthropic.F(a.model),
 		Messages:    anthropic.F(messages),
-		MaxTokens:   anthropic.F(a.maxTokens),
-		Temperature: anthropic.F(0.7),
+		MaxTokens:   anthropic.F(int64(params.MaxTokens)),
+		Temperature: anthropic.F(*params.Temperature),
+	}
+
+	if params.TopP != nil {
+		requestParams.TopP = anthropic.F(*params.TopP)
+	}
+
+	if params.TopK != nil {
+		requestParams.TopK = anthropic.F(int64(*params.TopK))
+	}
+
+	if len(params.Stop) > 0 {
+		requestParams.StopSequences = anthropic.F(params.Stop)
+	}
+
+	if len(params.Tools) > 0 {
+		tools := make([]anthropic.ToolParam, 0, len(params.Tools))
+
+		for _, tool := range params.Tools {
+			tools = append(tools, anthropic.ToolParam{
+				Name:        anthropic.F(tool.Name),
+				Description: anthropic.F(tool.Description),
+				InputSchema: anthropic.F[interface{}](tool.Parameters),
+			})
+		}
+
+		requestParams.Tools = anthropic.F(tools)
 	}
 
 	// Add system message if present (either from artifacts or Configure)
@@ -133,6 +215,35 @@ func (a *Anthropic) buildRequestParams(artifacts []*data.Artifact) anthropic.Mes
 	return requestParams
 }
 
+/*
+appendBlock adds the block to the last message when it has the same role, and
+starts a new message otherwise, since Anthropic wants the roles to alternate,
+and the results of tool calls to follow the message that made them.
+*/
+func appendBlock(
+	messages []anthropic.MessageParam, role anthropic.MessageParamRole, block anthropic.MessageParamContentUnion,
+) []anthropic.MessageParam {
+	if last := len(messages) - 1; last >= 0 && messages[last].Role.Value == role {
+		messages[last].Content = anthropic.F(append(messages[last].Content.Value, block))
+		return messages
+	}
+
+	return append(messages, anthropic.MessageParam{
+		Role:    anthropic.F(role),
+		Content: anthropic.F([]anthropic.MessageParamContentUnion{block}),
+	})
+}
+
+func appendImages(messages []anthropic.MessageParam, images []data.Part) []anthropic.MessageParam {
+	for _, image := range images {
+		messages = appendBlock(messages, anthropic.MessageParamRoleUser, anthropic.NewImageBlockBase64(
+			image.MIME, image.Base64(),
+		))
+	}
+
+	return messages
+}
+
 func (a *Anthropic) convertToAnthropicMessages(artifacts []*data.Artifact) []anthropic.MessageParam {
 	anthropicMsgs := make([]anthropic.MessageParam, 0, len(artifacts))
 
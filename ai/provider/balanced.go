@@ -2,135 +2,352 @@ package provider
 
 import (
 	"errors"
-	"math/rand"
-	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/anthropics/anthropic-sdk-go"
-	"github.com/openai/openai-go"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/twoface"
 	"github.com/theapemachine/errnie"
 )
 
+/*
+ProviderStatus is how a provider is doing. It has as many requests in flight
+as its concurrency allows at most, and its latency is how long it takes to
+start responding, on average. Failures are those in a row, which open the
+circuit of the provider, while requests and errors are counted since the
+provider was declared.
+*/
 type ProviderStatus struct {
-	name     string
-	provider Provider
-	occupied bool
-	lastUsed time.Time
-	failures int
-	mu       sync.Mutex
+	name        string
+	config      ProviderConfig
+	provider    Provider
+	inFlight    int
+	lastUsed    time.Time
+	failures    int
+	latency     time.Duration
+	state       string
+	openedAt    time.Time
+	requests    int
+	errors      int
+	lastError   string
+	lastFailure time.Time
+	mu          sync.Mutex
 }
 
+/*
+BalancedProvider spreads requests over the providers declared in the config.
+A request that fails before its first token is retried, on another provider
+when there is one, and a provider that keeps failing is left alone until its
+circuit closes again.
+*/
 type BalancedProvider struct {
 	providers   []*ProviderStatus
+	retry       Retry
+	breaker     Breaker
 	selectIndex int
 	initMu      sync.Mutex
 	initialized bool
+	mu          sync.RWMutex
 }
 
 var (
-	balancedProviderInstance *BalancedProvider
+	balancedProviderInstance atomic.Pointer[BalancedProvider]
 	onceBalancedProvider     sync.Once
 )
 
+/*
+NewBalancedProvider returns the shared provider that balances over the
+providers declared in the config.
+*/
 func NewBalancedProvider() *BalancedProvider {
 	onceBalancedProvider.Do(func() {
-		balancedProviderInstance = &BalancedProvider{
-			providers: []*ProviderStatus{
-				{
-					name: "gpt-4o-mini",
-					provider: NewOpenAI(
-						os.Getenv("OPENAI_API_KEY"),
-						openai.ChatModelGPT4oMini,
-					),
-					occupied: false,
-				},
-				{
-					name:     "claude-3-5-sonnet",
-					provider: NewAnthropic(os.Getenv("ANTHROPIC_API_KEY"), anthropic.ModelClaude3_5Sonnet20241022),
-					occupied: false,
-				},
-				{
-					name:     "gemini-1.5-flash",
-					provider: NewGoogle(os.Getenv("GEMINI_API_KEY"), "gemini-1.5-flash"),
-					occupied: false,
-				},
-				{
-					name:     "command-r",
-					provider: NewCohere(os.Getenv("COHERE_API_KEY"), "command-r"),
-					occupied: false,
-				},
-				// {
-				// 	name:     "llama3.2:3b",
-				// 	provider: NewOllama("llama3.2:3b"),
-				// 	occupied: false,
-				// },
-				// {
-				// 	name:     "LM Studio",
-				// 	provider: NewOpenAI(
-				// 		os.Getenv("LM_STUDIO_API_KEY"),
-				// 		"https://api.openai.com/v1",
-				// 		"bartowski/Llama-3.1-8B-Lexi-Uncensored-V2-GGUF",
-				// 	),
-				// 	occupied: false,
-				// },
-				// {
-				// 	name:     "NVIDIA",
-				// 	provider: NewOpenAI(
-				// 		os.Getenv("NVIDIA_API_KEY"),
-				// 		"https://api.openai.com/v1",
-				// 		"nvidia/llama-3.1-nemotron-70b-instruct",
-				// 	),
-				// 	occupied: false,
-				// },
-			},
+		lb := &BalancedProvider{
+			providers:   make([]*ProviderStatus, 0),
 			selectIndex: 0,
 			initialized: false,
 		}
+
+		if err := lb.Reload(); err != nil {
+			errnie.Error(err)
+		}
+
+		balancedProviderInstance.Store(lb)
 	})
 
-	return balancedProviderInstance
+	return balancedProviderInstance.Load()
+}
+
+/*
+ReloadBalancedProvider reloads the shared provider after the config changed,
+unless it was never used, in which case it reads the config when it is.
+*/
+func ReloadBalancedProvider() {
+	lb := balancedProviderInstance.Load()
+
+	if lb == nil {
+		return
+	}
+
+	if err := lb.Reload(); err != nil {
+		errnie.Error(err)
+	}
+}
+
+/*
+Reload constructs the providers from the config again, and reads how to retry
+and when to open a circuit. Providers that are still declared under the same
+name keep their health, and requests that are in flight finish on the
+provider they started on. When the config is invalid, the current providers
+are kept.
+*/
+func (lb *BalancedProvider) Reload() error {
+	configs, err := NewConfigProviders()
+	if err != nil {
+		return err
+	}
+
+	statuses := buildProviders(configs)
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	current := make(map[string]*ProviderStatus, len(lb.providers))
+
+	for _, ps := range lb.providers {
+		current[ps.name] = ps
+	}
+
+	for _, ps := range statuses {
+		if previous, ok := current[ps.name]; ok {
+			previous.mu.Lock()
+			ps.lastUsed = previous.lastUsed
+			ps.failures = previous.failures
+			ps.latency = previous.latency
+			ps.state = previous.state
+			ps.openedAt = previous.openedAt
+			ps.requests = previous.requests
+			ps.errors = previous.errors
+			ps.lastError = previous.lastError
+			ps.lastFailure = previous.lastFailure
+			previous.mu.Unlock()
+		}
+	}
+
+	lb.providers = statuses
+	lb.retry = NewConfigRetry()
+	lb.breaker = NewConfigBreaker()
+	errnie.Info("provider.BalancedProvider.Reload %d providers", len(statuses))
+
+	return nil
 }
 
-func (lb *BalancedProvider) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
+/*
+snapshot returns the current providers, so they can be gone over while the
+config is reloaded.
+*/
+func (lb *BalancedProvider) snapshot() []*ProviderStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return lb.providers
+}
+
+/*
+settings returns how to retry and when to open a circuit, with the defaults
+for a provider that never read them from the config.
+*/
+func (lb *BalancedProvider) settings() (Retry, Breaker) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return lb.retry.withDefaults(), lb.breaker.withDefaults()
+}
+
+/*
+Generate streams the response of the provider the request is routed to, which
+is picked by the policy in the params, from the providers that have the
+capabilities, context length and budget the request needs. When the provider
+fails before its first token, the request goes to another provider, and once
+every provider that can handle it has been tried, to the same ones again,
+after backing off, for as many attempts as the retry allows, as long as the
+error is transient. Once tokens were streamed, a failure can no longer be
+hidden, and the error artifact is passed on, as it is when no attempt
+succeeds.
+*/
+func (lb *BalancedProvider) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	route := NewRoute(params, artifacts)
+
 	return twoface.NewAccumulator(
 		"balanced",
 		"provider",
 		"completion",
 		artifacts...,
 	).Yield(func(accumulator *twoface.Accumulator) {
-		provider := lb.getAvailableProvider()
-		if provider == nil {
-			errnie.Error(errors.New("no available provider found"))
-		}
+		defer close(accumulator.Out)
 
-		provider.mu.Lock()
-		provider.occupied = true
-		provider.lastUsed = time.Now()
-		provider.mu.Unlock()
+		retry, breaker := lb.settings()
+		failure := NewErrorArtifact("balanced", "", &ProviderError{
+			Provider: "balanced", Kind: ERROR_UNAVAILABLE, Err: errors.New("no available provider found"),
+		})
 
-		defer close(accumulator.Out)
+		for attempt := 0; attempt < retry.Attempts; attempt++ {
+			if attempt > 0 && !lb.untried(route) {
+				// Only a transient error is worth trying again on a provider
+				// that already failed the request.
+				if err, _ := ErrorOf(failure); !err.Retryable() {
+					break
+				}
 
-		for artifact := range provider.provider.Generate(artifacts) {
-			accumulator.Out <- artifact
+				route.tried = nil
+				time.Sleep(retry.delay(attempt))
+			}
+
+			provider := lb.getAvailableProvider(route)
+			if provider == nil {
+				break
+			}
+
+			started, artifact := lb.stream(provider, breaker, params, artifacts, accumulator.Out)
+
+			if artifact == nil {
+				return
+			}
+
+			failure = artifact
+
+			if err, _ := ErrorOf(artifact); started || err.Kind == ERROR_INVALID {
+				break
+			}
+
+			errnie.Warn("provider.BalancedProvider.Generate attempt %d failed on %s: %s", attempt+1, provider.name, failure.Peek("payload"))
+			route.tried = append(route.tried, provider.name)
 		}
 
-		provider.mu.Lock()
-		provider.occupied = false
-		provider.mu.Unlock()
+		accumulator.Out <- failure
 	}).Generate()
 }
 
-func (lb *BalancedProvider) getAvailableProvider() *ProviderStatus {
-	if provider := lb.handleFirstRequest(); provider != nil {
+/*
+stream passes on the response of the provider, and reports whether it started
+responding, and the error artifact it failed with, if it failed. The error
+artifact itself is left for the caller to pass on or to retry. The usage of
+the call is marked with the name of the provider, and what it cost there.
+*/
+func (lb *BalancedProvider) stream(
+	provider *ProviderStatus, breaker Breaker, params GenerationParams, artifacts []*data.Artifact, out chan<- *data.Artifact,
+) (bool, *data.Artifact) {
+	start := time.Now()
+	latency := time.Duration(0)
+
+	var failure *data.Artifact
+
+	for artifact := range provider.provider.Generate(params, artifacts) {
+		if _, ok := ErrorOf(artifact); ok {
+			failure = artifact
+			continue
+		}
+
+		if usage, ok := UsageOf(artifact); ok {
+			artifact.Poke("provider", provider.name)
+			artifact.Poke("cost", strconv.FormatFloat(provider.config.Cost.Of(usage), 'g', -1, 64))
+		}
+
+		if latency == 0 {
+			latency = time.Since(start)
+		}
+
+		out <- artifact
+	}
+
+	lb.release(provider, latency)
+
+	if failure == nil {
+		provider.succeed()
+		return true, nil
+	}
+
+	failure.Poke("provider", provider.name)
+	err, _ := ErrorOf(failure)
+	provider.fail(breaker, err)
+
+	return latency > 0, failure
+}
+
+func (lb *BalancedProvider) getAvailableProvider(route Route) *ProviderStatus {
+	if !lb.routable(route) {
+		return nil
+	}
+
+	if provider := lb.handleFirstRequest(route); provider != nil {
 		return provider
 	}
-	return lb.findBestAvailableProvider()
+
+	return lb.findBestAvailableProvider(route)
 }
 
-func (lb *BalancedProvider) handleFirstRequest() *ProviderStatus {
+/*
+routable reports whether any provider can handle the request, and has a
+circuit that lets it through, once it has room for it, so a request no
+provider can handle fails straight away instead of waiting for one.
+*/
+func (lb *BalancedProvider) routable(route Route) bool {
+	_, breaker := lb.settings()
+
+	for _, ps := range lb.snapshot() {
+		if err := route.Allows(ps.config); err != nil {
+			errnie.Debug("provider.BalancedProvider.routable %s", err)
+			continue
+		}
+
+		ps.mu.Lock()
+		allows := ps.allows(breaker)
+		ps.mu.Unlock()
+
+		if allows {
+			return true
+		}
+	}
+
+	errnie.Warn("provider.BalancedProvider.routable no provider has what the request needs")
+	return false
+}
+
+/*
+untried reports whether a provider that can handle the request, and whose
+circuit lets it through, was not tried yet.
+*/
+func (lb *BalancedProvider) untried(route Route) bool {
+	_, breaker := lb.settings()
+
+	for _, ps := range lb.snapshot() {
+		if route.Allows(ps.config) != nil || !route.untried(ps.name) {
+			continue
+		}
+
+		ps.mu.Lock()
+		allows := ps.allows(breaker)
+		ps.mu.Unlock()
+
+		if allows {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+handleFirstRequest spreads the very first request at random, so it does not
+always end up on the first provider in the config. Only the balanced policy
+does this, since the others have their own idea of which provider goes first.
+*/
+func (lb *BalancedProvider) handleFirstRequest(route Route) *ProviderStatus {
+	if route.Policy != POLICY_BALANCED {
+		return nil
+	}
+
 	lb.initMu.Lock()
 	defer lb.initMu.Unlock()
 
@@ -138,22 +355,24 @@ func (lb *BalancedProvider) handleFirstRequest() *ProviderStatus {
 		return nil
 	}
 
-	availableProviders := lb.getUnoccupiedProviders()
-	if len(availableProviders) == 0 {
+	statuses, candidates := lb.candidates(route)
+	if len(statuses) == 0 {
 		return nil
 	}
 
-	selected := availableProviders[rand.Intn(len(availableProviders))]
-	lb.markProviderAsOccupied(selected)
-	lb.initialized = true
+	selected := statuses[weighted(route, candidates)]
+	if !lb.markProviderAsOccupied(selected) {
+		return nil
+	}
 
+	lb.initialized = true
 	return selected
 }
 
-func (lb *BalancedProvider) findBestAvailableProvider() *ProviderStatus {
+func (lb *BalancedProvider) findBestAvailableProvider(route Route) *ProviderStatus {
 	maxAttempts := 10
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		if provider := lb.selectBestProvider(); provider != nil {
+		if provider := lb.selectBestProvider(route); provider != nil {
 			return provider
 		}
 		errnie.Warn("all providers occupied or in cooldown, attempt %d, waiting...", attempt+1)
@@ -164,39 +383,67 @@ func (lb *BalancedProvider) findBestAvailableProvider() *ProviderStatus {
 	return nil
 }
 
-func (lb *BalancedProvider) selectBestProvider() *ProviderStatus {
-	var bestProvider *ProviderStatus
-	oldestUse := time.Now()
-	cooldownPeriod := 60 * time.Second
-	maxFailures := 3
+/*
+selectBestProvider has the policy of the route pick from the providers that
+can handle the request and have room for it.
+*/
+func (lb *BalancedProvider) selectBestProvider(route Route) *ProviderStatus {
+	statuses, candidates := lb.candidates(route)
+	if len(statuses) == 0 {
+		return nil
+	}
 
-	for _, ps := range lb.providers {
-		ps.mu.Lock()
+	selected := statuses[policyFor(route.Policy)(route, candidates)]
 
-		if !lb.isProviderAvailable(ps, cooldownPeriod, maxFailures) {
-			ps.mu.Unlock()
+	// Another request can take the last room on the provider in the meantime,
+	// in which case the caller tries again.
+	if !lb.markProviderAsOccupied(selected) {
+		return nil
+	}
+
+	return selected
+}
+
+/*
+candidates returns the providers that can handle the request and have room
+for it, with the state the policy picks by.
+*/
+func (lb *BalancedProvider) candidates(route Route) ([]*ProviderStatus, []Candidate) {
+	_, breaker := lb.settings()
+
+	statuses := make([]*ProviderStatus, 0)
+	candidates := make([]Candidate, 0)
+
+	for _, ps := range lb.snapshot() {
+		if route.Allows(ps.config) != nil || !route.untried(ps.name) {
 			continue
 		}
 
-		if lb.isBetterProvider(ps, bestProvider, oldestUse) {
-			bestProvider = ps
-			oldestUse = ps.lastUsed
+		ps.mu.Lock()
+
+		if lb.isProviderAvailable(ps, breaker) {
+			statuses = append(statuses, ps)
+			candidates = append(candidates, Candidate{
+				Name:     ps.name,
+				Config:   ps.config,
+				InFlight: ps.inFlight,
+				Failures: ps.failures,
+				LastUsed: ps.lastUsed,
+				Latency:  ps.latency,
+			})
 		}
-		ps.mu.Unlock()
-	}
 
-	if bestProvider != nil {
-		lb.markProviderAsOccupied(bestProvider)
+		ps.mu.Unlock()
 	}
 
-	return bestProvider
+	return statuses, candidates
 }
 
 func (lb *BalancedProvider) getUnoccupiedProviders() []*ProviderStatus {
 	available := make([]*ProviderStatus, 0)
-	for _, ps := range lb.providers {
+	for _, ps := range lb.snapshot() {
 		ps.mu.Lock()
-		if !ps.occupied {
+		if !ps.full() {
 			available = append(available, ps)
 		}
 		ps.mu.Unlock()
@@ -204,31 +451,112 @@ func (lb *BalancedProvider) getUnoccupiedProviders() []*ProviderStatus {
 	return available
 }
 
-func (lb *BalancedProvider) isProviderAvailable(ps *ProviderStatus, cooldownPeriod time.Duration, maxFailures int) bool {
-	if ps.occupied {
-		return false
-	}
+/*
+isProviderAvailable reports whether the provider has room for a request, and
+its circuit lets it through. The caller holds the lock.
+*/
+func (lb *BalancedProvider) isProviderAvailable(ps *ProviderStatus, breaker Breaker) bool {
+	return !ps.full() && ps.allows(breaker)
+}
 
-	if ps.failures >= maxFailures && time.Since(ps.lastUsed) < cooldownPeriod {
+/*
+markProviderAsOccupied takes up room on the provider for a request, and
+reports false when there is none left.
+*/
+func (lb *BalancedProvider) markProviderAsOccupied(ps *ProviderStatus) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// A half open circuit lets through a single probe, which another request
+	// can have become in the meantime.
+	if ps.full() || (ps.state == CIRCUIT_HALF_OPEN && ps.inFlight > 0) {
 		return false
 	}
 
-	if ps.failures >= maxFailures && time.Since(ps.lastUsed) >= cooldownPeriod {
-		ps.failures = 0
+	ps.inFlight++
+	ps.lastUsed = time.Now()
+	return true
+}
+
+/*
+release frees up the room the request took on the provider, and averages in
+how long it took to start responding, unless it never did.
+*/
+func (lb *BalancedProvider) release(ps *ProviderStatus, latency time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.inFlight--
+
+	switch {
+	case latency == 0:
+	case ps.latency == 0:
+		ps.latency = latency
+	default:
+		ps.latency = (ps.latency*7 + latency*3) / 10
 	}
+}
 
-	return true
+/*
+full reports whether the provider has as many requests in flight as its
+concurrency allows. The caller holds the lock.
+*/
+func (ps *ProviderStatus) full() bool {
+	return ps.inFlight >= max(ps.config.Concurrency, 1)
 }
 
-func (lb *BalancedProvider) isBetterProvider(candidate, current *ProviderStatus, oldestUse time.Time) bool {
-	return current == nil ||
-		candidate.failures < current.failures ||
-		(candidate.failures == current.failures && candidate.lastUsed.Before(oldestUse))
+/*
+ProviderHealth is how a provider is doing, as reported by Status.
+*/
+type ProviderHealth struct {
+	Name        string        `json:"name"`
+	Type        string        `json:"type"`
+	Model       string        `json:"model"`
+	State       string        `json:"state"`
+	InFlight    int           `json:"in_flight"`
+	Concurrency int           `json:"concurrency"`
+	Failures    int           `json:"failures"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	Latency     time.Duration `json:"latency"`
+	LastUsed    time.Time     `json:"last_used"`
+	LastFailure time.Time     `json:"last_failure"`
+	LastError   string        `json:"last_error,omitempty"`
 }
 
-func (lb *BalancedProvider) markProviderAsOccupied(ps *ProviderStatus) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	ps.occupied = true
-	ps.lastUsed = time.Now()
+/*
+Status reports how every provider is doing, in the order of the config.
+*/
+func (lb *BalancedProvider) Status() []ProviderHealth {
+	statuses := lb.snapshot()
+	health := make([]ProviderHealth, 0, len(statuses))
+
+	for _, ps := range statuses {
+		ps.mu.Lock()
+
+		state := ps.state
+		if state == "" {
+			state = CIRCUIT_CLOSED
+		}
+
+		health = append(health, ProviderHealth{
+			Name:        ps.name,
+			Type:        ps.config.Type,
+			Model:       ps.config.Model,
+			State:       state,
+			InFlight:    ps.inFlight,
+			Concurrency: max(ps.config.Concurrency, 1),
+			Failures:    ps.failures,
+			Requests:    ps.requests,
+			Errors:      ps.errors,
+			Latency:     ps.latency,
+			LastUsed:    ps.lastUsed,
+			LastFailure: ps.lastFailure,
+			LastError:   ps.lastError,
+		})
+
+		ps.mu.Unlock()
+	}
+
+	return health
 }
@@ -13,19 +13,17 @@ func TestBalancedProvider(t *testing.T) {
 			providers: []*ProviderStatus{
 				{
 					name:     "test-provider-1",
-					occupied: false,
 					failures: 0,
 					lastUsed: time.Now().Add(-2 * time.Hour),
 				},
 				{
 					name:     "test-provider-2",
-					occupied: false,
 					failures: 2,
 					lastUsed: time.Now().Add(-1 * time.Hour),
 				},
 				{
 					name:     "test-provider-3",
-					occupied: true,
+					inFlight: 1,
 					failures: 0,
 					lastUsed: time.Now(),
 				},
@@ -33,14 +31,13 @@ func TestBalancedProvider(t *testing.T) {
 		}
 
 		Convey("When checking provider availability", func() {
-			cooldownPeriod := 60 * time.Second
-			maxFailures := 3
+			breaker := Breaker{Threshold: 3, Cooldown: 60 * time.Second}
 
 			Convey("Should identify available providers correctly", func() {
-				available := bp.isProviderAvailable(bp.providers[0], cooldownPeriod, maxFailures)
+				available := bp.isProviderAvailable(bp.providers[0], breaker)
 				So(available, ShouldBeTrue)
 
-				occupied := bp.isProviderAvailable(bp.providers[2], cooldownPeriod, maxFailures)
+				occupied := bp.isProviderAvailable(bp.providers[2], breaker)
 				So(occupied, ShouldBeFalse)
 			})
 		})
@@ -49,7 +46,10 @@ func TestBalancedProvider(t *testing.T) {
 			oldestUse := time.Now()
 
 			Convey("Should prefer providers with fewer failures", func() {
-				better := bp.isBetterProvider(bp.providers[0], bp.providers[1], oldestUse)
+				better := healthier(
+					Candidate{Failures: bp.providers[0].failures, LastUsed: bp.providers[0].lastUsed},
+					Candidate{Failures: bp.providers[1].failures, LastUsed: oldestUse},
+				)
 				So(better, ShouldBeTrue)
 			})
 		})
@@ -63,13 +63,13 @@ func TestBalancedProvider(t *testing.T) {
 
 			Convey("Should not include occupied providers", func() {
 				for _, p := range unoccupied {
-					So(p.occupied, ShouldBeFalse)
+					So(p.inFlight, ShouldEqual, 0)
 				}
 			})
 		})
 
 		Convey("When selecting best provider", func() {
-			best := bp.selectBestProvider()
+			best := bp.selectBestProvider(Route{Policy: POLICY_BALANCED})
 
 			Convey("Should select provider with fewest failures and oldest last use", func() {
 				So(best, ShouldNotBeNil)
@@ -77,7 +77,7 @@ func TestBalancedProvider(t *testing.T) {
 			})
 
 			Convey("Should mark selected provider as occupied", func() {
-				So(best.occupied, ShouldBeTrue)
+				So(best.inFlight, ShouldEqual, 1)
 				So(time.Since(best.lastUsed), ShouldBeLessThan, time.Second)
 			})
 		})
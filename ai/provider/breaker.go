@@ -0,0 +1,177 @@
+package provider
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+The states of the circuit breaker of a provider. A closed circuit lets every
+request through. Once the provider fails often enough in a row, the circuit
+opens and lets nothing through, until the cooldown has passed and it is half
+open, which lets through a single request to probe whether the provider is
+back. When the probe succeeds the circuit closes, and when it fails it opens
+again.
+*/
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half_open"
+)
+
+/*
+Retry is how often the balanced provider tries a request that fails before its
+first token, and how long it backs off before trying a provider it already
+tried. The backoff doubles with every attempt, up to MaxBackoff.
+*/
+type Retry struct {
+	Attempts   int           `mapstructure:"attempts"`
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+/*
+Breaker is how many failures in a row open the circuit of a provider, and how
+long it stays open.
+*/
+type Breaker struct {
+	Threshold int           `mapstructure:"threshold"`
+	Cooldown  time.Duration `mapstructure:"cooldown"`
+}
+
+/*
+NewConfigRetry reads `ai.retry` from the config, filling in the defaults.
+*/
+func NewConfigRetry() Retry {
+	retry := Retry{}
+
+	if err := viper.GetViper().UnmarshalKey("ai.retry", &retry); err != nil {
+		errnie.Warn("provider.NewConfigRetry %s", err)
+	}
+
+	return retry.withDefaults()
+}
+
+/*
+NewConfigBreaker reads `ai.breaker` from the config, filling in the defaults.
+*/
+func NewConfigBreaker() Breaker {
+	breaker := Breaker{}
+
+	if err := viper.GetViper().UnmarshalKey("ai.breaker", &breaker); err != nil {
+		errnie.Warn("provider.NewConfigBreaker %s", err)
+	}
+
+	return breaker.withDefaults()
+}
+
+func (retry Retry) withDefaults() Retry {
+	if retry.Attempts < 1 {
+		retry.Attempts = 3
+	}
+
+	if retry.Backoff <= 0 {
+		retry.Backoff = 500 * time.Millisecond
+	}
+
+	if retry.MaxBackoff <= 0 {
+		retry.MaxBackoff = 10 * time.Second
+	}
+
+	return retry
+}
+
+func (breaker Breaker) withDefaults() Breaker {
+	if breaker.Threshold < 1 {
+		breaker.Threshold = 3
+	}
+
+	if breaker.Cooldown <= 0 {
+		breaker.Cooldown = 60 * time.Second
+	}
+
+	return breaker
+}
+
+/*
+delay is how long to back off before the attempt, with up to half of it added
+at random, so requests that failed together do not all come back together.
+*/
+func (retry Retry) delay(attempt int) time.Duration {
+	delay := retry.Backoff
+
+	for range attempt - 1 {
+		if delay *= 2; delay >= retry.MaxBackoff {
+			delay = retry.MaxBackoff
+			break
+		}
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+/*
+allows reports whether the circuit lets a request through, moving an open
+circuit to half open once the cooldown has passed. The caller holds the lock.
+*/
+func (ps *ProviderStatus) allows(breaker Breaker) bool {
+	switch ps.state {
+	case CIRCUIT_OPEN:
+		if time.Since(ps.openedAt) < breaker.Cooldown {
+			return false
+		}
+
+		ps.state = CIRCUIT_HALF_OPEN
+		return ps.inFlight == 0
+	case CIRCUIT_HALF_OPEN:
+		return ps.inFlight == 0
+	}
+
+	return true
+}
+
+/*
+succeed closes the circuit, and forgets about earlier failures.
+*/
+func (ps *ProviderStatus) succeed() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.requests++
+	ps.failures = 0
+	ps.state = CIRCUIT_CLOSED
+}
+
+/*
+fail records the failure, and opens the circuit when the provider failed too
+often in a row, or failed the probe of a half open circuit. An invalid request
+is the fault of the request, so it is recorded, but not held against the
+provider.
+*/
+func (ps *ProviderStatus) fail(breaker Breaker, err *ProviderError) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.requests++
+	ps.errors++
+	ps.lastError = err.Error()
+	ps.lastFailure = time.Now()
+
+	if err.Kind == ERROR_INVALID {
+		return
+	}
+
+	ps.failures++
+
+	if ps.state == CIRCUIT_HALF_OPEN || ps.failures >= breaker.Threshold {
+		if ps.state != CIRCUIT_OPEN {
+			errnie.Warn("provider.ProviderStatus.fail opening the circuit of %s: %s", ps.name, err)
+		}
+
+		ps.state = CIRCUIT_OPEN
+		ps.openedAt = time.Now()
+	}
+}
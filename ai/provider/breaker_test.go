@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+/*
+midstream is a fake provider that gets a token out before it fails.
+*/
+type midstream struct {
+	calls int
+}
+
+func (midstream *midstream) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	midstream.calls++
+	out := make(chan *data.Artifact, 2)
+
+	out <- data.New("midstream", "assistant", "model", []byte("half"))
+	out <- NewErrorArtifact("midstream", "model", errors.New("connection reset"))
+	close(out)
+
+	return out
+}
+
+func failing(name string, failures int, kind string) *ProviderStatus {
+	return &ProviderStatus{
+		name:   name,
+		config: ProviderConfig{Name: name},
+		provider: NewScriptedProvider(&Script{
+			Responses: []string{name},
+			Failures:  failures,
+			Err:       &ProviderError{Provider: name, Kind: kind, Err: errors.New(kind)},
+		}),
+	}
+}
+
+func TestRetry(t *testing.T) {
+	Convey("Given a retry", t, func() {
+		retry := Retry{Attempts: 5, Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+		Convey("It should back off longer with every attempt, up to the maximum", func() {
+			So(retry.delay(1), ShouldBeBetweenOrEqual, 100*time.Millisecond, 150*time.Millisecond)
+			So(retry.delay(2), ShouldBeBetweenOrEqual, 200*time.Millisecond, 300*time.Millisecond)
+			So(retry.delay(4), ShouldBeBetweenOrEqual, 300*time.Millisecond, 450*time.Millisecond)
+		})
+
+		Convey("It should fill in the defaults", func() {
+			So(Retry{}.withDefaults().Attempts, ShouldEqual, 3)
+			So(Breaker{}.withDefaults().Cooldown, ShouldEqual, 60*time.Second)
+		})
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("Given a provider with a circuit breaker", t, func() {
+		breaker := Breaker{Threshold: 2, Cooldown: time.Minute}
+		ps := &ProviderStatus{name: "test"}
+		err := &ProviderError{Kind: ERROR_SERVER, Err: errors.New("down")}
+
+		Convey("It should open the circuit after failing too often in a row", func() {
+			ps.fail(breaker, err)
+			So(ps.allows(breaker), ShouldBeTrue)
+
+			ps.fail(breaker, err)
+			So(ps.state, ShouldEqual, CIRCUIT_OPEN)
+			So(ps.allows(breaker), ShouldBeFalse)
+		})
+
+		Convey("It should not hold invalid requests against the provider", func() {
+			for range 5 {
+				ps.fail(breaker, &ProviderError{Kind: ERROR_INVALID, Err: errors.New("bad")})
+			}
+
+			So(ps.failures, ShouldEqual, 0)
+			So(ps.errors, ShouldEqual, 5)
+			So(ps.allows(breaker), ShouldBeTrue)
+		})
+
+		Convey("Once the cooldown has passed", func() {
+			ps.state = CIRCUIT_OPEN
+			ps.failures = 2
+			ps.openedAt = time.Now().Add(-2 * time.Minute)
+
+			Convey("It should let a single probe through", func() {
+				So(ps.allows(breaker), ShouldBeTrue)
+				So(ps.state, ShouldEqual, CIRCUIT_HALF_OPEN)
+
+				ps.inFlight = 1
+				So(ps.allows(breaker), ShouldBeFalse)
+			})
+
+			Convey("It should close when the probe succeeds", func() {
+				ps.allows(breaker)
+				ps.succeed()
+
+				So(ps.state, ShouldEqual, CIRCUIT_CLOSED)
+				So(ps.failures, ShouldEqual, 0)
+			})
+
+			Convey("It should open again when the probe fails", func() {
+				ps.allows(breaker)
+				ps.fail(breaker, err)
+
+				So(ps.state, ShouldEqual, CIRCUIT_OPEN)
+				So(ps.allows(breaker), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestFailover(t *testing.T) {
+	Convey("Given a balanced provider over a provider that fails", t, func() {
+		lb := &BalancedProvider{
+			initialized: true,
+			retry:       Retry{Attempts: 3, Backoff: time.Millisecond},
+			breaker:     Breaker{Threshold: 2, Cooldown: time.Minute},
+		}
+
+		Convey("It should fail over to another provider before the first token", func() {
+			lb.providers = []*ProviderStatus{
+				failing("flaky", 1, ERROR_RATE_LIMIT),
+				failing("steady", 0, ERROR_RATE_LIMIT),
+			}
+
+			So(respond(lb, GenerationParams{}), ShouldEqual, "steady")
+
+			status := lb.Status()
+			So(status[0].Errors, ShouldEqual, 1)
+			So(status[0].LastError, ShouldContainSubstring, ERROR_RATE_LIMIT)
+			So(status[1].Requests, ShouldEqual, 1)
+		})
+
+		Convey("It should back off and retry when there is no other provider", func() {
+			lb.providers = []*ProviderStatus{failing("flaky", 1, ERROR_SERVER)}
+
+			So(respond(lb, GenerationParams{}), ShouldEqual, "flaky")
+			So(lb.Status()[0].State, ShouldEqual, CIRCUIT_CLOSED)
+		})
+
+		Convey("It should open the circuit of a provider that keeps failing", func() {
+			lb.providers = []*ProviderStatus{failing("broken", 10, ERROR_SERVER)}
+
+			So(respond(lb, GenerationParams{}), ShouldEqual, ERROR_SERVER)
+
+			status := lb.Status()[0]
+			So(status.State, ShouldEqual, CIRCUIT_OPEN)
+			So(status.Errors, ShouldEqual, 2)
+		})
+
+		Convey("It should fail over, but not retry, when the provider refuses the key", func() {
+			refused := failing("refused", 10, ERROR_AUTH)
+			lb.providers = []*ProviderStatus{refused}
+
+			So(respond(lb, GenerationParams{}), ShouldEqual, ERROR_AUTH)
+			So(refused.provider.(*ScriptedProvider).Prompts(), ShouldHaveLength, 1)
+
+			lb.providers = []*ProviderStatus{failing("refused", 10, ERROR_AUTH), failing("accepted", 0, ERROR_AUTH)}
+			So(respond(lb, GenerationParams{}), ShouldEqual, "accepted")
+		})
+
+		Convey("It should not retry a request that is invalid", func() {
+			invalid := failing("strict", 1, ERROR_INVALID)
+			lb.providers = []*ProviderStatus{invalid, failing("lenient", 0, ERROR_INVALID)}
+
+			So(respond(lb, GenerationParams{}), ShouldEqual, ERROR_INVALID)
+			So(invalid.provider.(*ScriptedProvider).Prompts(), ShouldHaveLength, 1)
+		})
+
+		Convey("It should pass on an error after the first token, instead of retrying", func() {
+			broken := &midstream{}
+			lb.providers = []*ProviderStatus{{name: "midstream", config: ProviderConfig{Name: "midstream"}, provider: broken}}
+
+			artifacts := make([]*data.Artifact, 0)
+
+			for artifact := range lb.Generate(GenerationParams{}, nil) {
+				artifacts = append(artifacts, artifact)
+			}
+
+			So(artifacts, ShouldHaveLength, 2)
+			So(artifacts[0].Peek("payload"), ShouldEqual, "half")
+
+			err, ok := ErrorOf(artifacts[1])
+			So(ok, ShouldBeTrue)
+			So(err.Provider, ShouldEqual, "midstream")
+			So(broken.calls, ShouldEqual, 1)
+		})
+
+		Convey("It should report when there is no provider at all", func() {
+			So(respond(lb, GenerationParams{}), ShouldEqual, ERROR_UNAVAILABLE)
+		})
+	})
+}
@@ -0,0 +1,456 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+CacheConfig is how the completions of a provider are cached. Completions are
+kept for TTL, or forever when it is zero, and requests with an artifact in
+one of the Skip scopes are never cached.
+*/
+type CacheConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Dir     string        `mapstructure:"dir"`
+	TTL     time.Duration `mapstructure:"ttl"`
+	Skip    []string      `mapstructure:"skip"`
+}
+
+/*
+NewConfigCacheConfig reads `ai.cache` from the config, with the completions
+kept in ~/.amsh/cache when no directory is set.
+*/
+func NewConfigCacheConfig() CacheConfig {
+	config := CacheConfig{}
+
+	if err := viper.GetViper().UnmarshalKey("ai.cache", &config); err != nil {
+		errnie.Warn("provider.NewConfigCacheConfig %s", err)
+	}
+
+	home, _ := os.UserHomeDir()
+
+	if config.Dir == "" {
+		config.Dir = filepath.Join(home, ".amsh", "cache")
+	}
+
+	if rest, ok := strings.CutPrefix(config.Dir, "~/"); ok {
+		config.Dir = filepath.Join(home, rest)
+	}
+
+	return config
+}
+
+/*
+CacheStore is where the cache keeps completions, by key. Load returns an
+error that is os.ErrNotExist when there is nothing under the key.
+*/
+type CacheStore interface {
+	Load(key string) ([]byte, error)
+	Save(key string, value []byte) error
+	Delete(key string) error
+}
+
+/*
+DiskStore keeps completions as files in a directory, named after their key.
+*/
+type DiskStore struct {
+	root string
+}
+
+func NewDiskStore(root string) *DiskStore {
+	return &DiskStore{root: root}
+}
+
+func (store *DiskStore) Load(key string) ([]byte, error) {
+	return os.ReadFile(store.path(key))
+}
+
+/*
+Save writes the value to a temporary file first, and moves it in place, so a
+completion that is being saved is never replayed half written.
+*/
+func (store *DiskStore) Save(key string, value []byte) error {
+	if err := os.MkdirAll(store.root, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(store.root, key+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), store.path(key))
+}
+
+func (store *DiskStore) Delete(key string) error {
+	return os.Remove(store.path(key))
+}
+
+func (store *DiskStore) path(key string) string {
+	return filepath.Join(store.root, key+".json")
+}
+
+/*
+CacheStats counts what the cache did since it was made. Skips are requests
+that were opted out by their scope, and expired are completions that were
+found, but were too old to replay.
+*/
+type CacheStats struct {
+	Hits    int `json:"hits"`
+	Misses  int `json:"misses"`
+	Stores  int `json:"stores"`
+	Skips   int `json:"skips"`
+	Expired int `json:"expired"`
+}
+
+/*
+Cache is a Provider that replays the completions of the provider it wraps for
+requests it saw before, so identical prompts are not paid for twice. Requests
+are identical when their artifacts have the same roles, scopes and payloads,
+and their params would sample the same way. Routing params are left out, as
+they pick the provider, but do not change the request. Only completions that
+streamed without an error are cached, and a replayed completion streams the
+same artifacts, marked with a `cache` attribute of `hit`.
+*/
+type Cache struct {
+	provider Provider
+	store    CacheStore
+	config   CacheConfig
+	stats    CacheStats
+	mu       sync.RWMutex
+}
+
+var (
+	cachedProviderInstance atomic.Pointer[Cache]
+	onceCachedProvider     sync.Once
+)
+
+func NewCache(provider Provider, store CacheStore, config CacheConfig) *Cache {
+	return &Cache{
+		provider: provider,
+		store:    store,
+		config:   config,
+	}
+}
+
+/*
+NewCachedProvider returns the shared balanced provider behind the shared
+cache, which only caches when `ai.cache.enabled` is set.
+*/
+func NewCachedProvider() *Cache {
+	onceCachedProvider.Do(func() {
+		config := NewConfigCacheConfig()
+		cachedProviderInstance.Store(NewCache(NewBalancedProvider(), NewDiskStore(config.Dir), config))
+	})
+
+	return cachedProviderInstance.Load()
+}
+
+/*
+ReloadCachedProvider reads the config of the shared cache again, unless it
+was never used.
+*/
+func ReloadCachedProvider() {
+	cache := cachedProviderInstance.Load()
+
+	if cache == nil {
+		return
+	}
+
+	config := NewConfigCacheConfig()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if config.Dir != cache.config.Dir {
+		cache.store = NewDiskStore(config.Dir)
+	}
+
+	cache.config = config
+}
+
+func (cache *Cache) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	cache.mu.RLock()
+	config, store := cache.config, cache.store
+	cache.mu.RUnlock()
+
+	if !config.Enabled {
+		return cache.provider.Generate(params, artifacts)
+	}
+
+	if cache.skips(config, artifacts) {
+		cache.count(func(stats *CacheStats) { stats.Skips++ })
+		return cache.provider.Generate(params, artifacts)
+	}
+
+	key := cacheKey(params, artifacts)
+
+	if entry, ok := cache.load(store, config, key); ok {
+		cache.count(func(stats *CacheStats) { stats.Hits++ })
+		return entry.replay(artifacts)
+	}
+
+	cache.count(func(stats *CacheStats) { stats.Misses++ })
+
+	return twoface.NewAccumulator(
+		"cache",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		entry := cacheEntry{Created: time.Now()}
+		failed := false
+
+		for artifact := range cache.provider.Generate(params, artifacts) {
+			if _, ok := ErrorOf(artifact); ok {
+				failed = true
+			}
+
+			entry.Artifacts = append(entry.Artifacts, newCachedArtifact(artifact))
+			accumulator.Out <- artifact
+		}
+
+		if failed || len(entry.Artifacts) == 0 {
+			return
+		}
+
+		if err := cache.save(store, key, entry); err != nil {
+			errnie.Warn("provider.Cache.Generate %s", err)
+			return
+		}
+
+		cache.count(func(stats *CacheStats) { stats.Stores++ })
+	}).Generate()
+}
+
+/*
+Stats returns what the cache did so far.
+*/
+func (cache *Cache) Stats() CacheStats {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	return cache.stats
+}
+
+func (cache *Cache) count(update func(*CacheStats)) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	update(&cache.stats)
+}
+
+/*
+skips reports whether one of the artifacts is in a scope that opted out of
+caching.
+*/
+func (cache *Cache) skips(config CacheConfig, artifacts []*data.Artifact) bool {
+	for _, artifact := range artifacts {
+		if slices.Contains(config.Skip, artifact.Peek("scope")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+load returns the completion cached under the key, removing it when it has
+expired, or cannot be read.
+*/
+func (cache *Cache) load(store CacheStore, config CacheConfig, key string) (cacheEntry, bool) {
+	entry := cacheEntry{}
+
+	buf, err := store.Load(key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			errnie.Warn("provider.Cache.load %s", err)
+		}
+
+		return entry, false
+	}
+
+	if err = json.Unmarshal(buf, &entry); err != nil {
+		errnie.Warn("provider.Cache.load %s: %s", key, err)
+		store.Delete(key)
+		return entry, false
+	}
+
+	if config.TTL > 0 && time.Since(entry.Created) > config.TTL {
+		cache.count(func(stats *CacheStats) { stats.Expired++ })
+		store.Delete(key)
+		return entry, false
+	}
+
+	return entry, true
+}
+
+func (cache *Cache) save(store CacheStore, key string, entry cacheEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return store.Save(key, buf)
+}
+
+/*
+cacheEntry is a completion as it was streamed, and when.
+*/
+type cacheEntry struct {
+	Created   time.Time        `json:"created"`
+	Artifacts []cachedArtifact `json:"artifacts"`
+}
+
+/*
+cachedArtifact is an artifact of a completion as it is kept in the cache,
+without the parts attached to it, which are left to the artifacts they came
+with, rather than written to disk with every completion.
+*/
+type cachedArtifact struct {
+	Origin     string            `json:"origin"`
+	Role       string            `json:"role"`
+	Scope      string            `json:"scope"`
+	Payload    string            `json:"payload"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func newCachedArtifact(artifact *data.Artifact) cachedArtifact {
+	cached := cachedArtifact{
+		Origin:     artifact.Peek("origin"),
+		Role:       artifact.Peek("role"),
+		Scope:      artifact.Peek("scope"),
+		Payload:    artifact.Peek("payload"),
+		Attributes: make(map[string]string),
+	}
+
+	// The lineage is that of the completion that was cached, and a replay is
+	// derived from the artifacts it replays for instead.
+	artifact.Range(func(key, value string) bool {
+		if key != data.ATTRIBUTE_PARENTS && key != data.ATTRIBUTE_TRACE {
+			cached.Attributes[key] = value
+		}
+
+		return true
+	})
+
+	return cached
+}
+
+/*
+replay streams the cached completion again, as new artifacts.
+*/
+func (entry cacheEntry) replay(artifacts []*data.Artifact) <-chan *data.Artifact {
+	return twoface.NewAccumulator(
+		"cache",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		for _, cached := range entry.Artifacts {
+			artifact := data.New(cached.Origin, cached.Role, cached.Scope, []byte(cached.Payload))
+
+			artifact.PokeAll(cached.Attributes)
+			artifact.Poke("cache", "hit")
+			accumulator.Out <- artifact
+		}
+	}).Generate()
+}
+
+/*
+cacheKey hashes what makes a request what it is. Payloads are normalized, so
+requests that only differ in line endings, or in whitespace around them, are
+the same request. Tool calls and their results are keyed on the tool and the
+call they belong to as well, as their payloads are only the arguments and the
+result.
+*/
+func cacheKey(params GenerationParams, artifacts []*data.Artifact) string {
+	type message struct {
+		Role    string   `json:"role"`
+		Scope   string   `json:"scope"`
+		Payload string   `json:"payload"`
+		Parts   []string `json:"parts,omitempty"`
+		Name    string   `json:"name,omitempty"`
+		CallID  string   `json:"tool_call_id,omitempty"`
+	}
+
+	request := struct {
+		Temperature      *float64         `json:"temperature"`
+		TopP             *float64         `json:"top_p"`
+		TopK             *int             `json:"top_k"`
+		PresencePenalty  *float64         `json:"presence_penalty"`
+		FrequencyPenalty *float64         `json:"frequency_penalty"`
+		MaxTokens        int              `json:"max_tokens"`
+		Stop             []string         `json:"stop"`
+		Tools            []ToolDefinition `json:"tools"`
+		Format           *ResponseFormat  `json:"format"`
+		Messages         []message        `json:"messages"`
+	}{
+		Temperature:      params.Temperature,
+		TopP:             params.TopP,
+		TopK:             params.TopK,
+		PresencePenalty:  params.PresencePenalty,
+		FrequencyPenalty: params.FrequencyPenalty,
+		MaxTokens:        params.MaxTokens,
+		Stop:             params.Stop,
+		Tools:            params.Tools,
+		Format:           params.Format,
+		Messages:         make([]message, 0, len(artifacts)),
+	}
+
+	for _, artifact := range artifacts {
+		parts := make([]string, 0)
+
+		for _, part := range artifact.Parts() {
+			digest := sha256.Sum256(part.Data)
+			parts = append(parts, part.MIME+":"+hex.EncodeToString(digest[:]))
+		}
+
+		request.Messages = append(request.Messages, message{
+			Role:    artifact.Peek("role"),
+			Scope:   artifact.Peek("scope"),
+			Payload: strings.TrimSpace(strings.ReplaceAll(artifact.Peek("payload"), "\r\n", "\n")),
+			Parts:   parts,
+			Name:    artifact.Peek("name"),
+			CallID:  artifact.Peek("tool_call_id"),
+		})
+	}
+
+	buf, err := json.Marshal(request)
+	if err != nil {
+		errnie.Error(err)
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
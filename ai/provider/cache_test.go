@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+func complete(provider Provider, params GenerationParams, artifacts ...*data.Artifact) []*data.Artifact {
+	completion := make([]*data.Artifact, 0)
+
+	for artifact := range provider.Generate(params, artifacts) {
+		completion = append(completion, artifact)
+	}
+
+	return completion
+}
+
+func TestCache(t *testing.T) {
+	Convey("Given a cache in front of a provider", t, func() {
+		scripted := NewScriptedProvider(&Script{Responses: []string{"first answer", "second answer"}})
+		config := CacheConfig{Enabled: true, TTL: time.Hour, Skip: []string{"secret"}}
+		cache := NewCache(scripted, NewDiskStore(t.TempDir()), config)
+
+		system := data.New("test", "system", "prompt", []byte("You are a helpdesk."))
+		question := data.New("test", "user", "prompt", []byte("Label this ticket."))
+		params := GenerationParams{Temperature: utils.Float64Ptr(0.2)}
+
+		Convey("It should replay a completion for a request it saw before", func() {
+			first := complete(cache, params, system, question)
+			second := complete(cache, params, system, data.New("test", "user", "prompt", []byte("Label this ticket.\r\n")))
+
+			So(first, ShouldHaveLength, 3)
+			So(second, ShouldHaveLength, 3)
+			So(second[0].Peek("payload")+second[1].Peek("payload"), ShouldEqual, "first answer")
+			So(second[0].Peek("cache"), ShouldEqual, "hit")
+			So(scripted.Prompts(), ShouldHaveLength, 1)
+			So(cache.Stats(), ShouldResemble, CacheStats{Hits: 1, Misses: 1, Stores: 1})
+		})
+
+		Convey("It should not replay the lineage of the completion it cached", func() {
+			answer := data.New("test", "assistant", "answer", []byte("bug")).DeriveFrom(system, question)
+			answer.Poke("chain", "test")
+
+			So(newCachedArtifact(answer).Attributes, ShouldResemble, map[string]string{"chain": "test"})
+		})
+
+		Convey("It should not replay for a request that samples differently", func() {
+			complete(cache, params, system, question)
+			complete(cache, GenerationParams{Temperature: utils.Float64Ptr(0.9)}, system, question)
+
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+		})
+
+		Convey("It should not mind how the request is routed", func() {
+			complete(cache, params, system, question)
+
+			routed := params
+			routed.Policy = POLICY_CHEAPEST
+			complete(cache, routed, system, question)
+
+			So(scripted.Prompts(), ShouldHaveLength, 1)
+		})
+
+		Convey("It should keep tool calls as they were", func() {
+			tools := NewScriptedProvider(&Script{Responses: []string{"```json\n{\"tool\": \"lookup\", \"arguments\": {\"id\": 1}}\n```"}})
+			cache.provider = tools
+			params.Tools = []ToolDefinition{{Name: "lookup"}}
+
+			complete(cache, params, system, question)
+			replayed := complete(cache, params, system, question)
+
+			call, ok := ToolCallOf(replayed[len(replayed)-2])
+			So(ok, ShouldBeTrue)
+			So(call.Name, ShouldEqual, "lookup")
+			So(tools.Prompts(), ShouldHaveLength, 1)
+		})
+
+		Convey("It should not replay for tool calls that only differ in the tool", func() {
+			lookup := NewToolCallArtifact("test", "test", ToolCall{ID: "call_1", Name: "lookup", Arguments: map[string]any{"id": 1}})
+			remove := NewToolCallArtifact("test", "test", ToolCall{ID: "call_1", Name: "delete", Arguments: map[string]any{"id": 1}})
+			result := NewToolResultArtifact("test", ToolCall{ID: "call_1", Name: "lookup"}, "done")
+			otherCall := NewToolResultArtifact("test", ToolCall{ID: "call_2", Name: "lookup"}, "done")
+
+			So(cacheKey(params, []*data.Artifact{question, lookup}), ShouldNotEqual, cacheKey(params, []*data.Artifact{question, remove}))
+			So(cacheKey(params, []*data.Artifact{question, result}), ShouldNotEqual, cacheKey(params, []*data.Artifact{question, otherCall}))
+		})
+
+		Convey("It should not cache a completion that failed", func() {
+			failing := NewScriptedProvider(&Script{Responses: []string{"fine"}, Failures: 1})
+			cache.provider = failing
+
+			_, ok := ErrorOf(complete(cache, params, question)[0])
+			So(ok, ShouldBeTrue)
+			So(complete(cache, params, question)[0].Peek("payload"), ShouldEqual, "fine")
+			So(cache.Stats().Stores, ShouldEqual, 1)
+		})
+
+		Convey("It should not replay a completion that expired", func() {
+			cache.config.TTL = time.Nanosecond
+
+			complete(cache, params, question)
+			time.Sleep(time.Millisecond)
+			complete(cache, params, question)
+
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+			So(cache.Stats().Expired, ShouldEqual, 1)
+		})
+
+		Convey("It should leave requests in a scope that opted out alone", func() {
+			secret := data.New("test", "user", "secret", []byte("hunter2"))
+
+			complete(cache, params, secret)
+			complete(cache, params, secret)
+
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+			So(cache.Stats(), ShouldResemble, CacheStats{Skips: 2})
+		})
+
+		Convey("It should pass everything through when it is disabled", func() {
+			cache.config.Enabled = false
+
+			complete(cache, params, question)
+			complete(cache, params, question)
+
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+			So(cache.Stats(), ShouldResemble, CacheStats{})
+		})
+	})
+}
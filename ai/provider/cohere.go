@@ -3,11 +3,14 @@ package provider
 import (
 	"context"
 	"io"
+	"strings"
 
 	cohereCore "github.com/cohere-ai/cohere-go/v2"
 	cohereclient "github.com/cohere-ai/cohere-go/v2/client"
+	"github.com/google/uuid"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/amsh/utils"
 	"github.com/theapemachine/errnie"
 )
 
@@ -37,7 +40,7 @@ func NewCohere(apiKey string, model string) *Cohere {
 		maxTokens: 4096,
 	}
 }
-func (cohere *Cohere) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
+func (cohere *Cohere) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
 	return twoface.NewAccumulator(
 		"cohere",
 		"provider",
@@ -47,19 +50,22 @@ func (cohere *Cohere) Generate(artifacts []*data.Artifact) <-chan *data.Artifact
 		defer close(accumulator.Out)
 
 		errnie.Log("===START===")
-		prompt := cohere.convertMessagesToCoherePrompt(artifacts)
+		request := cohere.buildRequest(params, artifacts)
 		errnie.Log("===END===")
 
-		stream, err := cohere.client.ChatStream(context.Background(), &cohereCore.ChatStreamRequest{
-			Message: prompt,
-			Model:   &cohere.model,
-		})
+		stream, err := cohere.client.ChatStream(context.Background(), request)
 		if err != nil {
 			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("cohere", cohere.model, err)
 			return
 		}
 		defer stream.Close()
 
+		var (
+			content                   strings.Builder
+			inputTokens, outputTokens float64
+		)
+
 		for {
 			resp, err := stream.Recv()
 			if err == io.EOF {
@@ -67,29 +73,180 @@ func (cohere *Cohere) Generate(artifacts []*data.Artifact) <-chan *data.Artifact
 			}
 			if err != nil {
 				errnie.Error(err)
-				break
+				accumulator.Out <- NewErrorArtifact("cohere", cohere.model, err)
+				return
+			}
+
+			if resp.StreamEnd != nil {
+				inputTokens, outputTokens = cohere.billed(resp.StreamEnd)
 			}
 
 			if resp.TextGeneration != nil {
+				content.WriteString(resp.TextGeneration.Text)
 				response := data.New("cohere", "assistant", cohere.model, []byte(resp.TextGeneration.Text))
 				accumulator.Out <- response
 			}
+
+			if resp.ToolCallsGeneration != nil {
+				for _, call := range resp.ToolCallsGeneration.ToolCalls {
+					accumulator.Out <- NewToolCallArtifact("cohere", cohere.model, ToolCall{
+						ID:        "call_" + uuid.NewString(),
+						Name:      call.Name,
+						Arguments: call.Parameters,
+					})
+				}
+			}
 		}
+
+		accumulator.Out <- NewUsageArtifact("cohere", cohere.model, newUsage(
+			int(inputTokens), int(outputTokens), artifacts, content.String(),
+		))
 	}).Generate()
 }
 
+/*
+billed returns the input and output tokens Cohere billed for the response,
+which are zero when it did not say.
+*/
+func (cohere *Cohere) billed(end *cohereCore.ChatStreamEndEvent) (input, output float64) {
+	if end.Response == nil || end.Response.Meta == nil || end.Response.Meta.BilledUnits == nil {
+		return 0, 0
+	}
+
+	billed := end.Response.Meta.BilledUnits
+
+	if billed.InputTokens != nil {
+		input = *billed.InputTokens
+	}
+
+	if billed.OutputTokens != nil {
+		output = *billed.OutputTokens
+	}
+
+	return input, output
+}
+
+/*
+buildRequest converts the artifacts to a prompt, and sets whatever the params
+ask for on the request, keeping the max tokens as the default. Cohere wants
+the call with every tool result, so results are matched to their calls by ID.
+A format uses JSON mode, without the schema, as Cohere only takes a subset of
+JSON schema.
+*/
+func (cohere *Cohere) buildRequest(params GenerationParams, artifacts []*data.Artifact) *cohereCore.ChatStreamRequest {
+	params = params.WithDefaults(GenerationParams{MaxTokens: cohere.maxTokens})
+
+	request := &cohereCore.ChatStreamRequest{
+		Message:          cohere.convertMessagesToCoherePrompt(artifacts),
+		Model:            &cohere.model,
+		Temperature:      params.Temperature,
+		P:                params.TopP,
+		K:                params.TopK,
+		PresencePenalty:  params.PresencePenalty,
+		FrequencyPenalty: params.FrequencyPenalty,
+		MaxTokens:        utils.IntPtr(params.MaxTokens),
+	}
+
+	if len(params.Stop) > 0 {
+		request.StopSequences = params.Stop
+	}
+
+	if params.Format != nil {
+		request.ResponseFormat = &cohereCore.ResponseFormat{JsonObject: &cohereCore.JsonResponseFormat{}}
+	}
+
+	for _, tool := range params.Tools {
+		request.Tools = append(request.Tools, &cohereCore.Tool{
+			Name:                 tool.Name,
+			Description:          tool.Description,
+			ParameterDefinitions: toCohereParameters(tool.Parameters),
+		})
+	}
+
+	calls := make(map[string]ToolCall)
+
+	for _, artifact := range artifacts {
+		if call, ok := ToolCallOf(artifact); ok {
+			calls[call.ID] = call
+			continue
+		}
+
+		if artifact.Peek("role") != "tool" {
+			continue
+		}
+
+		call := calls[artifact.Peek("tool_call_id")]
+
+		request.ToolResults = append(request.ToolResults, &cohereCore.ToolResult{
+			Call:    &cohereCore.ToolCall{Name: artifact.Peek("name"), Parameters: call.Arguments},
+			Outputs: []map[string]interface{}{{"result": artifact.Peek("payload")}},
+		})
+	}
+
+	return request
+}
+
+/*
+toCohereParameters converts the properties of a JSON schema to the parameter
+definitions Cohere uses, which are flat, and typed the way Python types are.
+*/
+func toCohereParameters(schema map[string]any) map[string]*cohereCore.ToolParameterDefinitionsValue {
+	properties, _ := schema["properties"].(map[string]any)
+	required := make(map[string]bool)
+
+	for _, name := range asSlice(schema["required"]) {
+		if name, ok := name.(string); ok {
+			required[name] = true
+		}
+	}
+
+	out := make(map[string]*cohereCore.ToolParameterDefinitionsValue, len(properties))
+
+	for name, property := range properties {
+		property, _ := property.(map[string]any)
+		definition := &cohereCore.ToolParameterDefinitionsValue{Type: "Dict", Required: utils.BoolPtr(required[name])}
+
+		if description, ok := property["description"].(string); ok {
+			definition.Description = &description
+		}
+
+		switch property["type"] {
+		case "string":
+			definition.Type = "str"
+		case "integer":
+			definition.Type = "int"
+		case "number":
+			definition.Type = "float"
+		case "boolean":
+			definition.Type = "bool"
+		case "array":
+			definition.Type = "List"
+		}
+
+		out[name] = definition
+	}
+
+	return out
+}
+
 // convertMessagesToCoherePrompt converts the message array into a string prompt
-// that Cohere can understand
+// that Cohere can understand, which has no room for images, so they are only
+// mentioned
 func (cohere *Cohere) convertMessagesToCoherePrompt(artifacts []*data.Artifact) string {
 	var prompt string
 	for _, artifact := range artifacts {
+		// Tool calls and their results are sent as tool results instead.
+		if artifact.Peek("scope") == "tool_call" {
+			continue
+		}
+
 		switch artifact.Peek("role") {
 		case "system":
-			prompt += "System: " + artifact.Peek("payload") + "\n"
+			prompt += "System: " + plainTextOf(artifact) + "\n"
 		case "user":
-			prompt += "Human: " + artifact.Peek("payload") + "\n"
+			prompt += "Human: " + plainTextOf(artifact) + "\n"
 		case "assistant":
-			prompt += "Assistant: " + artifact.Peek("payload") + "\n"
+			prompt += "Assistant: " + plainTextOf(artifact) + "\n"
 		}
 	}
 	return prompt
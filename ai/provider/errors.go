@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	cohereCore "github.com/cohere-ai/cohere-go/v2"
+	"github.com/cohere-ai/cohere-go/v2/core"
+	"github.com/ollama/ollama/api"
+	sdk "github.com/openai/openai-go"
+	"github.com/theapemachine/amsh/data"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+The kinds of errors a provider can fail with, whatever the backend. Rate
+limits, server errors, timeouts and network errors are transient, and worth
+trying again, as is an error that cannot be told apart. An invalid request
+fails on any provider, so it is not held against the provider that reported
+it.
+*/
+const (
+	ERROR_RATE_LIMIT  = "rate_limit"
+	ERROR_AUTH        = "auth"
+	ERROR_INVALID     = "invalid"
+	ERROR_SERVER      = "server"
+	ERROR_TIMEOUT     = "timeout"
+	ERROR_NETWORK     = "network"
+	ERROR_UNAVAILABLE = "unavailable"
+	ERROR_UNKNOWN     = "unknown"
+)
+
+/*
+ProviderError is an error from a provider, classified by Kind, with the HTTP
+status the backend responded with, when it responded at all.
+*/
+type ProviderError struct {
+	Provider string
+	Kind     string
+	Status   int
+	Err      error
+}
+
+/*
+NewProviderError classifies the error a provider failed with. An error that
+was already classified is returned as it is.
+*/
+func NewProviderError(provider string, err error) *ProviderError {
+	var providerErr *ProviderError
+
+	if errors.As(err, &providerErr) {
+		return providerErr
+	}
+
+	status := statusOf(err)
+
+	return &ProviderError{
+		Provider: provider,
+		Kind:     kindOf(status, err),
+		Status:   status,
+		Err:      err,
+	}
+}
+
+func (providerErr *ProviderError) Error() string {
+	return providerErr.Provider + ": " + providerErr.Kind + ": " + providerErr.Err.Error()
+}
+
+func (providerErr *ProviderError) Unwrap() error {
+	return providerErr.Err
+}
+
+/*
+Retryable reports whether the same request is worth trying again on the same
+provider, after backing off.
+*/
+func (providerErr *ProviderError) Retryable() bool {
+	switch providerErr.Kind {
+	case ERROR_RATE_LIMIT, ERROR_SERVER, ERROR_TIMEOUT, ERROR_NETWORK, ERROR_UNKNOWN:
+		return true
+	}
+
+	return false
+}
+
+/*
+statusOf finds the HTTP status in the error of any of the backends.
+*/
+func statusOf(err error) int {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch err := err.(type) {
+		case *sdk.Error:
+			return err.StatusCode
+		case *anthropic.Error:
+			return err.StatusCode
+		case *googleapi.Error:
+			return err.Code
+		case *core.APIError:
+			return err.StatusCode
+		case api.StatusError:
+			return err.StatusCode
+		case *api.StatusError:
+			return err.StatusCode
+		// The errors Cohere responds with embed the APIError, which does not
+		// unwrap to it, so the common ones are picked out by type.
+		case *cohereCore.TooManyRequestsError:
+			return err.StatusCode
+		case *cohereCore.UnauthorizedError:
+			return err.StatusCode
+		case *cohereCore.ForbiddenError:
+			return err.StatusCode
+		case *cohereCore.BadRequestError:
+			return err.StatusCode
+		case *cohereCore.InternalServerError:
+			return err.StatusCode
+		case *cohereCore.ServiceUnavailableError:
+			return err.StatusCode
+		case *cohereCore.GatewayTimeoutError:
+			return err.StatusCode
+		}
+	}
+
+	return 0
+}
+
+func kindOf(status int, err error) string {
+	var netErr net.Error
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ERROR_RATE_LIMIT
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return ERROR_AUTH
+	case status == http.StatusRequestTimeout, status == http.StatusGatewayTimeout:
+		return ERROR_TIMEOUT
+	case status >= 500:
+		return ERROR_SERVER
+	case status >= 400:
+		return ERROR_INVALID
+	case errors.Is(err, context.DeadlineExceeded):
+		return ERROR_TIMEOUT
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return ERROR_TIMEOUT
+		}
+
+		return ERROR_NETWORK
+	}
+
+	return ERROR_UNKNOWN
+}
+
+/*
+NewErrorArtifact returns the artifact a provider streams when it fails, so the
+failure reaches whoever consumes the stream, instead of the stream just ending.
+*/
+func NewErrorArtifact(origin, model string, err error) *data.Artifact {
+	providerErr := NewProviderError(origin, err)
+
+	artifact := data.New(origin, "error", "error", []byte(providerErr.Err.Error()))
+	artifact.Poke("model", model)
+	artifact.Poke("provider", providerErr.Provider)
+	artifact.Poke("kind", providerErr.Kind)
+	artifact.Poke("status", strconv.Itoa(providerErr.Status))
+
+	return artifact
+}
+
+/*
+ErrorOf returns the error an artifact holds, if it holds one.
+*/
+func ErrorOf(artifact *data.Artifact) (*ProviderError, bool) {
+	if artifact.Peek("role") != "error" {
+		return nil, false
+	}
+
+	status, _ := strconv.Atoi(artifact.Peek("status"))
+
+	return &ProviderError{
+		Provider: artifact.Peek("provider"),
+		Kind:     artifact.Peek("kind"),
+		Status:   status,
+		Err:      errors.New(artifact.Peek("payload")),
+	}, true
+}
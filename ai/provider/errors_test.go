@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	cohereCore "github.com/cohere-ai/cohere-go/v2"
+	"github.com/cohere-ai/cohere-go/v2/core"
+	"github.com/ollama/ollama/api"
+	sdk "github.com/openai/openai-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/googleapi"
+)
+
+func TestProviderError(t *testing.T) {
+	Convey("Given the errors of the backends", t, func() {
+		Convey("It should classify them by their status", func() {
+			for err, kind := range map[error]string{
+				&sdk.Error{StatusCode: 429}:                                            ERROR_RATE_LIMIT,
+				&anthropic.Error{StatusCode: 401}:                                      ERROR_AUTH,
+				fmt.Errorf("stream: %w", &googleapi.Error{Code: 504}):                  ERROR_TIMEOUT,
+				core.NewAPIError(500, errors.New("oops")):                              ERROR_SERVER,
+				&cohereCore.TooManyRequestsError{APIError: core.NewAPIError(429, nil)}: ERROR_RATE_LIMIT,
+				api.StatusError{StatusCode: 400}:                                       ERROR_INVALID,
+			} {
+				So(NewProviderError("test", err).Kind, ShouldEqual, kind)
+			}
+		})
+
+		Convey("It should classify those without a status by what went wrong", func() {
+			So(NewProviderError("test", context.DeadlineExceeded).Kind, ShouldEqual, ERROR_TIMEOUT)
+			So(NewProviderError("test", &net.OpError{Op: "dial", Err: errors.New("refused")}).Kind, ShouldEqual, ERROR_NETWORK)
+			So(NewProviderError("test", errors.New("oops")).Kind, ShouldEqual, ERROR_UNKNOWN)
+		})
+
+		Convey("It should only retry those that are transient", func() {
+			So(NewProviderError("test", &sdk.Error{StatusCode: 503}).Retryable(), ShouldBeTrue)
+			So(NewProviderError("test", &sdk.Error{StatusCode: 401}).Retryable(), ShouldBeFalse)
+			So(NewProviderError("test", &sdk.Error{StatusCode: 400}).Retryable(), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given an error artifact", t, func() {
+		artifact := NewErrorArtifact("test", "model", &ProviderError{
+			Provider: "test", Kind: ERROR_RATE_LIMIT, Status: 429, Err: errors.New("slow down"),
+		})
+
+		Convey("It should give the error back", func() {
+			err, ok := ErrorOf(artifact)
+
+			So(ok, ShouldBeTrue)
+			So(err.Kind, ShouldEqual, ERROR_RATE_LIMIT)
+			So(err.Status, ShouldEqual, 429)
+			So(err.Error(), ShouldEqual, "test: rate_limit: slow down")
+		})
+
+		Convey("It should not be mistaken for text", func() {
+			_, ok := ErrorOf(NewToolResultArtifact("test", ToolCall{}, "fine"))
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -1,110 +1,319 @@
-package provider
-
-import (
-	"context"
-
-	"github.com/google/generative-ai-go/genai"
-	"github.com/theapemachine/amsh/data"
-	"github.com/theapemachine/amsh/twoface"
-	"github.com/theapemachine/errnie"
-	"google.golang.org/api/option"
-)
-
-type Google struct {
-	client    *genai.Client
-	model     string
-	maxTokens int
-	system    string
-}
-
-func NewGoogle(apiKey string, model string) *Google {
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
-	if err != nil {
-		errnie.Error(err)
-		return nil
-	}
-
-	return &Google{
-		client:    client,
-		model:     model,
-		maxTokens: 4096,
-	}
-}
-
-func (g *Google) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
-	return twoface.NewAccumulator(
-		"google",
-		"provider",
-		"completion",
-		artifacts...,
-	).Yield(func(accumulator *twoface.Accumulator) {
-		defer close(accumulator.Out)
-
-		errnie.Log("===START===")
-		parts := g.convertToGoogleParts(artifacts)
-		errnie.Log("===END===")
-
-		model := g.client.GenerativeModel(g.model)
-		temp := float32(0.7) // You might want to make this configurable
-
-		// Set system message if available
-		if g.system != "" {
-			model.SystemInstruction = &genai.Content{
-				Parts: []genai.Part{genai.Text(g.system)},
-				Role:  "system",
-			}
-		}
-		model.Temperature = &temp
-
-		iter := model.GenerateContentStream(context.Background(), parts...)
-
-		for {
-			resp, err := iter.Next()
-			if err != nil {
-				if err.Error() == "iterator done" {
-					break
-				}
-				errnie.Error(err)
-				break
-			}
-
-			for _, part := range resp.Candidates[0].Content.Parts {
-				if text, ok := part.(genai.Text); ok {
-					response := data.New("google", "assistant", g.model, []byte(text))
-					accumulator.Out <- response
-				}
-			}
-		}
-	}).Generate()
-}
-
-func (g *Google) convertToGoogleParts(artifacts []*data.Artifact) []genai.Part {
-	var parts []genai.Part
-
-	for _, artifact := range artifacts {
-		role := artifact.Peek("role")
-		payload := artifact.Peek("payload")
-
-		errnie.Log("Google.Generate role %s payload %s", role, payload)
-
-		// Skip system messages as they're handled separately
-		if role == "system" {
-			g.system = payload
-			continue
-		}
-
-		content := genai.Content{
-			Parts: []genai.Part{genai.Text(payload)},
-		}
-		parts = append(parts, content.Parts...)
-	}
-
-	return parts
-}
-
-func (g *Google) Configure(config map[string]interface{}) {
-	if systemMsg, ok := config["system_message"].(string); ok {
-		g.system = systemMsg
-	}
-}
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/uuid"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/amsh/utils"
+	"github.com/theapemachine/errnie"
+	"google.golang.org/api/option"
+)
+
+type Google struct {
+	client    *genai.Client
+	model     string
+	maxTokens int
+	system    string
+}
+
+func NewGoogle(apiKey string, model string) *Google {
+	ctx := context.Background()
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		errnie.Error(err)
+		return nil
+	}
+
+	return &Google{
+		client:    client,
+		model:     model,
+		maxTokens: 4096,
+	}
+}
+
+func (g *Google) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	return twoface.NewAccumulator(
+		"google",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		system, turns := g.history(artifacts)
+
+		if system == "" {
+			system = g.system
+		}
+
+		model := g.client.GenerativeModel(g.model)
+
+		// Set system message if available
+		if system != "" {
+			model.SystemInstruction = &genai.Content{
+				Parts: []genai.Part{genai.Text(system)},
+				Role:  "system",
+			}
+		}
+
+		g.configure(model, params)
+
+		// The last turn is sent as the message, on top of the turns before it.
+		session := model.StartChat()
+		var last []genai.Part
+
+		if len(turns) > 0 {
+			session.History = turns[:len(turns)-1]
+			last = turns[len(turns)-1].Parts
+		}
+
+		iter := session.SendMessageStream(context.Background(), last...)
+
+		var (
+			content strings.Builder
+			usage   genai.UsageMetadata
+		)
+
+		for {
+			resp, err := iter.Next()
+			if err != nil {
+				if err.Error() == "iterator done" {
+					break
+				}
+				errnie.Error(err)
+				accumulator.Out <- NewErrorArtifact("google", g.model, err)
+				return
+			}
+
+			if resp.UsageMetadata != nil {
+				usage = *resp.UsageMetadata
+			}
+
+			for _, part := range resp.Candidates[0].Content.Parts {
+				switch part := part.(type) {
+				case genai.Text:
+					content.WriteString(string(part))
+					response := data.New("google", "assistant", g.model, []byte(part))
+					accumulator.Out <- response
+				case genai.FunctionCall:
+					// Gemini does not identify its calls, so they are given an ID
+					// here, to tie the result back to the call like the others.
+					accumulator.Out <- NewToolCallArtifact("google", g.model, ToolCall{
+						ID:        "call_" + uuid.NewString(),
+						Name:      part.Name,
+						Arguments: part.Args,
+					})
+				}
+			}
+		}
+
+		accumulator.Out <- NewUsageArtifact("google", g.model, newUsage(
+			int(usage.PromptTokenCount), int(usage.CandidatesTokenCount), artifacts, content.String(),
+		))
+	}).Generate()
+}
+
+/*
+configure sets whatever the params ask for on the model, keeping the
+temperature and max tokens used before params could be passed as the defaults.
+Gemini has no penalties, so those are left out, and its JSON mode cannot be
+combined with tools, so a format is only asked for natively without them.
+*/
+func (g *Google) configure(model *genai.GenerativeModel, params GenerationParams) {
+	params = params.WithDefaults(GenerationParams{
+		Temperature: utils.Float64Ptr(0.7),
+		MaxTokens:   g.maxTokens,
+	})
+
+	model.SetTemperature(float32(*params.Temperature))
+	model.SetMaxOutputTokens(int32(params.MaxTokens))
+
+	if params.TopP != nil {
+		model.SetTopP(float32(*params.TopP))
+	}
+
+	if params.TopK != nil {
+		model.SetTopK(int32(*params.TopK))
+	}
+
+	if len(params.Stop) > 0 {
+		model.StopSequences = params.Stop
+	}
+
+	if len(params.Tools) > 0 {
+		declarations := make([]*genai.FunctionDeclaration, 0, len(params.Tools))
+
+		for _, tool := range params.Tools {
+			declarations = append(declarations, &genai.FunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  toGoogleSchema(tool.Parameters, tool.Parameters),
+			})
+		}
+
+		model.Tools = []*genai.Tool{{FunctionDeclarations: declarations}}
+	}
+
+	if params.Format != nil && len(params.Tools) == 0 {
+		model.ResponseMIMEType = "application/json"
+	}
+}
+
+/*
+toGoogleSchema converts a JSON schema to the subset Gemini understands,
+resolving references against the root, since Gemini does not support them.
+*/
+func toGoogleSchema(schema map[string]any, root map[string]any) *genai.Schema {
+	if ref, ok := schema["$ref"].(string); ok {
+		defs, _ := root["$defs"].(map[string]any)
+		resolved, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+
+		if resolved == nil {
+			return &genai.Schema{Type: genai.TypeObject}
+		}
+
+		schema = resolved
+	}
+
+	out := &genai.Schema{}
+	out.Description, _ = schema["description"].(string)
+
+	switch schema["type"] {
+	case "string":
+		out.Type = genai.TypeString
+	case "number":
+		out.Type = genai.TypeNumber
+	case "integer":
+		out.Type = genai.TypeInteger
+	case "boolean":
+		out.Type = genai.TypeBoolean
+	case "array":
+		out.Type = genai.TypeArray
+		items, _ := schema["items"].(map[string]any)
+		out.Items = toGoogleSchema(items, root)
+	default:
+		out.Type = genai.TypeObject
+	}
+
+	for _, value := range asSlice(schema["enum"]) {
+		if value, ok := value.(string); ok {
+			out.Enum = append(out.Enum, value)
+		}
+	}
+
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		out.Properties = make(map[string]*genai.Schema, len(properties))
+
+		for name, property := range properties {
+			property, _ := property.(map[string]any)
+			out.Properties[name] = toGoogleSchema(property, root)
+		}
+	}
+
+	for _, value := range asSlice(schema["required"]) {
+		if value, ok := value.(string); ok {
+			out.Required = append(out.Required, value)
+		}
+	}
+
+	return out
+}
+
+/*
+asSlice returns the value as a slice, whether it was decoded from JSON or
+built in Go.
+*/
+func asSlice(value any) []any {
+	switch value := value.(type) {
+	case []any:
+		return value
+	case []string:
+		out := make([]any, len(value))
+
+		for i, item := range value {
+			out[i] = item
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+/*
+history converts the artifacts to the turns of a chat, returning the system
+message apart, as Gemini takes it as an instruction. What the model said, and
+the functions it called, go in model turns, and everything else in user
+turns, including the responses of the functions, in the turn right after the
+one that called them. Consecutive parts of the same role are merged into one
+turn, as Gemini expects the turns to alternate.
+*/
+func (g *Google) history(artifacts []*data.Artifact) (string, []*genai.Content) {
+	var (
+		system string
+		turns  []*genai.Content
+	)
+
+	for _, artifact := range artifacts {
+		role := artifact.Peek("role")
+		payload, images := contentOf(artifact)
+
+		errnie.Log("Google.Generate role %s payload %s", role, payload)
+
+		if role == "system" {
+			system = payload
+			continue
+		}
+
+		if call, ok := ToolCallOf(artifact); ok {
+			turns = appendTurn(turns, "model", genai.FunctionCall{Name: call.Name, Args: call.Arguments})
+			continue
+		}
+
+		if role == "tool" {
+			turns = appendTurn(turns, "user", genai.FunctionResponse{
+				Name:     artifact.Peek("name"),
+				Response: map[string]any{"result": payload},
+			})
+
+			continue
+		}
+
+		turn := "user"
+
+		if role == "assistant" {
+			turn = "model"
+		}
+
+		turns = appendTurn(turns, turn, genai.Text(payload))
+
+		for _, image := range images {
+			turns = appendTurn(turns, turn, genai.Blob{MIMEType: image.MIME, Data: image.Data})
+		}
+	}
+
+	return system, turns
+}
+
+/*
+appendTurn adds the part to the last turn when it is of the role, or starts
+a turn of the role with it.
+*/
+func appendTurn(turns []*genai.Content, role string, part genai.Part) []*genai.Content {
+	if len(turns) > 0 && turns[len(turns)-1].Role == role {
+		turns[len(turns)-1].Parts = append(turns[len(turns)-1].Parts, part)
+		return turns
+	}
+
+	return append(turns, &genai.Content{Role: role, Parts: []genai.Part{part}})
+}
+
+func (g *Google) Configure(config map[string]interface{}) {
+	if systemMsg, ok := config["system_message"].(string); ok {
+		g.system = systemMsg
+	}
+}
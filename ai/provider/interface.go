@@ -3,17 +3,20 @@ package provider
 import (
 	"fmt"
 
+	"github.com/spf13/viper"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/utils"
+	"github.com/theapemachine/errnie"
 )
 
 // Event represents different types of provider events
 type Event struct {
-	TeamID  string
-	AgentID string
-	Type    EventType
-	Content string
-	Error   error
+	TeamID   string
+	AgentID  string
+	Type     EventType
+	Content  string
+	ToolCall *ToolCall
+	Error    error
 }
 
 type EventType int
@@ -45,32 +48,192 @@ func mapMessages(messages []Message) []string {
 	return result
 }
 
+/*
+GenerationParams tunes how a provider samples a response, for a single call.
+The sampling fields are pointers, so zero can be asked for explicitly, while
+anything left nil, or a MaxTokens of zero, is up to the provider. Not every
+backend supports every field, and those it does not are left out.
+
+Tools are the tools the model can call. Providers with native tool support
+stream a tool call artifact for every call, and the others are asked for JSON
+blocks, which are turned into the same artifacts.
+
+Format asks for a response that is a JSON object, which providers with a
+native JSON mode are held to, and which the others are only asked for in the
+prompt, by whoever set it, such as Structured.
+
+Policy, Capabilities and Budget are only used by the balanced provider, to
+route the call. Policy names the routing policy, Capabilities are those the
+provider must have on top of what the call itself needs, and Budget is the
+most the call may cost, which is not limited when zero.
+*/
 type GenerationParams struct {
 	Messages               []Message
-	Temperature            float64
-	PresencePenalty        float64
-	FrequencyPenalty       float64
-	TopP                   float64
-	TopK                   int
+	Temperature            *float64
+	PresencePenalty        *float64
+	FrequencyPenalty       *float64
+	TopP                   *float64
+	TopK                   *int
+	MaxTokens              int
+	Stop                   []string
+	Tools                  []ToolDefinition
+	Format                 *ResponseFormat
+	Policy                 string
+	Capabilities           []string
+	Budget                 float64
 	Interestingness        float64
 	InterestingnessHistory []float64
 }
 
+/*
+NewConfigGenerationParams reads the params set under the key in the config,
+such as `boogie.generation.behaviors.moonshot`, using the snake case names
+accepted by Set, `stop` for the stop sequences, and `policy`, `capabilities`
+and `budget` for routing.
+*/
+func NewConfigGenerationParams(key string) GenerationParams {
+	params := GenerationParams{}
+	v := viper.GetViper()
+
+	for name := range v.GetStringMap(key) {
+		switch name {
+		case "stop":
+			params.Stop = v.GetStringSlice(key + ".stop")
+		case "policy":
+			params.Policy = v.GetString(key + ".policy")
+		case "capabilities":
+			params.Capabilities = v.GetStringSlice(key + ".capabilities")
+		case "budget":
+			params.Budget = v.GetFloat64(key + ".budget")
+		default:
+			if err := params.Set(name, v.GetFloat64(key+"."+name)); err != nil {
+				errnie.Warn("provider.NewConfigGenerationParams %s: %s", key, err)
+			}
+		}
+	}
+
+	return params
+}
+
+/*
+Set changes a single param by name, which is how tuning suggestions, such as
+those of the persona optimizer, are applied.
+*/
+func (params *GenerationParams) Set(name string, value float64) error {
+	switch name {
+	case "temperature":
+		params.Temperature = utils.Float64Ptr(value)
+	case "top_p":
+		params.TopP = utils.Float64Ptr(value)
+	case "top_k":
+		params.TopK = utils.IntPtr(int(value))
+	case "presence_penalty":
+		params.PresencePenalty = utils.Float64Ptr(value)
+	case "frequency_penalty":
+		params.FrequencyPenalty = utils.Float64Ptr(value)
+	case "max_tokens":
+		params.MaxTokens = int(value)
+	default:
+		return fmt.Errorf("unknown generation param '%s'", name)
+	}
+
+	return nil
+}
+
+/*
+WithDefaults fills in whatever is not set with the defaults.
+*/
+func (params GenerationParams) WithDefaults(defaults GenerationParams) GenerationParams {
+	if params.Temperature == nil {
+		params.Temperature = defaults.Temperature
+	}
+
+	if params.TopP == nil {
+		params.TopP = defaults.TopP
+	}
+
+	if params.TopK == nil {
+		params.TopK = defaults.TopK
+	}
+
+	if params.PresencePenalty == nil {
+		params.PresencePenalty = defaults.PresencePenalty
+	}
+
+	if params.FrequencyPenalty == nil {
+		params.FrequencyPenalty = defaults.FrequencyPenalty
+	}
+
+	if params.MaxTokens == 0 {
+		params.MaxTokens = defaults.MaxTokens
+	}
+
+	if len(params.Stop) == 0 {
+		params.Stop = defaults.Stop
+	}
+
+	if params.Policy == "" {
+		params.Policy = defaults.Policy
+	}
+
+	if len(params.Capabilities) == 0 {
+		params.Capabilities = defaults.Capabilities
+	}
+
+	if params.Budget == 0 {
+		params.Budget = defaults.Budget
+	}
+
+	return params
+}
+
 func (params GenerationParams) String() string {
 	return utils.JoinWith("\n\n",
 		utils.JoinWith("\n", mapMessages(params.Messages)...),
 		utils.JoinWith(
 			"\n",
-			fmt.Sprintf("Temperature: %f", params.Temperature),
-			fmt.Sprintf("PresencePenalty: %f", params.PresencePenalty),
-			fmt.Sprintf("FrequencyPenalty: %f", params.FrequencyPenalty),
-			fmt.Sprintf("TopP: %f", params.TopP),
-			fmt.Sprintf("TopK: %d", params.TopK),
+			"Temperature: "+format(params.Temperature),
+			"PresencePenalty: "+format(params.PresencePenalty),
+			"FrequencyPenalty: "+format(params.FrequencyPenalty),
+			"TopP: "+format(params.TopP),
+			"TopK: "+format(params.TopK),
+			fmt.Sprintf("MaxTokens: %d", params.MaxTokens),
+			fmt.Sprintf("Stop: %q", params.Stop),
+			fmt.Sprintf("Tools: %d", len(params.Tools)),
+			"Format: "+params.Format.String(),
+			"Policy: "+params.Policy,
+			fmt.Sprintf("Capabilities: %q", params.Capabilities),
+			fmt.Sprintf("Budget: %g", params.Budget),
 		),
 	)
 }
 
+/*
+ResponseFormat is the JSON object a response must be, described by a JSON
+schema, under a name that is only used to tell formats apart.
+*/
+type ResponseFormat struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+func (format *ResponseFormat) String() string {
+	if format == nil {
+		return "text"
+	}
+
+	return "json " + format.Name
+}
+
+func format[T int | float64](value *T) string {
+	if value == nil {
+		return "default"
+	}
+
+	return fmt.Sprint(*value)
+}
+
 // Provider defines the interface for AI providers
 type Provider interface {
-	Generate([]*data.Artifact) <-chan *data.Artifact
+	Generate(GenerationParams, []*data.Artifact) <-chan *data.Artifact
 }
@@ -0,0 +1,270 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+The accounts usage is tallied under. An agent is accounted by its role, a
+team by its name, a Boogie program by its fingerprint, and an HTTP request by
+its request ID.
+*/
+const (
+	ACCOUNT_AGENT   = "agent"
+	ACCOUNT_TEAM    = "team"
+	ACCOUNT_PROGRAM = "program"
+	ACCOUNT_REQUEST = "request"
+)
+
+type accountsKey struct{}
+
+/*
+WithAccount returns a context that tallies the usage of whatever runs under it
+to the account of the kind, on top of the accounts the context already had.
+*/
+func WithAccount(ctx context.Context, kind, name string) context.Context {
+	accounts := maps.Clone(AccountsOf(ctx))
+
+	if accounts == nil {
+		accounts = make(map[string]string)
+	}
+
+	accounts[kind] = name
+
+	return context.WithValue(ctx, accountsKey{}, accounts)
+}
+
+/*
+AccountsOf returns the accounts usage under the context is tallied to, by
+kind.
+*/
+func AccountsOf(ctx context.Context) map[string]string {
+	accounts, _ := ctx.Value(accountsKey{}).(map[string]string)
+	return accounts
+}
+
+/*
+Tally adds up the usage of the calls made for an account.
+*/
+type Tally struct {
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	Estimated        int     `json:"estimated"`
+	Cached           int     `json:"cached"`
+}
+
+func (tally *Tally) add(usage Usage) {
+	tally.Calls++
+	tally.PromptTokens += usage.PromptTokens
+	tally.CompletionTokens += usage.CompletionTokens
+	tally.Cost += usage.Cost
+
+	if usage.Estimated {
+		tally.Estimated++
+	}
+
+	if usage.Cached {
+		tally.Cached++
+	}
+}
+
+/*
+UsageRecord is the usage of a single call, and the accounts it was made for.
+*/
+type UsageRecord struct {
+	Time     time.Time         `json:"time"`
+	Usage    Usage             `json:"usage"`
+	Accounts map[string]string `json:"accounts,omitempty"`
+}
+
+/*
+Report is the total usage, and the usage per account, by kind and name.
+*/
+type Report struct {
+	Total    Tally                        `json:"total"`
+	Accounts map[string]map[string]*Tally `json:"accounts"`
+}
+
+func NewReport() *Report {
+	return &Report{Accounts: make(map[string]map[string]*Tally)}
+}
+
+func (report *Report) add(record UsageRecord) {
+	report.Total.add(record.Usage)
+
+	for kind, name := range record.Accounts {
+		if report.Accounts[kind] == nil {
+			report.Accounts[kind] = make(map[string]*Tally)
+		}
+
+		if report.Accounts[kind][name] == nil {
+			report.Accounts[kind][name] = &Tally{}
+		}
+
+		report.Accounts[kind][name].add(record.Usage)
+	}
+}
+
+func (report *Report) clone() *Report {
+	clone := NewReport()
+	clone.Total = report.Total
+
+	for kind, tallies := range report.Accounts {
+		clone.Accounts[kind] = make(map[string]*Tally, len(tallies))
+
+		for name, tally := range tallies {
+			copied := *tally
+			clone.Accounts[kind][name] = &copied
+		}
+	}
+
+	return clone
+}
+
+/*
+Ledger tallies the usage of the calls made since it was made, and appends
+every call to its file, when it has one, so the usage of earlier runs can be
+read back with ReadLedger.
+*/
+type Ledger struct {
+	path   string
+	report *Report
+	mu     sync.Mutex
+}
+
+var (
+	ledgerInstance atomic.Pointer[Ledger]
+	onceLedger     sync.Once
+)
+
+func NewLedger(path string) *Ledger {
+	return &Ledger{path: path, report: NewReport()}
+}
+
+/*
+NewConfigLedger returns the shared ledger, which appends to the file set as
+`ai.usage.file` in the config, and only keeps the usage in memory when none
+is set.
+*/
+func NewConfigLedger() *Ledger {
+	onceLedger.Do(func() {
+		ledgerInstance.Store(NewLedger(ledgerPath(viper.GetViper().GetString("ai.usage.file"))))
+	})
+
+	return ledgerInstance.Load()
+}
+
+func ledgerPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, rest)
+	}
+
+	return path
+}
+
+/*
+Record tallies the usage to the accounts of the context.
+*/
+func (ledger *Ledger) Record(ctx context.Context, usage Usage) {
+	record := UsageRecord{Time: time.Now(), Usage: usage, Accounts: AccountsOf(ctx)}
+
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	ledger.report.add(record)
+
+	if ledger.path == "" {
+		return
+	}
+
+	if err := ledger.write(record); err != nil {
+		errnie.Warn("provider.Ledger.Record %s", err)
+	}
+}
+
+/*
+Report returns the usage tallied so far.
+*/
+func (ledger *Ledger) Report() *Report {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	return ledger.report.clone()
+}
+
+func (ledger *Ledger) write(record UsageRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(ledger.path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(ledger.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(buf, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+/*
+ReadLedger tallies the usage in the file of a ledger, of the calls made since
+the given time. A ledger that was never written to has no usage.
+*/
+func ReadLedger(path string, since time.Time) (*Report, error) {
+	report := NewReport()
+
+	file, err := os.Open(ledgerPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return report, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		record := UsageRecord{}
+
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			errnie.Warn("provider.ReadLedger skipping a record: %s", err)
+			continue
+		}
+
+		if record.Time.Before(since) {
+			continue
+		}
+
+		report.add(record)
+	}
+
+	return report, scanner.Err()
+}
@@ -0,0 +1,440 @@
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+MockLLM is a stand-in for an OpenAI compatible server, which answers chat
+completions with whatever the provider it wraps generates, usually a
+ScriptedProvider, so the whole stack, down to the HTTP client of the OpenAI
+provider, can be run and tested offline, and deterministically. Responses are
+streamed token by token, tool calls the provider makes are streamed as native
+tool calls, and a provider that fails before its first token fails the
+request with the status of its error.
+*/
+type MockLLM struct {
+	provider Provider
+	model    string
+}
+
+func NewMockLLM(model string, provider Provider) *MockLLM {
+	return &MockLLM{provider: provider, model: model}
+}
+
+/*
+NewConfigMockLLM serves the scripts set under `ai.mockllm.scripts` in the
+config, answering any prompt no script matches with `ai.mockllm.reply`.
+*/
+func NewConfigMockLLM() *MockLLM {
+	v := viper.GetViper()
+	scripts := make([]*Script, 0)
+
+	if err := v.UnmarshalKey("ai.mockllm.scripts", &scripts); err != nil {
+		errnie.Warn("provider.NewConfigMockLLM %s", err)
+	}
+
+	scripts = append(scripts, &Script{Responses: []string{v.GetString("ai.mockllm.reply")}})
+
+	return NewMockLLM(v.GetString("ai.mockllm.model"), NewScriptedProvider(scripts...))
+}
+
+func (mock *MockLLM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models"):
+		mock.models(w)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		mock.completions(w, r)
+	default:
+		mock.fail(w, http.StatusNotFound, "invalid_request_error", "no route for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (mock *MockLLM) models(w http.ResponseWriter) {
+	mock.write(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data": []map[string]any{
+			{"id": mock.model, "object": "model", "created": 0, "owned_by": "mockllm"},
+		},
+	})
+}
+
+/*
+mockRequest is the part of a chat completion request the mock understands.
+*/
+type mockRequest struct {
+	Model         string        `json:"model"`
+	Messages      []mockMessage `json:"messages"`
+	Stream        bool          `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Temperature      *float64 `json:"temperature"`
+	TopP             *float64 `json:"top_p"`
+	PresencePenalty  *float64 `json:"presence_penalty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty"`
+	MaxTokens        int      `json:"max_tokens"`
+	Stop             any      `json:"stop"`
+	ResponseFormat   struct {
+		Type       string          `json:"type"`
+		JSONSchema *ResponseFormat `json:"json_schema"`
+	} `json:"response_format"`
+	Tools []struct {
+		Function struct {
+			Name        string         `json:"name"`
+			Description string         `json:"description"`
+			Parameters  map[string]any `json:"parameters"`
+		} `json:"function"`
+	} `json:"tools"`
+}
+
+type mockMessage struct {
+	Role       string `json:"role"`
+	Content    any    `json:"content"`
+	ToolCallID string `json:"tool_call_id"`
+	ToolCalls  []struct {
+		ID       string `json:"id"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+}
+
+/*
+params converts the request to the params and artifacts of a call to the
+provider.
+*/
+func (request mockRequest) params() (GenerationParams, []*data.Artifact) {
+	params := GenerationParams{
+		Temperature:      request.Temperature,
+		TopP:             request.TopP,
+		PresencePenalty:  request.PresencePenalty,
+		FrequencyPenalty: request.FrequencyPenalty,
+		MaxTokens:        request.MaxTokens,
+	}
+
+	switch stop := request.Stop.(type) {
+	case string:
+		params.Stop = []string{stop}
+	case []any:
+		for _, sequence := range stop {
+			params.Stop = append(params.Stop, fmt.Sprint(sequence))
+		}
+	}
+
+	switch request.ResponseFormat.Type {
+	case "json_schema":
+		params.Format = request.ResponseFormat.JSONSchema
+	case "json_object":
+		params.Format = &ResponseFormat{Name: "json_object"}
+	}
+
+	for _, tool := range request.Tools {
+		params.Tools = append(params.Tools, ToolDefinition{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+
+	artifacts := make([]*data.Artifact, 0, len(request.Messages))
+
+	for _, message := range request.Messages {
+		for _, call := range message.ToolCalls {
+			arguments := make(map[string]any)
+			_ = json.Unmarshal([]byte(call.Function.Arguments), &arguments)
+
+			artifacts = append(artifacts, NewToolCallArtifact("mockllm", request.Model, ToolCall{
+				ID: call.ID, Name: call.Function.Name, Arguments: arguments,
+			}))
+		}
+
+		switch {
+		case message.Role == "tool":
+			artifacts = append(artifacts, NewToolResultArtifact("mockllm", ToolCall{ID: message.ToolCallID}, textOf(message.Content)))
+		case len(message.ToolCalls) == 0:
+			artifacts = append(artifacts, data.New(
+				"mockllm", message.Role, "prompt", []byte(textOf(message.Content)),
+			).Attach(imagesOf(message.Content)...))
+		}
+	}
+
+	return params, artifacts
+}
+
+/*
+textOf returns the text of the content of a message, which is either a
+string, or a list of parts, of which only the text is kept.
+*/
+func textOf(content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case []any:
+		text := make([]string, 0, len(content))
+
+		for _, part := range content {
+			if part, ok := part.(map[string]any); ok && part["type"] == "text" {
+				text = append(text, fmt.Sprint(part["text"]))
+			}
+		}
+
+		return strings.Join(text, "\n")
+	}
+
+	return ""
+}
+
+/*
+imagesOf returns the images in the parts of the content of a message, which
+are only understood as data URLs.
+*/
+func imagesOf(content any) []data.Part {
+	parts, _ := content.([]any)
+	images := make([]data.Part, 0)
+
+	for _, part := range parts {
+		part, _ := part.(map[string]any)
+		image, _ := part["image_url"].(map[string]any)
+		url, _ := image["url"].(string)
+
+		header, encoded, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ";base64,")
+		if !ok {
+			continue
+		}
+
+		buf, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			errnie.Error(err)
+			continue
+		}
+
+		images = append(images, data.NewPart(header, "image", buf))
+	}
+
+	return images
+}
+
+/*
+completions answers a chat completion, streamed when the request asks for it.
+The first artifact is waited for before anything is written, so a provider
+that fails straight away fails the request with the right status.
+*/
+func (mock *MockLLM) completions(w http.ResponseWriter, r *http.Request) {
+	request := mockRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		mock.fail(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	params, artifacts := request.params()
+	stream := mock.provider.Generate(params, artifacts)
+
+	first, ok := <-stream
+
+	if err, failed := ErrorOf(first); ok && failed {
+		for range stream {
+		}
+
+		status := err.Status
+
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+
+		mock.fail(w, status, err.Kind, err.Err.Error())
+		return
+	}
+
+	response := newMockResponse(mock.model)
+
+	if !request.Stream {
+		for artifact := first; ok; artifact, ok = <-stream {
+			response.add(artifact)
+		}
+
+		mock.write(w, http.StatusOK, response.completion())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for artifact := first; ok; artifact, ok = <-stream {
+		if err, failed := ErrorOf(artifact); failed {
+			mock.event(w, map[string]any{"error": map[string]any{"type": err.Kind, "message": err.Err.Error()}})
+			continue
+		}
+
+		if chunk := response.add(artifact); chunk != nil {
+			mock.event(w, chunk)
+		}
+	}
+
+	mock.event(w, response.chunk(map[string]any{}, response.finishReason()))
+
+	if request.StreamOptions.IncludeUsage {
+		usage := response.chunk(nil, "")
+		usage["choices"] = []any{}
+		usage["usage"] = response.usage()
+		mock.event(w, usage)
+	}
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	mock.flush(w)
+}
+
+func (mock *MockLLM) event(w http.ResponseWriter, payload any) {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		errnie.Error(err)
+		return
+	}
+
+	fmt.Fprintf(w, "data: %s\n\n", buf)
+	mock.flush(w)
+}
+
+func (mock *MockLLM) flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (mock *MockLLM) write(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		errnie.Error(err)
+	}
+}
+
+/*
+fail responds with an error the way OpenAI does.
+*/
+func (mock *MockLLM) fail(w http.ResponseWriter, status int, kind, message string) {
+	mock.write(w, status, map[string]any{
+		"error": map[string]any{"type": kind, "message": message, "code": strconv.Itoa(status)},
+	})
+}
+
+/*
+mockResponse is the response to a chat completion, as it is put together from
+the artifacts of the provider.
+*/
+type mockResponse struct {
+	id        string
+	model     string
+	created   int64
+	content   strings.Builder
+	calls     []map[string]any
+	prompt    int
+	generated int
+}
+
+func newMockResponse(model string) *mockResponse {
+	return &mockResponse{
+		id:      "chatcmpl-" + uuid.NewString(),
+		model:   model,
+		created: time.Now().Unix(),
+		calls:   make([]map[string]any, 0),
+	}
+}
+
+/*
+add puts the artifact in the response, and returns the chunk to stream for
+it, which is nil for the usage of the call.
+*/
+func (response *mockResponse) add(artifact *data.Artifact) map[string]any {
+	if usage, ok := UsageOf(artifact); ok {
+		response.prompt, response.generated = usage.PromptTokens, usage.CompletionTokens
+		return nil
+	}
+
+	if call, ok := ToolCallOf(artifact); ok {
+		arguments, _ := json.Marshal(call.Arguments)
+
+		delta := map[string]any{
+			"index":    len(response.calls),
+			"id":       call.ID,
+			"type":     "function",
+			"function": map[string]any{"name": call.Name, "arguments": string(arguments)},
+		}
+
+		response.calls = append(response.calls, delta)
+		return response.chunk(map[string]any{"tool_calls": []any{delta}}, "")
+	}
+
+	response.content.WriteString(artifact.Peek("payload"))
+	return response.chunk(map[string]any{"role": "assistant", "content": artifact.Peek("payload")}, "")
+}
+
+func (response *mockResponse) finishReason() string {
+	if len(response.calls) > 0 {
+		return "tool_calls"
+	}
+
+	return "stop"
+}
+
+func (response *mockResponse) usage() map[string]any {
+	return map[string]any{
+		"prompt_tokens":     response.prompt,
+		"completion_tokens": response.generated,
+		"total_tokens":      response.prompt + response.generated,
+	}
+}
+
+func (response *mockResponse) chunk(delta map[string]any, finishReason string) map[string]any {
+	choice := map[string]any{"index": 0, "delta": delta, "finish_reason": nil}
+
+	if finishReason != "" {
+		choice["finish_reason"] = finishReason
+	}
+
+	return map[string]any{
+		"id":      response.id,
+		"object":  "chat.completion.chunk",
+		"created": response.created,
+		"model":   response.model,
+		"choices": []any{choice},
+	}
+}
+
+func (response *mockResponse) completion() map[string]any {
+	message := map[string]any{"role": "assistant", "content": response.content.String()}
+
+	if len(response.calls) > 0 {
+		calls := make([]any, 0, len(response.calls))
+
+		for _, call := range response.calls {
+			calls = append(calls, map[string]any{"id": call["id"], "type": "function", "function": call["function"]})
+		}
+
+		message["tool_calls"] = calls
+	}
+
+	return map[string]any{
+		"id":      response.id,
+		"object":  "chat.completion",
+		"created": response.created,
+		"model":   response.model,
+		"choices": []any{map[string]any{"index": 0, "message": message, "finish_reason": response.finishReason()}},
+		"usage":   response.usage(),
+	}
+}
@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+func TestMockLLM(t *testing.T) {
+	Convey("Given the OpenAI provider talking to a mock server", t, func() {
+		scripted := NewScriptedProvider(
+			&Script{Key: "ticket", Responses: []string{"```json\n{\"tool\": \"label\", \"arguments\": {\"label\": \"bug\"}}\n```"}},
+			&Script{Key: "denied", Failures: 1, Status: http.StatusUnauthorized},
+			&Script{Responses: []string{"hello from the mock"}},
+		)
+
+		server := httptest.NewServer(NewMockLLM("mockllm", scripted))
+		defer server.Close()
+
+		openai := NewOpenAICompatible(server.URL+"/v1", "", "mockllm")
+		question := data.New("test", "user", "prompt", []byte("Say hello."))
+
+		Convey("It should stream the scripted reply", func() {
+			completion := complete(openai, GenerationParams{Temperature: utils.Float64Ptr(0.2)}, question)
+			text := ""
+
+			for _, artifact := range completion[:len(completion)-1] {
+				text += artifact.Peek("payload")
+			}
+
+			So(len(completion), ShouldBeGreaterThan, 2)
+			So(text, ShouldEqual, "hello from the mock")
+			So(scripted.Prompts(), ShouldResemble, []string{"Say hello."})
+			So(*scripted.Params()[0].Temperature, ShouldEqual, 0.2)
+		})
+
+		Convey("It should report the usage of the call", func() {
+			completion := complete(openai, GenerationParams{}, question)
+			usage, ok := UsageOf(completion[len(completion)-1])
+
+			So(ok, ShouldBeTrue)
+			So(usage.PromptTokens, ShouldBeGreaterThan, 0)
+			So(usage.CompletionTokens, ShouldBeGreaterThan, 0)
+			So(usage.Estimated, ShouldBeFalse)
+		})
+
+		Convey("It should stream tool calls as native tool calls", func() {
+			params := GenerationParams{Tools: []ToolDefinition{{Name: "label", Parameters: map[string]any{"type": "object"}}}}
+			completion := complete(openai, params, data.New("test", "user", "prompt", []byte("Label this ticket.")))
+
+			call, ok := ToolCallOf(completion[len(completion)-2])
+
+			So(ok, ShouldBeTrue)
+			So(call.Name, ShouldEqual, "label")
+			So(call.Arguments, ShouldResemble, map[string]any{"label": "bug"})
+		})
+
+		Convey("It should fail the request the way the script failed", func() {
+			completion := complete(openai, GenerationParams{}, data.New("test", "user", "prompt", []byte("Access denied?")))
+			err, ok := ErrorOf(completion[0])
+
+			So(completion, ShouldHaveLength, 1)
+			So(ok, ShouldBeTrue)
+			So(err.Kind, ShouldEqual, ERROR_AUTH)
+			So(err.Status, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("It should answer without streaming when it is not asked to", func() {
+			response, err := http.Post(
+				server.URL+"/v1/chat/completions", "application/json",
+				strings.NewReader(`{"model": "mockllm", "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}]}`),
+			)
+
+			So(err, ShouldBeNil)
+			defer response.Body.Close()
+
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(response.Header.Get("Content-Type"), ShouldEqual, "application/json")
+			So(scripted.Prompts(), ShouldResemble, []string{"hi"})
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"slices"
+
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+/*
+contentOf splits what an artifact carries into the text of its message and
+the images attached to it, for a provider to send the way it takes them. Files
+that can be read as text are put in the text, and any other file is mentioned
+by name, so the model at least knows it was there.
+*/
+func contentOf(artifact *data.Artifact) (string, []data.Part) {
+	text := []string{artifact.Peek("payload")}
+	images := make([]data.Part, 0)
+
+	for _, part := range artifact.Parts() {
+		switch {
+		case part.IsImage():
+			images = append(images, part)
+		case part.IsText():
+			text = append(text, "<file name=\""+part.Name+"\" type=\""+part.MIME+"\">\n"+string(part.Data)+"\n</file>")
+		default:
+			text = append(text, mention(part))
+		}
+	}
+
+	return utils.JoinWith("\n\n", text...), images
+}
+
+/*
+plainTextOf is the content of an artifact for providers that only take text, which
+mentions the images instead of sending them.
+*/
+func plainTextOf(artifact *data.Artifact) string {
+	text, images := contentOf(artifact)
+
+	for _, image := range images {
+		text += "\n\n" + mention(image)
+	}
+
+	return text
+}
+
+func mention(part data.Part) string {
+	return "[attached " + part.MIME + ": " + part.Name + ", which cannot be shown here]"
+}
+
+/*
+hasImages reports whether any of the artifacts has an image attached, which
+only providers with vision can take.
+*/
+func hasImages(artifacts []*data.Artifact) bool {
+	return slices.ContainsFunc(artifacts, func(artifact *data.Artifact) bool {
+		return slices.ContainsFunc(artifact.Parts(), data.Part.IsImage)
+	})
+}
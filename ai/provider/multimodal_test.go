@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+/*
+recorder keeps the artifacts of the last call, before it hands them to the
+provider it wraps.
+*/
+type recorder struct {
+	Provider
+	artifacts []*data.Artifact
+	mu        sync.Mutex
+}
+
+func (rec *recorder) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	rec.mu.Lock()
+	rec.artifacts = artifacts
+	rec.mu.Unlock()
+
+	return rec.Provider.Generate(params, artifacts)
+}
+
+func TestMultimodal(t *testing.T) {
+	Convey("Given a prompt with a screenshot and files attached", t, func() {
+		screenshot := data.NewPart("image/png", "screenshot.png", []byte{0x89, 'P', 'N', 'G', 0, 1, 2})
+		notes := data.NewPart("text/markdown", "notes.md", []byte("# Notes"))
+		archive := data.NewPart("application/zip", "logs.zip", []byte{'P', 'K'})
+
+		prompt := data.New("test", "user", "prompt", []byte("What is on the screen?")).Attach(screenshot, notes, archive)
+
+		Convey("It should keep the parts in the artifact", func() {
+			So(prompt.Parts(), ShouldResemble, []data.Part{screenshot, notes, archive})
+			So(prompt.Peek("payload"), ShouldEqual, "What is on the screen?")
+		})
+
+		Convey("It should send the images apart from the text", func() {
+			text, images := contentOf(prompt)
+
+			So(images, ShouldResemble, []data.Part{screenshot})
+			So(text, ShouldContainSubstring, "What is on the screen?")
+			So(text, ShouldContainSubstring, "# Notes")
+			So(text, ShouldContainSubstring, "logs.zip")
+			So(plainTextOf(prompt), ShouldContainSubstring, "screenshot.png")
+		})
+
+		Convey("It should only go to a provider that can see", func() {
+			route := NewRoute(GenerationParams{}, []*data.Artifact{prompt})
+
+			So(route.Capabilities, ShouldContain, CAPABILITY_VISION)
+			So(NewRoute(GenerationParams{}, []*data.Artifact{data.New("test", "user", "prompt", nil)}).Capabilities, ShouldBeEmpty)
+		})
+
+		Convey("It should not be cached as a prompt with another image", func() {
+			other := data.New("test", "user", "prompt", []byte("What is on the screen?")).Attach(
+				data.NewPart("image/png", "screenshot.png", []byte{0x89, 'P', 'N', 'G', 3}),
+			)
+
+			So(cacheKey(GenerationParams{}, []*data.Artifact{prompt}), ShouldNotEqual, cacheKey(GenerationParams{}, []*data.Artifact{other}))
+		})
+
+		Convey("It should keep the images of tool results for models without native tools", func() {
+			result := NewToolResultArtifact("test", ToolCall{ID: "call_1", Name: "browser"}, "Example Domain").Attach(screenshot)
+			rewritten := withoutTools([]ToolDefinition{{Name: "browser"}}, []*data.Artifact{result})
+
+			So(rewritten[len(rewritten)-1].Parts(), ShouldResemble, []data.Part{screenshot})
+		})
+
+		Convey("It should send the image natively through the OpenAI API", func() {
+			rec := &recorder{Provider: NewScriptedProvider(&Script{Responses: []string{"A login form."}})}
+			server := httptest.NewServer(NewMockLLM("mockllm", rec))
+			defer server.Close()
+
+			complete(NewOpenAICompatible(server.URL+"/v1", "", "mockllm"), GenerationParams{}, prompt)
+
+			So(rec.artifacts, ShouldHaveLength, 1)
+			So(rec.artifacts[0].Parts(), ShouldResemble, []data.Part{data.NewPart("image/png", "image", screenshot.Data)})
+			So(rec.artifacts[0].Peek("payload"), ShouldContainSubstring, "# Notes")
+		})
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/ollama/ollama/api"
 	"github.com/theapemachine/amsh/data"
@@ -18,11 +19,17 @@ type Ollama struct {
 	system string
 }
 
+/*
+NewOllama talks to the Ollama server set in OLLAMA_HOST, or to the one on
+localhost:11434 when it is not set.
+*/
 func NewOllama(model string) *Ollama {
-	client := api.NewClient(
-		&url.URL{Scheme: "http", Host: "localhost:11434"},
-		&http.Client{},
-	)
+	client, err := api.ClientFromEnvironment()
+
+	if err != nil {
+		errnie.Warn("provider.NewOllama %s", err)
+		return NewOllamaAt("http://localhost:11434", model)
+	}
 
 	return &Ollama{
 		client: client,
@@ -30,7 +37,25 @@ func NewOllama(model string) *Ollama {
 	}
 }
 
-func (o *Ollama) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
+/*
+NewOllamaAt talks to the Ollama server at the base URL, such as one running on
+another machine, or in a container.
+*/
+func NewOllamaAt(baseURL, model string) *Ollama {
+	base, err := url.Parse(baseURL)
+
+	if err != nil || base.Host == "" {
+		errnie.Warn("provider.NewOllamaAt invalid base url %s", baseURL)
+		base = &url.URL{Scheme: "http", Host: "localhost:11434"}
+	}
+
+	return &Ollama{
+		client: api.NewClient(base, &http.Client{}),
+		model:  model,
+	}
+}
+
+func (o *Ollama) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
 	return twoface.NewAccumulator(
 		"ollama",
 		"provider",
@@ -40,32 +65,99 @@ func (o *Ollama) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
 		defer close(accumulator.Out)
 
 		errnie.Log("===START===")
-		prompt := o.convertToOllamaPrompt(artifacts)
+		prompt, images := o.convertToOllamaPrompt(withoutTools(params.Tools, artifacts))
 		errnie.Log("===END===")
 
 		req := &api.GenerateRequest{
-			Model:  o.model,
-			Prompt: prompt,
-			Stream: utils.BoolPtr(true),
-			Options: map[string]interface{}{
-				"temperature": 0.7, // You might want to make this configurable
-			},
+			Model:   o.model,
+			Prompt:  prompt,
+			Stream:  utils.BoolPtr(true),
+			Options: o.options(params),
+			Images:  images,
+		}
+
+		if params.Format != nil {
+			req.Format = "json"
 		}
 
+		var (
+			response strings.Builder
+			metrics  api.Metrics
+		)
+
 		respFunc := func(resp api.GenerateResponse) error {
-			response := data.New("ollama", "assistant", o.model, []byte(resp.Response))
-			accumulator.Out <- response
+			if resp.Done {
+				metrics = resp.Metrics
+			}
+
+			response.WriteString(resp.Response)
+			accumulator.Out <- data.New("ollama", "assistant", o.model, []byte(resp.Response))
 			return nil
 		}
 
 		if err := o.client.Generate(context.Background(), req, respFunc); err != nil {
 			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("ollama", o.model, err)
+			return
 		}
+
+		// Ollama has no native tool support here, so the calls are found in
+		// the JSON blocks the model was asked to respond with.
+		for _, call := range extractToolCalls(response.String(), params.Tools) {
+			accumulator.Out <- NewToolCallArtifact("ollama", o.model, call)
+		}
+
+		accumulator.Out <- NewUsageArtifact("ollama", o.model, newUsage(
+			metrics.PromptEvalCount, metrics.EvalCount, artifacts, response.String(),
+		))
 	}).Generate()
 }
 
-func (o *Ollama) convertToOllamaPrompt(artifacts []*data.Artifact) string {
+/*
+options converts the params to the options Ollama understands, keeping the
+temperature used before params could be passed as the default.
+*/
+func (o *Ollama) options(params GenerationParams) map[string]interface{} {
+	params = params.WithDefaults(GenerationParams{Temperature: utils.Float64Ptr(0.7)})
+
+	options := map[string]interface{}{
+		"temperature": *params.Temperature,
+	}
+
+	if params.TopP != nil {
+		options["top_p"] = *params.TopP
+	}
+
+	if params.TopK != nil {
+		options["top_k"] = *params.TopK
+	}
+
+	if params.PresencePenalty != nil {
+		options["presence_penalty"] = *params.PresencePenalty
+	}
+
+	if params.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *params.FrequencyPenalty
+	}
+
+	if params.MaxTokens > 0 {
+		options["num_predict"] = params.MaxTokens
+	}
+
+	if len(params.Stop) > 0 {
+		options["stop"] = params.Stop
+	}
+
+	return options
+}
+
+/*
+convertToOllamaPrompt converts the artifacts to a prompt, and gathers the
+images attached to them, which Ollama takes alongside the prompt.
+*/
+func (o *Ollama) convertToOllamaPrompt(artifacts []*data.Artifact) (string, []api.ImageData) {
 	var prompt string
+	images := make([]api.ImageData, 0)
 
 	// Add system message if available
 	if o.system != "" {
@@ -74,10 +166,14 @@ func (o *Ollama) convertToOllamaPrompt(artifacts []*data.Artifact) string {
 
 	for _, artifact := range artifacts {
 		role := artifact.Peek("role")
-		payload := artifact.Peek("payload")
+		payload, parts := contentOf(artifact)
 
 		errnie.Log("Ollama.Generate role %s payload %s", role, payload)
 
+		for _, part := range parts {
+			images = append(images, api.ImageData(part.Data))
+		}
+
 		switch role {
 		case "system":
 			o.system = payload
@@ -90,7 +186,7 @@ func (o *Ollama) convertToOllamaPrompt(artifacts []*data.Artifact) string {
 		}
 	}
 
-	return prompt
+	return prompt, images
 }
 
 func (o *Ollama) Configure(config map[string]interface{}) {
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"strings"
 
 	sdk "github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
@@ -24,56 +25,231 @@ func NewOpenAI(apiKey, model string) *OpenAI {
 	}
 }
 
-func (openai *OpenAI) Generate(artifacts []*data.Artifact) <-chan *data.Artifact {
+/*
+NewOpenAICompatible talks to any server that implements the OpenAI API at the
+base URL, such as LM Studio or a self-hosted vLLM.
+*/
+func NewOpenAICompatible(baseURL, apiKey, model string) *OpenAI {
+	return &OpenAI{
+		client: sdk.NewClient(
+			option.WithBaseURL(baseURL),
+			option.WithAPIKey(apiKey),
+		),
+		model: model,
+	}
+}
+
+func (openai *OpenAI) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
 	return twoface.NewAccumulator(
 		"openai",
 		"provider",
 		"completion",
 		artifacts...,
 	).Yield(func(accumulator *twoface.Accumulator) {
-		openAIMessages := make([]sdk.ChatCompletionMessageParamUnion, len(artifacts))
-
 		defer close(accumulator.Out)
 
 		errnie.Log("===START===")
-
-		for i, msg := range artifacts {
-			role := msg.Peek("role")
-			payload := msg.Peek("payload")
-
-			errnie.Log("OpenAI.Generate role %s payload %s", role, payload)
-
-			switch role {
-			case "user":
-				openAIMessages[i] = sdk.UserMessage(payload)
-			case "assistant":
-				openAIMessages[i] = sdk.AssistantMessage(payload)
-			case "system":
-				openAIMessages[i] = sdk.SystemMessage(payload)
-			case "tool":
-				openAIMessages[i] = sdk.ToolMessage(msg.Peek("name"), payload)
-			default:
-				errnie.Warn("OpenAI.Generate unknown_role %s", role)
-			}
-		}
-
+		requestParams := openai.buildRequestParams(params, artifacts)
 		errnie.Log("===END===")
 
-		stream := openai.client.Chat.Completions.NewStreaming(context.Background(), sdk.ChatCompletionNewParams{
-			Messages: sdk.F(openAIMessages),
-			Model:    sdk.F(openai.model),
-		})
+		stream := openai.client.Chat.Completions.NewStreaming(context.Background(), requestParams)
+		calls := newToolCallDeltas()
+
+		var (
+			content strings.Builder
+			usage   sdk.CompletionUsage
+		)
 
 		for stream.Next() {
 			evt := stream.Current()
-			if len(evt.Choices) > 0 && evt.Choices[0].Delta.Content != "" {
+
+			// The usage comes in a chunk of its own, without any choices,
+			// after the last of the response.
+			if evt.Usage.PromptTokens > 0 {
+				usage = evt.Usage
+			}
+
+			if len(evt.Choices) == 0 {
+				continue
+			}
+
+			if evt.Choices[0].Delta.Content != "" {
+				content.WriteString(evt.Choices[0].Delta.Content)
 				response := data.New("openai", "assistant", openai.model, []byte(evt.Choices[0].Delta.Content))
 				accumulator.Out <- response
 			}
+
+			for _, delta := range evt.Choices[0].Delta.ToolCalls {
+				calls.add(delta.Index, delta.ID, delta.Function.Name, delta.Function.Arguments)
+			}
 		}
 
 		if err := stream.Err(); err != nil {
 			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("openai", openai.model, err)
+			return
+		}
+
+		for _, call := range calls.done() {
+			accumulator.Out <- NewToolCallArtifact("openai", openai.model, call)
 		}
+
+		accumulator.Out <- NewUsageArtifact("openai", openai.model, newUsage(
+			int(usage.PromptTokens), int(usage.CompletionTokens), artifacts, content.String(),
+		))
 	}).Generate()
 }
+
+/*
+userMessage is a plain user message, or one made of parts when it has images.
+*/
+func (openai *OpenAI) userMessage(text string, images []data.Part) sdk.ChatCompletionMessageParamUnion {
+	if len(images) == 0 {
+		return sdk.UserMessage(text)
+	}
+
+	parts := make([]sdk.ChatCompletionContentPartUnionParam, 0, len(images)+1)
+
+	if text != "" {
+		parts = append(parts, sdk.TextPart(text))
+	}
+
+	for _, image := range images {
+		parts = append(parts, sdk.ImagePart(image.DataURL()))
+	}
+
+	return sdk.UserMessageParts(parts...)
+}
+
+/*
+buildRequestParams converts the artifacts to messages, and sets whatever the
+params ask for, asking for the usage at the end of the stream. OpenAI has no
+top-k sampling, so TopK is left out. Tool calls
+are sent back in the assistant message before them, which holds all the
+calls of a round, and the text that came with them, followed by a tool
+message with the result of each. Images go in user messages only, so those
+attached to anything else follow in a user message of their own.
+*/
+func (openai *OpenAI) buildRequestParams(params GenerationParams, artifacts []*data.Artifact) sdk.ChatCompletionNewParams {
+	openAIMessages := make([]sdk.ChatCompletionMessageParamUnion, 0, len(artifacts))
+
+	for _, msg := range artifacts {
+		role := msg.Peek("role")
+		payload, images := contentOf(msg)
+
+		errnie.Log("OpenAI.Generate role %s payload %s", role, payload)
+
+		if call, ok := ToolCallOf(msg); ok {
+			openAIMessages = appendToolCall(openAIMessages, sdk.ChatCompletionMessageToolCallParam{
+				ID:   sdk.F(call.ID),
+				Type: sdk.F(sdk.ChatCompletionMessageToolCallTypeFunction),
+				Function: sdk.F(sdk.ChatCompletionMessageToolCallFunctionParam{
+					Name:      sdk.F(call.Name),
+					Arguments: sdk.F(payload),
+				}),
+			})
+
+			continue
+		}
+
+		switch role {
+		case "user":
+			openAIMessages = append(openAIMessages, openai.userMessage(payload, images))
+			continue
+		case "assistant":
+			openAIMessages = append(openAIMessages, sdk.AssistantMessage(payload))
+		case "system":
+			openAIMessages = append(openAIMessages, sdk.SystemMessage(payload))
+		case "tool":
+			openAIMessages = append(openAIMessages, sdk.ToolMessage(msg.Peek("tool_call_id"), payload))
+		default:
+			errnie.Warn("OpenAI.Generate unknown_role %s", role)
+		}
+
+		if len(images) > 0 {
+			openAIMessages = append(openAIMessages, openai.userMessage("", images))
+		}
+	}
+
+	requestParams := sdk.ChatCompletionNewParams{
+		Messages: sdk.F(openAIMessages),
+		Model:    sdk.F(openai.model),
+		StreamOptions: sdk.F(sdk.ChatCompletionStreamOptionsParam{
+			IncludeUsage: sdk.F(true),
+		}),
+	}
+
+	if params.Temperature != nil {
+		requestParams.Temperature = sdk.F(*params.Temperature)
+	}
+
+	if params.TopP != nil {
+		requestParams.TopP = sdk.F(*params.TopP)
+	}
+
+	if params.PresencePenalty != nil {
+		requestParams.PresencePenalty = sdk.F(*params.PresencePenalty)
+	}
+
+	if params.FrequencyPenalty != nil {
+		requestParams.FrequencyPenalty = sdk.F(*params.FrequencyPenalty)
+	}
+
+	if params.MaxTokens > 0 {
+		requestParams.MaxTokens = sdk.F(int64(params.MaxTokens))
+	}
+
+	if len(params.Stop) > 0 {
+		requestParams.Stop = sdk.F[sdk.ChatCompletionNewParamsStopUnion](sdk.ChatCompletionNewParamsStopArray(params.Stop))
+	}
+
+	if len(params.Tools) > 0 {
+		tools := make([]sdk.ChatCompletionToolParam, 0, len(params.Tools))
+
+		for _, tool := range params.Tools {
+			tools = append(tools, sdk.ChatCompletionToolParam{
+				Type: sdk.F(sdk.ChatCompletionToolTypeFunction),
+				Function: sdk.F(sdk.FunctionDefinitionParam{
+					Name:        sdk.F(tool.Name),
+					Description: sdk.F(tool.Description),
+					Parameters:  sdk.F(sdk.FunctionParameters(tool.Parameters)),
+				}),
+			})
+		}
+
+		requestParams.Tools = sdk.F(tools)
+	}
+
+	if params.Format != nil {
+		requestParams.ResponseFormat = sdk.F[sdk.ChatCompletionNewParamsResponseFormatUnion](sdk.ResponseFormatJSONSchemaParam{
+			Type: sdk.F(sdk.ResponseFormatJSONSchemaTypeJSONSchema),
+			JSONSchema: sdk.F(sdk.ResponseFormatJSONSchemaJSONSchemaParam{
+				Name:   sdk.F(params.Format.Name),
+				Schema: sdk.F[any](params.Format.Schema),
+			}),
+		})
+	}
+
+	return requestParams
+}
+
+/*
+appendToolCall adds the call to the assistant message the messages end with,
+as every tool message has to follow the one assistant message that holds all
+the calls they answer, or starts a new one.
+*/
+func appendToolCall(messages []sdk.ChatCompletionMessageParamUnion, call sdk.ChatCompletionMessageToolCallParam) []sdk.ChatCompletionMessageParamUnion {
+	if len(messages) > 0 {
+		if last, ok := messages[len(messages)-1].(sdk.ChatCompletionAssistantMessageParam); ok {
+			last.ToolCalls = sdk.F(append(last.ToolCalls.Value, call))
+			messages[len(messages)-1] = last
+
+			return messages
+		}
+	}
+
+	return append(messages, sdk.ChatCompletionAssistantMessageParam{
+		Role:      sdk.F(sdk.ChatCompletionAssistantMessageParamRoleAssistant),
+		ToolCalls: sdk.F([]sdk.ChatCompletionMessageToolCallParam{call}),
+	})
+}
@@ -0,0 +1,195 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	sdk "github.com/openai/openai-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+func tuned() GenerationParams {
+	return GenerationParams{
+		Temperature:      utils.Float64Ptr(0.2),
+		TopP:             utils.Float64Ptr(0.9),
+		TopK:             utils.IntPtr(40),
+		PresencePenalty:  utils.Float64Ptr(0.5),
+		FrequencyPenalty: utils.Float64Ptr(0.4),
+		MaxTokens:        256,
+		Stop:             []string{"END"},
+	}
+}
+
+func TestGenerationParams(t *testing.T) {
+	Convey("Given params with only some fields set", t, func() {
+		params := GenerationParams{Temperature: utils.Float64Ptr(0)}
+
+		Convey("It should fill in the rest from the defaults", func() {
+			filled := params.WithDefaults(tuned())
+
+			So(*filled.Temperature, ShouldEqual, 0)
+			So(*filled.TopP, ShouldEqual, 0.9)
+			So(*filled.TopK, ShouldEqual, 40)
+			So(filled.MaxTokens, ShouldEqual, 256)
+			So(filled.Stop, ShouldResemble, []string{"END"})
+		})
+
+		Convey("It should set params by name", func() {
+			So(params.Set("top_k", 12), ShouldBeNil)
+			So(params.Set("max_tokens", 100), ShouldBeNil)
+			So(*params.TopK, ShouldEqual, 12)
+			So(params.MaxTokens, ShouldEqual, 100)
+			So(params.Set("creativity", 1), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given params in the config", t, func() {
+		viper.Set("test.params", map[string]any{
+			"temperature":  1.1,
+			"top_k":        20,
+			"stop":         []string{"a", "b"},
+			"policy":       POLICY_CHEAPEST,
+			"capabilities": []string{CAPABILITY_JSON},
+			"budget":       0.5,
+		})
+		defer viper.Reset()
+
+		params := NewConfigGenerationParams("test.params")
+
+		Convey("It should read them", func() {
+			So(*params.Temperature, ShouldEqual, 1.1)
+			So(*params.TopK, ShouldEqual, 20)
+			So(params.TopP, ShouldBeNil)
+			So(params.Stop, ShouldResemble, []string{"a", "b"})
+		})
+
+		Convey("It should read how to route them", func() {
+			So(params.Policy, ShouldEqual, POLICY_CHEAPEST)
+			So(params.Capabilities, ShouldResemble, []string{CAPABILITY_JSON})
+			So(params.Budget, ShouldEqual, 0.5)
+		})
+	})
+}
+
+func TestProviderParams(t *testing.T) {
+	artifacts := []*data.Artifact{
+		data.New("test", "system", "prompt", []byte("be brief")),
+		data.New("test", "user", "prompt", []byte("hello")),
+	}
+
+	Convey("Given OpenAI", t, func() {
+		openai := &OpenAI{model: "model"}
+
+		Convey("It should map the params it supports", func() {
+			request := openai.buildRequestParams(tuned(), artifacts)
+
+			So(request.Messages.Value, ShouldHaveLength, 2)
+			So(request.Temperature.Value, ShouldEqual, 0.2)
+			So(request.TopP.Value, ShouldEqual, 0.9)
+			So(request.PresencePenalty.Value, ShouldEqual, 0.5)
+			So(request.FrequencyPenalty.Value, ShouldEqual, 0.4)
+			So(request.MaxTokens.Value, ShouldEqual, 256)
+			So(request.Stop.Value, ShouldResemble, sdk.ChatCompletionNewParamsStopArray{"END"})
+		})
+
+		Convey("It should leave out what is not set", func() {
+			request := openai.buildRequestParams(GenerationParams{}, artifacts)
+
+			So(request.Temperature.Present, ShouldBeFalse)
+			So(request.MaxTokens.Present, ShouldBeFalse)
+			So(request.Stop.Present, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given Anthropic", t, func() {
+		claude := &Anthropic{model: "model", maxTokens: 4096}
+
+		Convey("It should map the params it supports", func() {
+			request := claude.buildRequestParams(tuned(), artifacts)
+
+			So(request.Temperature.Value, ShouldEqual, 0.2)
+			So(request.TopP.Value, ShouldEqual, 0.9)
+			So(request.TopK.Value, ShouldEqual, 40)
+			So(request.MaxTokens.Value, ShouldEqual, 256)
+			So(request.StopSequences.Value, ShouldResemble, []string{"END"})
+		})
+
+		Convey("It should keep its defaults for what is not set", func() {
+			request := claude.buildRequestParams(GenerationParams{}, artifacts)
+
+			So(request.Temperature.Value, ShouldEqual, 0.7)
+			So(request.MaxTokens.Value, ShouldEqual, 4096)
+			So(request.TopK.Present, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given Google", t, func() {
+		google := &Google{model: "model", maxTokens: 4096}
+
+		Convey("It should map the params it supports", func() {
+			model := &genai.GenerativeModel{}
+			google.configure(model, tuned())
+
+			So(*model.Temperature, ShouldEqual, float32(0.2))
+			So(*model.TopP, ShouldEqual, float32(0.9))
+			So(*model.TopK, ShouldEqual, 40)
+			So(*model.MaxOutputTokens, ShouldEqual, 256)
+			So(model.StopSequences, ShouldResemble, []string{"END"})
+		})
+
+		Convey("It should keep its defaults for what is not set", func() {
+			model := &genai.GenerativeModel{}
+			google.configure(model, GenerationParams{})
+
+			So(*model.Temperature, ShouldEqual, float32(0.7))
+			So(*model.MaxOutputTokens, ShouldEqual, 4096)
+			So(model.TopK, ShouldBeNil)
+		})
+	})
+
+	Convey("Given Cohere", t, func() {
+		cohere := &Cohere{model: "model", maxTokens: 4096}
+
+		Convey("It should map all the params", func() {
+			request := cohere.buildRequest(tuned(), artifacts)
+
+			So(*request.Temperature, ShouldEqual, 0.2)
+			So(*request.P, ShouldEqual, 0.9)
+			So(*request.K, ShouldEqual, 40)
+			So(*request.PresencePenalty, ShouldEqual, 0.5)
+			So(*request.FrequencyPenalty, ShouldEqual, 0.4)
+			So(*request.MaxTokens, ShouldEqual, 256)
+			So(request.StopSequences, ShouldResemble, []string{"END"})
+		})
+
+		Convey("It should keep its max tokens for what is not set", func() {
+			request := cohere.buildRequest(GenerationParams{}, artifacts)
+
+			So(request.Temperature, ShouldBeNil)
+			So(*request.MaxTokens, ShouldEqual, 4096)
+		})
+	})
+
+	Convey("Given Ollama", t, func() {
+		ollama := &Ollama{model: "model"}
+
+		Convey("It should map all the params to options", func() {
+			So(ollama.options(tuned()), ShouldResemble, map[string]interface{}{
+				"temperature":       0.2,
+				"top_p":             0.9,
+				"top_k":             40,
+				"presence_penalty":  0.5,
+				"frequency_penalty": 0.4,
+				"num_predict":       256,
+				"stop":              []string{"END"},
+			})
+		})
+
+		Convey("It should keep its temperature for what is not set", func() {
+			So(ollama.options(GenerationParams{}), ShouldResemble, map[string]interface{}{"temperature": 0.7})
+		})
+	})
+}
@@ -0,0 +1,315 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Capabilities a provider can declare in the config, so requests that need them
+can be routed to a provider that has them.
+*/
+const (
+	CAPABILITY_TOOLS        = "tools"
+	CAPABILITY_JSON         = "json"
+	CAPABILITY_LONG_CONTEXT = "long_context"
+	CAPABILITY_VISION       = "vision"
+)
+
+var capabilities = map[string]bool{
+	CAPABILITY_TOOLS:        true,
+	CAPABILITY_JSON:         true,
+	CAPABILITY_LONG_CONTEXT: true,
+	CAPABILITY_VISION:       true,
+}
+
+/*
+Cost is what a provider charges per token, in whatever currency the config
+uses, which is the currency usage is reported in.
+*/
+type Cost struct {
+	Input  float64 `mapstructure:"input"`
+	Output float64 `mapstructure:"output"`
+}
+
+/*
+Of is what the usage costs at these prices.
+*/
+func (cost Cost) Of(usage Usage) float64 {
+	return float64(usage.PromptTokens)*cost.Input + float64(usage.CompletionTokens)*cost.Output
+}
+
+/*
+ProviderConfig declares a provider in `ai.providers` in the config. Type picks
+the factory that constructs it, and Key names the environment variable that
+holds the API key, so the key itself never ends up in the config. BaseURL
+points OpenAI compatible and Ollama types at another server, such as a
+self-hosted one, and the remote type at the address of a model server.
+Concurrency is how many requests the provider handles at once, and
+ContextLength how many tokens fit in its context, which is not limited when
+zero.
+*/
+type ProviderConfig struct {
+	Name          string   `mapstructure:"name"`
+	Type          string   `mapstructure:"type"`
+	Model         string   `mapstructure:"model"`
+	BaseURL       string   `mapstructure:"base_url"`
+	Key           string   `mapstructure:"key"`
+	Weight        int      `mapstructure:"weight"`
+	Concurrency   int      `mapstructure:"concurrency"`
+	ContextLength int      `mapstructure:"context_length"`
+	Cost          Cost     `mapstructure:"cost"`
+	Capabilities  []string `mapstructure:"capabilities"`
+	Disabled      bool     `mapstructure:"disabled"`
+}
+
+/*
+APIKey reads the API key from the environment, which is empty for providers
+that do not need one.
+*/
+func (config ProviderConfig) APIKey() (string, error) {
+	if config.Key == "" {
+		return "", nil
+	}
+
+	key := os.Getenv(config.Key)
+
+	if key == "" {
+		return "", fmt.Errorf("provider '%s' needs its API key in %s, which is not set", config.Name, config.Key)
+	}
+
+	return key, nil
+}
+
+/*
+Has reports whether the provider declared the capability.
+*/
+func (config ProviderConfig) Has(capability string) bool {
+	for _, declared := range config.Capabilities {
+		if declared == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Factory constructs a provider from its config.
+*/
+type Factory func(config ProviderConfig) (Provider, error)
+
+var (
+	factories   = make(map[string]Factory)
+	factoriesMu sync.RWMutex
+)
+
+/*
+RegisterFactory makes a type of provider available to the config, replacing
+whatever was registered for the type before.
+*/
+func RegisterFactory(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	factories[name] = factory
+}
+
+func init() {
+	RegisterFactory("openai", func(config ProviderConfig) (Provider, error) {
+		key, err := config.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if config.BaseURL != "" {
+			return NewOpenAICompatible(config.BaseURL, key, config.Model), nil
+		}
+
+		return NewOpenAI(key, config.Model), nil
+	})
+
+	RegisterFactory("anthropic", func(config ProviderConfig) (Provider, error) {
+		key, err := config.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewAnthropic(key, config.Model), nil
+	})
+
+	RegisterFactory("google", func(config ProviderConfig) (Provider, error) {
+		key, err := config.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if google := NewGoogle(key, config.Model); google != nil {
+			return google, nil
+		}
+
+		return nil, fmt.Errorf("provider '%s' could not create a client", config.Name)
+	})
+
+	RegisterFactory("cohere", func(config ProviderConfig) (Provider, error) {
+		key, err := config.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if cohere := NewCohere(key, config.Model); cohere != nil {
+			return cohere, nil
+		}
+
+		return nil, fmt.Errorf("provider '%s' needs an API key", config.Name)
+	})
+
+	RegisterFactory("ollama", func(config ProviderConfig) (Provider, error) {
+		if config.BaseURL != "" {
+			return NewOllamaAt(config.BaseURL, config.Model), nil
+		}
+
+		return NewOllama(config.Model), nil
+	})
+
+	RegisterFactory("remote", func(config ProviderConfig) (Provider, error) {
+		if config.BaseURL == "" {
+			return nil, fmt.Errorf("provider '%s' needs the base_url of the model server", config.Name)
+		}
+
+		token, err := config.APIKey()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewRemoteProvider(config.BaseURL).WithToken(token), nil
+	})
+}
+
+/*
+NewProvider constructs the provider the config declares.
+*/
+func NewProvider(config ProviderConfig) (Provider, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[config.Type]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("provider '%s' has unknown type '%s'", config.Name, config.Type)
+	}
+
+	return factory(config)
+}
+
+/*
+NewConfigProviders reads the providers declared in `ai.providers`, filling in
+the defaults, and falls back to DefaultProviders when there are none, as in a
+config written before providers could be declared.
+*/
+func NewConfigProviders() ([]ProviderConfig, error) {
+	configs := make([]ProviderConfig, 0)
+
+	if err := viper.GetViper().UnmarshalKey("ai.providers", &configs); err != nil {
+		return nil, err
+	}
+
+	if len(configs) == 0 {
+		return DefaultProviders(), nil
+	}
+
+	names := make(map[string]bool, len(configs))
+
+	for i := range configs {
+		config := &configs[i]
+
+		if config.Name == "" {
+			config.Name = config.Model
+		}
+
+		switch {
+		case config.Type == "":
+			return nil, fmt.Errorf("provider %d has no type", i)
+		case config.Name == "":
+			return nil, fmt.Errorf("provider %d has neither a name nor a model", i)
+		case names[config.Name]:
+			return nil, fmt.Errorf("provider '%s' is declared more than once", config.Name)
+		}
+
+		for _, capability := range config.Capabilities {
+			if !capabilities[capability] {
+				return nil, fmt.Errorf("provider '%s' has unknown capability '%s'", config.Name, capability)
+			}
+		}
+
+		names[config.Name] = true
+		config.Weight = max(config.Weight, 1)
+		config.Concurrency = max(config.Concurrency, 1)
+	}
+
+	return configs, nil
+}
+
+/*
+DefaultProviders are the providers used when the config declares none.
+*/
+func DefaultProviders() []ProviderConfig {
+	return []ProviderConfig{
+		{
+			Name: "gpt-4o-mini", Type: "openai", Model: "gpt-4o-mini", Key: "OPENAI_API_KEY",
+			Weight: 1, Concurrency: 1, ContextLength: 128000,
+			Cost:         Cost{Input: 0.00000015, Output: 0.0000006},
+			Capabilities: []string{CAPABILITY_TOOLS, CAPABILITY_JSON, CAPABILITY_LONG_CONTEXT, CAPABILITY_VISION},
+		},
+		{
+			Name: "claude-3-5-sonnet", Type: "anthropic", Model: "claude-3-5-sonnet-20241022", Key: "ANTHROPIC_API_KEY",
+			Weight: 1, Concurrency: 1, ContextLength: 200000,
+			Cost:         Cost{Input: 0.000003, Output: 0.000015},
+			Capabilities: []string{CAPABILITY_TOOLS, CAPABILITY_LONG_CONTEXT, CAPABILITY_VISION},
+		},
+		{
+			Name: "gemini-1.5-flash", Type: "google", Model: "gemini-1.5-flash", Key: "GEMINI_API_KEY",
+			Weight: 1, Concurrency: 1, ContextLength: 1000000,
+			Cost:         Cost{Input: 0.000000075, Output: 0.0000003},
+			Capabilities: []string{CAPABILITY_TOOLS, CAPABILITY_JSON, CAPABILITY_LONG_CONTEXT, CAPABILITY_VISION},
+		},
+		{
+			Name: "command-r", Type: "cohere", Model: "command-r", Key: "COHERE_API_KEY",
+			Weight: 1, Concurrency: 1, ContextLength: 128000,
+			Cost:         Cost{Input: 0.00000015, Output: 0.0000006},
+			Capabilities: []string{CAPABILITY_TOOLS, CAPABILITY_LONG_CONTEXT},
+		},
+	}
+}
+
+/*
+buildProviders constructs every enabled provider, skipping those that cannot
+be constructed, such as when their API key is not set, so one missing key does
+not take down the rest.
+*/
+func buildProviders(configs []ProviderConfig) []*ProviderStatus {
+	statuses := make([]*ProviderStatus, 0, len(configs))
+
+	for _, config := range configs {
+		if config.Disabled {
+			continue
+		}
+
+		provider, err := NewProvider(config)
+		if err != nil {
+			errnie.Warn("provider.buildProviders skipping %s: %s", config.Name, err)
+			continue
+		}
+
+		statuses = append(statuses, &ProviderStatus{
+			name:     config.Name,
+			config:   config,
+			provider: provider,
+		})
+	}
+
+	return statuses
+}
@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/data"
+)
+
+func init() {
+	RegisterFactory("fake", func(config ProviderConfig) (Provider, error) {
+		if _, err := config.APIKey(); err != nil {
+			return nil, err
+		}
+
+		return NewScriptedProvider(&Script{Responses: []string{"from " + config.Name}}), nil
+	})
+}
+
+func TestProviderRegistry(t *testing.T) {
+	Convey("Given a config without providers", t, func() {
+		viper.Reset()
+
+		configs, err := NewConfigProviders()
+
+		Convey("It should fall back to the defaults", func() {
+			So(err, ShouldBeNil)
+			So(configs, ShouldResemble, DefaultProviders())
+		})
+	})
+
+	Convey("Given providers declared in the config", t, func() {
+		t.Setenv("FAKE_KEY", "secret")
+
+		viper.Set("ai.providers", []map[string]any{
+			{"type": "fake", "model": "small", "key": "FAKE_KEY", "capabilities": []string{"tools"}},
+			{"name": "large", "type": "fake", "model": "large", "weight": 3, "cost": map[string]any{"input": 0.5}},
+			{"name": "keyless", "type": "fake", "key": "MISSING_KEY"},
+			{"name": "off", "type": "fake", "disabled": true},
+		})
+		defer viper.Reset()
+
+		configs, err := NewConfigProviders()
+
+		Convey("It should read them, filling in the defaults", func() {
+			So(err, ShouldBeNil)
+			So(configs, ShouldHaveLength, 4)
+
+			So(configs[0].Name, ShouldEqual, "small")
+			So(configs[0].Weight, ShouldEqual, 1)
+			So(configs[0].Concurrency, ShouldEqual, 1)
+			So(configs[0].Has(CAPABILITY_TOOLS), ShouldBeTrue)
+
+			So(configs[1].Weight, ShouldEqual, 3)
+			So(configs[1].Cost.Input, ShouldEqual, 0.5)
+		})
+
+		Convey("It should construct those that are enabled and have their key", func() {
+			statuses := buildProviders(configs)
+
+			So(statuses, ShouldHaveLength, 2)
+			So(statuses[0].name, ShouldEqual, "small")
+			So(statuses[1].name, ShouldEqual, "large")
+		})
+
+		Convey("It should balance over them", func() {
+			lb := &BalancedProvider{}
+			So(lb.Reload(), ShouldBeNil)
+
+			response := ""
+
+			for artifact := range lb.Generate(GenerationParams{}, []*data.Artifact{
+				data.New("test", "user", "prompt", []byte("hello")),
+			}) {
+				response += artifact.Peek("payload")
+			}
+
+			So(response, ShouldBeIn, []string{"from small", "from large"})
+		})
+
+		Convey("It should keep the health of providers across a reload", func() {
+			lb := &BalancedProvider{}
+			So(lb.Reload(), ShouldBeNil)
+
+			lb.providers[1].failures = 2
+
+			viper.Set("ai.providers", []map[string]any{
+				{"name": "large", "type": "fake"},
+				{"name": "extra", "type": "fake"},
+			})
+
+			So(lb.Reload(), ShouldBeNil)
+			So(lb.providers, ShouldHaveLength, 2)
+			So(lb.providers[0].name, ShouldEqual, "large")
+			So(lb.providers[0].failures, ShouldEqual, 2)
+			So(lb.providers[1].failures, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given providers that are declared wrong", t, func() {
+		defer viper.Reset()
+
+		for _, providers := range [][]map[string]any{
+			{{"name": "untyped"}},
+			{{"type": "fake"}},
+			{{"name": "twice", "type": "fake"}, {"name": "twice", "type": "fake"}},
+			{{"name": "psychic", "type": "fake", "capabilities": []string{"telepathy"}}},
+		} {
+			viper.Set("ai.providers", providers)
+
+			_, err := NewConfigProviders()
+			So(err, ShouldNotBeNil)
+		}
+
+		Convey("It should keep the current providers when reloading", func() {
+			lb := &BalancedProvider{providers: []*ProviderStatus{{name: "current"}}}
+
+			So(lb.Reload(), ShouldNotBeNil)
+			So(lb.providers[0].name, ShouldEqual, "current")
+		})
+
+		Convey("It should refuse unknown types", func() {
+			_, err := NewProvider(ProviderConfig{Name: "mystery", Type: "mystery"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
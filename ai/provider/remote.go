@@ -0,0 +1,487 @@
+package provider
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	capnp "capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/rpc"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+ModelServer serves a provider over Cap'n Proto RPC, as the ModelService of
+data/artifact.capnp, so a single host that has the API keys, or runs a local
+model, can serve completions to any number of amsh processes. Generate streams
+every artifact the provider generates to the sink of the caller as it comes
+in, and Query answers with the whole completion at once.
+
+The providers it serves are paid for with the API keys of the host, so it only
+serves on a loopback address or a unix socket, unless it has a token, which
+every connection then has to present before anything else.
+*/
+type ModelServer struct {
+	provider Provider
+	token    string
+}
+
+func NewModelServer(provider Provider) *ModelServer {
+	return &ModelServer{provider: provider}
+}
+
+/*
+TOKEN_TIMEOUT is how long a connection has to present the token of the model
+server, and TOKEN_LIMIT how long a token can be, so a connection that never
+does is not held on to.
+*/
+const (
+	TOKEN_TIMEOUT = 10 * time.Second
+	TOKEN_LIMIT   = 1024
+)
+
+/*
+ErrUnauthenticated is returned when a model server would accept connections
+from other hosts without a token to check them against.
+*/
+var ErrUnauthenticated = errors.New("a model server needs a token to serve beyond loopback")
+
+/*
+WithToken makes the server close every connection that does not present the
+token, on a line of its own, before its first message.
+*/
+func (server *ModelServer) WithToken(token string) *ModelServer {
+	server.token = token
+	return server
+}
+
+/*
+Serve serves the provider to every connection the listener accepts, until the
+listener is closed. It refuses to serve on a listener other hosts can reach
+when the server has no token.
+*/
+func (server *ModelServer) Serve(listener net.Listener) error {
+	if server.token == "" && !loopback(listener.Addr()) {
+		return ErrUnauthenticated
+	}
+
+	boot := capnp.Client(data.ModelService_ServerToClient(server))
+	defer boot.Release()
+
+	for {
+		socket, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go server.accept(socket, boot.AddRef())
+	}
+}
+
+/*
+accept serves the connection once it presented the token, if the server has
+one, and closes it otherwise.
+*/
+func (server *ModelServer) accept(socket net.Conn, boot capnp.Client) {
+	if server.token != "" {
+		if err := server.authenticate(socket); err != nil {
+			errnie.Warn("model server closed %s: %s", socket.RemoteAddr(), err)
+			boot.Release()
+			socket.Close()
+			return
+		}
+	}
+
+	rpc.NewConn(rpc.NewStreamTransport(socket), &rpc.Options{BootstrapClient: boot})
+}
+
+/*
+authenticate reads the token from the connection, a byte at a time, so none
+of the RPC messages that follow it are read along with it.
+*/
+func (server *ModelServer) authenticate(socket net.Conn) error {
+	if err := socket.SetReadDeadline(time.Now().Add(TOKEN_TIMEOUT)); err != nil {
+		return err
+	}
+
+	token := make([]byte, 0, len(server.token))
+	char := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(socket, char); err != nil {
+			return err
+		}
+
+		if char[0] == '\n' {
+			break
+		}
+
+		if len(token) == TOKEN_LIMIT {
+			return errors.New("token too long")
+		}
+
+		token = append(token, char[0])
+	}
+
+	if subtle.ConstantTimeCompare(token, []byte(server.token)) != 1 {
+		return errors.New("wrong token")
+	}
+
+	return socket.SetReadDeadline(time.Time{})
+}
+
+/*
+ListenAndServe serves the provider on the address, `tcp://host:port` or
+`unix:///path/to/socket`. Without a token, the host of a TCP address has to
+be a loopback one.
+*/
+func (server *ModelServer) ListenAndServe(address string) error {
+	network, addr, err := endpoint(address)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	errnie.Info("model server listening on %s", address)
+	return server.Serve(listener)
+}
+
+/*
+Query generates a completion for the request, with the default params, and
+answers with the whole of its text. A provider that fails fails the call.
+*/
+func (server *ModelServer) Query(ctx context.Context, call data.ModelService_query) error {
+	call.Go()
+
+	request, err := call.Args().Request()
+	if err != nil {
+		return err
+	}
+
+	prompt, err := detach(request)
+	if err != nil {
+		return err
+	}
+
+	var (
+		payload []byte
+		failure error
+	)
+
+	for artifact := range server.provider.Generate(GenerationParams{}, []*data.Artifact{prompt}) {
+		if providerErr, ok := ErrorOf(artifact); ok {
+			failure = providerErr
+			continue
+		}
+
+		if _, ok := ToolCallOf(artifact); ok {
+			continue
+		}
+
+		if _, ok := UsageOf(artifact); !ok {
+			payload = append(payload, artifact.Peek("payload")...)
+		}
+	}
+
+	if failure != nil {
+		return failure
+	}
+
+	results, err := call.AllocResults()
+	if err != nil {
+		return err
+	}
+
+	return results.SetResponse(*data.New("remote", "assistant", "completion", payload))
+}
+
+/*
+Generate streams the artifacts the provider generates for the call to its
+sink, in order, and returns once the sink received all of them. A provider
+that fails streams an error artifact, the way it does locally.
+*/
+func (server *ModelServer) Generate(ctx context.Context, call data.ModelService_generate) error {
+	call.Go()
+
+	args := call.Args()
+	params := GenerationParams{}
+
+	if buf, err := args.Params(); err == nil && len(buf) > 0 {
+		if err = json.Unmarshal(buf, &params); err != nil {
+			return fmt.Errorf("params: %w", err)
+		}
+	}
+
+	list, err := args.Artifacts()
+	if err != nil {
+		return err
+	}
+
+	artifacts := make([]*data.Artifact, 0, list.Len())
+
+	for idx := 0; idx < list.Len(); idx++ {
+		artifact, err := detach(list.At(idx))
+		if err != nil {
+			return err
+		}
+
+		artifacts = append(artifacts, artifact)
+	}
+
+	sink := args.Sink()
+
+	// The provider is drained whatever happens to the sink, so it is never
+	// left blocked on a stream nobody reads.
+	for artifact := range server.provider.Generate(params, artifacts) {
+		if err != nil {
+			continue
+		}
+
+		err = sink.Send(ctx, func(p data.ArtifactSink_send_Params) error {
+			return p.SetArtifact(*artifact)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return sink.WaitStreaming()
+}
+
+/*
+RemoteProvider is a Provider that generates on a ModelServer, over TCP or a
+unix socket, so it streams whatever the provider the server serves generates,
+including its tool calls, usage and errors. It connects on the first call,
+and again on the first call after the connection was lost, presenting the
+token of the server first, when it has one.
+*/
+type RemoteProvider struct {
+	address string
+	token   string
+	conn    *rpc.Conn
+	client  data.ModelService
+	mu      sync.Mutex
+}
+
+func NewRemoteProvider(address string) *RemoteProvider {
+	return &RemoteProvider{address: address}
+}
+
+/*
+WithToken sets the token the provider presents to the model server.
+*/
+func (remote *RemoteProvider) WithToken(token string) *RemoteProvider {
+	remote.token = token
+	return remote
+}
+
+func (remote *RemoteProvider) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	return twoface.NewAccumulator(
+		"remote",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		if err := remote.generate(params, artifacts, accumulator.Out); err != nil {
+			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("remote", remote.address, err)
+		}
+	}).Generate()
+}
+
+/*
+Close hangs up on the server.
+*/
+func (remote *RemoteProvider) Close() error {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	if remote.conn == nil {
+		return nil
+	}
+
+	remote.client.Release()
+	err := remote.conn.Close()
+	remote.conn = nil
+
+	return err
+}
+
+func (remote *RemoteProvider) generate(params GenerationParams, artifacts []*data.Artifact, out chan<- *data.Artifact) error {
+	client, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Release()
+
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	sink := data.ArtifactSink_ServerToClient(remoteSink{out: out})
+	defer sink.Release()
+
+	future, release := client.Generate(context.Background(), func(p data.ModelService_generate_Params) error {
+		if err := p.SetParams(buf); err != nil {
+			return err
+		}
+
+		list, err := p.NewArtifacts(int32(len(artifacts)))
+		if err != nil {
+			return err
+		}
+
+		for idx, artifact := range artifacts {
+			if err = list.Set(idx, *artifact); err != nil {
+				return err
+			}
+		}
+
+		return p.SetSink(sink.AddRef())
+	})
+	defer release()
+
+	_, err = future.Struct()
+	return err
+}
+
+/*
+connect returns a reference to the ModelService of the server, dialing it
+when there is no connection, or the one there was is gone.
+*/
+func (remote *RemoteProvider) connect() (data.ModelService, error) {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	if remote.conn != nil {
+		select {
+		case <-remote.conn.Done():
+			remote.client.Release()
+			remote.conn = nil
+		default:
+			return remote.client.AddRef(), nil
+		}
+	}
+
+	network, addr, err := endpoint(remote.address)
+	if err != nil {
+		return data.ModelService{}, err
+	}
+
+	socket, err := net.Dial(network, addr)
+	if err != nil {
+		return data.ModelService{}, err
+	}
+
+	if remote.token != "" {
+		if _, err = io.WriteString(socket, remote.token+"\n"); err != nil {
+			socket.Close()
+			return data.ModelService{}, err
+		}
+	}
+
+	remote.conn = rpc.NewConn(rpc.NewStreamTransport(socket), nil)
+	remote.client = data.ModelService(remote.conn.Bootstrap(context.Background()))
+
+	return remote.client.AddRef(), nil
+}
+
+/*
+remoteSink receives the artifacts a ModelServer streams, and hands them on to
+the stream of the call. Calls to a sink are delivered one at a time, in order.
+*/
+type remoteSink struct {
+	out chan<- *data.Artifact
+}
+
+func (sink remoteSink) Send(ctx context.Context, call data.ArtifactSink_send) error {
+	artifact, err := call.Args().Artifact()
+	if err != nil {
+		return err
+	}
+
+	detached, err := detach(artifact)
+	if err != nil {
+		return err
+	}
+
+	sink.out <- detached
+	return nil
+}
+
+/*
+detach copies an artifact out of the RPC message it came in, which is released
+once the call returns, into a message of its own.
+*/
+func detach(artifact data.Artifact) (*data.Artifact, error) {
+	msg, _, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = msg.SetRoot(capnp.Struct(artifact).ToPtr()); err != nil {
+		return nil, err
+	}
+
+	detached, err := data.ReadRootArtifact(msg)
+	return &detached, err
+}
+
+/*
+loopback is whether only the host itself can connect to the address, which a
+unix socket, or a TCP address on a loopback interface, is. An unspecified
+host, such as that of `:7067`, is every interface, so it is not.
+*/
+func loopback(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+
+	return false
+}
+
+/*
+endpoint splits an address, `tcp://host:port` or `unix:///path/to/socket`,
+into the network and address to dial or listen on. An address without a
+scheme is taken to be TCP.
+*/
+func endpoint(address string) (string, string, error) {
+	if !strings.Contains(address, "://") {
+		return "tcp", address, nil
+	}
+
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch parsed.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		return parsed.Scheme, parsed.Host, nil
+	case "unix":
+		return "unix", parsed.Host + parsed.Path, nil
+	}
+
+	return "", "", errors.New("unsupported address: " + address)
+}
@@ -0,0 +1,238 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"capnproto.org/go/capnp/v3/rpc"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+func TestRemoteProvider(t *testing.T) {
+	Convey("Given a remote provider talking to a model server", t, func() {
+		scripted := NewScriptedProvider(
+			&Script{Key: "ticket", Responses: []string{"```json\n{\"tool\": \"label\", \"arguments\": {\"label\": \"bug\"}}\n```"}},
+			&Script{Key: "denied", Failures: 1, Status: http.StatusUnauthorized},
+			&Script{Responses: []string{"hello from the server"}},
+		)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		go NewModelServer(scripted).Serve(listener)
+
+		remote := NewRemoteProvider("tcp://" + listener.Addr().String())
+		defer remote.Close()
+
+		question := data.New("test", "user", "prompt", []byte("Say hello."))
+
+		Convey("It should stream what the provider of the server generates", func() {
+			completion := complete(remote, GenerationParams{Temperature: utils.Float64Ptr(0.2)}, question)
+			text := ""
+
+			for _, artifact := range completion[:len(completion)-1] {
+				text += artifact.Peek("payload")
+			}
+
+			_, ok := UsageOf(completion[len(completion)-1])
+
+			So(ok, ShouldBeTrue)
+			So(text, ShouldEqual, "hello from the server")
+			So(scripted.Prompts(), ShouldResemble, []string{"Say hello."})
+			So(*scripted.Params()[0].Temperature, ShouldEqual, 0.2)
+		})
+
+		Convey("It should send the tools, and stream the calls to them", func() {
+			params := GenerationParams{Tools: []ToolDefinition{{Name: "label", Parameters: map[string]any{"type": "object"}}}}
+			completion := complete(remote, params, data.New("test", "user", "prompt", []byte("Label this ticket.")))
+
+			call, ok := ToolCallOf(completion[len(completion)-2])
+
+			So(ok, ShouldBeTrue)
+			So(call.Name, ShouldEqual, "label")
+			So(call.Arguments, ShouldResemble, map[string]any{"label": "bug"})
+		})
+
+		Convey("It should stream the errors of the provider of the server", func() {
+			completion := complete(remote, GenerationParams{}, data.New("test", "user", "prompt", []byte("Access denied?")))
+			err, ok := ErrorOf(completion[0])
+
+			So(completion, ShouldHaveLength, 1)
+			So(ok, ShouldBeTrue)
+			So(err.Kind, ShouldEqual, ERROR_AUTH)
+		})
+
+		Convey("It should send the artifacts whole, with what is attached to them", func() {
+			rec := &recorder{Provider: scripted}
+			server, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer server.Close()
+
+			go NewModelServer(rec).Serve(server)
+
+			image := data.NewPart("image/png", "shot.png", []byte{0x89, 'P', 'N', 'G'})
+			prompt := data.New("test", "user", "prompt", []byte("Look.")).Attach(image)
+			prompt.Poke("chain", "test")
+
+			complete(NewRemoteProvider(server.Addr().String()), GenerationParams{}, prompt)
+
+			So(rec.artifacts, ShouldHaveLength, 1)
+			So(rec.artifacts[0].Parts(), ShouldResemble, []data.Part{image})
+			So(rec.artifacts[0].Peek("chain"), ShouldEqual, "test")
+		})
+
+		Convey("It should serve many calls at once", func() {
+			done := make(chan string)
+
+			for range 4 {
+				go func() {
+					text := ""
+
+					for _, artifact := range complete(remote, GenerationParams{}, question) {
+						if _, ok := UsageOf(artifact); !ok {
+							text += artifact.Peek("payload")
+						}
+					}
+
+					done <- text
+				}()
+			}
+
+			for range 4 {
+				So(<-done, ShouldEqual, "hello from the server")
+			}
+		})
+
+		Convey("It should answer a query with the whole completion", func() {
+			socket, err := net.Dial("tcp", listener.Addr().String())
+			So(err, ShouldBeNil)
+
+			conn := rpc.NewConn(rpc.NewStreamTransport(socket), nil)
+			defer conn.Close()
+
+			client := data.ModelService(conn.Bootstrap(context.Background()))
+			defer client.Release()
+
+			future, release := client.Query(context.Background(), func(p data.ModelService_query_Params) error {
+				return p.SetRequest(*question)
+			})
+			defer release()
+
+			results, err := future.Struct()
+			So(err, ShouldBeNil)
+
+			response, err := results.Response()
+			So(err, ShouldBeNil)
+
+			payload, _ := response.Payload()
+			So(string(payload), ShouldEqual, "hello from the server")
+		})
+	})
+
+	Convey("Given a model server on a unix socket", t, func() {
+		address := filepath.Join(t.TempDir(), "model.sock")
+		listener, err := net.Listen("unix", address)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		go NewModelServer(NewScriptedProvider(&Script{Responses: []string{"over the socket"}})).Serve(listener)
+
+		remote := NewRemoteProvider("unix://" + address)
+		defer remote.Close()
+
+		Convey("It should stream over the socket", func() {
+			completion := complete(remote, GenerationParams{}, data.New("test", "user", "prompt", []byte("hi")))
+			So(completion[0].Peek("payload"), ShouldEqual, "over ")
+		})
+	})
+
+	Convey("Given a remote provider without a server", t, func() {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		address := listener.Addr().String()
+		listener.Close()
+
+		remote := NewRemoteProvider(address)
+
+		Convey("It should stream a network error, so the request fails over", func() {
+			completion := complete(remote, GenerationParams{}, data.New("test", "user", "prompt", []byte("hi")))
+			err, ok := ErrorOf(completion[0])
+
+			So(ok, ShouldBeTrue)
+			So(err.Kind, ShouldEqual, ERROR_NETWORK)
+			So(err.Retryable(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a model server that other hosts can reach", t, func() {
+		listener, err := net.Listen("tcp", "0.0.0.0:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		address := "tcp://127.0.0.1:" + port
+		scripted := NewScriptedProvider(&Script{Responses: []string{"with a token"}})
+
+		Convey("It should refuse to serve without a token", func() {
+			So(NewModelServer(scripted).Serve(listener), ShouldEqual, ErrUnauthenticated)
+		})
+
+		Convey("When it has a token", func() {
+			go NewModelServer(scripted).WithToken("secret").Serve(listener)
+
+			Convey("It should serve the connections that present it", func() {
+				remote := NewRemoteProvider(address).WithToken("secret")
+				defer remote.Close()
+
+				completion := complete(remote, GenerationParams{}, data.New("test", "user", "prompt", []byte("hi")))
+				So(completion[0].Peek("payload"), ShouldEqual, "with ")
+			})
+
+			Convey("It should close the connections that do not", func() {
+				for _, token := range []string{"wrong", ""} {
+					remote := NewRemoteProvider(address).WithToken(token)
+
+					completion := complete(remote, GenerationParams{}, data.New("test", "user", "prompt", []byte("hi")))
+					_, ok := ErrorOf(completion[len(completion)-1])
+
+					So(ok, ShouldBeTrue)
+					remote.Close()
+				}
+			})
+		})
+	})
+
+	Convey("Given the addresses model servers listen on", t, func() {
+		Convey("It should only take loopback and unix sockets to be local", func() {
+			So(loopback(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}), ShouldBeTrue)
+			So(loopback(&net.TCPAddr{IP: net.ParseIP("::1")}), ShouldBeTrue)
+			So(loopback(&net.UnixAddr{Name: "/run/amsh.sock", Net: "unix"}), ShouldBeTrue)
+			So(loopback(&net.TCPAddr{IP: net.IPv4zero}), ShouldBeFalse)
+			So(loopback(&net.TCPAddr{IP: net.ParseIP("192.168.1.2")}), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given the addresses of model servers", t, func() {
+		Convey("It should split them into their network and address", func() {
+			for address, expected := range map[string][2]string{
+				"tcp://localhost:7067":  {"tcp", "localhost:7067"},
+				"localhost:7067":        {"tcp", "localhost:7067"},
+				"unix:///run/amsh.sock": {"unix", "/run/amsh.sock"},
+				"tcp6://[::1]:7067":     {"tcp6", "[::1]:7067"},
+			} {
+				network, addr, err := endpoint(address)
+
+				So(err, ShouldBeNil)
+				So([2]string{network, addr}, ShouldEqual, expected)
+			}
+
+			_, _, err := endpoint("http://localhost:7067")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,268 @@
+package provider
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+The routing policies the balanced provider has out of the box. Balanced
+spreads requests over the healthiest providers, cheapest goes to the provider
+the request costs the least on, fastest to the provider that has been quickest
+to respond, and weighted picks at random, in proportion to the weights in the
+config.
+*/
+const (
+	POLICY_BALANCED = "balanced"
+	POLICY_CHEAPEST = "cheapest"
+	POLICY_FASTEST  = "fastest"
+	POLICY_WEIGHTED = "weighted"
+)
+
+/*
+Route is what a request needs from the provider that handles it, and what it
+is expected to cost, worked out from the params and artifacts of the request.
+The providers it was already tried on are passed over while there are others.
+*/
+type Route struct {
+	Policy       string
+	Capabilities []string
+	Budget       float64
+	Tokens       int
+	MaxTokens    int
+	tried        []string
+}
+
+/*
+NewRoute works out the route of a request. Calls with tools need a provider
+that can call them, and calls with images one that can see them, on top of
+the capabilities the params ask for.
+*/
+func NewRoute(params GenerationParams, artifacts []*data.Artifact) Route {
+	route := Route{
+		Policy:       params.Policy,
+		Capabilities: params.Capabilities,
+		Budget:       params.Budget,
+		Tokens:       estimateTokens(artifacts),
+		MaxTokens:    params.MaxTokens,
+	}
+
+	if route.Policy == "" {
+		route.Policy = POLICY_BALANCED
+	}
+
+	if len(params.Tools) > 0 {
+		route.Capabilities = append([]string{CAPABILITY_TOOLS}, route.Capabilities...)
+	}
+
+	if hasImages(artifacts) {
+		route.Capabilities = append([]string{CAPABILITY_VISION}, route.Capabilities...)
+	}
+
+	return route
+}
+
+/*
+Cost is what the request is expected to cost on the provider, which counts the
+response as being as long as MaxTokens allows, and leaves it out when there is
+no limit.
+*/
+func (route Route) Cost(config ProviderConfig) float64 {
+	return float64(route.Tokens)*config.Cost.Input + float64(route.MaxTokens)*config.Cost.Output
+}
+
+/*
+Allows reports why the provider cannot handle the request, if it cannot,
+regardless of how busy or healthy it is.
+*/
+func (route Route) Allows(config ProviderConfig) error {
+	for _, capability := range route.Capabilities {
+		if !config.Has(capability) {
+			return fmt.Errorf("%s does not have the %s capability", config.Name, capability)
+		}
+	}
+
+	if config.ContextLength > 0 && route.Tokens+route.MaxTokens > config.ContextLength {
+		return fmt.Errorf(
+			"%s has a context of %d tokens, and the request needs %d", config.Name, config.ContextLength, route.Tokens+route.MaxTokens,
+		)
+	}
+
+	if cost := route.Cost(config); route.Budget > 0 && cost > route.Budget {
+		return fmt.Errorf("%s would cost %g, over the budget of %g", config.Name, cost, route.Budget)
+	}
+
+	return nil
+}
+
+/*
+untried reports whether the request was not tried on the provider yet.
+*/
+func (route Route) untried(name string) bool {
+	return !slices.Contains(route.tried, name)
+}
+
+/*
+estimateTokens counts the tokens of the artifacts by the rule of thumb of four
+characters per token, plus a few for every message, which is close enough to
+compare against the context length of a provider.
+*/
+func estimateTokens(artifacts []*data.Artifact) int {
+	tokens := 0
+
+	for _, artifact := range artifacts {
+		tokens += 4 + (len(artifact.Peek("payload"))+3)/4
+	}
+
+	return tokens
+}
+
+/*
+Candidate is a provider a policy can pick, as it was when the request came in.
+Latency is how long the provider takes to start responding, on average, and
+zero until it has responded once.
+*/
+type Candidate struct {
+	Name     string
+	Config   ProviderConfig
+	InFlight int
+	Failures int
+	LastUsed time.Time
+	Latency  time.Duration
+}
+
+/*
+Policy picks a provider for the request from the candidates that can handle it
+and have room for it, of which there is always at least one, and returns the
+index of the one it picked.
+*/
+type Policy func(route Route, candidates []Candidate) int
+
+var (
+	policies   = make(map[string]Policy)
+	policiesMu sync.RWMutex
+)
+
+/*
+RegisterPolicy makes a routing policy available by name, to the params of
+agents and Boogie behaviors, replacing whatever was registered under the name
+before.
+*/
+func RegisterPolicy(name string, policy Policy) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	policies[name] = policy
+}
+
+func init() {
+	RegisterPolicy(POLICY_BALANCED, balanced)
+	RegisterPolicy(POLICY_CHEAPEST, cheapest)
+	RegisterPolicy(POLICY_FASTEST, fastest)
+	RegisterPolicy(POLICY_WEIGHTED, weighted)
+}
+
+/*
+policyFor returns the policy registered under the name, falling back to the
+balanced policy for a name that is not.
+*/
+func policyFor(name string) Policy {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	if policy, ok := policies[name]; ok {
+		return policy
+	}
+
+	errnie.Warn("provider.policyFor unknown policy %s, using %s", name, POLICY_BALANCED)
+	return policies[POLICY_BALANCED]
+}
+
+/*
+balanced picks the provider with the fewest failures, and of those the one
+that was used the longest ago.
+*/
+func balanced(route Route, candidates []Candidate) int {
+	best := 0
+
+	for i, candidate := range candidates[1:] {
+		if healthier(candidate, candidates[best]) {
+			best = i + 1
+		}
+	}
+
+	return best
+}
+
+/*
+cheapest picks the provider the request costs the least on, going by balanced
+between providers that cost the same.
+*/
+func cheapest(route Route, candidates []Candidate) int {
+	best := 0
+
+	for i, candidate := range candidates[1:] {
+		cost, bestCost := route.Cost(candidate.Config), route.Cost(candidates[best].Config)
+
+		if cost < bestCost || (cost == bestCost && healthier(candidate, candidates[best])) {
+			best = i + 1
+		}
+	}
+
+	return best
+}
+
+/*
+fastest picks the provider that has been the quickest to start responding.
+Providers that have not responded yet go first, so every provider is measured.
+*/
+func fastest(route Route, candidates []Candidate) int {
+	best := 0
+
+	for i, candidate := range candidates[1:] {
+		latency, bestLatency := candidate.Latency, candidates[best].Latency
+
+		if latency < bestLatency || (latency == bestLatency && healthier(candidate, candidates[best])) {
+			best = i + 1
+		}
+	}
+
+	return best
+}
+
+/*
+weighted picks one of the providers at random, in proportion to the weight
+they were given in the config.
+*/
+func weighted(route Route, candidates []Candidate) int {
+	total := 0
+
+	for _, candidate := range candidates {
+		total += max(candidate.Config.Weight, 1)
+	}
+
+	pick := rand.Intn(total)
+
+	for i, candidate := range candidates {
+		if pick -= max(candidate.Config.Weight, 1); pick < 0 {
+			return i
+		}
+	}
+
+	return len(candidates) - 1
+}
+
+/*
+healthier reports whether the candidate has fewer failures than the current
+pick, or as many, but was used longer ago.
+*/
+func healthier(candidate, current Candidate) bool {
+	return candidate.Failures < current.Failures ||
+		(candidate.Failures == current.Failures && candidate.LastUsed.Before(current.LastUsed))
+}
@@ -0,0 +1,225 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+/*
+blocking is a fake provider that holds on to every request until it is
+released, so requests can be kept in flight.
+*/
+type blocking struct {
+	release chan struct{}
+}
+
+func (blocking *blocking) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	out := make(chan *data.Artifact)
+
+	go func() {
+		defer close(out)
+		<-blocking.release
+		out <- data.New("blocking", "assistant", "model", []byte("done"))
+	}()
+
+	return out
+}
+
+func fake(config ProviderConfig) *ProviderStatus {
+	return &ProviderStatus{
+		name:     config.Name,
+		config:   config,
+		provider: NewScriptedProvider(&Script{Responses: []string{config.Name}}),
+	}
+}
+
+/*
+respond returns the response of the provider, or the kind of error it failed
+with.
+*/
+func respond(lb *BalancedProvider, params GenerationParams) string {
+	response := ""
+
+	for artifact := range lb.Generate(params, []*data.Artifact{data.New("test", "user", "prompt", []byte("hello"))}) {
+		if err, ok := ErrorOf(artifact); ok {
+			return err.Kind
+		}
+
+		response += artifact.Peek("payload")
+	}
+
+	return response
+}
+
+func TestRoute(t *testing.T) {
+	Convey("Given a request with tools", t, func() {
+		route := NewRoute(GenerationParams{
+			Tools:        []ToolDefinition{{Name: "lookup"}},
+			Capabilities: []string{CAPABILITY_JSON},
+			MaxTokens:    100,
+		}, []*data.Artifact{data.New("test", "user", "prompt", []byte(strings.Repeat("a", 400)))})
+
+		Convey("It should need a provider that can call tools", func() {
+			So(route.Policy, ShouldEqual, POLICY_BALANCED)
+			So(route.Capabilities, ShouldResemble, []string{CAPABILITY_TOOLS, CAPABILITY_JSON})
+			So(route.Tokens, ShouldEqual, 104)
+		})
+
+		Convey("It should only allow providers that can handle it", func() {
+			capable := ProviderConfig{Name: "capable", Capabilities: []string{CAPABILITY_TOOLS, CAPABILITY_JSON}}
+
+			So(route.Allows(capable), ShouldBeNil)
+			So(route.Allows(ProviderConfig{Name: "plain"}), ShouldNotBeNil)
+
+			small := capable
+			small.ContextLength = 200
+			So(route.Allows(small), ShouldNotBeNil)
+
+			pricey := capable
+			pricey.Cost = Cost{Input: 0.01, Output: 0.01}
+			So(route.Cost(pricey), ShouldAlmostEqual, 2.04)
+			So(route.Allows(pricey), ShouldBeNil)
+
+			route.Budget = 1
+			So(route.Allows(pricey), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPolicies(t *testing.T) {
+	Convey("Given candidates for a request", t, func() {
+		route := Route{Tokens: 1000, MaxTokens: 1000}
+		now := time.Now()
+
+		candidates := []Candidate{
+			{Name: "pricey", Config: ProviderConfig{Cost: Cost{Input: 2, Output: 2}}, LastUsed: now, Latency: time.Second},
+			{Name: "cheap", Config: ProviderConfig{Cost: Cost{Input: 1, Output: 1}}, LastUsed: now, Latency: 3 * time.Second},
+			{Name: "quick", Config: ProviderConfig{Cost: Cost{Input: 1, Output: 1}, Weight: 98}, Failures: 1, Latency: 500 * time.Millisecond},
+		}
+
+		Convey("Balanced should pick the healthiest", func() {
+			So(candidates[balanced(route, candidates)].Name, ShouldEqual, "pricey")
+		})
+
+		Convey("Cheapest should pick the cheapest, and the healthiest of those", func() {
+			So(candidates[cheapest(route, candidates)].Name, ShouldEqual, "cheap")
+		})
+
+		Convey("Fastest should pick the quickest to respond", func() {
+			So(candidates[fastest(route, candidates)].Name, ShouldEqual, "quick")
+		})
+
+		Convey("Fastest should try providers that were not measured yet first", func() {
+			candidates[0].Latency = 0
+			So(candidates[fastest(route, candidates)].Name, ShouldEqual, "pricey")
+		})
+
+		Convey("Weighted should mostly pick the heaviest", func() {
+			picks := 0
+
+			for range 1000 {
+				if weighted(route, candidates) == 2 {
+					picks++
+				}
+			}
+
+			So(picks, ShouldBeGreaterThan, 900)
+		})
+
+		Convey("An unknown policy should fall back to balanced", func() {
+			So(candidates[policyFor("psychic")(route, candidates)].Name, ShouldEqual, "pricey")
+		})
+	})
+}
+
+func TestRouting(t *testing.T) {
+	Convey("Given a balanced provider over providers that differ", t, func() {
+		lb := &BalancedProvider{
+			initialized: true,
+			providers: []*ProviderStatus{
+				fake(ProviderConfig{Name: "plain", Cost: Cost{Input: 1}}),
+				fake(ProviderConfig{Name: "tools", Cost: Cost{Input: 2}, Capabilities: []string{CAPABILITY_TOOLS}}),
+				fake(ProviderConfig{Name: "vision", Cost: Cost{Input: 3}, Capabilities: []string{CAPABILITY_VISION}}),
+			},
+		}
+
+		Convey("It should route requests with tools to a provider that can call them", func() {
+			So(respond(lb, GenerationParams{Tools: []ToolDefinition{{Name: "lookup"}}}), ShouldEqual, "tools")
+		})
+
+		Convey("It should route requests to a provider with the capabilities they ask for", func() {
+			So(respond(lb, GenerationParams{Capabilities: []string{CAPABILITY_VISION}}), ShouldEqual, "vision")
+		})
+
+		Convey("It should route by the policy the params ask for", func() {
+			So(respond(lb, GenerationParams{Policy: POLICY_CHEAPEST}), ShouldEqual, "plain")
+		})
+
+		Convey("It should keep requests within their budget", func() {
+			So(respond(lb, GenerationParams{Policy: POLICY_CHEAPEST, Budget: 1000}), ShouldEqual, "plain")
+			So(respond(lb, GenerationParams{Budget: 0.001}), ShouldEqual, ERROR_UNAVAILABLE)
+		})
+
+		Convey("It should fail straight away when no provider can handle the request", func() {
+			start := time.Now()
+
+			So(respond(lb, GenerationParams{Capabilities: []string{CAPABILITY_LONG_CONTEXT}}), ShouldEqual, ERROR_UNAVAILABLE)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("It should measure how long providers take to respond", func() {
+			respond(lb, GenerationParams{Capabilities: []string{CAPABILITY_VISION}})
+
+			So(lb.providers[2].latency, ShouldBeGreaterThan, 0)
+			So(lb.providers[2].inFlight, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a provider that handles more than one request at once", t, func() {
+		slow := &blocking{release: make(chan struct{})}
+
+		lb := &BalancedProvider{
+			initialized: true,
+			providers: []*ProviderStatus{
+				{name: "slow", config: ProviderConfig{Name: "slow", Concurrency: 2}, provider: slow},
+			},
+		}
+
+		Convey("It should keep as many requests in flight as the concurrency allows", func() {
+			first := lb.Generate(GenerationParams{}, nil)
+			second := lb.Generate(GenerationParams{}, nil)
+
+			So(func() bool {
+				for range 100 {
+					lb.providers[0].mu.Lock()
+					inFlight := lb.providers[0].inFlight
+					lb.providers[0].mu.Unlock()
+
+					if inFlight == 2 {
+						return true
+					}
+
+					time.Sleep(10 * time.Millisecond)
+				}
+
+				return false
+			}(), ShouldBeTrue)
+
+			So(lb.selectBestProvider(Route{Policy: POLICY_BALANCED}), ShouldBeNil)
+
+			close(slow.release)
+
+			for range first {
+			}
+
+			for range second {
+			}
+
+			So(lb.providers[0].inFlight, ShouldEqual, 0)
+		})
+	})
+}
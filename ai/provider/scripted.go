@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/twoface"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Script is a scripted reply to any prompt that contains Key, or to every prompt
+when Key is empty. The first Failures calls fail, with Err when it is set,
+or as if the backend responded with Status when that is set, after which
+Responses are served in order, repeating the last one once they run out.
+Latency is waited out before the first token of every reply.
+*/
+type Script struct {
+	Key       string        `mapstructure:"key"`
+	Responses []string      `mapstructure:"responses"`
+	Failures  int           `mapstructure:"failures"`
+	Err       error         `mapstructure:"-"`
+	Status    int           `mapstructure:"status"`
+	Latency   time.Duration `mapstructure:"latency"`
+	calls     int
+}
+
+/*
+ScriptedProvider is an in-memory Provider that replies from a script instead
+of calling out to a model, so anything built on top of a Provider can be run
+offline, and deterministically. A failed call behaves like a real provider
+that errored, and streams an error artifact, and nothing else. Tools are
+called the way models without native tool support call them, with JSON blocks
+in the scripted responses.
+*/
+type ScriptedProvider struct {
+	scripts []*Script
+	prompts []string
+	params  []GenerationParams
+	mu      sync.Mutex
+}
+
+func NewScriptedProvider(scripts ...*Script) *ScriptedProvider {
+	return &ScriptedProvider{
+		scripts: scripts,
+		prompts: make([]string, 0),
+		params:  make([]GenerationParams, 0),
+	}
+}
+
+func (scripted *ScriptedProvider) Generate(params GenerationParams, artifacts []*data.Artifact) <-chan *data.Artifact {
+	return twoface.NewAccumulator(
+		"scripted",
+		"provider",
+		"completion",
+		artifacts...,
+	).Yield(func(accumulator *twoface.Accumulator) {
+		defer close(accumulator.Out)
+
+		prompt := ""
+		artifacts = withoutTools(params.Tools, artifacts)
+
+		if len(artifacts) > 0 {
+			prompt = artifacts[len(artifacts)-1].Peek("payload")
+		}
+
+		response, latency, err := scripted.next(prompt, params)
+
+		time.Sleep(latency)
+
+		if err != nil {
+			errnie.Error(err)
+			accumulator.Out <- NewErrorArtifact("scripted", "scripted", err)
+			return
+		}
+
+		for _, token := range strings.SplitAfter(response, " ") {
+			accumulator.Out <- data.New("scripted", "assistant", "scripted", []byte(token))
+		}
+
+		for _, call := range extractToolCalls(response, params.Tools) {
+			accumulator.Out <- NewToolCallArtifact("scripted", "scripted", call)
+		}
+
+		accumulator.Out <- NewUsageArtifact("scripted", "scripted", newUsage(0, 0, artifacts, response))
+	}).Generate()
+}
+
+/*
+Prompts returns the final message of every call made so far, in the order the
+calls were made.
+*/
+func (scripted *ScriptedProvider) Prompts() []string {
+	scripted.mu.Lock()
+	defer scripted.mu.Unlock()
+
+	prompts := make([]string, len(scripted.prompts))
+	copy(prompts, scripted.prompts)
+
+	return prompts
+}
+
+/*
+Params returns the generation params of every call made so far, in the order
+the calls were made.
+*/
+func (scripted *ScriptedProvider) Params() []GenerationParams {
+	scripted.mu.Lock()
+	defer scripted.mu.Unlock()
+
+	params := make([]GenerationParams, len(scripted.params))
+	copy(params, scripted.params)
+
+	return params
+}
+
+/*
+next records the prompt and params, and advances the first script it matches.
+*/
+func (scripted *ScriptedProvider) next(prompt string, params GenerationParams) (string, time.Duration, error) {
+	scripted.mu.Lock()
+	defer scripted.mu.Unlock()
+
+	scripted.prompts = append(scripted.prompts, prompt)
+	scripted.params = append(scripted.params, params)
+
+	for _, script := range scripted.scripts {
+		if !strings.Contains(prompt, script.Key) {
+			continue
+		}
+
+		script.calls++
+
+		if script.calls <= script.Failures && script.Err != nil {
+			return "", script.Latency, script.Err
+		}
+
+		if script.calls <= script.Failures && script.Status != 0 {
+			return "", script.Latency, &ProviderError{
+				Provider: "scripted",
+				Kind:     kindOf(script.Status, nil),
+				Status:   script.Status,
+				Err:      errors.New(http.StatusText(script.Status)),
+			}
+		}
+
+		if script.calls <= script.Failures {
+			return "", script.Latency, errors.New("scripted failure for '" + script.Key + "'")
+		}
+
+		if len(script.Responses) == 0 {
+			return "", script.Latency, nil
+		}
+
+		idx := min(script.calls-script.Failures, len(script.Responses)) - 1
+		return script.Responses[idx], script.Latency, nil
+	}
+
+	return "", 0, errors.New("no script matches the prompt")
+}
@@ -0,0 +1,502 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Structured generates a T instead of text, with the JSON schema reflected from
+T, as utils.GenerateSchema does for the prompts of the processes. The schema
+is set as the format of the call, for providers with a native JSON mode, and
+added to the system prompt for the others, unless it is in there already. A
+response that is not a valid T is sent back to the model with what is wrong
+with it, for it to repair, up to the number of repairs it is given.
+*/
+type Structured[T any] struct {
+	provider Provider
+	repairs  int
+	root     *jsonschema.Schema
+	format   *ResponseFormat
+	prompt   string
+}
+
+func NewStructured[T any](provider Provider, repairs int) *Structured[T] {
+	var instance T
+
+	root := jsonschema.Reflect(&instance)
+
+	return &Structured[T]{
+		provider: provider,
+		repairs:  repairs,
+		root:     root,
+		format:   newResponseFormat(root),
+		prompt:   utils.GenerateSchema[T](),
+	}
+}
+
+/*
+ValidationError is what is wrong with the last response of a structured call,
+after the model ran out of repairs.
+*/
+type ValidationError struct {
+	Attempts int
+	Problems []string
+	Response string
+}
+
+func (validationErr *ValidationError) Error() string {
+	return fmt.Sprintf(
+		"no valid response after %d attempts: %s", validationErr.Attempts, strings.Join(validationErr.Problems, "; "),
+	)
+}
+
+/*
+Generate runs the call until the response is a valid T, or the repairs run
+out, and records the usage of every attempt in the ledger, under the accounts
+of the context. A provider that fails is not repaired, but its error is
+returned as it is.
+*/
+func (structured *Structured[T]) Generate(ctx context.Context, params GenerationParams, artifacts []*data.Artifact) (T, error) {
+	var value T
+
+	params.Format = structured.format
+	conversation := structured.withSchema(artifacts)
+	problems := make([]string, 0)
+	response := ""
+
+	for attempt := 0; attempt <= structured.repairs; attempt++ {
+		var err error
+
+		if response, err = structured.complete(ctx, params, conversation); err != nil {
+			return value, err
+		}
+
+		if value, problems = structured.parse(response); len(problems) == 0 {
+			return value, nil
+		}
+
+		errnie.Warn("provider.Structured.Generate attempt %d: %s", attempt+1, strings.Join(problems, "; "))
+
+		conversation = append(
+			conversation,
+			data.New("structured", "assistant", "structured", []byte(response)),
+			data.New("structured", "user", "repair", []byte(repairPrompt(problems))),
+		)
+	}
+
+	return value, &ValidationError{Attempts: structured.repairs + 1, Problems: problems, Response: response}
+}
+
+/*
+complete runs a single attempt, and returns the text of the response.
+*/
+func (structured *Structured[T]) complete(ctx context.Context, params GenerationParams, artifacts []*data.Artifact) (string, error) {
+	var response strings.Builder
+
+	for artifact := range structured.provider.Generate(params, artifacts) {
+		if usage, ok := UsageOf(artifact); ok {
+			NewConfigLedger().Record(ctx, usage)
+			continue
+		}
+
+		if providerErr, ok := ErrorOf(artifact); ok {
+			return "", providerErr
+		}
+
+		if _, ok := ToolCallOf(artifact); ok {
+			continue
+		}
+
+		response.WriteString(artifact.Peek("payload"))
+	}
+
+	return response.String(), nil
+}
+
+/*
+parse turns the response into a T, and returns what is wrong with it, if
+anything.
+*/
+func (structured *Structured[T]) parse(response string) (T, []string) {
+	var value T
+
+	object := extractJSON(response)
+	decoder := json.NewDecoder(strings.NewReader(object))
+	decoder.UseNumber()
+
+	var document any
+
+	if err := decoder.Decode(&document); err != nil {
+		return value, []string{"the response is not a JSON object: " + err.Error()}
+	}
+
+	if problems := validate(structured.root, structured.root, document, "$"); len(problems) > 0 {
+		return value, problems
+	}
+
+	if err := json.Unmarshal([]byte(object), &value); err != nil {
+		return value, []string{err.Error()}
+	}
+
+	return value, nil
+}
+
+/*
+withSchema adds the schema to the system message, or as the system message
+when there is none, the way withoutTools adds the tools.
+*/
+func (structured *Structured[T]) withSchema(artifacts []*data.Artifact) []*data.Artifact {
+	prompt := utils.JoinWith("\n",
+		"Respond with a single JSON object, wrapped in a Markdown JSON code block, that is valid against this JSON schema:",
+		"",
+		structured.prompt,
+	)
+
+	out := make([]*data.Artifact, 0, len(artifacts)+1)
+	prompted := false
+
+	for _, artifact := range artifacts {
+		if artifact.Peek("role") == "system" && !prompted {
+			prompted = true
+
+			if !strings.Contains(artifact.Peek("payload"), structured.prompt) {
+				artifact = data.New(
+					artifact.Peek("origin"), "system", artifact.Peek("scope"),
+					[]byte(artifact.Peek("payload")+"\n\n"+prompt),
+				).Attach(artifact.Parts()...)
+			}
+		}
+
+		out = append(out, artifact)
+	}
+
+	if !prompted {
+		out = append([]*data.Artifact{data.New("structured", "system", "schema", []byte(prompt))}, out...)
+	}
+
+	return out
+}
+
+func repairPrompt(problems []string) string {
+	lines := []string{"Your response is not valid against the schema:", ""}
+
+	for _, problem := range problems {
+		lines = append(lines, "- "+problem)
+	}
+
+	return utils.JoinWith("\n", append(lines, "", "Respond again, with only the corrected JSON object.")...)
+}
+
+/*
+newResponseFormat turns the reflected schema into the format of the call. The
+root of a reflected schema only refers to the definition of the type, which
+is not accepted as the root of a format, so that definition is used instead,
+with the other definitions in it.
+*/
+func newResponseFormat(root *jsonschema.Schema) *ResponseFormat {
+	format := &ResponseFormat{Name: "response", Schema: make(map[string]any)}
+	definition := root
+
+	if name, ok := strings.CutPrefix(root.Ref, "#/$defs/"); ok && root.Definitions[name] != nil {
+		format.Name, definition = name, root.Definitions[name]
+	}
+
+	buf, err := json.Marshal(definition)
+	if err != nil {
+		errnie.Error(err)
+		return format
+	}
+
+	if err = json.Unmarshal(buf, &format.Schema); err != nil {
+		errnie.Error(err)
+	}
+
+	if len(root.Definitions) > 0 {
+		format.Schema["$defs"] = root.Definitions
+	}
+
+	return format
+}
+
+/*
+extractJSON finds the JSON object in a response, which is either the whole
+response, the first JSON block in it, or whatever is between its first and
+last brace.
+*/
+func extractJSON(response string) string {
+	response = strings.TrimSpace(response)
+
+	for _, block := range utils.ExtractCodeBlocks(response)["json"] {
+		if json.Valid([]byte(block)) {
+			return block
+		}
+	}
+
+	if json.Valid([]byte(response)) {
+		return response
+	}
+
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+
+	if start >= 0 && end > start {
+		return response[start : end+1]
+	}
+
+	return response
+}
+
+/*
+validate checks the value against the schema, resolving references against
+the root, and returns what is wrong with it, by path. It covers what
+reflected schemas use: types, required and additional properties, items,
+enums, constants, bounds and patterns.
+*/
+func validate(root, schema *jsonschema.Schema, value any, path string) []string {
+	if schema == nil || schema == jsonschema.TrueSchema {
+		return nil
+	}
+
+	if schema == jsonschema.FalseSchema {
+		return []string{path + " is not allowed"}
+	}
+
+	if name, ok := strings.CutPrefix(schema.Ref, "#/$defs/"); ok {
+		return validate(root, root.Definitions[name], value, path)
+	}
+
+	problems := make([]string, 0)
+
+	if schema.Type != "" && !hasType(value, schema.Type) {
+		return []string{fmt.Sprintf("%s should be of type %s, not %s", path, schema.Type, typeOf(value))}
+	}
+
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(option any) bool { return same(option, value) }) {
+		problems = append(problems, fmt.Sprintf("%s should be one of %v", path, schema.Enum))
+	}
+
+	if schema.Const != nil && !same(schema.Const, value) {
+		problems = append(problems, fmt.Sprintf("%s should be %v", path, schema.Const))
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		problems = append(problems, validateObject(root, schema, value, path)...)
+	case []any:
+		problems = append(problems, validateArray(root, schema, value, path)...)
+	case string:
+		problems = append(problems, validateString(schema, value, path)...)
+	case json.Number:
+		problems = append(problems, validateNumber(schema, value, path)...)
+	}
+
+	for _, sub := range schema.AllOf {
+		problems = append(problems, validate(root, sub, value, path)...)
+	}
+
+	if len(schema.AnyOf) > 0 && !slices.ContainsFunc(schema.AnyOf, func(sub *jsonschema.Schema) bool {
+		return len(validate(root, sub, value, path)) == 0
+	}) {
+		problems = append(problems, path+" does not match any of the schemas it may be")
+	}
+
+	if len(schema.OneOf) > 0 {
+		matches := 0
+
+		for _, sub := range schema.OneOf {
+			if len(validate(root, sub, value, path)) == 0 {
+				matches++
+			}
+		}
+
+		switch {
+		case matches == 0:
+			problems = append(problems, path+" does not match one of the schemas it may be")
+		case matches > 1:
+			problems = append(problems, fmt.Sprintf("%s matches %d of the schemas it may be, rather than exactly one", path, matches))
+		}
+	}
+
+	return problems
+}
+
+func validateObject(root, schema *jsonschema.Schema, object map[string]any, path string) []string {
+	problems := make([]string, 0)
+
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s is required", path, name))
+		}
+	}
+
+	names := make([]string, 0, len(object))
+
+	for name := range object {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		if schema.Properties != nil {
+			if property, ok := schema.Properties.Get(name); ok {
+				problems = append(problems, validate(root, property, object[name], path+"."+name)...)
+				continue
+			}
+		}
+
+		if schema.AdditionalProperties == jsonschema.FalseSchema {
+			problems = append(problems, fmt.Sprintf("%s.%s is not a known property", path, name))
+			continue
+		}
+
+		problems = append(problems, validate(root, schema.AdditionalProperties, object[name], path+"."+name)...)
+	}
+
+	return problems
+}
+
+func validateArray(root, schema *jsonschema.Schema, array []any, path string) []string {
+	problems := make([]string, 0)
+
+	if schema.MinItems != nil && uint64(len(array)) < *schema.MinItems {
+		problems = append(problems, fmt.Sprintf("%s should have at least %d items", path, *schema.MinItems))
+	}
+
+	if schema.MaxItems != nil && uint64(len(array)) > *schema.MaxItems {
+		problems = append(problems, fmt.Sprintf("%s should have at most %d items", path, *schema.MaxItems))
+	}
+
+	for idx, item := range array {
+		problems = append(problems, validate(root, schema.Items, item, fmt.Sprintf("%s[%d]", path, idx))...)
+	}
+
+	return problems
+}
+
+func validateString(schema *jsonschema.Schema, value string, path string) []string {
+	problems := make([]string, 0)
+	length := uint64(len([]rune(value)))
+
+	if schema.MinLength != nil && length < *schema.MinLength {
+		problems = append(problems, fmt.Sprintf("%s should be at least %d characters", path, *schema.MinLength))
+	}
+
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		problems = append(problems, fmt.Sprintf("%s should be at most %d characters", path, *schema.MaxLength))
+	}
+
+	if schema.Pattern != "" {
+		if pattern, err := regexp.Compile(schema.Pattern); err == nil && !pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%s should match %s", path, schema.Pattern))
+		}
+	}
+
+	return problems
+}
+
+func validateNumber(schema *jsonschema.Schema, value json.Number, path string) []string {
+	problems := make([]string, 0)
+	number, _ := value.Float64()
+
+	bounds := []struct {
+		bound json.Number
+		fails func(number, bound float64) bool
+		says  string
+	}{
+		{schema.Minimum, func(number, bound float64) bool { return number < bound }, "at least"},
+		{schema.Maximum, func(number, bound float64) bool { return number > bound }, "at most"},
+		{schema.ExclusiveMinimum, func(number, bound float64) bool { return number <= bound }, "more than"},
+		{schema.ExclusiveMaximum, func(number, bound float64) bool { return number >= bound }, "less than"},
+	}
+
+	for _, bound := range bounds {
+		if bound.bound == "" {
+			continue
+		}
+
+		if limit, err := bound.bound.Float64(); err == nil && bound.fails(number, limit) {
+			problems = append(problems, fmt.Sprintf("%s should be %s %s", path, bound.says, bound.bound))
+		}
+	}
+
+	return problems
+}
+
+/*
+hasType reports whether the value, decoded with json.Number for numbers, is of
+the JSON schema type.
+*/
+func hasType(value any, kind string) bool {
+	switch kind {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+
+		if !ok {
+			return false
+		}
+
+		float, err := number.Float64()
+		return err == nil && float == math.Trunc(float)
+	}
+
+	return true
+}
+
+func typeOf(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case nil:
+		return "null"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+/*
+same compares values from the schema to values from the response, which only
+differ in how their numbers were decoded.
+*/
+func same(expected, value any) bool {
+	left, _ := json.Marshal(expected)
+	right, _ := json.Marshal(value)
+
+	return bytes.Equal(left, right)
+}
@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/invopop/jsonschema"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+type Ticket struct {
+	Title    string   `json:"title" jsonschema:"title=Title,description=The title of the ticket,required"`
+	Label    string   `json:"label" jsonschema:"title=Label,description=The label of the ticket,enum=bug,enum=feature,required"`
+	Priority int      `json:"priority" jsonschema:"title=Priority,description=How urgent the ticket is,minimum=1,maximum=3,required"`
+	Tags     []string `json:"tags,omitempty" jsonschema:"title=Tags,description=Tags for the ticket"`
+}
+
+func TestStructured(t *testing.T) {
+	Convey("Given a structured call for a ticket", t, func() {
+		question := data.New("test", "user", "prompt", []byte("Label the ticket: the app crashes on start."))
+		valid := "```json\n{\"title\": \"Crash on start\", \"label\": \"bug\", \"priority\": 1}\n```"
+
+		Convey("It should return the ticket the model responded with", func() {
+			scripted := NewScriptedProvider(&Script{Responses: []string{valid}})
+			ticket, err := NewStructured[Ticket](scripted, 2).Generate(context.Background(), GenerationParams{}, []*data.Artifact{question})
+
+			So(err, ShouldBeNil)
+			So(ticket, ShouldResemble, Ticket{Title: "Crash on start", Label: "bug", Priority: 1})
+			So(scripted.Prompts(), ShouldHaveLength, 1)
+		})
+
+		Convey("It should ask for the format natively and in the prompt", func() {
+			scripted := NewScriptedProvider(&Script{Responses: []string{valid}})
+			system := data.New("test", "system", "prompt", []byte("You are a helpdesk."))
+			structured := NewStructured[Ticket](scripted, 0)
+
+			_, err := structured.Generate(context.Background(), GenerationParams{}, []*data.Artifact{system, question})
+
+			So(err, ShouldBeNil)
+			So(scripted.Params()[0].Format.Name, ShouldEqual, "Ticket")
+			So(scripted.Params()[0].Format.Schema["type"], ShouldEqual, "object")
+			So(structured.withSchema([]*data.Artifact{system})[0].Peek("payload"), ShouldContainSubstring, structured.prompt)
+			So(structured.withSchema([]*data.Artifact{question})[0].Peek("role"), ShouldEqual, "system")
+		})
+
+		Convey("It should have the model repair a response that is not valid", func() {
+			scripted := NewScriptedProvider(&Script{Responses: []string{
+				`{"title": "Crash on start", "label": "crash", "priority": 5, "owner": "me"}`,
+				valid,
+			}})
+
+			ticket, err := NewStructured[Ticket](scripted, 2).Generate(context.Background(), GenerationParams{}, []*data.Artifact{question})
+
+			So(err, ShouldBeNil)
+			So(ticket.Label, ShouldEqual, "bug")
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+			So(scripted.Prompts()[1], ShouldContainSubstring, "$.label should be one of [bug feature]")
+			So(scripted.Prompts()[1], ShouldContainSubstring, "$.priority should be at most 3")
+			So(scripted.Prompts()[1], ShouldContainSubstring, "$.owner is not a known property")
+		})
+
+		Convey("It should give up once the repairs run out", func() {
+			scripted := NewScriptedProvider(&Script{Responses: []string{"I would label it a bug."}})
+
+			_, err := NewStructured[Ticket](scripted, 1).Generate(context.Background(), GenerationParams{}, []*data.Artifact{question})
+
+			var validationErr *ValidationError
+			So(errors.As(err, &validationErr), ShouldBeTrue)
+			So(validationErr.Attempts, ShouldEqual, 2)
+			So(validationErr.Response, ShouldEqual, "I would label it a bug.")
+			So(scripted.Prompts(), ShouldHaveLength, 2)
+		})
+
+		Convey("It should not repair a provider that failed", func() {
+			scripted := NewScriptedProvider(&Script{Failures: 1, Status: 401})
+
+			_, err := NewStructured[Ticket](scripted, 2).Generate(context.Background(), GenerationParams{}, []*data.Artifact{question})
+
+			var providerErr *ProviderError
+			So(errors.As(err, &providerErr), ShouldBeTrue)
+			So(providerErr.Kind, ShouldEqual, ERROR_AUTH)
+			So(scripted.Prompts(), ShouldHaveLength, 1)
+		})
+
+		Convey("It should send the schema natively through the OpenAI API", func() {
+			scripted := NewScriptedProvider(&Script{Responses: []string{valid}})
+			server := httptest.NewServer(NewMockLLM("mockllm", scripted))
+			defer server.Close()
+
+			ticket, err := NewStructured[Ticket](NewOpenAICompatible(server.URL+"/v1", "", "mockllm"), 0).Generate(
+				context.Background(), GenerationParams{}, []*data.Artifact{question},
+			)
+
+			So(err, ShouldBeNil)
+			So(ticket.Priority, ShouldEqual, 1)
+			So(scripted.Params()[0].Format.Name, ShouldEqual, "Ticket")
+			So(scripted.Params()[0].Format.Schema["required"], ShouldContain, "label")
+		})
+	})
+
+	Convey("Given a schema that a value has to match exactly one branch of", t, func() {
+		short := uint64(3)
+		schema := &jsonschema.Schema{OneOf: []*jsonschema.Schema{
+			{Type: "string"},
+			{Type: "string", MaxLength: &short},
+			{Type: "integer"},
+		}}
+
+		Convey("It should take a value that matches one of them", func() {
+			So(validate(schema, schema, "ticket", "$"), ShouldBeEmpty)
+			So(validate(schema, schema, json.Number("7"), "$"), ShouldBeEmpty)
+		})
+
+		Convey("It should not take a value that matches two of them", func() {
+			So(validate(schema, schema, "bug", "$"), ShouldResemble, []string{"$ matches 2 of the schemas it may be, rather than exactly one"})
+		})
+
+		Convey("It should not take a value that matches none of them", func() {
+			So(validate(schema, schema, true, "$"), ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given a response to find the JSON object in", t, func() {
+		So(extractJSON(`{"a": 1}`), ShouldEqual, `{"a": 1}`)
+		So(extractJSON("Here you go:\n```json\n{\"a\": 1}\n```"), ShouldEqual, `{"a": 1}`)
+		So(extractJSON(`Sure! {"a": {"b": 2}} Hope that helps.`), ShouldEqual, `{"a": {"b": 2}}`)
+	})
+}
@@ -0,0 +1,295 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+/*
+ToolDefinition describes a tool a model can call, with its arguments as a
+JSON schema. Providers that support tools natively pass it on as their own
+kind of tool, and the others are told about it in the prompt.
+*/
+type ToolDefinition struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+}
+
+/*
+NewToolDefinition converts the schema of a tool, as returned by its
+GenerateSchema method, to a definition. The name is that of the type the
+schema was reflected from, lowercased, so the Browser tool is called browser.
+*/
+func NewToolDefinition(schema string) (ToolDefinition, error) {
+	var root map[string]any
+
+	if err := json.Unmarshal([]byte(schema), &root); err != nil {
+		return ToolDefinition{}, err
+	}
+
+	ref, _ := root["$ref"].(string)
+	name, ok := strings.CutPrefix(ref, "#/$defs/")
+	if !ok {
+		return ToolDefinition{}, errors.New("the schema does not refer to a definition")
+	}
+
+	defs, _ := root["$defs"].(map[string]any)
+	parameters, ok := defs[name].(map[string]any)
+	if !ok {
+		return ToolDefinition{}, fmt.Errorf("the schema does not define '%s'", name)
+	}
+
+	// Other definitions are kept, so nested references still resolve against
+	// the parameters, which are now the root of the schema.
+	if len(defs) > 1 {
+		parameters["$defs"] = defs
+	}
+
+	description, _ := parameters["description"].(string)
+
+	if description == "" {
+		description = "Use the " + strings.ToLower(name) + " tool."
+	}
+
+	return ToolDefinition{
+		Name:        strings.ToLower(name),
+		Description: description,
+		Parameters:  parameters,
+	}, nil
+}
+
+/*
+ToolCall is a call to a tool made by a model, with the ID that ties the result
+back to it.
+*/
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments map[string]any
+}
+
+/*
+NewToolCallArtifact returns the artifact a provider produces for a tool call,
+which has the arguments as its payload.
+*/
+func NewToolCallArtifact(origin, model string, call ToolCall) *data.Artifact {
+	arguments, _ := json.Marshal(call.Arguments)
+
+	artifact := data.New(origin, "assistant", "tool_call", arguments)
+	artifact.Poke("model", model)
+	artifact.Poke("tool_call_id", call.ID)
+	artifact.Poke("name", call.Name)
+
+	return artifact
+}
+
+/*
+NewToolResultArtifact returns the artifact that feeds the result of a tool
+call back to the model.
+*/
+func NewToolResultArtifact(origin string, call ToolCall, result string) *data.Artifact {
+	artifact := data.New(origin, "tool", "tool_result", []byte(result))
+	artifact.Poke("tool_call_id", call.ID)
+	artifact.Poke("name", call.Name)
+
+	return artifact
+}
+
+/*
+ToolCallOf returns the tool call an artifact holds, if it holds one.
+*/
+func ToolCallOf(artifact *data.Artifact) (ToolCall, bool) {
+	if artifact.Peek("scope") != "tool_call" {
+		return ToolCall{}, false
+	}
+
+	call := ToolCall{
+		ID:        artifact.Peek("tool_call_id"),
+		Name:      artifact.Peek("name"),
+		Arguments: make(map[string]any),
+	}
+
+	_ = json.Unmarshal([]byte(artifact.Peek("payload")), &call.Arguments)
+	return call, true
+}
+
+/*
+toolCallDeltas puts tool calls back together from the pieces they are
+streamed in, keyed by the index the provider gives each call.
+*/
+type toolCallDeltas struct {
+	order []int64
+	calls map[int64]*toolCallDelta
+}
+
+type toolCallDelta struct {
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+func newToolCallDeltas() *toolCallDeltas {
+	return &toolCallDeltas{
+		order: make([]int64, 0),
+		calls: make(map[int64]*toolCallDelta),
+	}
+}
+
+/*
+add records a piece of the call at the index. The ID and name come with the
+first piece, and the arguments are spread out over all of them.
+*/
+func (deltas *toolCallDeltas) add(index int64, id, name, arguments string) {
+	delta, ok := deltas.calls[index]
+
+	if !ok {
+		delta = &toolCallDelta{}
+		deltas.calls[index] = delta
+		deltas.order = append(deltas.order, index)
+	}
+
+	if id != "" {
+		delta.id = id
+	}
+
+	if name != "" {
+		delta.name = name
+	}
+
+	delta.arguments.WriteString(arguments)
+}
+
+/*
+done returns the complete calls, in the order they were started.
+*/
+func (deltas *toolCallDeltas) done() []ToolCall {
+	calls := make([]ToolCall, 0, len(deltas.order))
+
+	for _, index := range deltas.order {
+		delta := deltas.calls[index]
+
+		calls = append(calls, ToolCall{
+			ID:        delta.id,
+			Name:      delta.name,
+			Arguments: parseArguments(delta.arguments.String()),
+		})
+	}
+
+	return calls
+}
+
+/*
+parseArguments decodes the arguments of a tool call as they were streamed,
+which is nothing at all for a tool that takes none.
+*/
+func parseArguments(arguments string) map[string]any {
+	out := make(map[string]any)
+
+	if strings.TrimSpace(arguments) != "" {
+		_ = json.Unmarshal([]byte(arguments), &out)
+	}
+
+	return out
+}
+
+/*
+toolPrompt tells a model without native tool support which tools it has, and
+how to call them, so its calls can be found in the JSON blocks of its response.
+*/
+func toolPrompt(tools []ToolDefinition) string {
+	lines := []string{
+		"You have access to the following tools.",
+		"To call a tool, respond with a JSON block for every call, in this format:",
+		"",
+		"```json",
+		`{"tool": "<name>", "arguments": {<arguments>}}`,
+		"```",
+		"",
+	}
+
+	for _, tool := range tools {
+		schema, _ := json.Marshal(tool.Parameters)
+		lines = append(lines, "- "+tool.Name+": "+tool.Description, "  arguments: "+string(schema))
+	}
+
+	return utils.JoinWith("\n", lines...)
+}
+
+/*
+extractToolCalls finds the calls to known tools in the JSON blocks of a
+response, for models without native tool support.
+*/
+func extractToolCalls(response string, tools []ToolDefinition) []ToolCall {
+	known := make(map[string]bool, len(tools))
+
+	for _, tool := range tools {
+		known[tool.Name] = true
+	}
+
+	calls := make([]ToolCall, 0)
+
+	for _, block := range utils.ExtractJSONBlocks(response) {
+		name, _ := block["tool"].(string)
+
+		if !known[name] {
+			continue
+		}
+
+		arguments, _ := block["arguments"].(map[string]any)
+
+		if arguments == nil {
+			arguments = make(map[string]any)
+		}
+
+		calls = append(calls, ToolCall{ID: "call_" + uuid.NewString(), Name: name, Arguments: arguments})
+	}
+
+	return calls
+}
+
+/*
+withoutTools rewrites a conversation for models without native tool support.
+The tool prompt is added to the system message, or becomes the system message
+when there is none, and tool calls and results become plain messages.
+*/
+func withoutTools(tools []ToolDefinition, artifacts []*data.Artifact) []*data.Artifact {
+	out := make([]*data.Artifact, 0, len(artifacts)+1)
+	prompted := len(tools) == 0
+
+	for _, artifact := range artifacts {
+		switch {
+		case artifact.Peek("role") == "system" && !prompted:
+			out = append(out, data.New(
+				artifact.Peek("origin"), "system", artifact.Peek("scope"),
+				[]byte(artifact.Peek("payload")+"\n\n"+toolPrompt(tools)),
+			).Attach(artifact.Parts()...))
+			prompted = true
+		case artifact.Peek("scope") == "tool_call":
+			call, _ := ToolCallOf(artifact)
+			block, _ := json.Marshal(map[string]any{"tool": call.Name, "arguments": call.Arguments})
+			out = append(out, data.New(
+				artifact.Peek("origin"), "assistant", "tool_block", []byte("```json\n"+string(block)+"\n```"),
+			))
+		case artifact.Peek("role") == "tool":
+			out = append(out, data.New(
+				artifact.Peek("origin"), "user", "tool_result",
+				[]byte("The "+artifact.Peek("name")+" tool returned:\n"+artifact.Peek("payload")),
+			).Attach(artifact.Parts()...))
+		default:
+			out = append(out, artifact)
+		}
+	}
+
+	if !prompted {
+		out = append([]*data.Artifact{data.New("provider", "system", "tools", []byte(toolPrompt(tools)))}, out...)
+	}
+
+	return out
+}
@@ -0,0 +1,282 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/generative-ai-go/genai"
+	sdk "github.com/openai/openai-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/amsh/utils"
+)
+
+type Lookup struct {
+	Query string   `json:"query" jsonschema:"description=What to look up,required"`
+	Limit int      `json:"limit,omitempty" jsonschema:"description=How many results to return"`
+	Tags  []string `json:"tags,omitempty" jsonschema:"description=Tags to filter on,enum=news,enum=docs"`
+}
+
+func lookup() ToolDefinition {
+	definition, err := NewToolDefinition(utils.GenerateSchema[Lookup]())
+	So(err, ShouldBeNil)
+	return definition
+}
+
+/*
+conversation is a user message followed by a call to the lookup tool and its
+result, which is what a provider is sent to continue after calling a tool.
+*/
+func conversation() []*data.Artifact {
+	call := ToolCall{ID: "call_1", Name: "lookup", Arguments: map[string]any{"query": "boogie"}}
+
+	return []*data.Artifact{
+		data.New("test", "system", "prompt", []byte("be brief")),
+		data.New("test", "user", "prompt", []byte("what is boogie?")),
+		NewToolCallArtifact("test", "model", call),
+		NewToolResultArtifact("test", call, "a language"),
+	}
+}
+
+/*
+parallelConversation is a round in which the model said something, and called
+the lookup tool twice, followed by the results of both calls.
+*/
+func parallelConversation() []*data.Artifact {
+	first := ToolCall{ID: "call_1", Name: "lookup", Arguments: map[string]any{"query": "boogie"}}
+	second := ToolCall{ID: "call_2", Name: "lookup", Arguments: map[string]any{"query": "marvin"}}
+
+	return []*data.Artifact{
+		data.New("test", "user", "prompt", []byte("what are boogie and marvin?")),
+		data.New("test", "assistant", "model", []byte("Let me look both up.")),
+		NewToolCallArtifact("test", "model", first),
+		NewToolCallArtifact("test", "model", second),
+		NewToolResultArtifact("test", first, "a language"),
+		NewToolResultArtifact("test", second, "an agent"),
+	}
+}
+
+func TestToolDefinition(t *testing.T) {
+	Convey("Given the schema of a tool", t, func() {
+		definition := lookup()
+
+		Convey("It should be named after the type", func() {
+			So(definition.Name, ShouldEqual, "lookup")
+			So(definition.Description, ShouldEqual, "Use the lookup tool.")
+		})
+
+		Convey("It should have the definition of the type as its parameters", func() {
+			So(definition.Parameters["type"], ShouldEqual, "object")
+			So(definition.Parameters["required"], ShouldResemble, []any{"query"})
+			So(definition.Parameters["properties"], ShouldContainKey, "limit")
+		})
+	})
+
+	Convey("Given a schema that does not refer to a definition", t, func() {
+		_, err := NewToolDefinition(`{"type": "object"}`)
+
+		Convey("It should fail", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestToolCalls(t *testing.T) {
+	Convey("Given a tool call artifact", t, func() {
+		artifact := NewToolCallArtifact("test", "model", ToolCall{
+			ID: "call_1", Name: "lookup", Arguments: map[string]any{"query": "boogie"},
+		})
+
+		Convey("It should give the call back", func() {
+			call, ok := ToolCallOf(artifact)
+
+			So(ok, ShouldBeTrue)
+			So(call.ID, ShouldEqual, "call_1")
+			So(call.Name, ShouldEqual, "lookup")
+			So(call.Arguments, ShouldResemble, map[string]any{"query": "boogie"})
+		})
+
+		Convey("It should not be mistaken for text", func() {
+			_, ok := ToolCallOf(data.New("test", "assistant", "model", []byte("hello")))
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given tool calls streamed in pieces", t, func() {
+		deltas := newToolCallDeltas()
+		deltas.add(1, "call_b", "lookup", "")
+		deltas.add(0, "call_a", "lookup", `{"que`)
+		deltas.add(0, "", "", `ry": "a"}`)
+		deltas.add(1, "", "", `{"query": "b"}`)
+
+		Convey("It should put them back together, in the order they started", func() {
+			So(deltas.done(), ShouldResemble, []ToolCall{
+				{ID: "call_b", Name: "lookup", Arguments: map[string]any{"query": "b"}},
+				{ID: "call_a", Name: "lookup", Arguments: map[string]any{"query": "a"}},
+			})
+		})
+	})
+}
+
+func TestProviderTools(t *testing.T) {
+	Convey("Given OpenAI", t, func() {
+		openai := &OpenAI{model: "model"}
+		request := openai.buildRequestParams(GenerationParams{Tools: []ToolDefinition{lookup()}}, conversation())
+
+		Convey("It should define the tools as functions", func() {
+			So(request.Tools.Value, ShouldHaveLength, 1)
+			So(request.Tools.Value[0].Function.Value.Name.Value, ShouldEqual, "lookup")
+		})
+
+		Convey("It should send the call and its result back", func() {
+			messages := request.Messages.Value
+			So(messages, ShouldHaveLength, 4)
+
+			call := messages[2].(sdk.ChatCompletionAssistantMessageParam)
+			So(call.ToolCalls.Value[0].ID.Value, ShouldEqual, "call_1")
+			So(call.ToolCalls.Value[0].Function.Value.Arguments.Value, ShouldEqual, `{"query":"boogie"}`)
+
+			result := messages[3].(sdk.ChatCompletionToolMessageParam)
+			So(result.ToolCallID.Value, ShouldEqual, "call_1")
+		})
+
+		Convey("It should send the calls of a round in one assistant message, with its text, before the results", func() {
+			messages := openai.buildRequestParams(GenerationParams{}, parallelConversation()).Messages.Value
+			So(messages, ShouldHaveLength, 4)
+
+			round := messages[1].(sdk.ChatCompletionAssistantMessageParam)
+			So(round.Content.Value[0].(sdk.ChatCompletionContentPartTextParam).Text.Value, ShouldEqual, "Let me look both up.")
+			So(round.ToolCalls.Value, ShouldHaveLength, 2)
+			So(round.ToolCalls.Value[0].ID.Value, ShouldEqual, "call_1")
+			So(round.ToolCalls.Value[1].ID.Value, ShouldEqual, "call_2")
+
+			So(messages[2].(sdk.ChatCompletionToolMessageParam).ToolCallID.Value, ShouldEqual, "call_1")
+			So(messages[3].(sdk.ChatCompletionToolMessageParam).ToolCallID.Value, ShouldEqual, "call_2")
+		})
+	})
+
+	Convey("Given Anthropic", t, func() {
+		claude := &Anthropic{model: "model", maxTokens: 4096}
+		request := claude.buildRequestParams(GenerationParams{Tools: []ToolDefinition{lookup()}}, conversation())
+
+		Convey("It should define the tools", func() {
+			So(request.Tools.Value, ShouldHaveLength, 1)
+			So(request.Tools.Value[0].Name.Value, ShouldEqual, "lookup")
+		})
+
+		Convey("It should send the call as tool use, and the result in a user message after it", func() {
+			messages := request.Messages.Value
+			So(messages, ShouldHaveLength, 3)
+
+			So(messages[1].Role.Value, ShouldEqual, anthropic.MessageParamRoleAssistant)
+			So(messages[1].Content.Value[0].(anthropic.ToolUseBlockParam).ID.Value, ShouldEqual, "call_1")
+
+			So(messages[2].Role.Value, ShouldEqual, anthropic.MessageParamRoleUser)
+			So(messages[2].Content.Value[0].(anthropic.ToolResultBlockParam).ToolUseID.Value, ShouldEqual, "call_1")
+		})
+	})
+
+	Convey("Given Google", t, func() {
+		google := &Google{model: "model", maxTokens: 4096}
+		model := &genai.GenerativeModel{}
+		google.configure(model, GenerationParams{Tools: []ToolDefinition{lookup()}})
+
+		Convey("It should declare the tools as functions", func() {
+			declaration := model.Tools[0].FunctionDeclarations[0]
+
+			So(declaration.Name, ShouldEqual, "lookup")
+			So(declaration.Parameters.Type, ShouldEqual, genai.TypeObject)
+			So(declaration.Parameters.Required, ShouldResemble, []string{"query"})
+			So(declaration.Parameters.Properties["limit"].Type, ShouldEqual, genai.TypeInteger)
+			So(declaration.Parameters.Properties["tags"].Items.Enum, ShouldResemble, []string{"news", "docs"})
+		})
+
+		Convey("It should send the call in a model turn, and its result in the user turn after it", func() {
+			system, turns := google.history(conversation())
+
+			So(system, ShouldEqual, "be brief")
+			So(turns, ShouldHaveLength, 3)
+
+			So(turns[0].Role, ShouldEqual, "user")
+			So(turns[0].Parts, ShouldResemble, []genai.Part{genai.Text("what is boogie?")})
+
+			So(turns[1].Role, ShouldEqual, "model")
+			So(turns[1].Parts, ShouldResemble, []genai.Part{
+				genai.FunctionCall{Name: "lookup", Args: map[string]any{"query": "boogie"}},
+			})
+
+			So(turns[2].Role, ShouldEqual, "user")
+			So(turns[2].Parts, ShouldResemble, []genai.Part{
+				genai.FunctionResponse{Name: "lookup", Response: map[string]any{"result": "a language"}},
+			})
+		})
+
+		Convey("It should send the calls of a round in one model turn, and their results in one user turn", func() {
+			_, turns := google.history(parallelConversation())
+
+			So(turns, ShouldHaveLength, 3)
+			So(turns[1].Role, ShouldEqual, "model")
+			So(turns[1].Parts, ShouldHaveLength, 3)
+			So(turns[1].Parts[0], ShouldEqual, genai.Text("Let me look both up."))
+			So(turns[2].Role, ShouldEqual, "user")
+			So(turns[2].Parts, ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Given Cohere", t, func() {
+		cohere := &Cohere{model: "model", maxTokens: 4096}
+		request := cohere.buildRequest(GenerationParams{Tools: []ToolDefinition{lookup()}}, conversation())
+
+		Convey("It should define the tools with flat parameters", func() {
+			So(request.Tools, ShouldHaveLength, 1)
+			So(request.Tools[0].ParameterDefinitions["query"].Type, ShouldEqual, "str")
+			So(*request.Tools[0].ParameterDefinitions["query"].Required, ShouldBeTrue)
+			So(request.Tools[0].ParameterDefinitions["limit"].Type, ShouldEqual, "int")
+		})
+
+		Convey("It should send the result with the call that produced it", func() {
+			So(request.ToolResults, ShouldHaveLength, 1)
+			So(request.ToolResults[0].Call.Name, ShouldEqual, "lookup")
+			So(request.ToolResults[0].Call.Parameters, ShouldResemble, map[string]any{"query": "boogie"})
+			So(request.Message, ShouldNotContainSubstring, "query")
+		})
+	})
+
+	Convey("Given a provider without native tool support", t, func() {
+		scripted := NewScriptedProvider(
+			&Script{Key: "returned", Responses: []string{"boogie is a language"}},
+			&Script{Responses: []string{"```json\n{\"tool\": \"lookup\", \"arguments\": {\"query\": \"boogie\"}}\n```"}},
+		)
+
+		params := GenerationParams{Tools: []ToolDefinition{lookup()}}
+
+		Convey("It should turn the JSON blocks of its response into tool calls", func() {
+			calls := make([]ToolCall, 0)
+
+			for artifact := range scripted.Generate(params, conversation()[:2]) {
+				if call, ok := ToolCallOf(artifact); ok {
+					calls = append(calls, call)
+				}
+			}
+
+			So(calls, ShouldHaveLength, 1)
+			So(calls[0].Name, ShouldEqual, "lookup")
+			So(calls[0].Arguments, ShouldResemble, map[string]any{"query": "boogie"})
+		})
+
+		Convey("It should be told about the tools, and get the results as messages", func() {
+			rewritten := withoutTools(params.Tools, conversation())
+
+			So(rewritten, ShouldHaveLength, 4)
+			So(rewritten[0].Peek("payload"), ShouldContainSubstring, "- lookup: Use the lookup tool.")
+			So(rewritten[2].Peek("payload"), ShouldContainSubstring, `"tool":"lookup"`)
+			So(rewritten[3].Peek("role"), ShouldEqual, "user")
+			So(rewritten[3].Peek("payload"), ShouldEqual, "The lookup tool returned:\na language")
+
+			for range scripted.Generate(params, conversation()) {
+			}
+
+			So(scripted.Prompts()[0], ShouldEqual, "The lookup tool returned:\na language")
+		})
+	})
+}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/theapemachine/amsh/data"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Usage is what a single call to a provider took. The tokens are those the
+backend reported, or estimated when it reported none. Cost is only known once
+the call went through the balanced provider, which knows what the provider
+costs, and a call replayed from the cache is free.
+*/
+type Usage struct {
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	Estimated        bool    `json:"estimated,omitempty"`
+	Cached           bool    `json:"cached,omitempty"`
+}
+
+/*
+newUsage returns the usage of a call, with the tokens the backend reported,
+estimating the prompt from the artifacts, and the completion from the
+response, when it reported zero.
+*/
+func newUsage(promptTokens, completionTokens int, artifacts []*data.Artifact, response string) Usage {
+	usage := Usage{PromptTokens: promptTokens, CompletionTokens: completionTokens}
+
+	if usage.PromptTokens == 0 {
+		usage.Estimated = true
+
+		for _, artifact := range artifacts {
+			usage.PromptTokens += 4 + CountTokens(artifact.Peek("payload"))
+		}
+	}
+
+	if usage.CompletionTokens == 0 && response != "" {
+		usage.Estimated = true
+		usage.CompletionTokens = CountTokens(response)
+	}
+
+	return usage
+}
+
+/*
+NewUsageArtifact returns the artifact a provider streams last, once a call
+succeeded, holding what the call took in its attributes.
+*/
+func NewUsageArtifact(origin, model string, usage Usage) *data.Artifact {
+	artifact := data.New(origin, "assistant", "usage", []byte{})
+	artifact.Poke("model", model)
+	artifact.Poke("provider", origin)
+	artifact.Poke("prompt_tokens", strconv.Itoa(usage.PromptTokens))
+	artifact.Poke("completion_tokens", strconv.Itoa(usage.CompletionTokens))
+
+	if usage.Estimated {
+		artifact.Poke("estimated", "true")
+	}
+
+	return artifact
+}
+
+/*
+UsageOf returns the usage an artifact holds, if it holds one.
+*/
+func UsageOf(artifact *data.Artifact) (Usage, bool) {
+	if artifact.Peek("scope") != "usage" {
+		return Usage{}, false
+	}
+
+	usage := Usage{
+		Provider:  artifact.Peek("provider"),
+		Model:     artifact.Peek("model"),
+		Estimated: artifact.Peek("estimated") == "true",
+		Cached:    artifact.Peek("cache") == "hit",
+	}
+
+	usage.PromptTokens, _ = strconv.Atoi(artifact.Peek("prompt_tokens"))
+	usage.CompletionTokens, _ = strconv.Atoi(artifact.Peek("completion_tokens"))
+
+	if !usage.Cached {
+		usage.Cost, _ = strconv.ParseFloat(artifact.Peek("cost"), 64)
+	}
+
+	return usage, true
+}
+
+var (
+	encoding     *tiktoken.Tiktoken
+	onceEncoding sync.Once
+)
+
+/*
+CountTokens counts the tokens in the text. The encoding is only loaded once,
+and when it cannot be loaded, for instance when running offline, the count
+falls back to the rule of thumb of four characters per token.
+*/
+func CountTokens(text string) int {
+	onceEncoding.Do(func() {
+		var err error
+
+		if encoding, err = tiktoken.EncodingForModel("gpt-4o-mini"); err != nil {
+			errnie.Warn("provider.CountTokens %s", err)
+		}
+	})
+
+	if encoding == nil {
+		return (len(text) + 3) / 4
+	}
+
+	return len(encoding.Encode(text, nil, nil))
+}
@@ -0,0 +1,127 @@
+package provider
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/theapemachine/amsh/data"
+)
+
+func TestUsage(t *testing.T) {
+	Convey("Given the usage of a call", t, func() {
+		artifacts := []*data.Artifact{data.New("test", "user", "prompt", []byte("hello"))}
+
+		Convey("It should keep the tokens the backend reported", func() {
+			usage := newUsage(10, 20, artifacts, "hi there")
+
+			So(usage.PromptTokens, ShouldEqual, 10)
+			So(usage.CompletionTokens, ShouldEqual, 20)
+			So(usage.Estimated, ShouldBeFalse)
+		})
+
+		Convey("It should estimate the tokens the backend did not report", func() {
+			usage := newUsage(0, 0, artifacts, "hi there")
+
+			So(usage.PromptTokens, ShouldBeGreaterThan, 4)
+			So(usage.CompletionTokens, ShouldBeGreaterThan, 0)
+			So(usage.Estimated, ShouldBeTrue)
+		})
+
+		Convey("It should survive being an artifact", func() {
+			artifact := NewUsageArtifact("openai", "gpt-4o-mini", Usage{PromptTokens: 10, CompletionTokens: 20, Estimated: true})
+			artifact.Poke("cost", "0.5")
+
+			usage, ok := UsageOf(artifact)
+
+			So(ok, ShouldBeTrue)
+			So(usage, ShouldResemble, Usage{
+				Provider: "openai", Model: "gpt-4o-mini", PromptTokens: 10, CompletionTokens: 20, Cost: 0.5, Estimated: true,
+			})
+
+			_, ok = UsageOf(data.New("openai", "assistant", "gpt-4o-mini", []byte("hi")))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("It should be free when it was replayed from the cache", func() {
+			artifact := NewUsageArtifact("openai", "gpt-4o-mini", Usage{PromptTokens: 10})
+			artifact.Poke("cost", "0.5")
+			artifact.Poke("cache", "hit")
+
+			usage, _ := UsageOf(artifact)
+
+			So(usage.Cost, ShouldEqual, 0)
+			So(usage.Cached, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a balanced provider over a provider with a cost", t, func() {
+		lb := &BalancedProvider{
+			initialized: true,
+			providers:   []*ProviderStatus{fake(ProviderConfig{Name: "priced", Cost: Cost{Input: 1, Output: 2}})},
+		}
+
+		Convey("It should put what the call cost on its usage", func() {
+			var usage Usage
+
+			for artifact := range lb.Generate(GenerationParams{}, []*data.Artifact{data.New("test", "user", "prompt", []byte("hello"))}) {
+				if found, ok := UsageOf(artifact); ok {
+					usage = found
+				}
+			}
+
+			So(usage.Provider, ShouldEqual, "priced")
+			So(usage.Cost, ShouldEqual, float64(usage.PromptTokens+2*usage.CompletionTokens))
+			So(usage.Cost, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestLedger(t *testing.T) {
+	Convey("Given a ledger", t, func() {
+		path := filepath.Join(t.TempDir(), "usage.jsonl")
+		ledger := NewLedger(path)
+
+		team := WithAccount(context.Background(), ACCOUNT_TEAM, "helpdesk")
+		lead := WithAccount(team, ACCOUNT_AGENT, "lead")
+		member := WithAccount(team, ACCOUNT_AGENT, "member")
+
+		ledger.Record(lead, Usage{PromptTokens: 10, CompletionTokens: 5, Cost: 1})
+		ledger.Record(member, Usage{PromptTokens: 20, CompletionTokens: 10, Cost: 2, Estimated: true})
+		ledger.Record(member, Usage{PromptTokens: 20, CompletionTokens: 10, Cached: true})
+
+		Convey("It should tally the usage per account", func() {
+			report := ledger.Report()
+
+			So(report.Total, ShouldResemble, Tally{Calls: 3, PromptTokens: 50, CompletionTokens: 25, Cost: 3, Estimated: 1, Cached: 1})
+			So(report.Accounts[ACCOUNT_TEAM]["helpdesk"].Calls, ShouldEqual, 3)
+			So(report.Accounts[ACCOUNT_AGENT]["lead"].Cost, ShouldEqual, 1)
+			So(report.Accounts[ACCOUNT_AGENT]["member"].PromptTokens, ShouldEqual, 40)
+		})
+
+		Convey("It should not change the accounts of the context it came from", func() {
+			So(AccountsOf(team), ShouldResemble, map[string]string{ACCOUNT_TEAM: "helpdesk"})
+		})
+
+		Convey("It should read back what it recorded", func() {
+			report, err := ReadLedger(path, time.Time{})
+
+			So(err, ShouldBeNil)
+			So(report.Total, ShouldResemble, ledger.Report().Total)
+
+			report, err = ReadLedger(path, time.Now().Add(time.Hour))
+
+			So(err, ShouldBeNil)
+			So(report.Total.Calls, ShouldEqual, 0)
+		})
+
+		Convey("It should have nothing to report when it never recorded anything", func() {
+			report, err := ReadLedger(filepath.Join(t.TempDir(), "missing.jsonl"), time.Time{})
+
+			So(err, ShouldBeNil)
+			So(report.Total.Calls, ShouldEqual, 0)
+		})
+	})
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/theapemachine/amsh/ai"
 	"github.com/theapemachine/amsh/ai/marvin"
+	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/twoface"
 	"github.com/theapemachine/qpool"
@@ -19,7 +20,13 @@ type Team struct {
 	ctx       context.Context
 }
 
+/*
+NewTeam returns a team, led by an agent of its own, whose usage is tallied to
+the name of the team.
+*/
 func NewTeam(ctx context.Context, name string) *Team {
+	ctx = provider.WithAccount(ctx, provider.ACCOUNT_TEAM, name)
+
 	pool := qpool.NewQ(ctx, 2, 5, &qpool.Config{
 		SchedulingTimeout: time.Second * 5,
 	})
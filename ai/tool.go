@@ -3,6 +3,8 @@ package ai
 import (
 	"context"
 	"io"
+
+	"github.com/theapemachine/amsh/data"
 )
 
 // Tool represents a capability that can be used by an agent
@@ -11,6 +13,14 @@ type Tool interface {
 	Use(ctx context.Context, args map[string]any) string
 }
 
+// AttachingTool is a tool whose results can come with parts, such as the
+// screenshots of the browser, which are attached to the result the model sees
+type AttachingTool interface {
+	Tool
+	// Attachments returns the parts of the last result, and lets go of them
+	Attachments() []data.Part
+}
+
 // InteractiveTool represents a tool that requires ongoing IO communication
 type InteractiveTool interface {
 	Tool
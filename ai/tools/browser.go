@@ -14,6 +14,7 @@ import (
 	"github.com/go-rod/stealth"
 	"github.com/invopop/jsonschema"
 	"github.com/spf13/cast"
+	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/errnie"
 )
 
@@ -40,6 +41,7 @@ type Browser struct {
 	page        *rod.Page
 	history     []BrowseAction
 	proxy       *url.URL
+	attachments []data.Part
 }
 
 type BrowseAction struct {
@@ -69,10 +71,20 @@ type Cookie struct {
 
 func NewBrowser() *Browser {
 	return &Browser{
-		history: make([]BrowseAction, 0),
+		history:     make([]BrowseAction, 0),
+		attachments: make([]data.Part, 0),
 	}
 }
 
+// Attachments returns the screenshots taken since it was last called, so the
+// model can look at them
+func (browser *Browser) Attachments() []data.Part {
+	attachments := browser.attachments
+	browser.attachments = make([]data.Part, 0)
+
+	return attachments
+}
+
 func (browser *Browser) Use(ctx context.Context, args map[string]any) string {
 	return errnie.SafeMust(func() (string, error) {
 		return browser.Run(args)
@@ -204,9 +216,12 @@ func (browser *Browser) Run(args map[string]any) (string, error) {
 		browser.FillForm(formData)
 	}
 
-	// Handle screenshots
-	if screenshot, ok := args["screenshot"].(map[string]string); ok {
-		browser.Screenshot(screenshot["selector"], screenshot["filepath"])
+	// Handle screenshots, either asked for as the operation, or with the
+	// selector and filepath to take it with
+	if screenshot, ok := args["screenshot"].(map[string]any); ok {
+		browser.Screenshot(cast.ToString(screenshot["selector"]), cast.ToString(screenshot["filepath"]))
+	} else if args["operation"] == "screenshot" || cast.ToBool(args["screenshot"]) {
+		browser.Screenshot(cast.ToString(args["selector"]), "")
 	}
 
 	// Handle network interception
@@ -258,7 +273,8 @@ func (browser *Browser) FillForm(fields map[string]string) {
 	}
 }
 
-// Screenshot captures the current page or element
+// Screenshot captures the current page or element, which is attached to the
+// result of the tool, and written to the filepath when there is one
 func (browser *Browser) Screenshot(selector string, filepath string) {
 	var img []byte
 
@@ -280,7 +296,12 @@ func (browser *Browser) Screenshot(selector string, filepath string) {
 		})
 	}
 
-	errnie.MustVoid(os.WriteFile(filepath, img, 0644))
+	browser.attachments = append(browser.attachments, data.NewPart("image/png", "screenshot.png", img))
+
+	if filepath != "" {
+		errnie.MustVoid(os.WriteFile(filepath, img, 0644))
+	}
+
 	browser.recordAction("screenshot", map[string]string{
 		"selector": selector,
 		"filepath": filepath,
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/theapemachine/amsh/ai/boogie"
+	"github.com/theapemachine/amsh/lsp"
+)
+
+var write bool
+
+/*
+boogieCmd groups the tooling for the Boogie language.
+*/
+var boogieCmd = &cobra.Command{
+	Use:   "boogie",
+	Short: "Tooling for the Boogie language",
+	Long:  boogietxt,
+}
+
+/*
+boogieFmtCmd formats Boogie programs into their canonical form.
+*/
+var boogieFmtCmd = &cobra.Command{
+	Use:   "fmt [file...]",
+	Short: "Format Boogie programs",
+	Long:  boogiefmttxt,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			source, err := io.ReadAll(cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+
+			formatted, err := boogie.Format(string(source))
+			if err != nil {
+				return err
+			}
+
+			_, err = io.WriteString(cmd.OutOrStdout(), formatted)
+			return err
+		}
+
+		for _, path := range args {
+			if err := formatFile(cmd, path); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+/*
+boogieLspCmd runs a language server for Boogie programs over stdio.
+*/
+var boogieLspCmd = &cobra.Command{
+	Use:   "lsp",
+	Short: "Run the Boogie language server over stdio",
+	Long:  boogielsptxt,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return lsp.NewBoogieServer(cmd.InOrStdin(), cmd.OutOrStdout()).Serve()
+	},
+}
+
+func init() {
+	boogieFmtCmd.Flags().BoolVarP(&write, "write", "w", false, "write the result back to the file instead of stdout")
+
+	boogieCmd.AddCommand(boogieFmtCmd)
+	boogieCmd.AddCommand(boogieLspCmd)
+	rootCmd.AddCommand(boogieCmd)
+}
+
+func formatFile(cmd *cobra.Command, path string) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	formatted, err := boogie.Format(string(source))
+	if err != nil {
+		return fmt.Errorf("%s:\n%w", path, err)
+	}
+
+	if !write {
+		_, err = io.WriteString(cmd.OutOrStdout(), formatted)
+		return err
+	}
+
+	if formatted == string(source) {
+		return nil
+	}
+
+	return os.WriteFile(path, []byte(formatted), 0644)
+}
+
+/*
+boogietxt provides a long description for the boogie command.
+*/
+var boogietxt = `
+Tooling for the Boogie language, which the agents use to describe their workflows.
+`
+
+/*
+boogiefmttxt provides a long description for the boogie fmt command.
+*/
+var boogiefmttxt = `
+Format Boogie programs into their canonical form, so programs written by agents
+can be diffed and stored in a stable form. Comments are preserved.
+
+Without any files, the program is read from stdin and written to stdout.
+`
+
+/*
+boogielsptxt provides a long description for the boogie lsp command.
+*/
+var boogielsptxt = `
+Run a language server for Boogie programs, speaking LSP over stdin and stdout,
+so editors get diagnostics, hover documentation, completion and go-to-definition
+for labels in .boogie files.
+
+Documentation comes from boogie.constructs in the config, and the operations,
+behaviors and tools that are offered come from boogie.registry.
+`
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/theapemachine/amsh/ai/provider"
+	"github.com/theapemachine/errnie"
+)
+
+var mockllmPort int
+
+/*
+mockllmCmd serves deterministic chat completions the way an OpenAI compatible
+server does, so the stack can be run without any real provider.
+*/
+var mockllmCmd = &cobra.Command{
+	Use:   "mockllm",
+	Short: "Serve deterministic, scripted chat completions over the OpenAI API",
+	Long:  mockllmtxt,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		addr := fmt.Sprintf(":%d", mockllmPort)
+		errnie.Info("mockllm listening on %s", addr)
+
+		return http.ListenAndServe(addr, provider.NewConfigMockLLM())
+	},
+}
+
+func init() {
+	mockllmCmd.Flags().IntVar(&mockllmPort, "port", 8089, "the port to serve the OpenAI API on")
+
+	rootCmd.AddCommand(mockllmCmd)
+}
+
+/*
+mockllmtxt provides a long description for the mockllm command.
+*/
+var mockllmtxt = `
+Serve chat completions on /v1/chat/completions and the model on /v1/models,
+the way an OpenAI compatible server does, but answered from the scripts under
+ai.mockllm in the config, instead of by a model.
+
+A script answers every prompt that contains its key with its responses, in
+order, after failing its first failures calls, with status when it is set, and
+waiting out its latency. Responses are streamed token by token, JSON tool
+blocks in them are streamed as native tool calls, and usage is reported when
+the client asks for it.
+
+Enable the mockllm provider in ai.providers to point the whole stack at it.
+`
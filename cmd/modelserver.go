@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/theapemachine/amsh/ai/provider"
+)
+
+/*
+MODELSERVER_TOKEN is the environment variable the modelserver command reads
+its token from, so it does not show up in the arguments of the process.
+*/
+const MODELSERVER_TOKEN = "AMSH_MODELSERVER_TOKEN"
+
+var modelserverListen string
+
+/*
+modelserverCmd serves the providers of the config over Cap'n Proto RPC, to the
+remote providers of other amsh processes.
+*/
+var modelserverCmd = &cobra.Command{
+	Use:   "modelserver",
+	Short: "Serve the configured providers to other amsh processes over Cap'n Proto RPC",
+	Long:  modelservertxt,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		return provider.NewModelServer(
+			provider.NewCachedProvider(),
+		).WithToken(os.Getenv(MODELSERVER_TOKEN)).ListenAndServe(modelserverListen)
+	},
+}
+
+func init() {
+	modelserverCmd.Flags().StringVar(&modelserverListen, "listen", "tcp://127.0.0.1:7067", "the address to serve on, tcp://host:port or unix:///path/to/socket")
+
+	rootCmd.AddCommand(modelserverCmd)
+}
+
+/*
+modelservertxt provides a long description for the modelserver command.
+*/
+var modelservertxt = `
+Serve the ModelService of data/artifact.capnp, generating with the providers
+under ai.providers, balanced, retried and cached the way they are locally.
+
+Other amsh processes use it through a provider of the remote type, with its
+base_url set to the address served on, so only the host running the
+modelserver needs the API keys, or the local model.
+
+Anyone who can connect generates on those API keys, so by default it only
+listens on 127.0.0.1. To serve other hosts, set a shared token in
+AMSH_MODELSERVER_TOKEN, and the same token in the environment variable under
+the key of the remote provider on each of them. Without a token, it refuses
+to listen on anything but a loopback address or a unix socket. The token is
+sent in the clear, so beyond a trusted network, serve it through a TLS tunnel.
+`
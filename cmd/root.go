@@ -9,8 +9,10 @@ import (
 	"log"
 	"os"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/utils"
 	"github.com/theapemachine/errnie"
 )
@@ -68,6 +70,14 @@ func initConfig() {
 		log.Println("failed to read config file", err)
 		return
 	}
+
+	// Providers can be changed while running, without restarting.
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		provider.ReloadBalancedProvider()
+		provider.ReloadCachedProvider()
+	})
+
+	viper.WatchConfig()
 }
 
 func writeConfig() (err error) {
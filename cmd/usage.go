@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/ai/provider"
+)
+
+var (
+	usageBy    string
+	usageSince time.Duration
+)
+
+/*
+usageCmd reports the tokens and cost of the calls made to the providers, from
+the ledger they were recorded in.
+*/
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Report the token usage and cost of the calls made to the providers",
+	Long:  usagetxt,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := viper.GetViper().GetString("ai.usage.file")
+
+		if path == "" {
+			return fmt.Errorf("no ledger to report on, set ai.usage.file in the config")
+		}
+
+		since := time.Time{}
+
+		if usageSince > 0 {
+			since = time.Now().Add(-usageSince)
+		}
+
+		report, err := provider.ReadLedger(path, since)
+		if err != nil {
+			return err
+		}
+
+		kinds := []string{provider.ACCOUNT_AGENT, provider.ACCOUNT_TEAM, provider.ACCOUNT_PROGRAM, provider.ACCOUNT_REQUEST}
+
+		if usageBy != "" {
+			kinds = []string{usageBy}
+		}
+
+		writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ACCOUNT\tNAME\tCALLS\tPROMPT\tCOMPLETION\tCOST\tESTIMATED\tCACHED")
+
+		for _, kind := range kinds {
+			tallies := report.Accounts[kind]
+
+			for _, name := range slices.Sorted(maps.Keys(tallies)) {
+				writeTally(writer, kind, name, *tallies[name])
+			}
+		}
+
+		writeTally(writer, "total", "", report.Total)
+
+		return writer.Flush()
+	},
+}
+
+func init() {
+	usageCmd.Flags().StringVar(&usageBy, "by", "", "only report the accounts of this kind: agent, team, program or request")
+	usageCmd.Flags().DurationVar(&usageSince, "since", 0, "only report the calls made this long ago at most, e.g. 24h")
+
+	rootCmd.AddCommand(usageCmd)
+}
+
+func writeTally(writer *tabwriter.Writer, kind, name string, tally provider.Tally) {
+	fmt.Fprintf(
+		writer, "%s\t%s\t%d\t%d\t%d\t%.6f\t%d\t%d\n",
+		kind, name, tally.Calls, tally.PromptTokens, tally.CompletionTokens, tally.Cost, tally.Estimated, tally.Cached,
+	)
+}
+
+/*
+usagetxt provides a long description for the usage command.
+*/
+var usagetxt = `
+Report the tokens and cost of the calls made to the providers, in total and per
+agent role, team, Boogie program and HTTP request, from the ledger set as
+ai.usage.file in the config.
+
+Tokens are those the provider reported, or estimated when it reported none, and
+cost is in whatever currency the cost of the providers is set in. Calls that
+were replayed from the cache are free.
+`
@@ -8,6 +8,7 @@ import (
 	fc "capnproto.org/go/capnp/v3/flowcontrol"
 	schemas "capnproto.org/go/capnp/v3/schemas"
 	server "capnproto.org/go/capnp/v3/server"
+	stream "capnproto.org/go/capnp/v3/std/capnp/stream"
 	context "context"
 )
 
@@ -17,12 +18,12 @@ type Artifact capnp.Struct
 const Artifact_TypeID = 0xff7ca5c7f859f959
 
 func NewArtifact(s *capnp.Segment) (Artifact, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 10})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 11})
 	return Artifact(st), err
 }
 
 func NewRootArtifact(s *capnp.Segment) (Artifact, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 10})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 11})
 	return Artifact(st), err
 }
 
@@ -236,12 +237,36 @@ func (s Artifact) SetPayload(v []byte) error {
 	return capnp.Struct(s).SetData(9, v)
 }
 
+func (s Artifact) Attachments() (Attachment_List, error) {
+	p, err := capnp.Struct(s).Ptr(10)
+	return Attachment_List(p.List()), err
+}
+
+func (s Artifact) HasAttachments() bool {
+	return capnp.Struct(s).HasPtr(10)
+}
+
+func (s Artifact) SetAttachments(v Attachment_List) error {
+	return capnp.Struct(s).SetPtr(10, v.ToPtr())
+}
+
+// NewAttachments sets the attachments field to a newly
+// allocated Attachment_List, preferring placement in s's segment.
+func (s Artifact) NewAttachments(n int32) (Attachment_List, error) {
+	l, err := NewAttachment_List(capnp.Struct(s).Segment(), n)
+	if err != nil {
+		return Attachment_List{}, err
+	}
+	err = capnp.Struct(s).SetPtr(10, l.ToPtr())
+	return l, err
+}
+
 // Artifact_List is a list of Artifact.
 type Artifact_List = capnp.StructList[Artifact]
 
 // NewArtifact creates a new list of Artifact.
 func NewArtifact_List(s *capnp.Segment, sz int32) (Artifact_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 10}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 11}, sz)
 	return capnp.StructList[Artifact](l), err
 }
 
@@ -353,6 +378,119 @@ func (f Attribute_Future) Struct() (Attribute, error) {
 	return Attribute(p.Struct()), err
 }
 
+type Attachment capnp.Struct
+
+// Attachment_TypeID is the unique identifier for the type Attachment.
+const Attachment_TypeID = 0xc11de5e03443d73c
+
+func NewAttachment(s *capnp.Segment) (Attachment, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3})
+	return Attachment(st), err
+}
+
+func NewRootAttachment(s *capnp.Segment) (Attachment, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3})
+	return Attachment(st), err
+}
+
+func ReadRootAttachment(msg *capnp.Message) (Attachment, error) {
+	root, err := msg.Root()
+	return Attachment(root.Struct()), err
+}
+
+func (s Attachment) String() string {
+	str, _ := text.Marshal(0xc11de5e03443d73c, capnp.Struct(s))
+	return str
+}
+
+func (s Attachment) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Attachment) DecodeFromPtr(p capnp.Ptr) Attachment {
+	return Attachment(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Attachment) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Attachment) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Attachment) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Attachment) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Attachment) Mime() (string, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.Text(), err
+}
+
+func (s Attachment) HasMime() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Attachment) MimeBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.TextBytes(), err
+}
+
+func (s Attachment) SetMime(v string) error {
+	return capnp.Struct(s).SetText(0, v)
+}
+
+func (s Attachment) Name() (string, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return p.Text(), err
+}
+
+func (s Attachment) HasName() bool {
+	return capnp.Struct(s).HasPtr(1)
+}
+
+func (s Attachment) NameBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return p.TextBytes(), err
+}
+
+func (s Attachment) SetName(v string) error {
+	return capnp.Struct(s).SetText(1, v)
+}
+
+func (s Attachment) Data() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(2)
+	return []byte(p.Data()), err
+}
+
+func (s Attachment) HasData() bool {
+	return capnp.Struct(s).HasPtr(2)
+}
+
+func (s Attachment) SetData(v []byte) error {
+	return capnp.Struct(s).SetData(2, v)
+}
+
+// Attachment_List is a list of Attachment.
+type Attachment_List = capnp.StructList[Attachment]
+
+// NewAttachment creates a new list of Attachment.
+func NewAttachment_List(s *capnp.Segment, sz int32) (Attachment_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3}, sz)
+	return capnp.StructList[Attachment](l), err
+}
+
+// Attachment_Future is a wrapper for a Attachment promised by a client call.
+type Attachment_Future struct{ *capnp.Future }
+
+func (f Attachment_Future) Struct() (Attachment, error) {
+	p, err := f.Future.Ptr()
+	return Attachment(p.Struct()), err
+}
+
 type ModelService capnp.Client
 
 // ModelService_TypeID is the unique identifier for the type ModelService.
@@ -378,6 +516,26 @@ func (c ModelService) Query(ctx context.Context, params func(ModelService_query_
 
 }
 
+func (c ModelService) Generate(ctx context.Context, params func(ModelService_generate_Params) error) (ModelService_generate_Results_Future, capnp.ReleaseFunc) {
+
+	s := capnp.Send{
+		Method: capnp.Method{
+			InterfaceID:   0xee73f44b4fdab4e9,
+			MethodID:      1,
+			InterfaceName: "artifact.capnp:ModelService",
+			MethodName:    "generate",
+		},
+	}
+	if params != nil {
+		s.ArgsSize = capnp.ObjectSize{DataSize: 0, PointerCount: 3}
+		s.PlaceArgs = func(s capnp.Struct) error { return params(ModelService_generate_Params(s)) }
+	}
+
+	ans, release := capnp.Client(c).SendCall(ctx, s)
+	return ModelService_generate_Results_Future{Future: ans.Future()}, release
+
+}
+
 func (c ModelService) WaitStreaming() error {
 	return capnp.Client(c).WaitStreaming()
 }
@@ -452,6 +610,8 @@ func (c ModelService) GetFlowLimiter() fc.FlowLimiter {
 // A ModelService_Server is a ModelService with a local implementation.
 type ModelService_Server interface {
 	Query(context.Context, ModelService_query) error
+
+	Generate(context.Context, ModelService_generate) error
 }
 
 // ModelService_NewServer creates a new Server from an implementation of ModelService_Server.
@@ -470,7 +630,7 @@ func ModelService_ServerToClient(s ModelService_Server) ModelService {
 // This can be used to create a more complicated Server.
 func ModelService_Methods(methods []server.Method, s ModelService_Server) []server.Method {
 	if cap(methods) == 0 {
-		methods = make([]server.Method, 0, 1)
+		methods = make([]server.Method, 0, 2)
 	}
 
 	methods = append(methods, server.Method{
@@ -485,6 +645,18 @@ func ModelService_Methods(methods []server.Method, s ModelService_Server) []serv
 		},
 	})
 
+	methods = append(methods, server.Method{
+		Method: capnp.Method{
+			InterfaceID:   0xee73f44b4fdab4e9,
+			MethodID:      1,
+			InterfaceName: "artifact.capnp:ModelService",
+			MethodName:    "generate",
+		},
+		Impl: func(ctx context.Context, call *server.Call) error {
+			return s.Generate(ctx, ModelService_generate{call})
+		},
+	})
+
 	return methods
 }
 
@@ -505,6 +677,23 @@ func (c ModelService_query) AllocResults() (ModelService_query_Results, error) {
 	return ModelService_query_Results(r), err
 }
 
+// ModelService_generate holds the state for a server call to ModelService.generate.
+// See server.Call for documentation.
+type ModelService_generate struct {
+	*server.Call
+}
+
+// Args returns the call's arguments.
+func (c ModelService_generate) Args() ModelService_generate_Params {
+	return ModelService_generate_Params(c.Call.Args())
+}
+
+// AllocResults allocates the results struct.
+func (c ModelService_generate) AllocResults() (ModelService_generate_Results, error) {
+	r, err := c.Call.AllocResults(capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return ModelService_generate_Results(r), err
+}
+
 // ModelService_List is a list of ModelService.
 type ModelService_List = capnp.CapList[ModelService]
 
@@ -696,54 +885,519 @@ func (p ModelService_query_Results_Future) Response() Artifact_Future {
 	return Artifact_Future{Future: p.Future.Field(0, nil)}
 }
 
-const schema_e363a5839bf866c4 = "x\xda\x8c\x93\xbdk4U\x18\xc5\xcf\xb93\xb3_d" +
-	"\xdd\x0cw\x04QqU\"\xbc\xaf$/\xf9\x12L\x88" +
-	"d\x0d\x8a1\x1a\xdc\xc9h\x11\xbb\xc9\xec\x8d\x0e\xd9\xdd" +
-	"\x99\xccGd!\x10\x826\xfe\x0d\xd6[Z\x08\xf6\x82" +
-	"\x04\x04\xb1\x91XY\x9aBlD\xc4\"V#w\xd9" +
-	"/\xb0I7\xcf\x8f\xe7y\xce\xbd\xe7\x9eY\xbdd\xcb" +
-	"\\\xab7\x0d\x08w\xc9*\x15?\xf5\xefj7\xb7\xd7" +
-	"_\xc2~\x9e\x80\xc52\xb0\x91\xf3\x88\xa0\xbc\xe6.X" +
-	"l<\xe7\xfe~{\x19\xfe\x0c\xbb\xc1\xe2\xe6\xf4\xfe\xab" +
-	"\xcf\x87\xc1\x1d,Q\x06\xe4\x90?\xcao\xf4\x88\xfc\x9a" +
-	"\x9f\x81\xc5\x1f\xdf\xfe\xfa\xc1{\xff\xa4\x7f\xc2n\x18\xb3" +
-	"^PV\xc5o\xf2\xe9\xd1\x88-\xde\x91[\xfa\xab\xf8" +
-	"\xee\x97\xe1\x17\x7f\xbf\x10\xfc5\xaf\xfc\x928\xd0\xca+" +
-	"B+\x1f\xff{|\xff\xc3\xf0\xb2\x80\xdb\xe0\xbctM" +
-	"\xef9\x14\xdf\xcb\x8f\xf4\x9e\x0dWD\x02+\x85\x9fd" +
-	"\xe1\xa9\x1fd\xe6\x93\xc0\x8f\xfb\xf1\xf6a\xd4Q]O" +
-	"%\x17a\xa0\x9e\x9c\xe7*\x19,\x1d\xa94\xeffL" +
-	"]\xd30\x01\x93\x80]?\x00\xdc\x05\x83\xee3\x82E" +
-	"\xa2\xd28\xea\xa7\x0a\x00\x17g\xf2 \x17\xc1\xa9\x80\x18" +
-	"\x0b\xbc\x99eIx\x92g\x0ah\x93ne\xba\xf3\xf1" +
-	"\xcb\x80\xbbd\xd0]\x15\xb4I\x87\x1a\xae\xac\x03\xee#" +
-	"\x83\xee\xa6`\xf9L\x0d\xb8\x00\xc1\x05\xb0y\xe1ws" +
-	"5\xa9\xfe'2\xbdE9\x0c\x94\x961\x0dk\xce;" +
-	"N\x9e\xcf\xb6\xd7!l\xab\xdc\x1c\xdd\xb4\xc56\xf9\x10" +
-	"G\xda~\xe2\xf7R`\xde\x91=\xc0\xad\x18t\x1d\xc1" +
-	"\xabD\x9d\xe7*\xcd\x1e\xe2\xc6\xb8\x1ey\xb1<\xd9&" +
-	"_\xe1\xb3\x80\xf7\"\x0dz\xcb\x9c\xd9!\x1f\xf3\x00\xf0" +
-	"\x1ei\xbe\xa9\xb9\x10\x0e\x05 \xd7\xb8\x0dx\xcb\x9a\xbf" +
-	"\xae\xb9a84\x00\xf9\x1a\xf7\x00oU\xf3\x1d\xcdM" +
-	"\xd3\xa1\x09\xc8-\xbe\x0ax\x9b\x9a\xb7(H\xcb\xa1\x05" +
-	"\xc87x\x04x;\x1a\xef\xeb\xf6\x92\xe5\xb0\x04\xc8\xb7" +
-	"G\xeb[\x9a\xbf\xafy\xb9\xe4\x8c\xe2\xfb\xeeh\xcd[" +
-	"\x9a\xb75\xaf\x94\x1dVt\xca\xb8\x0ex\xfb\x9a\x7f\xa8" +
-	"y\xb5\xe2\xb0\x0aH\x97\x1f\x03^[\xf3\xae\xe6\xb5\xaa" +
-	"\xc3\x1a \xc3\xd11;\x9a\xc7\x144\xc2\xce\xf4e\x83" +
-	"OUp\x96\xe6=\x1d\xae:\x04\xeb\xe0n\x9c\x9f\xe8" +
-	"(\x8c\xcb\xab\x0b\x95\xa4a\xd4\x9f\x8c4\xb2A<K" +
-	"F\x16\xf6T\x9a\xf9=0f\x15\x82Up7J\xc2" +
-	"O\xc2Y\x7f\x12u\xa7\xfd\xcd4\x88\xe6\xa6\xfdqX" +
-	"a\xa8\x94O\x81m\x83\\\x9c\xfd\xdb\xa0\x86W\xb1?" +
-	"\xe8F~gr\xa0\xff\x02\x00\x00\xff\xff\xee\x83\xed\x86"
+type ModelService_generate_Params capnp.Struct
+
+// ModelService_generate_Params_TypeID is the unique identifier for the type ModelService_generate_Params.
+const ModelService_generate_Params_TypeID = 0xe93909a332bf4458
+
+func NewModelService_generate_Params(s *capnp.Segment) (ModelService_generate_Params, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3})
+	return ModelService_generate_Params(st), err
+}
+
+func NewRootModelService_generate_Params(s *capnp.Segment) (ModelService_generate_Params, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3})
+	return ModelService_generate_Params(st), err
+}
+
+func ReadRootModelService_generate_Params(msg *capnp.Message) (ModelService_generate_Params, error) {
+	root, err := msg.Root()
+	return ModelService_generate_Params(root.Struct()), err
+}
+
+func (s ModelService_generate_Params) String() string {
+	str, _ := text.Marshal(0xe93909a332bf4458, capnp.Struct(s))
+	return str
+}
+
+func (s ModelService_generate_Params) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (ModelService_generate_Params) DecodeFromPtr(p capnp.Ptr) ModelService_generate_Params {
+	return ModelService_generate_Params(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s ModelService_generate_Params) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s ModelService_generate_Params) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s ModelService_generate_Params) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s ModelService_generate_Params) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s ModelService_generate_Params) Params() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return []byte(p.Data()), err
+}
+
+func (s ModelService_generate_Params) HasParams() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s ModelService_generate_Params) SetParams(v []byte) error {
+	return capnp.Struct(s).SetData(0, v)
+}
+
+func (s ModelService_generate_Params) Artifacts() (Artifact_List, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return Artifact_List(p.List()), err
+}
+
+func (s ModelService_generate_Params) HasArtifacts() bool {
+	return capnp.Struct(s).HasPtr(1)
+}
+
+func (s ModelService_generate_Params) SetArtifacts(v Artifact_List) error {
+	return capnp.Struct(s).SetPtr(1, v.ToPtr())
+}
+
+// NewArtifacts sets the artifacts field to a newly
+// allocated Artifact_List, preferring placement in s's segment.
+func (s ModelService_generate_Params) NewArtifacts(n int32) (Artifact_List, error) {
+	l, err := NewArtifact_List(capnp.Struct(s).Segment(), n)
+	if err != nil {
+		return Artifact_List{}, err
+	}
+	err = capnp.Struct(s).SetPtr(1, l.ToPtr())
+	return l, err
+}
+func (s ModelService_generate_Params) Sink() ArtifactSink {
+	p, _ := capnp.Struct(s).Ptr(2)
+	return ArtifactSink(p.Interface().Client())
+}
+
+func (s ModelService_generate_Params) HasSink() bool {
+	return capnp.Struct(s).HasPtr(2)
+}
+
+func (s ModelService_generate_Params) SetSink(v ArtifactSink) error {
+	if !v.IsValid() {
+		return capnp.Struct(s).SetPtr(2, capnp.Ptr{})
+	}
+	seg := s.Segment()
+	in := capnp.NewInterface(seg, seg.Message().CapTable().Add(capnp.Client(v)))
+	return capnp.Struct(s).SetPtr(2, in.ToPtr())
+}
+
+// ModelService_generate_Params_List is a list of ModelService_generate_Params.
+type ModelService_generate_Params_List = capnp.StructList[ModelService_generate_Params]
+
+// NewModelService_generate_Params creates a new list of ModelService_generate_Params.
+func NewModelService_generate_Params_List(s *capnp.Segment, sz int32) (ModelService_generate_Params_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 3}, sz)
+	return capnp.StructList[ModelService_generate_Params](l), err
+}
+
+// ModelService_generate_Params_Future is a wrapper for a ModelService_generate_Params promised by a client call.
+type ModelService_generate_Params_Future struct{ *capnp.Future }
+
+func (f ModelService_generate_Params_Future) Struct() (ModelService_generate_Params, error) {
+	p, err := f.Future.Ptr()
+	return ModelService_generate_Params(p.Struct()), err
+}
+func (p ModelService_generate_Params_Future) Sink() ArtifactSink {
+	return ArtifactSink(p.Future.Field(2, nil).Client())
+}
+
+type ModelService_generate_Results capnp.Struct
+
+// ModelService_generate_Results_TypeID is the unique identifier for the type ModelService_generate_Results.
+const ModelService_generate_Results_TypeID = 0xa1a26a39c164a96b
+
+func NewModelService_generate_Results(s *capnp.Segment) (ModelService_generate_Results, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return ModelService_generate_Results(st), err
+}
+
+func NewRootModelService_generate_Results(s *capnp.Segment) (ModelService_generate_Results, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return ModelService_generate_Results(st), err
+}
+
+func ReadRootModelService_generate_Results(msg *capnp.Message) (ModelService_generate_Results, error) {
+	root, err := msg.Root()
+	return ModelService_generate_Results(root.Struct()), err
+}
+
+func (s ModelService_generate_Results) String() string {
+	str, _ := text.Marshal(0xa1a26a39c164a96b, capnp.Struct(s))
+	return str
+}
+
+func (s ModelService_generate_Results) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (ModelService_generate_Results) DecodeFromPtr(p capnp.Ptr) ModelService_generate_Results {
+	return ModelService_generate_Results(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s ModelService_generate_Results) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s ModelService_generate_Results) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s ModelService_generate_Results) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s ModelService_generate_Results) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+
+// ModelService_generate_Results_List is a list of ModelService_generate_Results.
+type ModelService_generate_Results_List = capnp.StructList[ModelService_generate_Results]
+
+// NewModelService_generate_Results creates a new list of ModelService_generate_Results.
+func NewModelService_generate_Results_List(s *capnp.Segment, sz int32) (ModelService_generate_Results_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0}, sz)
+	return capnp.StructList[ModelService_generate_Results](l), err
+}
+
+// ModelService_generate_Results_Future is a wrapper for a ModelService_generate_Results promised by a client call.
+type ModelService_generate_Results_Future struct{ *capnp.Future }
+
+func (f ModelService_generate_Results_Future) Struct() (ModelService_generate_Results, error) {
+	p, err := f.Future.Ptr()
+	return ModelService_generate_Results(p.Struct()), err
+}
+
+type ArtifactSink capnp.Client
+
+// ArtifactSink_TypeID is the unique identifier for the type ArtifactSink.
+const ArtifactSink_TypeID = 0xbf5c0fa179cd51b6
+
+func (c ArtifactSink) Send(ctx context.Context, params func(ArtifactSink_send_Params) error) error {
+	s := capnp.Send{
+		Method: capnp.Method{
+			InterfaceID:   0xbf5c0fa179cd51b6,
+			MethodID:      0,
+			InterfaceName: "artifact.capnp:ArtifactSink",
+			MethodName:    "send",
+		},
+	}
+	if params != nil {
+		s.ArgsSize = capnp.ObjectSize{DataSize: 0, PointerCount: 1}
+		s.PlaceArgs = func(s capnp.Struct) error { return params(ArtifactSink_send_Params(s)) }
+	}
+
+	return capnp.Client(c).SendStreamCall(ctx, s)
+
+}
+
+func (c ArtifactSink) WaitStreaming() error {
+	return capnp.Client(c).WaitStreaming()
+}
+
+// String returns a string that identifies this capability for debugging
+// purposes.  Its format should not be depended on: in particular, it
+// should not be used to compare clients.  Use IsSame to compare clients
+// for equality.
+func (c ArtifactSink) String() string {
+	return "ArtifactSink(" + capnp.Client(c).String() + ")"
+}
+
+// AddRef creates a new Client that refers to the same capability as c.
+// If c is nil or has resolved to null, then AddRef returns nil.
+func (c ArtifactSink) AddRef() ArtifactSink {
+	return ArtifactSink(capnp.Client(c).AddRef())
+}
+
+// Release releases a capability reference.  If this is the last
+// reference to the capability, then the underlying resources associated
+// with the capability will be released.
+//
+// Release will panic if c has already been released, but not if c is
+// nil or resolved to null.
+func (c ArtifactSink) Release() {
+	capnp.Client(c).Release()
+}
+
+// Resolve blocks until the capability is fully resolved or the Context
+// expires.
+func (c ArtifactSink) Resolve(ctx context.Context) error {
+	return capnp.Client(c).Resolve(ctx)
+}
+
+func (c ArtifactSink) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Client(c).EncodeAsPtr(seg)
+}
+
+func (ArtifactSink) DecodeFromPtr(p capnp.Ptr) ArtifactSink {
+	return ArtifactSink(capnp.Client{}.DecodeFromPtr(p))
+}
+
+// IsValid reports whether c is a valid reference to a capability.
+// A reference is invalid if it is nil, has resolved to null, or has
+// been released.
+func (c ArtifactSink) IsValid() bool {
+	return capnp.Client(c).IsValid()
+}
+
+// IsSame reports whether c and other refer to a capability created by the
+// same call to NewClient.  This can return false negatives if c or other
+// are not fully resolved: use Resolve if this is an issue.  If either
+// c or other are released, then IsSame panics.
+func (c ArtifactSink) IsSame(other ArtifactSink) bool {
+	return capnp.Client(c).IsSame(capnp.Client(other))
+}
+
+// Update the flowcontrol.FlowLimiter used to manage flow control for
+// this client. This affects all future calls, but not calls already
+// waiting to send. Passing nil sets the value to flowcontrol.NopLimiter,
+// which is also the default.
+func (c ArtifactSink) SetFlowLimiter(lim fc.FlowLimiter) {
+	capnp.Client(c).SetFlowLimiter(lim)
+}
+
+// Get the current flowcontrol.FlowLimiter used to manage flow control
+// for this client.
+func (c ArtifactSink) GetFlowLimiter() fc.FlowLimiter {
+	return capnp.Client(c).GetFlowLimiter()
+}
+
+// A ArtifactSink_Server is a ArtifactSink with a local implementation.
+type ArtifactSink_Server interface {
+	Send(context.Context, ArtifactSink_send) error
+}
+
+// ArtifactSink_NewServer creates a new Server from an implementation of ArtifactSink_Server.
+func ArtifactSink_NewServer(s ArtifactSink_Server) *server.Server {
+	c, _ := s.(server.Shutdowner)
+	return server.New(ArtifactSink_Methods(nil, s), s, c)
+}
+
+// ArtifactSink_ServerToClient creates a new Client from an implementation of ArtifactSink_Server.
+// The caller is responsible for calling Release on the returned Client.
+func ArtifactSink_ServerToClient(s ArtifactSink_Server) ArtifactSink {
+	return ArtifactSink(capnp.NewClient(ArtifactSink_NewServer(s)))
+}
+
+// ArtifactSink_Methods appends Methods to a slice that invoke the methods on s.
+// This can be used to create a more complicated Server.
+func ArtifactSink_Methods(methods []server.Method, s ArtifactSink_Server) []server.Method {
+	if cap(methods) == 0 {
+		methods = make([]server.Method, 0, 1)
+	}
+
+	methods = append(methods, server.Method{
+		Method: capnp.Method{
+			InterfaceID:   0xbf5c0fa179cd51b6,
+			MethodID:      0,
+			InterfaceName: "artifact.capnp:ArtifactSink",
+			MethodName:    "send",
+		},
+		Impl: func(ctx context.Context, call *server.Call) error {
+			return s.Send(ctx, ArtifactSink_send{call})
+		},
+	})
+
+	return methods
+}
+
+// ArtifactSink_send holds the state for a server call to ArtifactSink.send.
+// See server.Call for documentation.
+type ArtifactSink_send struct {
+	*server.Call
+}
+
+// Args returns the call's arguments.
+func (c ArtifactSink_send) Args() ArtifactSink_send_Params {
+	return ArtifactSink_send_Params(c.Call.Args())
+}
+
+// AllocResults allocates the results struct.
+func (c ArtifactSink_send) AllocResults() (stream.StreamResult, error) {
+	r, err := c.Call.AllocResults(capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return stream.StreamResult(r), err
+}
+
+// ArtifactSink_List is a list of ArtifactSink.
+type ArtifactSink_List = capnp.CapList[ArtifactSink]
+
+// NewArtifactSink_List creates a new list of ArtifactSink.
+func NewArtifactSink_List(s *capnp.Segment, sz int32) (ArtifactSink_List, error) {
+	l, err := capnp.NewPointerList(s, sz)
+	return capnp.CapList[ArtifactSink](l), err
+}
+
+type ArtifactSink_send_Params capnp.Struct
+
+// ArtifactSink_send_Params_TypeID is the unique identifier for the type ArtifactSink_send_Params.
+const ArtifactSink_send_Params_TypeID = 0xe3230a75f41cae10
+
+func NewArtifactSink_send_Params(s *capnp.Segment) (ArtifactSink_send_Params, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return ArtifactSink_send_Params(st), err
+}
+
+func NewRootArtifactSink_send_Params(s *capnp.Segment) (ArtifactSink_send_Params, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return ArtifactSink_send_Params(st), err
+}
+
+func ReadRootArtifactSink_send_Params(msg *capnp.Message) (ArtifactSink_send_Params, error) {
+	root, err := msg.Root()
+	return ArtifactSink_send_Params(root.Struct()), err
+}
+
+func (s ArtifactSink_send_Params) String() string {
+	str, _ := text.Marshal(0xe3230a75f41cae10, capnp.Struct(s))
+	return str
+}
+
+func (s ArtifactSink_send_Params) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (ArtifactSink_send_Params) DecodeFromPtr(p capnp.Ptr) ArtifactSink_send_Params {
+	return ArtifactSink_send_Params(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s ArtifactSink_send_Params) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s ArtifactSink_send_Params) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s ArtifactSink_send_Params) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s ArtifactSink_send_Params) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s ArtifactSink_send_Params) Artifact() (Artifact, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return Artifact(p.Struct()), err
+}
+
+func (s ArtifactSink_send_Params) HasArtifact() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s ArtifactSink_send_Params) SetArtifact(v Artifact) error {
+	return capnp.Struct(s).SetPtr(0, capnp.Struct(v).ToPtr())
+}
+
+// NewArtifact sets the artifact field to a newly
+// allocated Artifact struct, preferring placement in s's segment.
+func (s ArtifactSink_send_Params) NewArtifact() (Artifact, error) {
+	ss, err := NewArtifact(capnp.Struct(s).Segment())
+	if err != nil {
+		return Artifact{}, err
+	}
+	err = capnp.Struct(s).SetPtr(0, capnp.Struct(ss).ToPtr())
+	return ss, err
+}
+
+// ArtifactSink_send_Params_List is a list of ArtifactSink_send_Params.
+type ArtifactSink_send_Params_List = capnp.StructList[ArtifactSink_send_Params]
+
+// NewArtifactSink_send_Params creates a new list of ArtifactSink_send_Params.
+func NewArtifactSink_send_Params_List(s *capnp.Segment, sz int32) (ArtifactSink_send_Params_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1}, sz)
+	return capnp.StructList[ArtifactSink_send_Params](l), err
+}
+
+// ArtifactSink_send_Params_Future is a wrapper for a ArtifactSink_send_Params promised by a client call.
+type ArtifactSink_send_Params_Future struct{ *capnp.Future }
+
+func (f ArtifactSink_send_Params_Future) Struct() (ArtifactSink_send_Params, error) {
+	p, err := f.Future.Ptr()
+	return ArtifactSink_send_Params(p.Struct()), err
+}
+func (p ArtifactSink_send_Params_Future) Artifact() Artifact_Future {
+	return Artifact_Future{Future: p.Future.Field(0, nil)}
+}
+
+const schema_e363a5839bf866c4 = "x\xda\x8cU\xdfk\x1cU\x14\xfe\xce\xbd3\x99l\x9a" +
+	"t;\xcc\x08V\xabEmA\x0b\x86\xfc\xe8KC!" +
+	"\xdb4\xc146\xb8\x93\xa9\x90H\xc0Nvo\x9b\xe9" +
+	"\xee\xcengfS\x02\x85X\xfc\xd1\x16\xf4\x0fP\x9f" +
+	"\xaa\x04\xed\x8b\"\xa8\xaf\xb1R\x10E\x1fj-\xa2 " +
+	"\xd8\x86 y\xa8\x88\xf4\xa1}Z9\x9b\xdd\xd95\x09" +
+	"\xd5\xb7\xb9\xdf=?\xbfs\xbf3}o\x89\x8c\xd6\xdf" +
+	"sQ\x87p2zG\xed\xfb`\xb5\xeb\xfa\xcd\x0b\x97" +
+	"a\xee!@'\x03\x18\xbc*\xa6\x08d}!\x86A" +
+	"\xb5\xc2\xd5\xfc\xb5Cg>\xb8\xb2a\xa0\xf1\xfd/\xe2" +
+	"\x0c\xdf\xaf\x09\x03T\xfb\xd2\xf9a\xf1Jzv\x05f" +
+	"Z\xd6\xae\x9f\xba\xff\xfe\xeb\xcb\xb9U\x80\xaco\xc5\x1d" +
+	"\xeb\x960\x00\xeb\x86x\xc1z\xc0_\xb5\xc3?\x1f=" +
+	"\xf8\xfb\xda\x13\xd7`\xa6\xa9e\xacK\xb6\xba-~\xb4" +
+	"\xee\xd6\xed\xd7\xc5\xa7\xa0\xda\xe0\xe3\xce\x1f7\xcf\xfb7" +
+	"6\xd9\xd6-.\xc8\xef\xacw\xea^\x97\xe59Pm" +
+	"\xd7'{\xeeU\xbb\x9eYm\xefbM\x8ep\x95w" +
+	"%w1=\xba2\xf0a\xea\xd0z\xc3\x80]\x07\x1f" +
+	"\xd1\xe6\xd8\xe0)\x8d\xb3\xad\x7f\xfe\xebK/\xde\x8b\xfe" +
+	"\xdc\xd2\xc6-\xed\x8eu\x9b\xdb\xb6~\xd3.Z\xfd:" +
+	"\xb7\xb1\xf2\xd3\xf2\x1b\x7f?\x99\xfb\xab=\xddn}\x82" +
+	"\xa3\xed\xd79\xdd\xcc\x83\x99\xfb\xdf,\x9f\xaf\xc1IS" +
+	"{\xf1;8\xce\x98\xfe\xb55\xc9q\x06\x8f\xe9\x1f\x09" +
+	"\x1c\xadya\xec\x9f\xf2r\xb1\xd6\x9b\xf3*Aeh" +
+	"\xb2\x9cWEW\x85\x0b~N\xf5\x9e\xad\xaapq\xdf" +
+	"\x94\x8a\xaa\xc5\x98\"G\x93\x1a\xa0\x11`\xf6L\x00N" +
+	"\xb7$\xe7QA\xb5PE\x95r\x10)\x00\xb4\xab\x95" +
+	"\x1eD\xbb@\x0fOpZ\x05*\xf4b\xc59\xd2\xd5" +
+	"b\x1ce\xa5\x96x\x88\x86\xc7\x91\xc6\xd95\xfc\xa0\x90" +
+	"%r4\xa9\x03\x09\xef\x14|\xf6\xd5\xb9\xc1\xf7^}" +
+	"\xd74\x0f@\x98\xba\x91\x8eT\x90\xcfP\x96hk\xa8" +
+	"8\xf6r\xf3%\x15P\xcc\x81\xba\x93\x86\xc6\x0e\x00N" +
+	"F\x92s\\\x90Id\x13\x83\xc7\x18\x1c\x95\xe4d\x05" +
+	"\x99B\xd8$\x00s\x92\xc1qI\xce\x09A\xe9\x92_" +
+	"R\xd4\x0dA\xdd\xa0t\xe0\xb5\x1d\xf2^\xecQ\x0f\x04" +
+	"\xf5`\xdb2B\x7f\xae\x1a+\x80\xcb\xe8L\xcax\xee" +
+	"i\xc0\xd9'\xc9\xe9k+\xe3\xf9\x01\xc0yV\x92s" +
+	"P\x90QP\x8b\xcd\x1c{\x17\xbcb5\xc9\xb8\x85\xe8" +
+	"\x846?(\xf42%\xfb\xb2^\xe8\x95\"l7\xc7" +
+	"=\xa2\x15`\xf3\x1c\x91!F\xfe\xf7,\xb3^hx" +
+	"\xa5\xa8\x9d\xdd\xa1\xed\xd8\x9dj\x109\xdf\xc6\xaebv" +
+	"OJr*\x82\x86+\xf5z\xb7\xb0\x08\x8ah'(" +
+	"+i\x9b2w\x82\xd2\x91\x1f\x14\xc8lm\x87\xc6\x95" +
+	"\xb9\xcd$\x92\x0e\x0c?\xa76f\xa1\xb7\x89\x8c\x9a+" +
+	"\xca\xec\x1f\x800\xf7\x1b\xd4\x9235\xb7\x93\xb9{\x02" +
+	"\xc24\x8d\xbdu\xb9d\xa8\xd6d\xa2\x9e8K\xff\xc1" +
+	"\xdb\x86\xc8\x1a\xb3\xf9\xd7pF\x00\xa7S\x92c\x0bZ" +
+	"\x0a\xd5\xd9\xaa\x8a\xe2\x87\x08l\xb3\\\xeaO\xab\xaf\x19" +
+	"\xcd:B\x8f\x01\xeea\x92\xe4\x8eSk\x0c\xd6\x18M" +
+	"\x00\xee(\xe3YjM\xc2\x9a\xa4!\xc0\x1dg\xfc\x04" +
+	"\xe3R\xda$\x01\xcb\xa1\x11\xc0=\xce\xf84\xe3\x9af" +
+	"\x93\x06X/\xd3\x01\xc0\xcd2>K\x82H\xb7I\x07" +
+	"\xac\x19\x9a\x02\xdci\x86\xf3l\xde\xa1\xdb\xd4\x01X^" +
+	"=\xfc,\xe3\xf3\x8c\x1b\x1d6\xf1\x82R\xf50'\x19" +
+	"/2\xdei\xd8\xd4\x09X>\x0d\x00n\x9e\xf1\x0a\xe3" +
+	"\xa9N\x9bR\x80U\xa2W\x00\xb7\xc8\xf8%\xc6\xbbR" +
+	"6u\x01\xd6\x9b\xf52_c\xfcm\xc6wt\xd9\xb4" +
+	"\x83w6\xcd\x01\xee%\xc6?&A\xd2\xcf'\x02\xca" +
+	"\xcd\xab\\!\xaa\x96\x004\xdf\xdcp\xa5:\xc7\x8ak" +
+	"\x1c\x97\x16T\x18\xf9\xe5 Qy\xbcXi\x090\xf6" +
+	"K*\x8a\xbd\x12\xa8B)\x08J\x81\x86\xcb\xa1\x7f\xda" +
+	"o\xd9\x87\xe5bb\xbf7\xca\x95\xdb\xbc\xbd\xc6N\x80" +
+	"Tm\xcf;\xf9\x11\x81\x18\\\xaax\x8b\xc5\xb2\x97o" +
+	"i\xa2\xb1\xd0`\x04q\x9b[\xf2\xafk\xa9\xe2\x9f\x01" +
+	"\x00\x03\xb3\xd2x"
 
 func RegisterSchema(reg *schemas.Registry) {
 	reg.Register(&schemas.Schema{
 		String: schema_e363a5839bf866c4,
 		Nodes: []uint64{
 			0x8981d3c40ae36ecc,
+			0xa1a26a39c164a96b,
+			0xbf5c0fa179cd51b6,
+			0xc11de5e03443d73c,
 			0xd1697cd3e7511b33,
+			0xe3230a75f41cae10,
+			0xe93909a332bf4458,
 			0xee73f44b4fdab4e9,
 			0xf0631ef284a5d4bf,
 			0xff7ca5c7f859f959,
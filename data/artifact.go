@@ -1,6 +1,7 @@
 package data
 
 import (
+	"errors"
 	"time"
 
 	"capnproto.org/go/capnp/v3"
@@ -81,47 +82,15 @@ func New(origin, role, scope string, data []byte) *Artifact {
 
 /*
 Peek retrieves a value from the artifact, starting by looking for an existing field,
-and falling back to searching the attribute list.
+and falling back to searching the attribute list. The value is empty when the
+artifact does not have it, which Lookup tells apart from an empty value.
 */
-// Peek returns (value, exists)
 func (artifact *Artifact) Peek(key string) string {
-	var (
-		value string
-		data  []byte
-		err   error
-	)
-
-	// Check if the key corresponds to a top-level field.
-	switch key {
-	case "id":
-		value, err = artifact.Id()
-	case "version":
-		value, err = artifact.Version()
-	case "type":
-		value, err = artifact.Type()
-	case "origin":
-		value, err = artifact.Origin()
-	case "role":
-		value, err = artifact.Role()
-	case "scope":
-		value, err = artifact.Scope()
-	case "payload":
-		data, err = artifact.Payload()
-		value = string(data)
-	default:
-		// If the key is not a top-level field, look in the attributes list.
-		value, err = artifact.getAttributeValue(key)
-	}
-
-	if err != nil {
-		errnie.Error(err)
-		return err.Error()
-	}
-
+	value, _ := artifact.Lookup(key)
 	return value
 }
 
-// Poke sets a value and returns a boolean indicating success
+// Poke sets a field, or an attribute, adding it when the artifact does not have it yet.
 func (artifact *Artifact) Poke(key, value string) {
 	var err error
 
@@ -151,53 +120,43 @@ func (artifact *Artifact) Poke(key, value string) {
 }
 
 // getAttributeValue searches the attribute list for the given key.
-func (artifact *Artifact) getAttributeValue(key string) (string, error) {
-	attrs, err := artifact.Attributes()
-	if errnie.Error(err) != nil {
-		return "", err
+func (artifact *Artifact) getAttributeValue(key string) (string, bool) {
+	attrs, idx := artifact.findAttribute(key)
+	if idx < 0 {
+		return "", false
 	}
 
-	// Iterate through the attributes list to find a matching key.
-	for i := 0; i < attrs.Len(); i++ {
-		attr := attrs.At(i) // Only one return value now.
-		attrKey, err := attr.Key()
-		if errnie.Error(err) != nil {
-			return "", err
-		}
-
-		if attrKey == key {
-			return attr.Value()
-		}
+	value, err := attrs.At(idx).Value()
+	if errnie.Error(err) != nil {
+		return "", false
 	}
 
-	return "", nil
+	return value, true
 }
 
 /*
-addAttribute adds a new attribute to the artifact.
+addAttribute adds a new attribute to the artifact, in the first free slot,
+growing the list when there is none.
 */
 func (artifact *Artifact) addAttribute(key, value string) error {
-	// Retrieve the existing attributes.
-	attrs, err := artifact.Attributes()
-	if err != nil {
+	if err := artifact.reserve(1); err != nil {
 		return errnie.Error(err)
 	}
 
-	// Create a new list of attributes, with length increased by 1 to accommodate the new attribute.
-	newAttrs, err := NewAttribute_List(artifact.Segment(), int32(attrs.Len()+1))
+	attrs, err := artifact.Attributes()
 	if err != nil {
 		return errnie.Error(err)
 	}
 
-	// Copy existing attributes to the new list.
-	for i := 0; i < attrs.Len(); i++ {
-		if err := newAttrs.Set(i, attrs.At(i)); err != nil {
-			return errnie.Error(err)
+	idx := 0
+
+	for ; idx < attrs.Len(); idx++ {
+		if attrKey, _ := attrs.At(idx).Key(); attrKey == "" {
+			break
 		}
 	}
 
-	// Add the new attribute at the last position.
-	newAttr := newAttrs.At(attrs.Len())
+	newAttr := attrs.At(idx)
 	if err := newAttr.SetKey(key); err != nil {
 		return errnie.Error(err)
 	}
@@ -205,35 +164,18 @@ func (artifact *Artifact) addAttribute(key, value string) error {
 		return errnie.Error(err)
 	}
 
-	// Set the updated list of attributes back to the artifact.
-	if err := artifact.SetAttributes(newAttrs); err != nil {
-		return errnie.Error(err)
-	}
-
 	return nil
 }
 
 // updateOrAddAttribute updates an existing attribute or adds a new one if it doesn't exist
 func (artifact *Artifact) updateOrAddAttribute(key, value string) error {
-	attrs, err := artifact.Attributes()
-	if err != nil {
-		return errnie.Error(err)
+	if key == "" {
+		return errnie.Error(errors.New("an attribute needs a key"))
 	}
 
-	// Check if the attribute already exists
-	for i := 0; i < attrs.Len(); i++ {
-		attr := attrs.At(i)
-		attrKey, err := attr.Key()
-		if err != nil {
-			return errnie.Error(err)
-		}
-
-		if attrKey == key {
-			// Update existing attribute
-			return attr.SetValue(value)
-		}
+	if attrs, idx := artifact.findAttribute(key); idx >= 0 {
+		return attrs.At(idx).SetValue(value)
 	}
 
-	// If the attribute doesn't exist, add a new one
 	return artifact.addAttribute(key, value)
 }
@@ -0,0 +1,325 @@
+package data
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
+
+	"capnproto.org/go/capnp/v3"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Attributes are kept in a list that grows by doubling, rather than by one on
+every insert, as a capnp list cannot grow in place, and every list it outgrows
+stays behind in the message. The slots that are not used yet, and those of
+deleted attributes, have an empty key, which no attribute can have, and are
+filled before the list grows again.
+*/
+const minAttributes = 4
+
+/*
+Lookup returns the value of a field, such as `role`, or of an attribute, such
+as `chain`, and whether the artifact has it. An artifact always has its
+fields, but only the attributes that were poked into it.
+*/
+func (artifact *Artifact) Lookup(key string) (string, bool) {
+	var (
+		value string
+		data  []byte
+		err   error
+	)
+
+	switch key {
+	case "id":
+		value, err = artifact.Id()
+	case "version":
+		value, err = artifact.Version()
+	case "type":
+		value, err = artifact.Type()
+	case "origin":
+		value, err = artifact.Origin()
+	case "role":
+		value, err = artifact.Role()
+	case "scope":
+		value, err = artifact.Scope()
+	case "payload":
+		data, err = artifact.Payload()
+		value = string(data)
+	default:
+		return artifact.getAttributeValue(key)
+	}
+
+	if err != nil {
+		errnie.Error(err)
+		return "", false
+	}
+
+	return value, true
+}
+
+/*
+Delete removes an attribute, and reports whether the artifact had it. Fields
+cannot be deleted.
+*/
+func (artifact *Artifact) Delete(key string) bool {
+	if isField(key) {
+		return false
+	}
+
+	attrs, idx := artifact.findAttribute(key)
+
+	if idx < 0 {
+		return false
+	}
+
+	attr := attrs.At(idx)
+
+	if err := attr.SetKey(""); err != nil {
+		errnie.Error(err)
+		return false
+	}
+
+	errnie.Error(attr.SetValue(""))
+	return true
+}
+
+/*
+Range calls fn with every attribute, in the order they are kept in, until it
+returns false.
+*/
+func (artifact *Artifact) Range(fn func(key, value string) bool) {
+	attrs, err := artifact.Attributes()
+	if errnie.Error(err) != nil {
+		return
+	}
+
+	for idx := 0; idx < attrs.Len(); idx++ {
+		key, _ := attrs.At(idx).Key()
+
+		if key == "" {
+			continue
+		}
+
+		value, _ := attrs.At(idx).Value()
+
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+/*
+PokeAll sets a number of fields and attributes at once, growing the list of
+attributes at most once for all of them. Keys are set in sorted order, so the
+attributes are added in the same order whatever order the map is in.
+*/
+func (artifact *Artifact) PokeAll(values map[string]string) {
+	keys := make([]string, 0, len(values))
+	added := 0
+
+	for key := range values {
+		keys = append(keys, key)
+
+		if _, idx := artifact.findAttribute(key); idx < 0 && !isField(key) {
+			added++
+		}
+	}
+
+	slices.Sort(keys)
+	errnie.Error(artifact.reserve(added))
+
+	for _, key := range keys {
+		artifact.Poke(key, values[key])
+	}
+}
+
+/*
+Clone returns a deep copy of the artifact, in a message of its own, so it can
+be changed without changing the artifact, and outlives the message the
+artifact is in.
+*/
+func (artifact *Artifact) Clone() *Artifact {
+	msg, _, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if errnie.Error(err) != nil {
+		return Empty()
+	}
+
+	if err = msg.SetRoot(capnp.Struct(*artifact).ToPtr()); errnie.Error(err) != nil {
+		return Empty()
+	}
+
+	clone, err := ReadRootArtifact(msg)
+	if errnie.Error(err) != nil {
+		return Empty()
+	}
+
+	return &clone
+}
+
+/*
+PeekInt returns an attribute as an integer, and whether the artifact has it,
+as one.
+*/
+func (artifact *Artifact) PeekInt(key string) (int64, bool) {
+	value, ok := artifact.Lookup(key)
+	if !ok {
+		return 0, false
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	return number, err == nil
+}
+
+func (artifact *Artifact) PokeInt(key string, value int64) {
+	artifact.Poke(key, strconv.FormatInt(value, 10))
+}
+
+/*
+PeekFloat returns an attribute as a float, and whether the artifact has it, as
+one.
+*/
+func (artifact *Artifact) PeekFloat(key string) (float64, bool) {
+	value, ok := artifact.Lookup(key)
+	if !ok {
+		return 0, false
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	return number, err == nil
+}
+
+func (artifact *Artifact) PokeFloat(key string, value float64) {
+	artifact.Poke(key, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+/*
+PeekBool returns an attribute as a bool, and whether the artifact has it, as
+one.
+*/
+func (artifact *Artifact) PeekBool(key string) (bool, bool) {
+	value, ok := artifact.Lookup(key)
+	if !ok {
+		return false, false
+	}
+
+	flag, err := strconv.ParseBool(value)
+	return flag, err == nil
+}
+
+func (artifact *Artifact) PokeBool(key string, value bool) {
+	artifact.Poke(key, strconv.FormatBool(value))
+}
+
+/*
+PeekTime returns an attribute as a time, kept as RFC 3339 with nanoseconds,
+and whether the artifact has it, as one.
+*/
+func (artifact *Artifact) PeekTime(key string) (time.Time, bool) {
+	value, ok := artifact.Lookup(key)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	moment, err := time.Parse(time.RFC3339Nano, value)
+	return moment, err == nil
+}
+
+func (artifact *Artifact) PokeTime(key string, value time.Time) {
+	artifact.Poke(key, value.Format(time.RFC3339Nano))
+}
+
+/*
+PeekJSON unmarshals an attribute into v, and reports whether the artifact has
+it, as JSON that fits v.
+*/
+func (artifact *Artifact) PeekJSON(key string, v any) bool {
+	value, ok := artifact.Lookup(key)
+	return ok && json.Unmarshal([]byte(value), v) == nil
+}
+
+func (artifact *Artifact) PokeJSON(key string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	artifact.Poke(key, string(buf))
+	return nil
+}
+
+/*
+findAttribute returns the list of attributes, and the index of the key in it,
+which is -1 when the artifact does not have it.
+*/
+func (artifact *Artifact) findAttribute(key string) (Attribute_List, int) {
+	attrs, err := artifact.Attributes()
+	if errnie.Error(err) != nil || key == "" {
+		return attrs, -1
+	}
+
+	for idx := 0; idx < attrs.Len(); idx++ {
+		if attrKey, _ := attrs.At(idx).Key(); attrKey == key {
+			return attrs, idx
+		}
+	}
+
+	return attrs, -1
+}
+
+/*
+reserve makes sure there are at least n free slots in the list of attributes,
+growing it to twice what it needs when there are not.
+*/
+func (artifact *Artifact) reserve(n int) error {
+	attrs, err := artifact.Attributes()
+	if err != nil {
+		return err
+	}
+
+	used := 0
+
+	for idx := 0; idx < attrs.Len(); idx++ {
+		if key, _ := attrs.At(idx).Key(); key != "" {
+			used++
+		}
+	}
+
+	if attrs.Len()-used >= n {
+		return nil
+	}
+
+	grown, err := NewAttribute_List(artifact.Segment(), int32(max(minAttributes, 2*(used+n))))
+	if err != nil {
+		return err
+	}
+
+	// Only the attributes in use are copied, which compacts the slots of the
+	// deleted ones.
+	next := 0
+
+	for idx := 0; idx < attrs.Len(); idx++ {
+		if key, _ := attrs.At(idx).Key(); key != "" {
+			if err = grown.Set(next, attrs.At(idx)); err != nil {
+				return err
+			}
+
+			next++
+		}
+	}
+
+	return artifact.SetAttributes(grown)
+}
+
+/*
+isField reports whether the key is that of a field, rather than an attribute.
+*/
+func isField(key string) bool {
+	switch key {
+	case "id", "version", "type", "origin", "role", "scope", "payload":
+		return true
+	}
+
+	return false
+}
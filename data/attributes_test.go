@@ -0,0 +1,159 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttributes(t *testing.T) {
+	Convey("Given an artifact with attributes", t, func() {
+		artifact := New("test", "user", "prompt", []byte("hello"))
+		artifact.Poke("chain", "planner")
+		artifact.Poke("empty", "")
+
+		Convey("It should tell a missing attribute apart from an empty one", func() {
+			value, ok := artifact.Lookup("empty")
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, "")
+
+			_, ok = artifact.Lookup("missing")
+			So(ok, ShouldBeFalse)
+			So(artifact.Peek("missing"), ShouldEqual, "")
+
+			value, ok = artifact.Lookup("role")
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, "user")
+		})
+
+		Convey("It should update an attribute in place", func() {
+			artifact.Poke("chain", "executor")
+
+			So(artifact.Peek("chain"), ShouldEqual, "executor")
+			So(artifact.attributeMap(), ShouldHaveLength, 2)
+		})
+
+		Convey("It should delete attributes, but not fields", func() {
+			So(artifact.Delete("chain"), ShouldBeTrue)
+			So(artifact.Delete("chain"), ShouldBeFalse)
+			So(artifact.Delete("role"), ShouldBeFalse)
+
+			_, ok := artifact.Lookup("chain")
+			So(ok, ShouldBeFalse)
+			So(artifact.Peek("role"), ShouldEqual, "user")
+
+			artifact.Poke("chain", "reviewer")
+			So(artifact.Peek("chain"), ShouldEqual, "reviewer")
+		})
+
+		Convey("It should range over the attributes until told to stop", func() {
+			seen := map[string]string{}
+
+			artifact.Range(func(key, value string) bool {
+				seen[key] = value
+				return true
+			})
+
+			So(seen, ShouldResemble, map[string]string{"chain": "planner", "empty": ""})
+
+			count := 0
+
+			artifact.Range(func(key, value string) bool {
+				count++
+				return false
+			})
+
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("It should clone into an artifact of its own", func() {
+			clone := artifact.Clone()
+			clone.Poke("chain", "executor")
+			clone.Poke("payload", "changed")
+
+			So(artifact.Peek("chain"), ShouldEqual, "planner")
+			So(artifact.Peek("payload"), ShouldEqual, "hello")
+			So(clone.Peek("chain"), ShouldEqual, "executor")
+			So(clone.Peek("id"), ShouldEqual, artifact.Peek("id"))
+		})
+
+		Convey("It should poke many values at once", func() {
+			artifact.PokeAll(map[string]string{"a": "1", "b": "2", "chain": "done", "scope": "answer"})
+
+			So(artifact.Peek("a"), ShouldEqual, "1")
+			So(artifact.Peek("b"), ShouldEqual, "2")
+			So(artifact.Peek("chain"), ShouldEqual, "done")
+			So(artifact.Peek("scope"), ShouldEqual, "answer")
+			So(artifact.attributeMap(), ShouldHaveLength, 4)
+		})
+
+		Convey("It should keep its digest whatever the list of attributes looks like", func() {
+			other := New("test", "user", "prompt", []byte("hello"))
+			So(other.SetId(artifact.Peek("id")), ShouldBeNil)
+			other.SetTimestamp(artifact.Timestamp())
+
+			other.Poke("gone", "soon")
+
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				other.Poke(key, key)
+				other.Delete(key)
+			}
+
+			other.Delete("gone")
+			other.PokeAll(map[string]string{"empty": "", "chain": "planner"})
+
+			So(other.Digest(), ShouldResemble, artifact.Digest())
+		})
+	})
+
+	Convey("Given typed attributes", t, func() {
+		artifact := New("test", "user", "prompt", nil)
+		moment := time.Date(2026, 10, 17, 12, 30, 0, 123456789, time.UTC)
+
+		artifact.PokeInt("retries", -3)
+		artifact.PokeFloat("temperature", 0.7)
+		artifact.PokeBool("final", true)
+		artifact.PokeTime("deadline", moment)
+		So(artifact.PokeJSON("route", map[string]any{"next": "executor"}), ShouldBeNil)
+
+		Convey("It should read them back as what they were poked as", func() {
+			retries, ok := artifact.PeekInt("retries")
+			So(ok, ShouldBeTrue)
+			So(retries, ShouldEqual, -3)
+
+			temperature, ok := artifact.PeekFloat("temperature")
+			So(ok, ShouldBeTrue)
+			So(temperature, ShouldEqual, 0.7)
+
+			final, ok := artifact.PeekBool("final")
+			So(ok, ShouldBeTrue)
+			So(final, ShouldBeTrue)
+
+			deadline, ok := artifact.PeekTime("deadline")
+			So(ok, ShouldBeTrue)
+			So(deadline.Equal(moment), ShouldBeTrue)
+
+			route := map[string]string{}
+			So(artifact.PeekJSON("route", &route), ShouldBeTrue)
+			So(route["next"], ShouldEqual, "executor")
+		})
+
+		Convey("It should report values that are missing, or not of the type", func() {
+			_, ok := artifact.PeekInt("missing")
+			So(ok, ShouldBeFalse)
+
+			_, ok = artifact.PeekInt("temperature")
+			So(ok, ShouldBeFalse)
+
+			_, ok = artifact.PeekBool("route")
+			So(ok, ShouldBeFalse)
+
+			_, ok = artifact.PeekTime("retries")
+			So(ok, ShouldBeFalse)
+
+			var route []string
+			So(artifact.PeekJSON("route", &route), ShouldBeFalse)
+		})
+	})
+}
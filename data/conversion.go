@@ -24,13 +24,20 @@ func (artifact *Artifact) Marshal(p []byte) {
 	copy(p, buf)
 }
 
-func (artifact *Artifact) Unmarshal(buf []byte) error {
+func (artifact *Artifact) Unmarshal(buf []byte) (err error) {
 	var (
 		msg    *capnp.Message
 		artfct Artifact
-		err    error
 	)
 
+	// capnp panics on some malformed messages, instead of returning an
+	// error, and buffers come in from the network.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed message: %v", r)
+		}
+	}()
+
 	if len(buf) == 0 {
 		return fmt.Errorf("empty buffer")
 	}
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+MAX_FRAME_SIZE is the largest artifact a decoder reads, so a corrupt or
+hostile length prefix cannot make it allocate whatever it claims.
+*/
+const MAX_FRAME_SIZE = 64 << 20
+
+/*
+frameHeader is the size of the length prefix in front of every artifact.
+*/
+const frameHeader = 4
+
+var ErrFrameSize = errors.New("artifact frame is larger than the maximum size")
+
+/*
+ArtifactEncoder writes artifacts to a stream, each framed by its length, as a
+big endian uint32, in front of the marshaled message, so any number of them
+can be sent over a file, a socket, a pipe, or the datalake, and be read back
+one by one by an ArtifactDecoder.
+*/
+type ArtifactEncoder struct {
+	w io.Writer
+}
+
+func NewArtifactEncoder(w io.Writer) *ArtifactEncoder {
+	return &ArtifactEncoder{w: w}
+}
+
+/*
+Encode writes the artifact as a single frame, in a single write, so frames
+written to a connection are never split over writes.
+*/
+func (encoder *ArtifactEncoder) Encode(artifact *Artifact) error {
+	frame, err := artifact.frame()
+	if err != nil {
+		return err
+	}
+
+	_, err = encoder.w.Write(frame)
+	return err
+}
+
+/*
+ArtifactDecoder reads the artifacts an ArtifactEncoder wrote from a stream.
+*/
+type ArtifactDecoder struct {
+	r io.Reader
+}
+
+func NewArtifactDecoder(r io.Reader) *ArtifactDecoder {
+	return &ArtifactDecoder{r: r}
+}
+
+/*
+Decode reads the next artifact. It returns io.EOF when the stream ends between
+frames, and io.ErrUnexpectedEOF when it ends halfway through one. A frame that
+does not hold an artifact is an error too, but as the frame was read whole,
+the artifacts after it can still be decoded.
+*/
+func (decoder *ArtifactDecoder) Decode() (*Artifact, error) {
+	artifact, _, err := decoder.next()
+	return artifact, err
+}
+
+/*
+next reads the next frame, and returns the artifact in it, with how many
+bytes were read.
+*/
+func (decoder *ArtifactDecoder) next() (*Artifact, int64, error) {
+	var header [frameHeader]byte
+
+	n, err := io.ReadFull(decoder.r, header[:])
+	if err != nil {
+		return nil, int64(n), err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+
+	if size > MAX_FRAME_SIZE {
+		return nil, int64(n), fmt.Errorf("%w: %d bytes", ErrFrameSize, size)
+	}
+
+	// The message keeps referring to the buffer it was unmarshaled from, so
+	// every frame gets a buffer of its own, which grows as the frame comes
+	// in, rather than being as large as the length prefix claims up front.
+	buf := bytes.NewBuffer(make([]byte, 0, min(size, bytes.MinRead)))
+	read, err := io.CopyN(buf, decoder.r, int64(size))
+
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, int64(n) + read, err
+	}
+
+	artifact := Empty()
+
+	if err = artifact.Unmarshal(buf.Bytes()); err != nil {
+		return nil, int64(n) + read, err
+	}
+
+	return artifact, int64(n) + read, nil
+}
+
+/*
+frame returns the artifact marshaled, with its length in front of it.
+*/
+func (artifact *Artifact) frame() ([]byte, error) {
+	buf, err := artifact.Message().Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) > MAX_FRAME_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameSize, len(buf))
+	}
+
+	frame := make([]byte, frameHeader, frameHeader+len(buf))
+	binary.BigEndian.PutUint32(frame, uint32(len(buf)))
+
+	return append(frame, buf...), nil
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestArtifactEncoder(t *testing.T) {
+	Convey("Given a stream of artifacts", t, func() {
+		var stream bytes.Buffer
+
+		encoder := NewArtifactEncoder(&stream)
+		payloads := []string{"first", "", string(bytes.Repeat([]byte("large"), 100000))}
+
+		for _, payload := range payloads {
+			So(encoder.Encode(New("test", "user", "prompt", []byte(payload))), ShouldBeNil)
+		}
+
+		Convey("It should decode them in order, and end with io.EOF", func() {
+			decoder := NewArtifactDecoder(&stream)
+
+			for _, payload := range payloads {
+				artifact, err := decoder.Decode()
+
+				So(err, ShouldBeNil)
+				So(artifact.Peek("payload"), ShouldEqual, payload)
+			}
+
+			_, err := decoder.Decode()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("It should report a stream that ends halfway through a frame", func() {
+			decoder := NewArtifactDecoder(bytes.NewReader(stream.Bytes()[:stream.Len()-1]))
+
+			for range payloads[:2] {
+				_, err := decoder.Decode()
+				So(err, ShouldBeNil)
+			}
+
+			_, err := decoder.Decode()
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+	})
+
+	Convey("Given a frame larger than the maximum size", t, func() {
+		header := binary.BigEndian.AppendUint32(nil, MAX_FRAME_SIZE+1)
+
+		Convey("It should not read it", func() {
+			_, err := NewArtifactDecoder(bytes.NewReader(header)).Decode()
+			So(errors.Is(err, ErrFrameSize), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a frame that does not hold an artifact", t, func() {
+		var stream bytes.Buffer
+
+		stream.Write(binary.BigEndian.AppendUint32(nil, 3))
+		stream.WriteString("bad")
+		NewArtifactEncoder(&stream).Encode(New("test", "user", "prompt", []byte("good")))
+
+		Convey("It should skip it, and decode the artifacts after it", func() {
+			decoder := NewArtifactDecoder(&stream)
+
+			_, err := decoder.Decode()
+			So(err, ShouldNotBeNil)
+
+			artifact, err := decoder.Decode()
+			So(err, ShouldBeNil)
+			So(artifact.Peek("payload"), ShouldEqual, "good")
+		})
+	})
+}
+
+func TestArtifactIO(t *testing.T) {
+	Convey("Given an artifact", t, func() {
+		artifact := New("test", "user", "prompt", []byte("hello"))
+		artifact.Poke("chain", "test")
+
+		Convey("It should be copied through any stream", func() {
+			var stream bytes.Buffer
+
+			_, err := io.Copy(&stream, artifact)
+			So(err, ShouldBeNil)
+
+			copied := Empty()
+			_, err = io.Copy(copied, &stream)
+
+			So(err, ShouldBeNil)
+			So(copied.Peek("payload"), ShouldEqual, "hello")
+			So(copied.Peek("chain"), ShouldEqual, "test")
+		})
+
+		Convey("It should be read over as many reads as it takes", func() {
+			large := New("test", "user", "prompt", bytes.Repeat([]byte("large"), 1000))
+			frame, err := large.frame()
+			So(err, ShouldBeNil)
+
+			buf, err := io.ReadAll(large.NewReader())
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, frame)
+
+			buf, err = io.ReadAll(iotest.OneByteReader(large.NewReader()))
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, frame)
+
+			So(iotest.TestReader(large.NewReader(), frame), ShouldBeNil)
+
+			decoded, err := NewArtifactDecoder(iotest.HalfReader(large.NewReader())).Decode()
+			So(err, ShouldBeNil)
+			So(decoded.Peek("payload"), ShouldEqual, large.Peek("payload"))
+		})
+
+		Convey("It should be read whole, from the start, on every read", func() {
+			frame, _ := artifact.frame()
+
+			n, err := artifact.Read(make([]byte, 8))
+			So(n, ShouldEqual, 0)
+			So(err, ShouldEqual, io.ErrShortBuffer)
+
+			for range 2 {
+				buf := make([]byte, len(frame)+8)
+				n, err = artifact.Read(buf)
+
+				So(err, ShouldEqual, io.EOF)
+				So(buf[:n], ShouldResemble, frame)
+			}
+
+			So(artifact.Close(), ShouldBeNil)
+		})
+
+		Convey("It should be written from a single frame", func() {
+			buf, _ := io.ReadAll(artifact.NewReader())
+			n := len(buf)
+			buf = append(buf, 0)
+
+			written := Empty()
+			m, err := written.Write(buf[:n])
+
+			So(err, ShouldBeNil)
+			So(m, ShouldEqual, n)
+			So(written.Peek("payload"), ShouldEqual, "hello")
+
+			m, err = Empty().Write(buf[:n-1])
+			So(m, ShouldEqual, 0)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+
+			m, err = Empty().Write(buf[:n+1])
+			So(m, ShouldEqual, n)
+			So(err, ShouldEqual, io.ErrShortWrite)
+		})
+	})
+}
+
+func FuzzArtifactDecoder(f *testing.F) {
+	var stream bytes.Buffer
+
+	encoder := NewArtifactEncoder(&stream)
+	encoder.Encode(New("test", "user", "prompt", []byte("hello")))
+	encoder.Encode(New("test", "assistant", "answer", nil).Attach(NewPart("text/plain", "note.txt", []byte("note"))))
+
+	f.Add(stream.Bytes())
+	f.Add(stream.Bytes()[:7])
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		decoder := NewArtifactDecoder(bytes.NewReader(input))
+
+		// Malformed input has to come back as errors, without panicking,
+		// and every frame has to be consumed, so decoding always ends.
+		for range len(input) + 1 {
+			artifact, err := decoder.Decode()
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrFrameSize) {
+				return
+			}
+
+			if err == nil {
+				artifact.Peek("payload")
+				artifact.Parts()
+				artifact.Verify()
+			}
+		}
+
+		t.Fatal("decoder did not reach the end of the input")
+	})
+}
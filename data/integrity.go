@@ -0,0 +1,186 @@
+package data
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"slices"
+
+	"github.com/theapemachine/errnie"
+)
+
+/*
+The ways an artifact can fail to verify.
+*/
+var (
+	ErrNoChecksum = errors.New("artifact has no checksum")
+	ErrChecksum   = errors.New("artifact does not match its checksum")
+	ErrSignature  = errors.New("artifact signature is not valid")
+	ErrUnsigned   = errors.New("artifact is not signed")
+	ErrUntrusted  = errors.New("artifact is signed by an untrusted key")
+)
+
+/*
+Digest hashes the canonical fields of the artifact: its id, version, type,
+timestamp, origin, role, scope, payload and public key, its attributes, sorted
+by key, leaving out the signature, which is made over the digest, and its
+parts, in order. Every field is length prefixed, and every list prefixed by
+how many it holds, so no two artifacts hash the same by moving bytes from one
+field to the next.
+*/
+func (artifact *Artifact) Digest() []byte {
+	hash := sha256.New()
+
+	field := func(value []byte) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(value)))
+
+		hash.Write(size[:])
+		hash.Write(value)
+	}
+
+	count := func(n int) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+
+		hash.Write(size[:])
+	}
+
+	for _, key := range []string{"id", "version", "type"} {
+		field([]byte(artifact.Peek(key)))
+	}
+
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], artifact.Timestamp())
+	field(timestamp[:])
+
+	for _, key := range []string{"origin", "role", "scope"} {
+		field([]byte(artifact.Peek(key)))
+	}
+
+	payload, err := artifact.Payload()
+	errnie.Error(err)
+	field(payload)
+
+	pubkey, err := artifact.Pubkey()
+	errnie.Error(err)
+	field(pubkey)
+
+	attributes := artifact.attributeMap()
+	delete(attributes, "signature")
+
+	keys := make([]string, 0, len(attributes))
+
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+	count(len(keys))
+
+	for _, key := range keys {
+		field([]byte(key))
+		field([]byte(attributes[key]))
+	}
+
+	parts := artifact.Parts()
+	count(len(parts))
+
+	for _, part := range parts {
+		field([]byte(part.MIME))
+		field([]byte(part.Name))
+		field(part.Data)
+	}
+
+	return hash.Sum(nil)
+}
+
+/*
+Seal sets the checksum of the artifact to its digest, which has to be done
+again after anything about it changed.
+*/
+func (artifact *Artifact) Seal() *Artifact {
+	errnie.Error(artifact.SetChecksum(artifact.Digest()))
+	return artifact
+}
+
+/*
+Sign seals the artifact under the public key of the signer, and puts the
+signature over the checksum in the `signature` attribute, with the name of
+the signer, such as the role of an agent, in the `signer` attribute.
+*/
+func (artifact *Artifact) Sign(signer string, key ed25519.PrivateKey) *Artifact {
+	artifact.Poke("signer", signer)
+	errnie.Error(artifact.SetPubkey(key.Public().(ed25519.PublicKey)))
+
+	checksum, _ := artifact.Seal().Checksum()
+	artifact.Poke("signature", base64.StdEncoding.EncodeToString(ed25519.Sign(key, checksum)))
+
+	return artifact
+}
+
+/*
+Signed reports whether the artifact carries a public key, and so claims to be
+signed.
+*/
+func (artifact *Artifact) Signed() bool {
+	pubkey, err := artifact.Pubkey()
+	return err == nil && len(pubkey) > 0
+}
+
+/*
+Signer returns the name of the signer, and its public key, hex encoded.
+*/
+func (artifact *Artifact) Signer() (string, string) {
+	pubkey, _ := artifact.Pubkey()
+	return artifact.Peek("signer"), hex.EncodeToString(pubkey)
+}
+
+/*
+Verify checks that the artifact matches its checksum, and that the signature
+over the checksum was made with the private key of its public key, when it is
+signed. It says nothing about whether that key is trusted, which is up to a
+Keyring.
+*/
+func (artifact *Artifact) Verify() error {
+	checksum, err := artifact.Checksum()
+
+	if err != nil || len(checksum) == 0 {
+		return ErrNoChecksum
+	}
+
+	if !bytes.Equal(checksum, artifact.Digest()) {
+		return ErrChecksum
+	}
+
+	if !artifact.Signed() {
+		return nil
+	}
+
+	pubkey, _ := artifact.Pubkey()
+	signature, err := base64.StdEncoding.DecodeString(artifact.Peek("signature"))
+
+	if err != nil || len(pubkey) != ed25519.PublicKeySize || !ed25519.Verify(pubkey, checksum, signature) {
+		return ErrSignature
+	}
+
+	return nil
+}
+
+/*
+attributeMap returns the attributes of the artifact by key.
+*/
+func (artifact *Artifact) attributeMap() map[string]string {
+	attributes := make(map[string]string)
+
+	artifact.Range(func(key, value string) bool {
+		attributes[key] = value
+		return true
+	})
+
+	return attributes
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerify(t *testing.T) {
+	Convey("Given an artifact", t, func() {
+		artifact := New("test", "assistant", "answer", []byte("bug"))
+		artifact.Poke("chain", "test")
+
+		Convey("It should not verify before it is sealed", func() {
+			So(artifact.Verify(), ShouldEqual, ErrNoChecksum)
+		})
+
+		Convey("It should verify once it is sealed", func() {
+			So(artifact.Seal().Verify(), ShouldBeNil)
+		})
+
+		Convey("It should not verify once its payload was tampered with", func() {
+			artifact.Seal().Poke("payload", "feature")
+			So(artifact.Verify(), ShouldEqual, ErrChecksum)
+		})
+
+		Convey("It should not verify once its attributes were tampered with", func() {
+			artifact.Seal().Poke("chain", "elsewhere")
+			So(artifact.Verify(), ShouldEqual, ErrChecksum)
+		})
+
+		Convey("When it is signed", func() {
+			_, key, _ := ed25519.GenerateKey(nil)
+			artifact.Sign("agent", key)
+
+			Convey("It should verify, and name its signer", func() {
+				name, pubkey := artifact.Signer()
+
+				So(artifact.Verify(), ShouldBeNil)
+				So(name, ShouldEqual, "agent")
+				So(pubkey, ShouldEqual, hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+			})
+
+			Convey("It should not verify once its payload was tampered with", func() {
+				artifact.Poke("payload", "feature")
+				So(artifact.Verify(), ShouldEqual, ErrChecksum)
+			})
+
+			Convey("It should not verify once its signature was tampered with", func() {
+				signature, _ := base64.StdEncoding.DecodeString(artifact.Peek("signature"))
+				signature[0] ^= 0xff
+				artifact.Poke("signature", base64.StdEncoding.EncodeToString(signature))
+
+				So(artifact.Verify(), ShouldEqual, ErrSignature)
+			})
+
+			Convey("It should not verify once it was signed over by another key", func() {
+				_, other, _ := ed25519.GenerateKey(nil)
+				So(artifact.SetPubkey(other.Public().(ed25519.PublicKey)), ShouldBeNil)
+				artifact.Seal()
+
+				So(artifact.Verify(), ShouldEqual, ErrSignature)
+			})
+		})
+	})
+}
+
+func TestKeyring(t *testing.T) {
+	Convey("Given artifacts that are not sealed, not signed, untrusted and trusted", t, func() {
+		keyring := NewKeyring("", true, false)
+		_, stranger, _ := ed25519.GenerateKey(nil)
+
+		bare := New("test", "user", "prompt", []byte("hi"))
+		sealed := New("test", "user", "prompt", []byte("hi")).Seal()
+		untrusted := New("test", "user", "prompt", []byte("hi")).Sign("stranger", stranger)
+		trusted := keyring.Sign("agent", New("test", "assistant", "answer", []byte("bug")))
+
+		tampered := keyring.Sign("agent", New("test", "assistant", "answer", []byte("bug")))
+		tampered.Poke("payload", "feature")
+
+		Convey("When signatures are not required", func() {
+			Convey("It should let in all of them", func() {
+				for _, artifact := range []*Artifact{bare, sealed, untrusted, trusted} {
+					So(keyring.Check(artifact), ShouldBeNil)
+				}
+			})
+
+			Convey("It should still turn away those that were tampered with", func() {
+				So(keyring.Check(tampered), ShouldEqual, ErrChecksum)
+			})
+		})
+
+		Convey("When signatures are required", func() {
+			keyring.require = true
+
+			Convey("It should only let in those signed by a trusted key", func() {
+				So(keyring.Check(bare), ShouldEqual, ErrNoChecksum)
+				So(keyring.Check(sealed), ShouldEqual, ErrUnsigned)
+				So(keyring.Check(untrusted), ShouldEqual, ErrUntrusted)
+				So(keyring.Check(trusted), ShouldBeNil)
+				So(keyring.Check(tampered), ShouldEqual, ErrChecksum)
+			})
+
+			Convey("It should let in those signed by a key it was told to trust", func() {
+				pubkey := hex.EncodeToString(stranger.Public().(ed25519.PublicKey))
+				So(NewKeyring("", true, true, pubkey).Check(untrusted), ShouldBeNil)
+			})
+		})
+
+		Convey("When it does not sign", func() {
+			unsigned := NewKeyring("", false, false).Sign("agent", New("test", "assistant", "answer", nil))
+
+			Convey("It should only seal", func() {
+				So(unsigned.Signed(), ShouldBeFalse)
+				So(unsigned.Verify(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given a keyring with a dir", t, func() {
+		dir := filepath.Join(t.TempDir(), "keys")
+		key := NewKeyring(dir, true, true).Key("agent")
+
+		Convey("It should keep the key in it, readable only by its owner", func() {
+			info, err := os.Stat(filepath.Join(dir, "agent.key"))
+
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("It should load the same key again, and trust it", func() {
+			signed := New("test", "assistant", "answer", []byte("bug")).Sign("agent", key)
+			reloaded := NewKeyring(dir, true, true)
+
+			So(reloaded.Check(signed), ShouldBeNil)
+			So(reloaded.Key("agent"), ShouldResemble, key)
+		})
+	})
+}
@@ -1,6 +1,9 @@
 package data
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"sync"
 
@@ -18,20 +21,122 @@ var bufpool = sync.Pool{
 
 /*
 Read implements the io.Reader interface for the Artifact.
-It marshals the entire artifact into the provided byte slice.
+It reads the artifact as a single frame, the way an ArtifactEncoder writes it,
+in one go, along with io.EOF, so p has to hold the whole frame, or nothing is
+read and the error is io.ErrShortBuffer. An artifact keeps no offset, so every
+read starts over. To read it in parts, use NewReader, or io.Copy, which writes
+it through WriteTo.
 */
 func (artifact *Artifact) Read(p []byte) (n int, err error) {
-	artifact.Marshal(p)
-	return len(p), io.EOF
+	frame, err := artifact.frame()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(p) < len(frame) {
+		return 0, io.ErrShortBuffer
+	}
+
+	return copy(p, frame), io.EOF
+}
+
+/*
+NewReader returns a reader of the artifact as a single frame, the way an
+ArtifactEncoder writes it, which reads it over as many reads as it takes. The
+frame is marshaled right away, so changes to the artifact after it are not
+read.
+*/
+func (artifact *Artifact) NewReader() io.Reader {
+	frame, err := artifact.frame()
+	if err != nil {
+		return failedReader{err: err}
+	}
+
+	return bytes.NewReader(frame)
+}
+
+/*
+failedReader is the reader of an artifact that could not be marshaled, which
+fails every read with why.
+*/
+type failedReader struct {
+	err error
+}
+
+func (reader failedReader) Read([]byte) (int, error) {
+	return 0, reader.err
 }
 
 /*
 Write implements the io.Writer interface for the Artifact.
-It unmarshals the provided bytes into the current artifact.
+It unmarshals a single frame, the way an ArtifactEncoder writes it, into the
+artifact. When p holds less than a frame, nothing is written and the error is
+io.ErrUnexpectedEOF, and when it holds more, only the first frame is written
+and the error is io.ErrShortWrite.
 */
 func (artifact *Artifact) Write(p []byte) (n int, err error) {
-	artifact.Unmarshal(p)
-	return len(p), nil
+	if len(p) < frameHeader {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	size := binary.BigEndian.Uint32(p)
+
+	if size > MAX_FRAME_SIZE {
+		return 0, ErrFrameSize
+	}
+
+	if uint64(len(p)-frameHeader) < uint64(size) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n = frameHeader + int(size)
+
+	// The message keeps referring to the buffer it was unmarshaled from,
+	// which belongs to the caller, and may be reused after the write.
+	if err = artifact.Unmarshal(bytes.Clone(p[frameHeader:n])); err != nil {
+		return 0, err
+	}
+
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+/*
+WriteTo implements the io.WriterTo interface for the Artifact, so io.Copy
+writes it to w as a single frame.
+*/
+func (artifact *Artifact) WriteTo(w io.Writer) (int64, error) {
+	frame, err := artifact.frame()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(frame)
+	return int64(n), err
+}
+
+/*
+ReadFrom implements the io.ReaderFrom interface for the Artifact, so io.Copy
+reads a frame from r into it. Only the first frame is read, leaving the rest
+of the stream to be read, and a stream that ends before it is an
+io.ErrUnexpectedEOF.
+*/
+func (artifact *Artifact) ReadFrom(r io.Reader) (int64, error) {
+	decoded, n, err := NewArtifactDecoder(r).next()
+
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return n, err
+	}
+
+	*artifact = *decoded
+	return n, nil
 }
 
 func (artifact *Artifact) Append(str string) error {
@@ -51,8 +156,8 @@ func (artifact *Artifact) Append(str string) error {
 
 /*
 Close implements the io.Closer interface for the Artifact.
+There is nothing to release, as an artifact keeps no state between reads.
 */
 func (artifact Artifact) Close() error {
-	// No-op for this example, but could be extended to manage resources.
 	return nil
 }
@@ -0,0 +1,206 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Keyring holds the ed25519 keys agents and services sign their artifacts with,
+one per name, and the public keys that are trusted to have signed the
+artifacts that come in at the trust boundaries, such as the webhooks, the
+websocket and the datalake. Keys are kept in dir, as the hex encoded seed in
+`<name>.key`, and are trusted on top of the trusted keys it is given. Without
+a dir, keys only last as long as the process. When it does not sign, artifacts
+are only sealed with their checksum, and when it requires signatures, unsigned
+and untrusted artifacts are turned away.
+*/
+type Keyring struct {
+	dir     string
+	sign    bool
+	require bool
+	keys    map[string]ed25519.PrivateKey
+	trusted map[string]bool
+	mu      sync.Mutex
+}
+
+func NewKeyring(dir string, sign, require bool, trusted ...string) *Keyring {
+	keyring := &Keyring{
+		dir:     dir,
+		sign:    sign,
+		require: require,
+		keys:    make(map[string]ed25519.PrivateKey),
+		trusted: make(map[string]bool),
+	}
+
+	for _, pubkey := range trusted {
+		keyring.trusted[strings.ToLower(pubkey)] = true
+	}
+
+	if dir == "" {
+		return keyring
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	errnie.Error(err)
+
+	for _, path := range paths {
+		if key, err := readKey(path); err == nil {
+			keyring.trusted[hex.EncodeToString(key.Public().(ed25519.PublicKey))] = true
+		}
+	}
+
+	return keyring
+}
+
+var (
+	configKeyring     *Keyring
+	configKeyringOnce sync.Once
+)
+
+/*
+NewConfigKeyring returns the keyring set under `integrity` in the config,
+shared by everything in the process.
+*/
+func NewConfigKeyring() *Keyring {
+	configKeyringOnce.Do(func() {
+		v := viper.GetViper()
+		dir := v.GetString("integrity.keys")
+
+		if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(dir, "~/") {
+			dir = filepath.Join(home, dir[2:])
+		}
+
+		configKeyring = NewKeyring(
+			dir, v.GetBool("integrity.sign"), v.GetBool("integrity.require"), v.GetStringSlice("integrity.trusted")...,
+		)
+	})
+
+	return configKeyring
+}
+
+/*
+Key returns the key of the name, which is created, and trusted, the first
+time it is asked for.
+*/
+func (keyring *Keyring) Key(name string) ed25519.PrivateKey {
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	if key, ok := keyring.keys[name]; ok {
+		return key
+	}
+
+	key, err := keyring.load(name)
+	if err != nil {
+		errnie.Warn("data.Keyring.Key %s: %s, using a key that lasts as long as the process", name, err)
+
+		_, key, _ = ed25519.GenerateKey(rand.Reader)
+	}
+
+	keyring.keys[name] = key
+	keyring.trusted[hex.EncodeToString(key.Public().(ed25519.PublicKey))] = true
+
+	return key
+}
+
+/*
+Sign signs the artifact with the key of the name, or only seals it when the
+keyring does not sign.
+*/
+func (keyring *Keyring) Sign(name string, artifact *Artifact) *Artifact {
+	if !keyring.sign {
+		return artifact.Seal()
+	}
+
+	return artifact.Sign(name, keyring.Key(name))
+}
+
+/*
+Check verifies an artifact that came in at a trust boundary. An artifact that
+does not match its checksum or signature is always turned away, and one that
+is not sealed, not signed, or signed by a key that is not trusted only when
+signatures are required.
+*/
+func (keyring *Keyring) Check(artifact *Artifact) error {
+	if err := artifact.Verify(); err != nil && !(errors.Is(err, ErrNoChecksum) && !keyring.require) {
+		return err
+	}
+
+	if !keyring.require {
+		return nil
+	}
+
+	if !artifact.Signed() {
+		return ErrUnsigned
+	}
+
+	_, pubkey := artifact.Signer()
+
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	if !keyring.trusted[pubkey] {
+		return ErrUntrusted
+	}
+
+	return nil
+}
+
+/*
+Requires reports whether artifacts have to be signed by a trusted key to be
+let in.
+*/
+func (keyring *Keyring) Requires() bool {
+	return keyring.require
+}
+
+/*
+load reads the key of the name from the dir, creating it when it is not there.
+*/
+func (keyring *Keyring) load(name string) (ed25519.PrivateKey, error) {
+	if keyring.dir == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	path := filepath.Join(keyring.dir, name+".key")
+
+	if key, err := readKey(path); !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(keyring.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())), 0600)
+}
+
+func readKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("not an ed25519 seed: " + path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
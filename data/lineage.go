@@ -0,0 +1,126 @@
+package data
+
+import (
+	"strings"
+)
+
+/*
+The lineage of an artifact is kept in its attributes, under `parents` for the
+ids of the artifacts it was derived from, separated by commas, and `trace` for
+the id of the artifact the whole chain of them started from. So it is covered
+by the checksum and the signature, and travels with the artifact wherever it
+is marshaled to.
+*/
+const (
+	ATTRIBUTE_PARENTS = "parents"
+	ATTRIBUTE_TRACE   = "trace"
+)
+
+/*
+DeriveFrom records that the artifact was derived from the parents, on top of
+what it was derived from already, and puts it in the trace of the first of
+them, when it is not in one yet. An artifact is never its own parent, and the
+artifact is left as it is when there is nothing new to record, so a signed
+artifact can go through it again without its signature breaking.
+*/
+func (artifact *Artifact) DeriveFrom(parents ...*Artifact) *Artifact {
+	id := artifact.Peek("id")
+	ids := artifact.Parents()
+	known := len(ids)
+	seen := make(map[string]bool, len(ids)+len(parents))
+	values := make(map[string]string, 2)
+
+	for _, parentID := range ids {
+		seen[parentID] = true
+	}
+
+	_, traced := artifact.Lookup(ATTRIBUTE_TRACE)
+
+	for _, parent := range parents {
+		if parent == nil {
+			continue
+		}
+
+		parentID := parent.Peek("id")
+
+		if parentID == "" || parentID == id || seen[parentID] {
+			continue
+		}
+
+		seen[parentID] = true
+		ids = append(ids, parentID)
+
+		if !traced {
+			values[ATTRIBUTE_TRACE] = parent.Trace()
+			traced = true
+		}
+	}
+
+	if len(ids) == known {
+		return artifact
+	}
+
+	values[ATTRIBUTE_PARENTS] = strings.Join(ids, ",")
+	artifact.PokeAll(values)
+
+	return artifact
+}
+
+/*
+Node is an artifact as it is in the provenance graph, with its lineage, but
+without any of its other attributes, which is how it is served and exported.
+*/
+type Node struct {
+	ID        string   `json:"id"`
+	Trace     string   `json:"trace"`
+	Parents   []string `json:"parents"`
+	Origin    string   `json:"origin"`
+	Role      string   `json:"role"`
+	Scope     string   `json:"scope"`
+	Payload   string   `json:"payload"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+func NodeOf(artifact *Artifact) Node {
+	parents := artifact.Parents()
+
+	if parents == nil {
+		parents = []string{}
+	}
+
+	return Node{
+		ID:        artifact.Peek("id"),
+		Trace:     artifact.Trace(),
+		Parents:   parents,
+		Origin:    artifact.Peek("origin"),
+		Role:      artifact.Peek("role"),
+		Scope:     artifact.Peek("scope"),
+		Payload:   artifact.Peek("payload"),
+		Timestamp: int64(artifact.Timestamp()),
+	}
+}
+
+/*
+Parents returns the ids of the artifacts the artifact was derived from, in
+the order they were recorded in.
+*/
+func (artifact *Artifact) Parents() []string {
+	value, ok := artifact.Lookup(ATTRIBUTE_PARENTS)
+	if !ok || value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+/*
+Trace returns the id of the artifact the chain the artifact is in started
+from, which is its own id when it was not derived from anything.
+*/
+func (artifact *Artifact) Trace() string {
+	if trace, ok := artifact.Lookup(ATTRIBUTE_TRACE); ok && trace != "" {
+		return trace
+	}
+
+	return artifact.Peek("id")
+}
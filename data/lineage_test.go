@@ -0,0 +1,101 @@
+package data
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLineage(t *testing.T) {
+	Convey("Given a prompt, and an answer derived from it", t, func() {
+		system := New("test", "system", "prompt", []byte("You are a helpdesk."))
+		prompt := New("test", "user", "prompt", []byte("Label this ticket."))
+		answer := New("test", "assistant", "answer", []byte("bug")).DeriveFrom(system, prompt)
+
+		Convey("It should record the parents, in the trace of the first of them", func() {
+			So(system.Parents(), ShouldBeEmpty)
+			So(system.Trace(), ShouldEqual, system.Peek("id"))
+			So(answer.Parents(), ShouldResemble, []string{system.Peek("id"), prompt.Peek("id")})
+			So(answer.Trace(), ShouldEqual, system.Peek("id"))
+
+			node := NodeOf(answer)
+			So(node.Parents, ShouldResemble, answer.Parents())
+			So(node.Payload, ShouldEqual, "bug")
+			So(NodeOf(system).Parents, ShouldResemble, []string{})
+		})
+
+		Convey("It should keep the trace along the chain", func() {
+			followUp := New("test", "user", "prompt", []byte("Why?")).DeriveFrom(answer)
+			So(followUp.Trace(), ShouldEqual, system.Peek("id"))
+		})
+
+		Convey("It should not record a parent twice, or the artifact as its own", func() {
+			answer.DeriveFrom(prompt, answer, nil)
+			So(answer.Parents(), ShouldHaveLength, 2)
+		})
+
+		Convey("It should leave a signed artifact intact when there is nothing new", func() {
+			answer.Sign("agent", NewKeyring("", true, false).Key("agent"))
+			answer.DeriveFrom(system, prompt)
+
+			So(answer.Verify(), ShouldBeNil)
+		})
+	})
+}
+
+func TestProvenance(t *testing.T) {
+	Convey("Given the provenance of a conversation", t, func() {
+		provenance := NewProvenance(100)
+
+		system := New("test", "system", "prompt", []byte("You are a helpdesk."))
+		prompt := New("test", "user", "prompt", []byte("Label this ticket."))
+		call := New("test", "assistant", "tool_call", []byte("lookup")).DeriveFrom(system, prompt)
+		result := New("test", "tool", "tool_result", []byte("it crashes")).DeriveFrom(call)
+		answer := New("test", "assistant", "answer", []byte("bug")).DeriveFrom(system, prompt, call, result)
+		unrelated := New("test", "user", "prompt", []byte("Hello."))
+
+		provenance.Record(system, prompt, call, result, answer, unrelated)
+
+		Convey("It should return every input that led to the answer, oldest first", func() {
+			inputs := provenance.Inputs(answer.Peek("id"))
+			payloads := make([]string, 0, len(inputs))
+
+			for _, input := range inputs {
+				payloads = append(payloads, input.Peek("payload"))
+			}
+
+			So(payloads, ShouldResemble, []string{"You are a helpdesk.", "Label this ticket.", "lookup", "it crashes"})
+		})
+
+		Convey("It should return every artifact in the trace", func() {
+			So(provenance.Trace(system.Peek("id")), ShouldHaveLength, 4)
+			So(provenance.Trace(prompt.Peek("id")), ShouldHaveLength, 1)
+			So(provenance.Trace(unrelated.Peek("id")), ShouldHaveLength, 1)
+		})
+
+		Convey("It should keep the artifacts as they were when they were recorded", func() {
+			answer.Poke("payload", "feature")
+			recorded, ok := provenance.Get(answer.Peek("id"))
+
+			So(ok, ShouldBeTrue)
+			So(recorded.Peek("payload"), ShouldEqual, "bug")
+		})
+
+		Convey("It should forget the oldest artifacts beyond its capacity", func() {
+			small := NewProvenance(2)
+			small.Record(system, prompt, answer)
+
+			_, ok := small.Get(system.Peek("id"))
+			So(ok, ShouldBeFalse)
+			So(small.Inputs(answer.Peek("id")), ShouldHaveLength, 1)
+		})
+
+		Convey("It should keep nothing without a capacity", func() {
+			none := NewProvenance(0)
+			none.Record(answer)
+
+			_, ok := none.Get(answer.Peek("id"))
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/theapemachine/errnie"
+)
+
+/*
+Part is content an artifact carries on top of its payload, such as a
+screenshot, or a file attached to a prompt, typed by its MIME type.
+*/
+type Part struct {
+	MIME string
+	Name string
+	Data []byte
+}
+
+func NewPart(mime, name string, data []byte) Part {
+	return Part{MIME: mime, Name: name, Data: data}
+}
+
+/*
+IsImage reports whether the part is an image, which models with vision can
+look at.
+*/
+func (part Part) IsImage() bool {
+	return strings.HasPrefix(part.MIME, "image/")
+}
+
+/*
+IsText reports whether the part can be read as text, so it can be put in the
+prompt of a model that takes nothing else.
+*/
+func (part Part) IsText() bool {
+	switch {
+	case strings.HasPrefix(part.MIME, "text/"):
+		return true
+	case strings.HasSuffix(part.MIME, "json"), strings.HasSuffix(part.MIME, "xml"), strings.HasSuffix(part.MIME, "yaml"):
+		return true
+	}
+
+	return false
+}
+
+/*
+Base64 returns the data of the part, encoded the way APIs take it inline.
+*/
+func (part Part) Base64() string {
+	return base64.StdEncoding.EncodeToString(part.Data)
+}
+
+/*
+DataURL returns the part as a data URL, which is how OpenAI takes images.
+*/
+func (part Part) DataURL() string {
+	return "data:" + part.MIME + ";base64," + part.Base64()
+}
+
+/*
+Attach adds parts to the artifact, after the ones it has. Parts are kept in
+the attachments of the artifact, as they are, so they travel with it wherever
+it is marshaled to, without being copied into its attributes.
+*/
+func (artifact *Artifact) Attach(parts ...Part) *Artifact {
+	if len(parts) == 0 {
+		return artifact
+	}
+
+	attached, err := artifact.Attachments()
+	if errnie.Error(err) != nil {
+		return artifact
+	}
+
+	// A list cannot grow, so the parts are attached to a copy of it that
+	// has room for them.
+	grown, err := NewAttachment_List(artifact.Segment(), int32(attached.Len()+len(parts)))
+	if errnie.Error(err) != nil {
+		return artifact
+	}
+
+	for idx := 0; idx < attached.Len(); idx++ {
+		if errnie.Error(grown.Set(idx, attached.At(idx))) != nil {
+			return artifact
+		}
+	}
+
+	for idx, part := range parts {
+		attachment := grown.At(attached.Len() + idx)
+
+		errnie.Error(attachment.SetMime(part.MIME))
+		errnie.Error(attachment.SetName(part.Name))
+		errnie.Error(attachment.SetData(part.Data))
+	}
+
+	errnie.Error(artifact.SetAttachments(grown))
+	return artifact
+}
+
+/*
+Parts returns the parts attached to the artifact, in the order they were
+attached. Their data is that of the artifact, so it is not to be changed.
+*/
+func (artifact *Artifact) Parts() []Part {
+	attached, err := artifact.Attachments()
+	if errnie.Error(err) != nil || attached.Len() == 0 {
+		return nil
+	}
+
+	parts := make([]Part, 0, attached.Len())
+
+	for idx := 0; idx < attached.Len(); idx++ {
+		attachment := attached.At(idx)
+
+		mime, _ := attachment.Mime()
+		name, _ := attachment.Name()
+		data, _ := attachment.Data()
+
+		parts = append(parts, NewPart(mime, name, data))
+	}
+
+	return parts
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttach(t *testing.T) {
+	Convey("Given an artifact with parts attached to it", t, func() {
+		screenshot := NewPart("image/png", "screen.png", []byte{0x89, 'P', 'N', 'G'})
+		notes := NewPart("text/plain", "notes.txt", []byte("notes"))
+
+		artifact := New("test", "user", "prompt", []byte("Look.")).Attach(screenshot)
+		artifact.Attach(notes)
+
+		Convey("It should return them in the order they were attached", func() {
+			So(artifact.Parts(), ShouldResemble, []Part{screenshot, notes})
+		})
+
+		Convey("It should not keep them in its attributes", func() {
+			artifact.Range(func(key, value string) bool {
+				So(key, ShouldNotStartWith, "part")
+				return true
+			})
+		})
+
+		Convey("It should keep them through a stream", func() {
+			var stream bytes.Buffer
+
+			So(NewArtifactEncoder(&stream).Encode(artifact), ShouldBeNil)
+
+			decoded, err := NewArtifactDecoder(&stream).Decode()
+			So(err, ShouldBeNil)
+			So(decoded.Parts(), ShouldResemble, []Part{screenshot, notes})
+		})
+
+		Convey("It should keep them in its clones", func() {
+			So(artifact.Clone().Parts(), ShouldResemble, []Part{screenshot, notes})
+		})
+
+		Convey("It should not verify once they were tampered with", func() {
+			artifact.Seal()
+			So(artifact.Verify(), ShouldBeNil)
+
+			artifact.Attach(NewPart("text/plain", "more.txt", []byte("more")))
+			So(artifact.Verify(), ShouldEqual, ErrChecksum)
+		})
+	})
+
+	Convey("Given an artifact without parts", t, func() {
+		Convey("It should have none", func() {
+			So(New("test", "user", "prompt", []byte("hi")).Parts(), ShouldBeEmpty)
+		})
+	})
+}
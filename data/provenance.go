@@ -0,0 +1,171 @@
+package data
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+/*
+PROVENANCE_CAPACITY is how many artifacts the provenance of the config keeps
+when `provenance.capacity` is not set.
+*/
+const PROVENANCE_CAPACITY = 10000
+
+/*
+Provenance keeps the artifacts that went through the accumulators and agents,
+by id, so the lineage of any of them can be followed back to every input that
+led to it. It keeps a copy of each artifact as it was when it was recorded,
+and forgets the oldest ones once it holds its capacity of them. A capacity of
+zero keeps nothing.
+*/
+type Provenance struct {
+	capacity  int
+	artifacts map[string]*Artifact
+	order     []string
+	mu        sync.RWMutex
+}
+
+func NewProvenance(capacity int) *Provenance {
+	return &Provenance{
+		capacity:  capacity,
+		artifacts: make(map[string]*Artifact),
+	}
+}
+
+var (
+	configProvenance     *Provenance
+	configProvenanceOnce sync.Once
+)
+
+/*
+NewConfigProvenance returns the provenance with the capacity set under
+`provenance.capacity` in the config, shared by everything in the process.
+*/
+func NewConfigProvenance() *Provenance {
+	configProvenanceOnce.Do(func() {
+		capacity := PROVENANCE_CAPACITY
+
+		if viper.IsSet("provenance.capacity") {
+			capacity = viper.GetInt("provenance.capacity")
+		}
+
+		configProvenance = NewProvenance(capacity)
+	})
+
+	return configProvenance
+}
+
+/*
+Record keeps the artifacts, unless they were recorded already.
+*/
+func (provenance *Provenance) Record(artifacts ...*Artifact) {
+	if provenance.capacity <= 0 {
+		return
+	}
+
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	for _, artifact := range artifacts {
+		if artifact == nil {
+			continue
+		}
+
+		id := artifact.Peek("id")
+
+		if _, ok := provenance.artifacts[id]; ok || id == "" {
+			continue
+		}
+
+		if len(provenance.order) >= provenance.capacity {
+			delete(provenance.artifacts, provenance.order[0])
+			provenance.order = provenance.order[1:]
+		}
+
+		provenance.artifacts[id] = artifact.Clone()
+		provenance.order = append(provenance.order, id)
+	}
+}
+
+/*
+Get returns the artifact with the id, and whether it was recorded.
+*/
+func (provenance *Provenance) Get(id string) (*Artifact, bool) {
+	provenance.mu.RLock()
+	defer provenance.mu.RUnlock()
+
+	artifact, ok := provenance.artifacts[id]
+	return artifact, ok
+}
+
+/*
+Inputs returns every artifact that led to the one with the id, following its
+parents, and theirs, as far back as they were recorded, oldest first.
+*/
+func (provenance *Provenance) Inputs(id string) []*Artifact {
+	provenance.mu.RLock()
+	defer provenance.mu.RUnlock()
+
+	inputs := make([]*Artifact, 0)
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		artifact, ok := provenance.artifacts[queue[0]]
+		queue = queue[1:]
+
+		if !ok {
+			continue
+		}
+
+		for _, parentID := range artifact.Parents() {
+			if seen[parentID] {
+				continue
+			}
+
+			seen[parentID] = true
+			queue = append(queue, parentID)
+
+			if parent, ok := provenance.artifacts[parentID]; ok {
+				inputs = append(inputs, parent)
+			}
+		}
+	}
+
+	return sortByTime(inputs)
+}
+
+/*
+Trace returns every artifact recorded in the trace, oldest first.
+*/
+func (provenance *Provenance) Trace(trace string) []*Artifact {
+	provenance.mu.RLock()
+	defer provenance.mu.RUnlock()
+
+	artifacts := make([]*Artifact, 0)
+
+	for _, id := range provenance.order {
+		if artifact := provenance.artifacts[id]; artifact.Trace() == trace {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	return sortByTime(artifacts)
+}
+
+func sortByTime(artifacts []*Artifact) []*Artifact {
+	slices.SortStableFunc(artifacts, func(a, b *Artifact) int {
+		switch {
+		case a.Timestamp() < b.Timestamp():
+			return -1
+		case a.Timestamp() > b.Timestamp():
+			return 1
+		}
+
+		return 0
+	})
+
+	return artifacts
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/errnie"
 )
 
@@ -128,7 +129,10 @@ func (conn *Conn) Read(p []byte) (n int, err error) {
 func (conn *Conn) Write(p []byte) (n int, err error) {
 	uploader := uploaderPool.Get().(*manager.Uploader)
 	defer uploaderPool.Put(uploader)
-	defer conn.wg.Done()
+
+	if conn.wg != nil {
+		defer conn.wg.Done()
+	}
 
 	// Perform the S3 upload
 	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
@@ -145,6 +149,37 @@ func (conn *Conn) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// WriteArtifact stores the artifact under the current key, framed the way
+// ReadArtifact reads it back.
+func (conn *Conn) WriteArtifact(artifact *data.Artifact) error {
+	return data.NewArtifactEncoder(conn).Encode(artifact)
+}
+
+// ReadArtifact reads the artifact stored under the current key, which has to
+// pass the checks of the keyring, so nothing tampered with in storage, or not
+// signed by a trusted key when that is required, is taken for the real thing.
+func (conn *Conn) ReadArtifact() (*data.Artifact, error) {
+	s3Object, err := conn.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(conn.bucket),
+		Key:    aws.String(conn.key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer s3Object.Body.Close()
+
+	artifact, err := data.NewArtifactDecoder(s3Object.Body).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+
+	if err = data.NewConfigKeyring().Check(artifact); err != nil {
+		return nil, fmt.Errorf("artifact %s: %w", conn.key, err)
+	}
+
+	return artifact, nil
+}
+
 // ListFiles lists all files under the current key as a prefix recursively
 func (conn *Conn) ListFiles() []byte {
 	var (
@@ -0,0 +1,470 @@
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/theapemachine/amsh/ai/boogie"
+	"github.com/theapemachine/amsh/utils"
+	"github.com/theapemachine/errnie"
+)
+
+/*
+flowKeywords are offered as completions next to the operations, since they can
+appear wherever an operation can.
+*/
+var flowKeywords = []string{
+	"next",
+	"send",
+	"back",
+	"cancel",
+	"halt",
+	"match",
+	"join",
+}
+
+/*
+legendEntry matches a line of the behavior legend in the config, such as
+`- <surface> ; use surface-level analysis`.
+*/
+var legendEntry = regexp.MustCompile(`^-\s*<(\w+)>\s*;\s*(.*)$`)
+
+/*
+BoogieServer is a language server for Boogie programs, speaking LSP over a
+reader and writer, usually stdin and stdout. It publishes the diagnostics of
+the parser, linker and validator whenever a document changes, and answers hover,
+completion and go-to-definition requests. The documentation comes from the
+`boogie.constructs` section of the config, and what is valid from the
+`boogie.registry` section, and subprograms are looked up in the library.
+*/
+type BoogieServer struct {
+	conn      *Conn
+	registry  *boogie.Registry
+	library   *boogie.Library
+	legend    map[string]map[string]string
+	documents map[string]*document
+	shutdown  bool
+}
+
+func NewBoogieServer(reader io.Reader, writer io.Writer) *BoogieServer {
+	return &BoogieServer{
+		conn:      NewConn(reader, writer),
+		registry:  boogie.NewConfigRegistry(),
+		library:   boogie.NewConfigLibrary(),
+		legend:    parseLegend(viper.GetViper().GetString("boogie.constructs.behavior.legend")),
+		documents: make(map[string]*document),
+	}
+}
+
+/*
+Serve handles messages until the client sends `exit`, or goes away.
+*/
+func (server *BoogieServer) Serve() error {
+	for {
+		message, err := server.conn.Read()
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return errnie.Error(err)
+		}
+
+		if message.Method == "exit" {
+			if !server.shutdown {
+				errnie.Warn("lsp.BoogieServer exit without shutdown")
+			}
+
+			return nil
+		}
+
+		if err = server.handle(message); err != nil {
+			return errnie.Error(err)
+		}
+	}
+}
+
+func (server *BoogieServer) handle(message *Message) error {
+	switch message.Method {
+	case "initialize":
+		return server.conn.Respond(message.ID, map[string]any{
+			"capabilities": map[string]any{
+				// Ranges are converted from the runes the lexer counts to the
+				// UTF-16 code units every client supports.
+				"positionEncoding":   "utf-16",
+				"textDocumentSync":   1,
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]any{
+					"triggerCharacters": []string{"<", "["},
+				},
+			},
+			"serverInfo": map[string]any{"name": "boogie"},
+		})
+	case "shutdown":
+		server.shutdown = true
+		return server.conn.Respond(message.ID, nil)
+	case "textDocument/didOpen":
+		params := DidOpenTextDocumentParams{}
+
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			errnie.Error(err)
+			return nil
+		}
+
+		return server.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		params := DidChangeTextDocumentParams{}
+
+		if err := json.Unmarshal(message.Params, &params); err != nil || len(params.ContentChanges) == 0 {
+			errnie.Warn("lsp.BoogieServer ignoring change without content")
+			return nil
+		}
+
+		// The server asks for full sync, so the last change holds the whole document.
+		return server.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		params := DidCloseTextDocumentParams{}
+
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			errnie.Error(err)
+			return nil
+		}
+
+		delete(server.documents, params.TextDocument.URI)
+
+		return server.conn.Notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+			URI: params.TextDocument.URI, Diagnostics: []Diagnostic{},
+		})
+	case "textDocument/hover":
+		return server.position(message, server.hover)
+	case "textDocument/completion":
+		return server.position(message, server.completion)
+	case "textDocument/definition":
+		return server.position(message, server.definition)
+	}
+
+	if message.ID != nil {
+		return server.conn.Fail(message.ID, ERROR_METHOD_NOT_FOUND, fmt.Sprintf("method '%s' is not supported", message.Method))
+	}
+
+	return nil
+}
+
+/*
+update stores the new contents of a document, and publishes its diagnostics.
+*/
+func (server *BoogieServer) update(uri, source string) error {
+	doc := newDocument(uri, source)
+	server.documents[uri] = doc
+
+	return server.conn.Notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+		URI: uri, Diagnostics: doc.diagnostics(server.registry, server.library),
+	})
+}
+
+/*
+position answers a request about a position in a document, with null when the
+document is not open.
+*/
+func (server *BoogieServer) position(message *Message, answer func(*document, Position) any) error {
+	params := TextDocumentPositionParams{}
+
+	if err := json.Unmarshal(message.Params, &params); err != nil {
+		return server.conn.Fail(message.ID, ERROR_INVALID_PARAMS, err.Error())
+	}
+
+	doc, ok := server.documents[params.TextDocument.URI]
+	if !ok {
+		return server.conn.Respond(message.ID, nil)
+	}
+
+	return server.conn.Respond(message.ID, answer(doc, params.Position))
+}
+
+/*
+hover documents the operation, behavior, label or construct under the cursor.
+*/
+func (server *BoogieServer) hover(doc *document, position Position) any {
+	i := doc.at(position)
+	if i < 0 {
+		return nil
+	}
+
+	var text string
+	lexeme := doc.lexemes[i]
+
+	switch {
+	case lexeme.ID == boogie.OPERATION && server.known(lexeme.Text):
+		text = server.operationDoc(lexeme.Text)
+	case doc.text(i-1) == "<" && (doc.text(i-2) == "use" || doc.text(i-2) == "define"):
+		text = server.subprogramDoc(doc, lexeme.Text)
+	case lexeme.ID == boogie.VALUE && doc.text(i-1) == "<" && doc.lexemes[max(i-2, 0)].ID == boogie.OPERATION:
+		text = server.behaviorDoc(doc.text(i-2), lexeme.Text)
+	case lexeme.Text == "(" || lexeme.Text == ")":
+		text = viper.GetViper().GetString("boogie.constructs.closure.description")
+	case lexeme.Text == "<" || lexeme.Text == ">":
+		text = viper.GetViper().GetString("boogie.constructs.behavior.description")
+	default:
+		if name, ok := doc.label(i); ok {
+			text = server.labelDoc(doc, name)
+		}
+	}
+
+	if text == "" {
+		return nil
+	}
+
+	span := doc.rangeOf(lexeme)
+	return Hover{Contents: MarkupContent{Kind: "markdown", Value: text}, Range: &span}
+}
+
+/*
+completion offers what can be typed at the cursor: behaviors (or tools, for
+`call`) after `<`, labels after `[`, and operations and flows anywhere else.
+*/
+func (server *BoogieServer) completion(doc *document, position Position) any {
+	i, anchor := doc.before(position), position
+
+	// The cursor is at the end of a word being typed, so it is what comes right
+	// before that word which decides what fits.
+	if i >= 0 && doc.rangeOf(doc.lexemes[i]).End == position && doc.lexemes[i].ID != boogie.DELIMITER {
+		anchor = doc.rangeOf(doc.lexemes[i]).Start
+		i--
+	}
+
+	trigger := ""
+
+	if i >= 0 && doc.rangeOf(doc.lexemes[i]).End == anchor {
+		trigger = doc.text(i)
+	}
+
+	items := make([]CompletionItem, 0)
+
+	switch trigger {
+	case "<":
+		operation := doc.text(i - 1)
+
+		if operation == "use" || operation == "include" {
+			items = server.subprograms(doc, operation)
+			break
+		}
+
+		names := server.registry.Behaviors(operation)
+
+		if operation == "call" {
+			names = server.registry.Tools()
+		}
+
+		if len(names) == 0 {
+			names = sortedKeys(server.legend[operation])
+		}
+
+		for _, name := range names {
+			items = append(items, CompletionItem{
+				Label:         name,
+				Kind:          COMPLETION_ENUM,
+				Detail:        fmt.Sprintf("%s<%s>", operation, name),
+				Documentation: markdown(server.legend[operation][name]),
+			})
+		}
+	case "[":
+		for _, name := range sortedKeys(doc.definitions()) {
+			items = append(items, CompletionItem{Label: name, Kind: COMPLETION_VALUE, Detail: "label"})
+		}
+	default:
+		for _, operation := range server.operations() {
+			items = append(items, CompletionItem{
+				Label:         operation,
+				Kind:          COMPLETION_FUNCTION,
+				Detail:        "operation",
+				Documentation: markdown(server.operationDoc(operation)),
+			})
+		}
+
+		for _, flow := range flowKeywords {
+			items = append(items, CompletionItem{Label: flow, Kind: COMPLETION_KEYWORD, Detail: "flow"})
+		}
+	}
+
+	return items
+}
+
+/*
+definition finds where the label or subprogram under the cursor is defined,
+when that is in the same document.
+*/
+func (server *BoogieServer) definition(doc *document, position Position) any {
+	at := doc.at(position)
+	definitions := doc.definitions()
+	name, ok := doc.label(at)
+
+	if !ok && doc.text(at-1) == "<" && doc.text(at-2) == "use" {
+		name, definitions = doc.text(at), doc.subprograms()
+	}
+
+	i, ok := definitions[name]
+	if !ok {
+		return nil
+	}
+
+	return Location{URI: doc.uri, Range: doc.rangeOf(doc.lexemes[i])}
+}
+
+/*
+subprograms offers the subprograms that can be used, those of the document
+and those in the library, or only the library files for an include.
+*/
+func (server *BoogieServer) subprograms(doc *document, keyword string) []CompletionItem {
+	items := make([]CompletionItem, 0)
+	seen := make(map[string]bool)
+
+	if keyword == "use" {
+		defined := doc.subprograms()
+
+		for _, name := range sortedKeys(defined) {
+			seen[name] = true
+			items = append(items, CompletionItem{Label: name, Kind: COMPLETION_FUNCTION, Detail: doc.signature(defined[name])})
+		}
+	}
+
+	for _, name := range server.library.Names() {
+		if !seen[name] {
+			items = append(items, CompletionItem{Label: name, Kind: COMPLETION_FUNCTION, Detail: "library"})
+		}
+	}
+
+	return items
+}
+
+/*
+operations returns the operations that can be used, which are the registered
+ones, or the ones in the legend when nothing is registered.
+*/
+func (server *BoogieServer) operations() []string {
+	if operations := server.registry.Operations(); len(operations) > 0 {
+		return operations
+	}
+
+	return sortedKeys(server.legend)
+}
+
+func (server *BoogieServer) known(operation string) bool {
+	_, documented := server.legend[operation]
+	return documented || utils.ContainsAny(server.registry.Operations(), operation)
+}
+
+func (server *BoogieServer) operationDoc(operation string) string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "```boogie\n%s<behavior> => next\n```\n", operation)
+
+	names := server.registry.Behaviors(operation)
+	kind := "Behaviors"
+
+	if operation == "call" {
+		names, kind = server.registry.Tools(), "Tools"
+	}
+
+	if len(names) == 0 {
+		names = sortedKeys(server.legend[operation])
+	}
+
+	if len(names) > 0 {
+		fmt.Fprintf(&builder, "\n%s:\n", kind)
+	}
+
+	for _, name := range names {
+		if description := server.legend[operation][name]; description != "" {
+			fmt.Fprintf(&builder, "- `<%s>` %s\n", name, description)
+			continue
+		}
+
+		fmt.Fprintf(&builder, "- `<%s>`\n", name)
+	}
+
+	return builder.String()
+}
+
+func (server *BoogieServer) behaviorDoc(operation, behavior string) string {
+	text := fmt.Sprintf("```boogie\n%s<%s>\n```\n", operation, behavior)
+
+	if description := server.legend[operation][behavior]; description != "" {
+		text += "\n" + description + "\n"
+	}
+
+	if !server.registry.Behavior(operation, behavior) {
+		text += fmt.Sprintf("\n`%s` is not registered for `%s`.\n", behavior, operation)
+	}
+
+	return text
+}
+
+func (server *BoogieServer) subprogramDoc(doc *document, name string) string {
+	i, ok := doc.subprograms()[name]
+	if !ok {
+		return fmt.Sprintf("subprogram `%s`, from the library", name)
+	}
+
+	return fmt.Sprintf("```boogie\n%s\n```\n", doc.signature(i))
+}
+
+func (server *BoogieServer) labelDoc(doc *document, name string) string {
+	i, ok := doc.definitions()[name]
+	if !ok {
+		return fmt.Sprintf("label `[%s]` is not defined", name)
+	}
+
+	return fmt.Sprintf("label `[%s]`, defined at %s", name, doc.lexemes[i].Position)
+}
+
+/*
+parseLegend reads the behavior legend of the config, which lists the
+behaviors of every operation under a `### operation` heading, into a map of
+operation to behavior to description.
+*/
+func parseLegend(text string) map[string]map[string]string {
+	legend := make(map[string]map[string]string)
+	operation := ""
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+
+		if heading, ok := strings.CutPrefix(line, "###"); ok {
+			operation = strings.TrimSpace(heading)
+			legend[operation] = make(map[string]string)
+			continue
+		}
+
+		if match := legendEntry.FindStringSubmatch(line); match != nil && operation != "" {
+			legend[operation][match[1]] = strings.TrimSpace(match[2])
+		}
+	}
+
+	return legend
+}
+
+func markdown(text string) *MarkupContent {
+	if text == "" {
+		return nil
+	}
+
+	return &MarkupContent{Kind: "markdown", Value: text}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	out := make([]string, 0, len(m))
+
+	for key := range m {
+		out = append(out, key)
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,282 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+const uri = "file:///workflow.boogie"
+
+const program = `out <= (
+	[refine] => (
+		analyze<surface>   => next
+		verify<validation> => next
+		match (
+			ok    => send
+			error => [refine].jump
+		)
+	)
+) <= in`
+
+/*
+session runs the server on the messages, as a client that sends them all up
+front, and returns everything the server sent back.
+*/
+func session(messages ...*Message) []*Message {
+	input := &bytes.Buffer{}
+	output := &bytes.Buffer{}
+	client := NewConn(input, input)
+
+	for _, message := range messages {
+		So(client.Write(message), ShouldBeNil)
+	}
+
+	So(NewBoogieServer(input, output).Serve(), ShouldBeNil)
+
+	replies := make([]*Message, 0)
+	reader := NewConn(output, nil)
+
+	for {
+		reply, err := reader.Read()
+		if err != nil {
+			return replies
+		}
+
+		replies = append(replies, reply)
+	}
+}
+
+func request(id int, method string, params any) *Message {
+	raw := json.RawMessage([]byte{byte('0' + id)})
+	body, _ := json.Marshal(params)
+	return &Message{ID: &raw, Method: method, Params: body}
+}
+
+func notification(method string, params any) *Message {
+	body, _ := json.Marshal(params)
+	return &Message{Method: method, Params: body}
+}
+
+func open(text string) *Message {
+	return notification("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "boogie", Text: text},
+	})
+}
+
+func at(id int, method string, line, character int) *Message {
+	return request(id, method, TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: line, Character: character},
+	})
+}
+
+func decode[T any](message *Message) T {
+	var out T
+	So(json.Unmarshal(message.Result, &out), ShouldBeNil)
+	return out
+}
+
+func labels(items []CompletionItem) []string {
+	out := make([]string, len(items))
+
+	for i, item := range items {
+		out[i] = item.Label
+	}
+
+	return out
+}
+
+func TestBoogieServer(t *testing.T) {
+	viper.Set("boogie.registry.operations", map[string]any{
+		"analyze": []string{"surface", "practical"},
+		"verify":  []string{"validation"},
+		"call":    []string{},
+	})
+	viper.Set("boogie.registry.tools", []string{"browser", "wiki"})
+	library := t.TempDir()
+	os.WriteFile(filepath.Join(library, "review.boogie"), []byte("define<review> => ( verify => send )"), 0644)
+	viper.Set("boogie.library", library)
+	viper.Set("boogie.constructs.closure.description", "A closure is a self-contained block of code.")
+	viper.Set("boogie.constructs.behavior.legend", "### analyze\n- <surface>   ; use surface-level analysis\n- <practical> ; use practical analysis\n")
+
+	defer viper.Reset()
+
+	Convey("Given a client that initializes and shuts down the server", t, func() {
+		replies := session(
+			request(1, "initialize", map[string]any{}),
+			notification("initialized", map[string]any{}),
+			request(2, "shutdown", nil),
+			notification("exit", nil),
+		)
+
+		Convey("It should advertise what it can do, and answer the shutdown with null", func() {
+			So(replies, ShouldHaveLength, 2)
+
+			capabilities := decode[map[string]map[string]any](replies[0])["capabilities"]
+			So(capabilities["hoverProvider"], ShouldBeTrue)
+			So(capabilities["definitionProvider"], ShouldBeTrue)
+			So(capabilities["textDocumentSync"], ShouldEqual, 1)
+			So(capabilities["positionEncoding"], ShouldEqual, "utf-16")
+			So(string(replies[1].Result), ShouldEqual, "null")
+		})
+	})
+
+	Convey("Given a document that is opened, and then changed", t, func() {
+		replies := session(
+			open(program),
+			notification("textDocument/didChange", map[string]any{
+				"textDocument":   map[string]any{"uri": uri, "version": 2},
+				"contentChanges": []map[string]any{{"text": "out <= (\n\tanalyze<vibes> => next\n\treason => send\n"}},
+			}),
+		)
+
+		Convey("It should publish the diagnostics of every version", func() {
+			So(replies, ShouldHaveLength, 2)
+			So(replies[0].Method, ShouldEqual, "textDocument/publishDiagnostics")
+
+			params := []PublishDiagnosticsParams{}
+
+			for _, reply := range replies {
+				published := PublishDiagnosticsParams{}
+				So(json.Unmarshal(reply.Params, &published), ShouldBeNil)
+				params = append(params, published)
+			}
+
+			So(params[0].Diagnostics, ShouldBeEmpty)
+			So(params[1].Diagnostics, ShouldNotBeEmpty)
+			So(params[1].Diagnostics[0].Severity, ShouldEqual, DIAGNOSTIC_ERROR)
+			So(params[1].Diagnostics[0].Message, ShouldEqual, "unbalanced '(' is never closed")
+			So(params[1].Diagnostics[0].Range, ShouldResemble, Range{
+				Start: Position{Line: 0, Character: 7}, End: Position{Line: 0, Character: 8},
+			})
+		})
+	})
+
+	Convey("Given a valid document that uses unregistered behaviors", t, func() {
+		replies := session(open("out <= (\n\tanalyze<vibes> => send\n) <= in"))
+
+		Convey("It should publish the warnings of the validator", func() {
+			published := PublishDiagnosticsParams{}
+			So(json.Unmarshal(replies[0].Params, &published), ShouldBeNil)
+			So(published.Diagnostics, ShouldHaveLength, 1)
+			So(published.Diagnostics[0].Severity, ShouldEqual, DIAGNOSTIC_WARNING)
+			So(published.Diagnostics[0].Message, ShouldEqual, "behavior 'vibes' is not registered for 'analyze'")
+			So(published.Diagnostics[0].Range, ShouldResemble, Range{
+				Start: Position{Line: 1, Character: 9}, End: Position{Line: 1, Character: 14},
+			})
+		})
+	})
+
+	Convey("Given hover requests on an open document", t, func() {
+		replies := session(
+			open(program),
+			at(1, "textDocument/hover", 2, 4),
+			at(2, "textDocument/hover", 2, 12),
+			at(3, "textDocument/hover", 0, 7),
+			at(4, "textDocument/hover", 6, 14),
+			at(5, "textDocument/hover", 0, 3),
+		)[1:]
+
+		Convey("It should document operations, behaviors, closures and labels", func() {
+			So(decode[Hover](replies[0]).Contents.Value, ShouldContainSubstring, "`<surface>` use surface-level analysis")
+			So(decode[Hover](replies[0]).Contents.Value, ShouldContainSubstring, "`<practical>` use practical analysis")
+			So(decode[Hover](replies[1]).Contents.Value, ShouldContainSubstring, "use surface-level analysis")
+			So(decode[Hover](replies[1]).Range, ShouldResemble, &Range{
+				Start: Position{Line: 2, Character: 10}, End: Position{Line: 2, Character: 17},
+			})
+			So(decode[Hover](replies[2]).Contents.Value, ShouldEqual, "A closure is a self-contained block of code.")
+			So(decode[Hover](replies[3]).Contents.Value, ShouldEqual, "label `[refine]`, defined at 2:3")
+		})
+
+		Convey("It should answer null when there is nothing to document", func() {
+			So(string(replies[4].Result), ShouldEqual, "null")
+		})
+	})
+
+	Convey("Given a hover request on a line with a character outside the BMP", t, func() {
+		replies := session(
+			open("out <= (\n\t\"🙂\" analyze<surface> => next\n) <= in"),
+			at(1, "textDocument/hover", 1, 7),
+		)[1:]
+
+		Convey("It should count the character in UTF-16 code units, the way the client does", func() {
+			So(decode[Hover](replies[0]).Contents.Value, ShouldContainSubstring, "`<surface>` use surface-level analysis")
+			So(decode[Hover](replies[0]).Range, ShouldResemble, &Range{
+				Start: Position{Line: 1, Character: 6}, End: Position{Line: 1, Character: 13},
+			})
+		})
+	})
+
+	Convey("Given completion requests on a document being written", t, func() {
+		replies := session(
+			open("out <= (\n\t[retry] => (\n\t\tanalyze<pr\n\t\tcall<\n\t\tver\n\t\tverify => [\n"),
+			at(1, "textDocument/completion", 2, 12),
+			at(2, "textDocument/completion", 3, 7),
+			at(3, "textDocument/completion", 4, 5),
+			at(4, "textDocument/completion", 5, 13),
+		)[1:]
+
+		Convey("It should offer what fits where the cursor is", func() {
+			So(labels(decode[[]CompletionItem](replies[0])), ShouldResemble, []string{"practical", "surface"})
+			So(labels(decode[[]CompletionItem](replies[1])), ShouldResemble, []string{"browser", "wiki"})
+			So(labels(decode[[]CompletionItem](replies[2])), ShouldContain, "verify")
+			So(labels(decode[[]CompletionItem](replies[2])), ShouldContain, "send")
+			So(labels(decode[[]CompletionItem](replies[3])), ShouldResemble, []string{"retry"})
+		})
+	})
+
+	Convey("Given a definition request on a label that is jumped to", t, func() {
+		replies := session(
+			open(program),
+			at(1, "textDocument/definition", 6, 14),
+			at(2, "textDocument/definition", 2, 4),
+		)[1:]
+
+		Convey("It should point at the label where it is defined", func() {
+			So(decode[Location](replies[0]), ShouldResemble, Location{URI: uri, Range: Range{
+				Start: Position{Line: 1, Character: 2}, End: Position{Line: 1, Character: 8},
+			}})
+			So(string(replies[1].Result), ShouldEqual, "null")
+		})
+	})
+
+	Convey("Given a document with subprograms", t, func() {
+		replies := session(
+			open("define<checked>{focus} => ( analyze<focus> => next )\nout <= (\n\tuse<checked>{surface}\n\tuse<\n\tuse<missing>\n) <= in"),
+			at(1, "textDocument/completion", 3, 5),
+			at(2, "textDocument/definition", 2, 7),
+			at(3, "textDocument/hover", 2, 7),
+		)
+
+		Convey("It should report the problems in the document", func() {
+			published := PublishDiagnosticsParams{}
+			So(json.Unmarshal(replies[0].Params, &published), ShouldBeNil)
+			So(published.Diagnostics, ShouldNotBeEmpty)
+		})
+
+		Convey("It should offer the subprograms of the document and the library", func() {
+			items := decode[[]CompletionItem](replies[1])
+			So(labels(items), ShouldResemble, []string{"checked", "review"})
+			So(items[0].Detail, ShouldEqual, "define<checked>{focus}")
+		})
+
+		Convey("It should find and document where a subprogram is defined", func() {
+			So(decode[Location](replies[2]).Range.Start, ShouldResemble, Position{Line: 0, Character: 7})
+			So(decode[Hover](replies[3]).Contents.Value, ShouldContainSubstring, "define<checked>{focus}")
+		})
+	})
+
+	Convey("Given a request the server does not support", t, func() {
+		replies := session(request(1, "workspace/symbol", map[string]any{}))
+
+		Convey("It should answer with an error", func() {
+			So(replies[0].Error.Code, ShouldEqual, ERROR_METHOD_NOT_FOUND)
+		})
+	})
+}
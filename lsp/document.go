@@ -0,0 +1,258 @@
+package lsp
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	"github.com/theapemachine/amsh/ai/boogie"
+)
+
+/*
+document is an open Boogie file, kept as the lexemes it is made of, which is
+enough to find out what the cursor is on even while the program does not
+parse.
+*/
+type document struct {
+	uri     string
+	source  string
+	lines   []string
+	lexemes []boogie.Lexeme
+}
+
+func newDocument(uri, source string) *document {
+	doc := &document{uri: uri, source: source, lines: strings.Split(source, "\n")}
+
+	for lexeme := range boogie.NewLexer().Generate(source) {
+		doc.lexemes = append(doc.lexemes, lexeme)
+	}
+
+	return doc
+}
+
+/*
+diagnostics parses the document, and validates it against the registry when
+it parses and links, converting what was found to LSP diagnostics.
+*/
+func (doc *document) diagnostics(registry *boogie.Registry, library *boogie.Library) []Diagnostic {
+	program, found := boogie.Parse(doc.source)
+
+	if !found.HasErrors() {
+		program, found = boogie.NewLinker(library).Link(program)
+	}
+
+	if !found.HasErrors() {
+		found = append(found, boogie.NewValidator(registry).Validate(program)...)
+	}
+
+	out := make([]Diagnostic, 0, len(found))
+
+	for _, diagnostic := range found {
+		severity := DIAGNOSTIC_ERROR
+
+		if diagnostic.Severity == boogie.SEVERITY_WARNING {
+			severity = DIAGNOSTIC_WARNING
+		}
+
+		out = append(out, Diagnostic{
+			Range:    doc.span(diagnostic.Position),
+			Severity: severity,
+			Source:   "boogie",
+			Message:  diagnostic.Message,
+		})
+	}
+
+	return out
+}
+
+/*
+at returns the index of the lexeme under the cursor, or -1. A cursor right
+after a lexeme is still on it, since that is where it is while typing.
+*/
+func (doc *document) at(position Position) int {
+	for i, lexeme := range doc.lexemes {
+		span := doc.rangeOf(lexeme)
+
+		if span.Start.Line != position.Line {
+			continue
+		}
+
+		if position.Character >= span.Start.Character && position.Character <= span.End.Character {
+			return i
+		}
+	}
+
+	return -1
+}
+
+/*
+before returns the index of the last lexeme that ends at or before the cursor,
+or -1.
+*/
+func (doc *document) before(position Position) int {
+	found := -1
+
+	for i, lexeme := range doc.lexemes {
+		end := doc.rangeOf(lexeme).End
+
+		if end.Line > position.Line || (end.Line == position.Line && end.Character > position.Character) {
+			break
+		}
+
+		found = i
+	}
+
+	return found
+}
+
+/*
+text returns the text of the lexeme at the index, or nothing when the index is
+out of bounds, so neighbours can be checked without guarding every lookup.
+*/
+func (doc *document) text(i int) string {
+	if i < 0 || i >= len(doc.lexemes) {
+		return ""
+	}
+
+	return doc.lexemes[i].Text
+}
+
+/*
+label returns the name of the label when the lexeme at the index is the name
+inside `[...]`.
+*/
+func (doc *document) label(i int) (string, bool) {
+	if doc.text(i-1) != "[" || doc.text(i+1) != "]" {
+		return "", false
+	}
+
+	return doc.text(i), true
+}
+
+/*
+definitions finds the labels the document defines, by the index of the
+lexeme holding their name. A label in brackets is a definition, unless it is
+jumped to with `[x].jump`, or read from with `match <= [x]`.
+*/
+func (doc *document) definitions() map[string]int {
+	out := make(map[string]int)
+
+	for i := range doc.lexemes {
+		name, ok := doc.label(i)
+
+		if !ok || doc.text(i+2) == "." || doc.text(i-2) == "<=" {
+			continue
+		}
+
+		if _, defined := out[name]; !defined {
+			out[name] = i
+		}
+	}
+
+	return out
+}
+
+/*
+subprograms finds the subprograms the document defines, by the index of the
+lexeme holding their name in `define<name>`.
+*/
+func (doc *document) subprograms() map[string]int {
+	out := make(map[string]int)
+
+	for i := range doc.lexemes {
+		if doc.text(i) != "define" || doc.text(i+1) != "<" || doc.text(i+3) != ">" {
+			continue
+		}
+
+		if _, defined := out[doc.text(i+2)]; !defined {
+			out[doc.text(i+2)] = i + 2
+		}
+	}
+
+	return out
+}
+
+/*
+signature returns the `define<name>{params}` of the subprogram whose name is
+at the index.
+*/
+func (doc *document) signature(i int) string {
+	out := "define<" + doc.text(i) + ">"
+
+	if doc.text(i+2) != "{" {
+		return out
+	}
+
+	for j := i + 2; j < len(doc.lexemes); j++ {
+		out += doc.text(j)
+
+		switch doc.text(j) {
+		case "}":
+			return out
+		case ",":
+			out += " "
+		}
+	}
+
+	return out
+}
+
+/*
+span returns the range of the lexeme starting at the position, or a single
+character when there is none, such as at the end of the document.
+*/
+func (doc *document) span(position boogie.Position) Range {
+	for _, lexeme := range doc.lexemes {
+		if lexeme.Position == position {
+			return doc.rangeOf(lexeme)
+		}
+	}
+
+	line := position.Line - 1
+
+	return Range{
+		Start: Position{Line: line, Character: doc.character(position.Line, position.Column)},
+		End:   Position{Line: line, Character: doc.character(position.Line, position.Column+1)},
+	}
+}
+
+/*
+rangeOf converts the 1-based position of a lexeme to a zero-based LSP range.
+Strings lost their quotes while being lexed, so those are added back.
+*/
+func (doc *document) rangeOf(lexeme boogie.Lexeme) Range {
+	width := len([]rune(lexeme.Text))
+
+	if lexeme.ID == boogie.PARAMETER {
+		width += 2
+	}
+
+	line, column := lexeme.Position.Line, lexeme.Position.Column
+
+	return Range{
+		Start: Position{Line: line - 1, Character: doc.character(line, column)},
+		End:   Position{Line: line - 1, Character: doc.character(line, column+width)},
+	}
+}
+
+/*
+character converts the 1-based column of a rune on a 1-based line, which is
+how the lexer counts, to the zero-based offset in UTF-16 code units LSP counts
+characters in, so a rune outside the Basic Multilingual Plane, such as an
+emoji, takes two. Columns past the end of the line count one each.
+*/
+func (doc *document) character(line, column int) int {
+	character, runes := 0, 0
+
+	if line >= 1 && line <= len(doc.lines) {
+		for _, char := range doc.lines[line-1] {
+			if runes == column-1 {
+				break
+			}
+
+			character += max(1, utf16.RuneLen(char))
+			runes++
+		}
+	}
+
+	return character + max(0, column-1-runes)
+}
@@ -0,0 +1,245 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Message is a JSON-RPC message as it travels between an editor and a language
+server. Requests have both an ID and a Method, notifications only a Method,
+and responses an ID with either a Result or an Error.
+*/
+type Message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *ResponseError   `json:"error,omitempty"`
+}
+
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ERROR_PARSE            = -32700
+	ERROR_METHOD_NOT_FOUND = -32601
+	ERROR_INVALID_PARAMS   = -32602
+)
+
+/*
+Position is a zero-based line and character offset in a text document.
+*/
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type TextDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+type TextDocumentPositionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+type DidOpenTextDocumentParams struct {
+	TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+type DidChangeTextDocumentParams struct {
+	TextDocument   TextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type DidCloseTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type DiagnosticSeverity int
+
+const (
+	DIAGNOSTIC_ERROR   DiagnosticSeverity = 1
+	DIAGNOSTIC_WARNING DiagnosticSeverity = 2
+)
+
+type Diagnostic struct {
+	Range    Range              `json:"range"`
+	Severity DiagnosticSeverity `json:"severity"`
+	Source   string             `json:"source"`
+	Message  string             `json:"message"`
+}
+
+type PublishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+type MarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type Hover struct {
+	Contents MarkupContent `json:"contents"`
+	Range    *Range        `json:"range,omitempty"`
+}
+
+type CompletionItemKind int
+
+const (
+	COMPLETION_FUNCTION CompletionItemKind = 3
+	COMPLETION_KEYWORD  CompletionItemKind = 14
+	COMPLETION_VALUE    CompletionItemKind = 12
+	COMPLETION_ENUM     CompletionItemKind = 20
+)
+
+type CompletionItem struct {
+	Label         string             `json:"label"`
+	Kind          CompletionItemKind `json:"kind"`
+	Detail        string             `json:"detail,omitempty"`
+	Documentation *MarkupContent     `json:"documentation,omitempty"`
+}
+
+/*
+Conn reads and writes JSON-RPC messages using the base protocol of LSP, where
+every message is preceded by a Content-Length header.
+*/
+type Conn struct {
+	reader *bufio.Reader
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewConn(reader io.Reader, writer io.Writer) *Conn {
+	return &Conn{
+		reader: bufio.NewReader(reader),
+		writer: writer,
+	}
+}
+
+/*
+Read returns the next message, or io.EOF once the other side is gone.
+*/
+func (conn *Conn) Read() (*Message, error) {
+	length := -1
+
+	for {
+		line, err := conn.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			break
+		}
+
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(conn.reader, body); err != nil {
+		return nil, err
+	}
+
+	message := &Message{}
+
+	if err := json.Unmarshal(body, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+/*
+Respond answers the request with the given ID. A nil result is sent as null,
+which is how LSP says there is nothing to report.
+*/
+func (conn *Conn) Respond(id *json.RawMessage, result any) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return conn.Write(&Message{ID: id, Result: body})
+}
+
+/*
+Fail answers the request with the given ID with an error.
+*/
+func (conn *Conn) Fail(id *json.RawMessage, code int, message string) error {
+	return conn.Write(&Message{ID: id, Error: &ResponseError{Code: code, Message: message}})
+}
+
+/*
+Notify sends a notification, which expects no answer.
+*/
+func (conn *Conn) Notify(method string, params any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return conn.Write(&Message{Method: method, Params: body})
+}
+
+/*
+Write sends a message, and is safe to call from multiple goroutines.
+*/
+func (conn *Conn) Write(message *Message) error {
+	message.JSONRPC = "2.0"
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if _, err = fmt.Fprintf(conn.writer, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+
+	_, err = conn.writer.Write(body)
+	return err
+}
@@ -11,7 +11,10 @@ import (
 	"github.com/gofiber/fiber/v3/middleware/adaptor"
 	"github.com/gofiber/fiber/v3/middleware/cors"
 	"github.com/gofiber/fiber/v3/middleware/favicon"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
 	"github.com/gofiber/fiber/v3/middleware/static"
+	"github.com/theapemachine/amsh/ai/memory"
+	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/integration/comms"
 	"github.com/theapemachine/amsh/utils"
@@ -57,6 +60,7 @@ func (https *HTTPS) Up() error {
 			AllowMethods: []string{"*"},
 		}),
 		favicon.New(),
+		requestid.New(),
 	)
 
 	// WebSocket route using adaptor
@@ -65,6 +69,11 @@ func (https *HTTPS) Up() error {
 	https.app.Post("/webhook/trengo", https.NewWebhook("trengo", "managing"))
 	https.app.Post("/webhook/github", https.NewWebhook("github", "managing"))
 	https.app.Post("/events/slack", https.slackEvents.Run)
+	https.app.Get("/providers", https.providers)
+	https.app.Get("/cache", https.cache)
+	https.app.Get("/usage", https.usage)
+	https.app.Get("/provenance/:id", https.provenance)
+	https.app.Post("/provenance/:id/export", https.exportProvenance)
 	https.app.Use("/", static.New("./frontend"))
 
 	// Start the main HTTP server
@@ -86,6 +95,78 @@ func (https *HTTPS) Shutdown() error {
 	return nil
 }
 
+/*
+providers responds with the health of the providers requests are balanced over.
+*/
+func (https *HTTPS) providers(ctx fiber.Ctx) error {
+	return ctx.JSON(provider.NewBalancedProvider().Status())
+}
+
+/*
+cache responds with what the cache in front of the providers did so far.
+*/
+func (https *HTTPS) cache(ctx fiber.Ctx) error {
+	return ctx.JSON(provider.NewCachedProvider().Stats())
+}
+
+/*
+usage responds with the tokens and cost of the calls made to the providers
+since the service started, in total and per agent, team, program and request.
+*/
+func (https *HTTPS) usage(ctx fiber.Ctx) error {
+	return ctx.JSON(provider.NewConfigLedger().Report())
+}
+
+/*
+provenance responds with the artifact with the id, and every input that led
+to it, oldest first, as far back as the provenance of the config goes.
+*/
+func (https *HTTPS) provenance(ctx fiber.Ctx) error {
+	artifact, inputs, ok := lineage(ctx.Params("id"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	nodes := make([]data.Node, 0, len(inputs))
+
+	for _, input := range inputs {
+		nodes = append(nodes, data.NodeOf(input))
+	}
+
+	return ctx.JSON(fiber.Map{"artifact": data.NodeOf(artifact), "inputs": nodes})
+}
+
+/*
+exportProvenance writes the artifact with the id, and every input that led to
+it, to the Neo4j memory, as a graph of the artifacts they were derived from.
+*/
+func (https *HTTPS) exportProvenance(ctx fiber.Ctx) error {
+	artifact, inputs, ok := lineage(ctx.Params("id"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	graph := memory.NewNeo4j()
+	defer graph.Close()
+
+	if err := graph.ExportLineage(append(inputs, artifact)...); err != nil {
+		return errnie.Error(err)
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+func lineage(id string) (*data.Artifact, []*data.Artifact, bool) {
+	provenance := data.NewConfigProvenance()
+
+	artifact, ok := provenance.Get(id)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return artifact, provenance.Inputs(id), true
+}
+
 func handler(f http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(f)
 }
@@ -113,9 +194,33 @@ func (https *HTTPS) websocketHandler(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			// Create a new message
-			message := data.New(utils.NewName(), "task", "managing", msg)
-			message.Poke("chain", "websocket")
+			if _, err := https.inbound(msg); err != nil {
+				errnie.Warn("websocket: %s", err)
+			}
 		}
 	}()
 }
+
+/*
+inbound turns a message from the websocket into an artifact. A marshaled
+artifact has to pass the checks of the keyring, and anything else is taken
+as the payload of a new artifact, signed by the service, unless signatures are
+required, in which case it is turned away.
+*/
+func (https *HTTPS) inbound(msg []byte) (*data.Artifact, error) {
+	keyring := data.NewConfigKeyring()
+	artifact := data.Empty()
+
+	if err := artifact.Unmarshal(msg); err == nil {
+		return artifact, keyring.Check(artifact)
+	}
+
+	if keyring.Requires() {
+		return nil, data.ErrUnsigned
+	}
+
+	message := data.New(utils.NewName(), "task", "managing", msg)
+	message.Poke("chain", "websocket")
+
+	return keyring.Sign("service", message), nil
+}
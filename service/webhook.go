@@ -1,13 +1,21 @@
 package service
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"os"
+	"strings"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
 	"github.com/spf13/viper"
 	"github.com/theapemachine/amsh/ai/marvin"
+	"github.com/theapemachine/amsh/ai/provider"
 	"github.com/theapemachine/amsh/data"
 	"github.com/theapemachine/amsh/utils"
 	"github.com/theapemachine/errnie"
@@ -45,6 +53,11 @@ type GitHubReviewPayload struct {
 
 func (https *HTTPS) NewWebhook(origin, scope string) fiber.Handler {
 	return func(ctx fiber.Ctx) (err error) {
+		if !https.authentic(origin, ctx) {
+			errnie.Warn("webhook %s: signature does not match the body", origin)
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
 		// Route to appropriate process based on origin
 		switch origin {
 		case "trengo":
@@ -70,14 +83,25 @@ func (https *HTTPS) NewWebhook(origin, scope string) fiber.Handler {
 					fmt.Sprintf("event_type: %s", values.Get("event_type")),
 				}
 
-				agent := marvin.NewAgent(ctx.Context(), "webhook", "helpdesk", data.New(
+				// The labelling outlives the request, so it runs on a context
+				// of its own, which tallies its usage to the request.
+				account := provider.WithAccount(context.Background(), provider.ACCOUNT_REQUEST, requestid.FromContext(ctx))
+
+				agent := marvin.NewAgent(account, "webhook", "helpdesk", data.New(
 					"webhook",
 					"helpdesk",
 					"inbound",
 					[]byte(viper.GetViper().GetString("ai.setups.marvin.templates.system")),
 				))
 
-				agent.Generate(data.New("webhook", "helpdesk", "inbound", []byte(utils.JoinWith("\n", ticket...))))
+				labels := agent.Generate(data.NewConfigKeyring().Sign(
+					"service", data.New("webhook", "helpdesk", "inbound", []byte(utils.JoinWith("\n", ticket...))),
+				))
+
+				go func() {
+					for range labels {
+					}
+				}()
 			} else {
 				// Handle JSON payload (fallback or unexpected case)
 				if err := json.Unmarshal(ctx.Body(), &payload); err != nil {
@@ -110,14 +134,32 @@ func (https *HTTPS) handleGitHubWebhook(ctx fiber.Ctx) error {
 		return err
 	}
 
-	// Create a message for the AI system to process the review
-	message := data.New(
-		"github_review",
-		"github",
-		"code_review",
-		ctx.Body(),
-	)
-	message.Poke("chain", "github")
-
 	return ctx.SendStatus(fiber.StatusOK)
 }
+
+/*
+authentic reports whether the body of a webhook was signed with the secret set
+for its origin, under `integrity.webhooks.<origin>`, which holds the hex encoded
+HMAC-SHA256 of the body in its header, after the prefix, such as the `sha256=`
+of GitHub. Without a secret, webhooks are only let in when signatures are not
+required.
+*/
+func (https *HTTPS) authentic(origin string, ctx fiber.Ctx) bool {
+	v := viper.GetViper()
+	key := "integrity.webhooks." + origin
+	secret := os.Getenv(v.GetString(key + ".secret"))
+
+	if secret == "" {
+		return !data.NewConfigKeyring().Requires()
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(ctx.Get(v.GetString(key+".header")), v.GetString(key+".prefix")))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(ctx.Body())
+
+	return hmac.Equal(mac.Sum(nil), signature)
+}
@@ -7,18 +7,27 @@ import (
 // Generator is a function type that processes artifacts and writes results to a channel
 type Generator func(*Accumulator)
 
+// Finisher is a function type that completes the accumulated result, such as by signing it
+type Finisher func(*data.Artifact)
+
 // Accumulator provides a reusable generator pattern with consistent channel management
 type Accumulator struct {
 	buffer  *data.Artifact
 	In      []*data.Artifact
 	Out     chan *data.Artifact
 	through chan *data.Artifact
+	finish  Finisher
 	origin  string
 	role    string
 	scope   string
 }
 
-// NewAccumulator creates a new Accumulator instance
+/*
+NewAccumulator creates a new Accumulator instance. Once the generator is done,
+what it accumulated is recorded as derived from the artifacts it was given,
+along with any the generator added to In, and goes into the provenance of the
+config along with them.
+*/
 func NewAccumulator(origin, role, scope string, artifacts ...*data.Artifact) *Accumulator {
 	return &Accumulator{
 		buffer:  data.New(origin, role, scope, []byte{}),
@@ -44,6 +53,18 @@ func (accumulator *Accumulator) Generate() <-chan *data.Artifact {
 			accumulator.buffer.Append(artifact.Peek("payload"))
 			accumulator.through <- artifact
 		}
+
+		// The lineage is that of the whole result, rather than of every
+		// artifact it was streamed in.
+		accumulator.buffer.DeriveFrom(accumulator.In...)
+
+		if accumulator.finish != nil {
+			accumulator.finish(accumulator.buffer)
+		}
+
+		provenance := data.NewConfigProvenance()
+		provenance.Record(accumulator.In...)
+		provenance.Record(accumulator.buffer)
 	}()
 
 	return accumulator.through
@@ -55,6 +76,15 @@ func (accumulator *Accumulator) Yield(generator Generator) *Accumulator {
 	return accumulator
 }
 
+/*
+Finish sets what completes the accumulated result, once the generator is done,
+before it is recorded, and before the stream of the results is closed.
+*/
+func (accumulator *Accumulator) Finish(finisher Finisher) *Accumulator {
+	accumulator.finish = finisher
+	return accumulator
+}
+
 func (accumulator *Accumulator) Take() *data.Artifact {
 	return accumulator.buffer
 }
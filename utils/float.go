@@ -0,0 +1,5 @@
+package utils
+
+func Float64Ptr(f float64) *float64 {
+	return &f
+}